@@ -18,6 +18,13 @@ type Up interface {
 	Id() string
 	Label() string
 	User() (string, string)
+	// RequestKeyframe requests a keyframe on all video tracks.  If
+	// force is true, rate limiting is bypassed.  It returns true if
+	// a request was actually sent.
+	RequestKeyframe(force bool) bool
+	// SetMuted sets whether the tracks of the given kind have been
+	// muted by an operator.  Media from muted tracks is not forwarded.
+	SetMuted(kind webrtc.RTPCodecType, muted bool)
 }
 
 // Type UpTrack represents a track in the client to server direction.
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,10 +17,12 @@ import (
 	"github.com/at-wat/ebml-go/webm"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
 
 	"github.com/jech/galene/conn"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
 )
 
 var Directory string
@@ -31,6 +34,10 @@ type Client struct {
 	mu     sync.Mutex
 	down   map[string]*diskConn
 	closed bool
+	// whether the recording is paused, and whether the current
+	// segment was closed when it was paused
+	paused bool
+	split  bool
 }
 
 func newId() string {
@@ -146,6 +153,12 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 		return err
 	}
 
+	if client.paused {
+		down.mu.Lock()
+		down.pause(client.split, time.Now())
+		down.mu.Unlock()
+	}
+
 	client.down[up.Id()] = down
 	return nil
 }
@@ -157,11 +170,22 @@ type diskConn struct {
 	hasVideo  bool
 
 	mu            sync.Mutex
-	file          *os.File
+	file          io.WriteCloser
 	remote        conn.Up
 	tracks        []*diskTrack
 	width, height uint32
 	lastWarning   time.Time
+	// the difference between the sender's clock and ours, computed
+	// from the first sender report received on any track
+	skew      time.Duration
+	skewValid bool
+	// the time, in our clock, of the first sample of the recording
+	origin time.Time
+	// if not zero, the time at which the recording was paused
+	pausedAt time.Time
+	// the total duration of the pauses, in milliseconds, which is
+	// removed from the timestamps of the current file
+	gap int64
 }
 
 // called locked
@@ -176,7 +200,7 @@ func (conn *diskConn) warn(message string) {
 }
 
 // called locked
-func (conn *diskConn) reopen() error {
+func (conn *diskConn) closeWriters() {
 	for _, t := range conn.tracks {
 		if t.writer != nil {
 			t.writer.Close()
@@ -184,6 +208,11 @@ func (conn *diskConn) reopen() error {
 		}
 	}
 	conn.file = nil
+}
+
+// called locked
+func (conn *diskConn) reopen() error {
+	conn.closeWriters()
 
 	file, err := openDiskFile(conn.directory, conn.username)
 	if err != nil {
@@ -200,6 +229,7 @@ func (conn *diskConn) Close() error {
 	conn.mu.Lock()
 	tracks := make([]*diskTrack, 0, len(conn.tracks))
 	for _, t := range conn.tracks {
+		t.flush()
 		if t.writer != nil {
 			t.writer.Close()
 			t.writer = nil
@@ -214,7 +244,31 @@ func (conn *diskConn) Close() error {
 	return nil
 }
 
-func openDiskFile(directory, username string) (*os.File, error) {
+// flush writes the packets held by the jitter buffer.  In order not to
+// create a new file just for the last few packets, nothing is written if
+// there is no current file.  Called locked.
+func (t *diskTrack) flush() {
+	for t.writer != nil {
+		p := t.buffer.flush()
+		if p == nil {
+			break
+		}
+		t.writePacket(p)
+	}
+}
+
+func openDiskFile(directory, username string) (io.WriteCloser, error) {
+	var key []byte
+	extension := "webm"
+	if KeyFile != "" {
+		var err error
+		key, err = ReadKey(KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		extension = extension + EncryptedSuffix
+	}
+
 	filenameFormat := "2006-01-02T15:04:05.000"
 	if runtime.GOOS == "windows" {
 		filenameFormat = "2006-01-02T15-04-05-000"
@@ -227,9 +281,10 @@ func openDiskFile(directory, username string) (*os.File, error) {
 	for counter := 0; counter < 100; counter++ {
 		var fn string
 		if counter == 0 {
-			fn = fmt.Sprintf("%v.webm", filename)
+			fn = fmt.Sprintf("%v.%v", filename, extension)
 		} else {
-			fn = fmt.Sprintf("%v-%02d.webm", filename, counter)
+			fn = fmt.Sprintf("%v-%02d.%v",
+				filename, counter, extension)
 		}
 
 		fn = filepath.Join(directory, fn)
@@ -237,7 +292,16 @@ func openDiskFile(directory, username string) (*os.File, error) {
 			fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600,
 		)
 		if err == nil {
-			return f, nil
+			if key == nil {
+				return f, nil
+			}
+			w, err := newEncryptWriter(f, key)
+			if err != nil {
+				f.Close()
+				os.Remove(fn)
+				return nil, err
+			}
+			return w, nil
 		} else if !os.IsExist(err) {
 			return nil, err
 		}
@@ -250,6 +314,7 @@ type diskTrack struct {
 	conn   *diskConn
 
 	writer  webm.BlockWriteCloser
+	buffer  *jitterBuffer
 	builder *samplebuilder.SampleBuilder
 
 	// bit 32 is a boolean indicating that the origin is valid
@@ -257,6 +322,56 @@ type diskTrack struct {
 
 	lastKf  uint32
 	savedKf *rtp.Packet
+
+	// the time, in our clock, at which the sample with timestamp srRTP
+	// was captured.  Until the first sender report arrives, this is
+	// derived from the time at which samples are written.
+	srTime time.Time
+	srRTP  uint32
+	// the offset, in milliseconds, of the track's origin relative to
+	// the connection's origin, and the values of the previous sample
+	offset      int64
+	offsetValid bool
+	lastElapsed int64
+	lastTm      int64
+	// true if samples are dropped until the next keyframe, after
+	// a pause
+	needKf bool
+}
+
+// senderReporter is implemented by tracks that expose the timing of
+// the sender reports that they receive.
+type senderReporter interface {
+	SenderReport() (uint64, uint64, uint32)
+}
+
+// newBuilder returns a sample builder for the given codec, or nil if the
+// codec cannot be recorded.
+func newBuilder(codec webrtc.RTPCodecCapability) *samplebuilder.SampleBuilder {
+	switch strings.ToLower(codec.MimeType) {
+	case "audio/opus":
+		return samplebuilder.New(
+			16, &codecs.OpusPacket{}, codec.ClockRate,
+			samplebuilder.WithPartitionHeadChecker(
+				&codecs.OpusPartitionHeadChecker{},
+			),
+		)
+	case "video/vp8":
+		return samplebuilder.New(
+			128, &codecs.VP8Packet{}, codec.ClockRate,
+			samplebuilder.WithPartitionHeadChecker(
+				&codecs.VP8PartitionHeadChecker{},
+			),
+		)
+	case "video/vp9":
+		return samplebuilder.New(
+			128, &codecs.VP9Packet{}, codec.ClockRate,
+			samplebuilder.WithPartitionHeadChecker(
+				&codecs.VP9PartitionHeadChecker{},
+			),
+		)
+	}
+	return nil
 }
 
 func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []conn.UpTrack) (*diskConn, error) {
@@ -269,49 +384,38 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 		remote:    up,
 	}
 	for _, remote := range remoteTracks {
-		var builder *samplebuilder.SampleBuilder
 		codec := remote.Codec()
-		switch strings.ToLower(codec.MimeType) {
-		case "audio/opus":
-			builder = samplebuilder.New(
-				16, &codecs.OpusPacket{}, codec.ClockRate,
-				samplebuilder.WithPartitionHeadChecker(
-					&codecs.OpusPartitionHeadChecker{},
-				),
+		builder := newBuilder(codec)
+		if builder == nil {
+			client.group.WallOps(
+				"Cannot record codec " + codec.MimeType,
 			)
-		case "video/vp8":
+			continue
+		}
+		if remote.Kind() == webrtc.RTPCodecTypeVideo {
 			if conn.hasVideo {
 				return nil, errors.New("multiple video tracks not supported")
 			}
-			builder = samplebuilder.New(
-				128, &codecs.VP8Packet{}, codec.ClockRate,
-				samplebuilder.WithPartitionHeadChecker(
-					&codecs.VP8PartitionHeadChecker{},
-				),
-			)
 			conn.hasVideo = true
-		case "video/vp9":
-			if conn.hasVideo {
-				return nil, errors.New("multiple video tracks not supported")
-			}
-			builder = samplebuilder.New(
-				128, &codecs.VP9Packet{}, codec.ClockRate,
-				samplebuilder.WithPartitionHeadChecker(
-					&codecs.VP9PartitionHeadChecker{},
-				),
-			)
-			conn.hasVideo = true
-		default:
-			client.group.WallOps(
-				"Cannot record codec " + codec.MimeType,
-			)
-			continue
 		}
 		track := &diskTrack{
 			remote:  remote,
+			buffer:  newJitterBuffer(codec.ClockRate, Latency),
 			builder: builder,
 			conn:    &conn,
 		}
+		if sr, ok := remote.(senderReporter); ok {
+			srTime, ntp, rtp := sr.SenderReport()
+			if srTime != 0 {
+				age := rtptime.ToDuration(
+					rtptime.Jiffies()-srTime,
+					rtptime.JiffiesPerSec,
+				)
+				track.setSenderReport(
+					time.Now().Add(-age), ntp, rtp,
+				)
+			}
+		}
 		conn.tracks = append(conn.tracks, track)
 	}
 
@@ -329,10 +433,102 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 		return nil, err
 	}
 
+	// Start the recording at a keyframe rather than waiting for the
+	// sender's next periodic one.
+	if conn.hasVideo {
+		up.RequestKeyframe(true)
+	}
+
 	return &conn, nil
 }
 
 func (t *diskTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	t.conn.mu.Lock()
+	defer t.conn.mu.Unlock()
+	t.setSenderReport(time.Now(), ntp, rtp)
+}
+
+// setSenderReport records the mapping between RTP and NTP time carried
+// by a sender report received at time recv.  All tracks of a connection
+// share the sender's clock, so they are converted to our clock using the
+// same skew, which keeps them synchronised.  Called locked.
+func (t *diskTrack) setSenderReport(recv time.Time, ntp uint64, rtp uint32) {
+	sender := rtptime.NTPToTime(ntp)
+	if !t.conn.skewValid {
+		t.conn.skew = sender.Sub(recv)
+		t.conn.skewValid = true
+	}
+	t.srTime = sender.Add(-t.conn.skew)
+	t.srRTP = rtp
+}
+
+// maxSyncJump is the largest difference, in milliseconds, between the
+// current and the desired offset of a track that is corrected gradually.
+const maxSyncJump = 1000
+
+// adjustOffset returns the offset of a track moved towards target.  In
+// order to avoid audible glitches, the offset changes by at most 5% of
+// the elapsed duration, unless it is very far from the target.
+func adjustOffset(offset, target, elapsed int64) int64 {
+	d := target - offset
+	if d > maxSyncJump || d < -maxSyncJump {
+		return target
+	}
+	step := elapsed / 20
+	if step < 1 {
+		step = 1
+	}
+	if d > step {
+		return offset + step
+	} else if d < -step {
+		return offset - step
+	}
+	return target
+}
+
+// timestamp returns the presentation time, in milliseconds, of a sample
+// with RTP timestamp ts that is being written at time now.  Called
+// locked.
+func (t *diskTrack) timestamp(ts uint32, now time.Time) int64 {
+	clockrate := t.remote.Codec().ClockRate
+	if t.origin == 0 {
+		t.origin = uint64(ts) | (1 << 32)
+	}
+	origin := uint32(t.origin)
+
+	if t.srTime.IsZero() {
+		// no sender report yet, assume that the sample was captured
+		// now.  This is corrected when a sender report arrives.
+		t.srTime = now
+		t.srRTP = ts
+	}
+
+	start := t.srTime.Add(
+		time.Duration(int32(origin-t.srRTP)) * time.Second /
+			time.Duration(clockrate),
+	)
+	if t.conn.origin.IsZero() {
+		t.conn.origin = start
+	}
+	target := int64(start.Sub(t.conn.origin) / time.Millisecond)
+
+	elapsed := int64(ts-origin) * 1000 / int64(clockrate)
+	if !t.offsetValid {
+		t.offset = target
+		t.offsetValid = true
+	} else {
+		t.offset = adjustOffset(
+			t.offset, target, elapsed-t.lastElapsed,
+		)
+	}
+	t.lastElapsed = elapsed
+
+	tm := elapsed + t.offset - t.conn.gap
+	if tm < t.lastTm {
+		tm = t.lastTm
+	}
+	t.lastTm = tm
+	return tm
 }
 
 func (t *diskTrack) SetCname(string) {
@@ -422,17 +618,37 @@ func (t *diskTrack) WriteRTP(packet *rtp.Packet) error {
 	t.conn.mu.Lock()
 	defer t.conn.mu.Unlock()
 
-	if t.builder == nil {
+	if t.builder == nil || !t.conn.pausedAt.IsZero() {
 		return nil
 	}
 
-	codec := t.remote.Codec()
-
 	p := clonePacket(packet)
 	if p == nil {
 		return nil
 	}
 
+	now := rtptime.Jiffies()
+	t.buffer.push(p, now)
+
+	var err error
+	for {
+		p := t.buffer.pop(now)
+		if p == nil {
+			break
+		}
+		e := t.writePacket(p)
+		if e != nil && err != conn.ErrKeyframeNeeded {
+			err = e
+		}
+	}
+	return err
+}
+
+// writePacket passes a packet released by the jitter buffer to the
+// sample builder, and writes any complete samples.  Called locked.
+func (t *diskTrack) writePacket(p *rtp.Packet) error {
+	codec := t.remote.Codec()
+
 	if strings.ToLower(codec.MimeType) == "video/vp9" {
 		var vp9 codecs.VP9Packet
 		_, err := vp9.Unmarshal(p.Payload)
@@ -482,6 +698,10 @@ func (t *diskTrack) WriteRTP(packet *rtp.Packet) error {
 					return err
 				}
 				t.lastKf = ts
+				t.needKf = false
+			} else if t.needKf {
+				kfNeeded = true
+				continue
 			} else if t.writer != nil {
 				// Request a keyframe every 4s
 				delta := ts - t.lastKf
@@ -511,13 +731,8 @@ func (t *diskTrack) WriteRTP(packet *rtp.Packet) error {
 			return nil
 		}
 
-		if t.origin == 0 {
-			t.origin = uint64(ts) | (1 << 32)
-		}
-		ts -= uint32(t.origin)
-
-		tm := ts / (t.remote.Codec().ClockRate / 1000)
-		_, err := t.writer.Write(keyframe, int64(tm), sample.Data)
+		tm := t.timestamp(ts, time.Now())
+		_, err := t.writer.Write(keyframe, tm, sample.Data)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,163 @@
+package diskwriter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/rtptime"
+)
+
+type fakeUpTrack struct {
+	codec webrtc.RTPCodecCapability
+}
+
+func (t *fakeUpTrack) AddLocal(conn.DownTrack) error {
+	return nil
+}
+
+func (t *fakeUpTrack) DelLocal(conn.DownTrack) bool {
+	return false
+}
+
+func (t *fakeUpTrack) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeAudio
+}
+
+func (t *fakeUpTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *fakeUpTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	return 0
+}
+
+func (t *fakeUpTrack) Nack(conn conn.Up, seqnos []uint16) error {
+	return nil
+}
+
+func TestAdjustOffset(t *testing.T) {
+	a := []struct {
+		offset, target, elapsed, expected int64
+	}{
+		{0, 0, 20, 0},
+		{0, 100, 20, 1},
+		{0, -100, 20, -1},
+		{0, 100, 200, 10},
+		{99, 100, 200, 100},
+		{0, 5000, 20, 5000},
+		{0, -5000, 20, -5000},
+		{0, 100, 0, 1},
+	}
+	for _, s := range a {
+		o := adjustOffset(s.offset, s.target, s.elapsed)
+		if o != s.expected {
+			t.Errorf("%v %v %v: expected %v, got %v",
+				s.offset, s.target, s.elapsed, s.expected, o)
+		}
+	}
+}
+
+// syncTracks returns an audio and a video track of a fresh connection.
+func syncTracks() (*diskTrack, *diskTrack) {
+	c := &diskConn{}
+	audio := &diskTrack{
+		remote: &fakeUpTrack{
+			webrtc.RTPCodecCapability{MimeType: "audio/opus",
+				ClockRate: 48000},
+		},
+		conn: c,
+	}
+	video := &diskTrack{
+		remote: &fakeUpTrack{
+			webrtc.RTPCodecCapability{MimeType: "video/VP8",
+				ClockRate: 90000},
+		},
+		conn: c,
+	}
+	return audio, video
+}
+
+func TestTimestampSync(t *testing.T) {
+	base := time.Now()
+	// the sender's clock is 10s ahead of ours
+	sender := base.Add(10 * time.Second)
+	audioRTP := func(ms int) uint32 { return 1000 + uint32(48*ms) }
+	videoRTP := func(ms int) uint32 { return 5000 + uint32(90*ms) }
+
+	audio, video := syncTracks()
+	audio.setSenderReport(base.Add(50*time.Millisecond),
+		rtptime.TimeToNTP(sender), audioRTP(0))
+	video.setSenderReport(base.Add(160*time.Millisecond),
+		rtptime.TimeToNTP(sender.Add(100*time.Millisecond)),
+		videoRTP(100))
+
+	// video starts 500ms after audio, and is written with more delay
+	a0 := audio.timestamp(audioRTP(0), base.Add(300*time.Millisecond))
+	v0 := video.timestamp(videoRTP(500), base.Add(900*time.Millisecond))
+	if a0 != 0 || v0 < 499 || v0 > 501 {
+		t.Errorf("Expected 0 500, got %v %v", a0, v0)
+	}
+
+	a := audio.timestamp(audioRTP(2000), base.Add(2300*time.Millisecond))
+	v := video.timestamp(videoRTP(2000), base.Add(2400*time.Millisecond))
+	if a < 1999 || a > 2001 || v < 1999 || v > 2001 {
+		t.Errorf("Expected 2000 2000, got %v %v", a, v)
+	}
+}
+
+func TestTimestampBeforeSR(t *testing.T) {
+	base := time.Now()
+	sender := base.Add(-3 * time.Second)
+	audioRTP := func(ms int) uint32 { return 1000 + uint32(48*ms) }
+	videoRTP := func(ms int) uint32 { return 5000 + uint32(90*ms) }
+
+	audio, video := syncTracks()
+
+	// no sender reports yet, the video is written with more delay
+	// than the audio, so it is initially out of sync
+	var lastA, lastV int64
+	for ms := 0; ms < 1000; ms += 20 {
+		now := base.Add(time.Duration(ms+300) * time.Millisecond)
+		lastA = audio.timestamp(audioRTP(ms), now)
+	}
+	for ms := 0; ms < 1000; ms += 40 {
+		now := base.Add(time.Duration(ms+450) * time.Millisecond)
+		lastV = video.timestamp(videoRTP(ms), now)
+	}
+	if d := lastV - lastA; d < 100 {
+		t.Errorf("Expected video to be late, got %v", d)
+	}
+
+	audio.setSenderReport(base.Add(1000*time.Millisecond),
+		rtptime.TimeToNTP(sender.Add(980*time.Millisecond)),
+		audioRTP(980))
+	video.setSenderReport(base.Add(1030*time.Millisecond),
+		rtptime.TimeToNTP(sender.Add(1000*time.Millisecond)),
+		videoRTP(1000))
+
+	// the tracks converge, and timestamps never go backwards
+	for ms := 1000; ms < 10000; ms += 20 {
+		now := base.Add(time.Duration(ms+300) * time.Millisecond)
+		a := audio.timestamp(audioRTP(ms), now)
+		if a < lastA {
+			t.Fatalf("Audio went backwards: %v < %v", a, lastA)
+		}
+		lastA = a
+		if ms%40 == 0 {
+			now := base.Add(time.Duration(ms+450) *
+				time.Millisecond)
+			v := video.timestamp(videoRTP(ms), now)
+			if v < lastV {
+				t.Fatalf("Video went backwards: %v < %v",
+					v, lastV)
+			}
+			lastV = v
+		}
+	}
+	if d := lastV - lastA; d < -21 || d > 21 {
+		t.Errorf("Expected tracks in sync, got %v", d)
+	}
+}
@@ -0,0 +1,294 @@
+package diskwriter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyFile is the name of a file containing the master key used for
+// encrypting recordings, as 64 hexadecimal digits.  If empty, recordings
+// are not encrypted.  The file is read whenever a recording file is
+// created, so that the key can be rotated without a restart.
+var KeyFile string
+
+// Encrypted recordings consist of a header followed by a sequence of
+// chunks.  Each chunk is encrypted with AES-GCM under a key derived from
+// the master key and the salt in the header, with a nonce consisting of
+// an 11-byte counter and a byte indicating the last chunk, which allows
+// detecting truncation (this is the STREAM construction).  The header is
+// authenticated as additional data of every chunk.
+const (
+	encryptedMagic     = "GALENC01"
+	encryptedChunkSize = 64 * 1024
+	// magic, key id, salt, chunk size
+	encryptedHeaderSize = 8 + 8 + 32 + 4
+	// the suffix appended to the names of encrypted files
+	EncryptedSuffix = ".enc"
+)
+
+var (
+	ErrUnknownKey = errors.New("recording encrypted with unknown key")
+	ErrTruncated  = errors.New("recording is truncated")
+	errBadHeader  = errors.New("bad encrypted recording header")
+)
+
+// ReadKey reads a master key from a file.
+func ReadKey(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+// keyId identifies a master key without revealing it.  It is stored in
+// the header, so that the right key can be selected after rotation.
+func keyId(key []byte) []byte {
+	h := sha256.Sum256(append([]byte("galene key id "), key...))
+	return h[:8]
+}
+
+func newAEAD(master []byte, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(
+		hkdf.New(sha256.New, master, salt, []byte("galene recording")),
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// An encryptWriter encrypts data written to it, one chunk at a time.
+// Data that has not yet filled a chunk is lost if the server crashes.
+type encryptWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+func newEncryptWriter(w io.WriteCloser, master []byte) (*encryptWriter, error) {
+	header := make([]byte, encryptedHeaderSize)
+	copy(header[0:8], encryptedMagic)
+	copy(header[8:16], keyId(master))
+	salt := header[16:48]
+	_, err := crand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[48:52], encryptedChunkSize)
+
+	aead, err := newAEAD(master, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (w *encryptWriter) writeChunk(last bool) error {
+	data := w.aead.Seal(
+		nil, chunkNonce(w.counter, last), w.buf, w.header,
+	)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(data)
+	return err
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == encryptedChunkSize {
+			w.err = w.writeChunk(false)
+			if w.err != nil {
+				return n, w.err
+			}
+		}
+		m := encryptedChunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close writes the last chunk, which may be empty, and closes the
+// underlying writer.
+func (w *encryptWriter) Close() error {
+	if w.err == nil {
+		w.err = w.writeChunk(true)
+	}
+	err := w.w.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  []byte
+	plain  []byte
+	// the decrypted data that has not been read yet
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+// NewDecryptReader returns a reader that decrypts an encrypted recording.
+// The master key is chosen among keys according to the key id stored in
+// the recording.  If the recording is truncated, all the data that can be
+// authenticated is returned before ErrTruncated.
+func NewDecryptReader(r io.Reader, keys [][]byte) (io.Reader, error) {
+	header := make([]byte, encryptedHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errBadHeader
+		}
+		return nil, err
+	}
+	if string(header[0:8]) != encryptedMagic {
+		return nil, errBadHeader
+	}
+	size := binary.BigEndian.Uint32(header[48:52])
+	if size == 0 || size > 16*1024*1024 {
+		return nil, errBadHeader
+	}
+
+	var master []byte
+	for _, k := range keys {
+		if bytes.Equal(keyId(k), header[8:16]) {
+			master = k
+			break
+		}
+	}
+	if master == nil {
+		return nil, ErrUnknownKey
+	}
+
+	aead, err := newAEAD(master, header[16:48])
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, int(size)+aead.Overhead()),
+		plain:  make([]byte, 0, int(size)),
+	}, nil
+}
+
+func (r *decryptReader) readChunk() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			// the last chunk is missing
+			return ErrTruncated
+		}
+		return err
+	}
+	last := n < len(r.chunk)
+	if !last {
+		_, err := r.r.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	data, err := r.aead.Open(
+		r.plain[:0], chunkNonce(r.counter, last), r.chunk[:n], r.header,
+	)
+	if err != nil {
+		if !last {
+			return err
+		}
+		// the file ends with a chunk that is not marked as the
+		// last one, either complete or partially written.
+		data, err = r.aead.Open(
+			r.plain[:0], chunkNonce(r.counter, false),
+			r.chunk[:n], r.header,
+		)
+		if err == nil {
+			r.buf = data
+		}
+		return ErrTruncated
+	}
+	r.counter++
+	r.buf = data
+	if last {
+		return io.EOF
+	}
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
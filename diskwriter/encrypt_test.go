@@ -0,0 +1,187 @@
+package diskwriter
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := crand.Read(key)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key, data []byte, close bool) []byte {
+	var b bufferCloser
+	w, err := newEncryptWriter(&b, key)
+	if err != nil {
+		t.Fatalf("newEncryptWriter: %v", err)
+	}
+	// write in small pieces, as the webm writer does
+	for i := 0; i < len(data); i += 1000 {
+		j := i + 1000
+		if j > len(data) {
+			j = len(data)
+		}
+		_, err := w.Write(data[i:j])
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if close {
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if !b.closed {
+			t.Errorf("Underlying writer was not closed")
+		}
+	}
+	return b.Bytes()
+}
+
+func decrypt(data []byte, keys [][]byte) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, l := range []int{0, 1, encryptedChunkSize,
+		3*encryptedChunkSize + 17} {
+		data := make([]byte, l)
+		crand.Read(data)
+		enc := encrypt(t, key, data, true)
+		dec, err := decrypt(enc, [][]byte{newKey(t), key})
+		if err != nil {
+			t.Errorf("%v: decrypt: %v", l, err)
+		}
+		if !bytes.Equal(dec, data) {
+			t.Errorf("%v: data mismatch", l)
+		}
+	}
+}
+
+func TestDecryptUnknownKey(t *testing.T) {
+	enc := encrypt(t, newKey(t), []byte("hello"), true)
+	_, err := decrypt(enc, [][]byte{newKey(t)})
+	if err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := newKey(t)
+	data := make([]byte, 2*encryptedChunkSize+100)
+	crand.Read(data)
+
+	// the writer was never closed
+	enc := encrypt(t, key, data, false)
+	dec, err := decrypt(enc, [][]byte{key})
+	if err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	if !bytes.Equal(dec, data[:2*encryptedChunkSize]) {
+		t.Errorf("Expected %v bytes, got %v",
+			2*encryptedChunkSize, len(dec))
+	}
+
+	// the file was cut at a chunk boundary
+	enc = encrypt(t, key, data, true)
+	cut := encryptedHeaderSize + 2*(encryptedChunkSize+16)
+	dec, err = decrypt(enc[:cut], [][]byte{key})
+	if err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	if !bytes.Equal(dec, data[:2*encryptedChunkSize]) {
+		t.Errorf("Expected %v bytes, got %v",
+			2*encryptedChunkSize, len(dec))
+	}
+
+	// the file was cut in the middle of a chunk
+	dec, err = decrypt(enc[:cut+50], [][]byte{key})
+	if err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	if !bytes.Equal(dec, data[:2*encryptedChunkSize]) {
+		t.Errorf("Expected %v bytes, got %v",
+			2*encryptedChunkSize, len(dec))
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := newKey(t)
+	enc := encrypt(t, key, make([]byte, 3*encryptedChunkSize), true)
+	enc[encryptedHeaderSize+encryptedChunkSize+100] ^= 1
+	dec, err := decrypt(enc, [][]byte{key})
+	if err == nil || err == ErrTruncated {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+	if len(dec) != encryptedChunkSize {
+		t.Errorf("Expected %v bytes, got %v",
+			encryptedChunkSize, len(dec))
+	}
+}
+
+func TestOpenDiskFileEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	KeyFile = filepath.Join(dir, "key")
+	defer func() { KeyFile = "" }()
+	err = ioutil.WriteFile(KeyFile,
+		[]byte("000102030405060708090a0b0c0d0e0f"+
+			"101112131415161718191a1b1c1d1e1f\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	key, err := ReadKey(KeyFile)
+	if err != nil {
+		t.Fatalf("ReadKey: %v", err)
+	}
+
+	w, err := openDiskFile(dir, "user")
+	if err != nil {
+		t.Fatalf("openDiskFile: %v", err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm.enc"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one encrypted file, got %v %v", files, err)
+	}
+	enc, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	dec, err := decrypt(enc, [][]byte{key})
+	if err != nil || string(dec) != "hello" {
+		t.Errorf("Expected hello, got %v %v", string(dec), err)
+	}
+}
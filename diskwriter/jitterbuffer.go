@@ -0,0 +1,127 @@
+package diskwriter
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/jitter"
+	"github.com/jech/galene/rtptime"
+)
+
+// Latency is the target latency of the jitter buffer that reorders
+// packets before they are written to disk.  Since recordings are not
+// watched live, this can be much larger than what is acceptable for
+// live viewers, which gives retransmissions a chance to arrive.
+var Latency = 300 * time.Millisecond
+
+const (
+	// the maximum time that a packet is held, whatever the jitter
+	maxJitterBufferDelay = 2 * rtptime.JiffiesPerSec
+	// the maximum number of packets held
+	maxJitterBufferPackets = 1024
+)
+
+type bufferedPacket struct {
+	packet  *rtp.Packet
+	arrival uint64
+}
+
+// A jitterBuffer reorders packets according to their sequence numbers.
+// A packet that follows the last packet released is released
+// immediately; when there is a gap, or at the start, packets are held
+// for the target latency or a small multiple of the measured jitter,
+// whichever is larger, in order to give the missing packets a chance to
+// arrive.
+type jitterBuffer struct {
+	target  uint64
+	jitter  *jitter.Estimator
+	packets []bufferedPacket
+	// the seqno of the next packet to release
+	next      uint16
+	nextValid bool
+}
+
+func newJitterBuffer(clockRate uint32, target time.Duration) *jitterBuffer {
+	return &jitterBuffer{
+		target: rtptime.FromDuration(target, rtptime.JiffiesPerSec),
+		jitter: jitter.New(clockRate),
+	}
+}
+
+// delay returns the time for which a packet that follows a gap is held.
+func (b *jitterBuffer) delay() uint64 {
+	d := b.target
+	j := 4 * uint64(b.jitter.Jitter()) *
+		rtptime.JiffiesPerSec / uint64(b.jitter.HZ())
+	if j > d {
+		d = j
+	}
+	if d > maxJitterBufferDelay {
+		d = maxJitterBufferDelay
+	}
+	return d
+}
+
+// push inserts a packet that arrived at time now, in jiffies.
+func (b *jitterBuffer) push(p *rtp.Packet, now uint64) {
+	hz := uint64(b.jitter.HZ())
+	// avoid overflow in the multiplication
+	t := (now/rtptime.JiffiesPerSec)*hz +
+		(now%rtptime.JiffiesPerSec)*hz/rtptime.JiffiesPerSec
+	b.jitter.AccumulateAt(p.Timestamp, uint32(t))
+
+	seqno := p.SequenceNumber
+	if b.nextValid && int16(seqno-b.next) < 0 {
+		// too late, we have already given up on this packet
+		return
+	}
+
+	i := len(b.packets)
+	for i > 0 {
+		s := b.packets[i-1].packet.SequenceNumber
+		if s == seqno {
+			// duplicate
+			return
+		}
+		if int16(seqno-s) > 0 {
+			break
+		}
+		i--
+	}
+	b.packets = append(b.packets, bufferedPacket{})
+	copy(b.packets[i+1:], b.packets[i:])
+	b.packets[i] = bufferedPacket{packet: p, arrival: now}
+}
+
+// pop returns the next packet that is ready to be released at time now,
+// or nil if there is none.
+func (b *jitterBuffer) pop(now uint64) *rtp.Packet {
+	if len(b.packets) == 0 {
+		return nil
+	}
+	first := b.packets[0]
+	inOrder := b.nextValid && first.packet.SequenceNumber == b.next
+	if !inOrder && now-first.arrival < b.delay() &&
+		len(b.packets) < maxJitterBufferPackets {
+		return nil
+	}
+	return b.release()
+}
+
+// flush returns the next packet, whether it is ready or not.
+func (b *jitterBuffer) flush() *rtp.Packet {
+	if len(b.packets) == 0 {
+		return nil
+	}
+	return b.release()
+}
+
+func (b *jitterBuffer) release() *rtp.Packet {
+	p := b.packets[0].packet
+	b.packets[0] = bufferedPacket{}
+	b.packets = b.packets[1:]
+	b.next = p.SequenceNumber + 1
+	b.nextValid = true
+	return p
+}
@@ -0,0 +1,149 @@
+package diskwriter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func packet(seqno uint16) *rtp.Packet {
+	return &rtp.Packet{
+		Header: rtp.Header{
+			SequenceNumber: seqno,
+			Timestamp:      uint32(seqno) * 960,
+		},
+	}
+}
+
+func popAll(b *jitterBuffer, now uint64) []uint16 {
+	var seqnos []uint16
+	for {
+		p := b.pop(now)
+		if p == nil {
+			return seqnos
+		}
+		seqnos = append(seqnos, p.SequenceNumber)
+	}
+}
+
+func equal(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJitterBuffer(t *testing.T) {
+	b := newJitterBuffer(48000, 100*time.Millisecond)
+	step := uint64(rtptime.JiffiesPerSec / 50)
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	seqno := uint16(65530)
+
+	// the first packet is held
+	b.push(packet(seqno), now)
+	if s := popAll(b, now); len(s) != 0 {
+		t.Errorf("Expected nothing, got %v", s)
+	}
+	now += b.delay()
+	if s := popAll(b, now); !equal(s, []uint16{seqno}) {
+		t.Errorf("Expected %v, got %v", seqno, s)
+	}
+
+	// packets in order are released immediately
+	for i := 1; i < 4; i++ {
+		now += step
+		b.push(packet(seqno+uint16(i)), now)
+		s := popAll(b, now)
+		if !equal(s, []uint16{seqno + uint16(i)}) {
+			t.Errorf("Expected %v, got %v", seqno+uint16(i), s)
+		}
+	}
+	seqno += 4
+
+	// reordering across the wraparound
+	now += step
+	b.push(packet(seqno+1), now)
+	b.push(packet(seqno+3), now)
+	if s := popAll(b, now); len(s) != 0 {
+		t.Errorf("Expected nothing, got %v", s)
+	}
+	now += step
+	b.push(packet(seqno+2), now)
+	b.push(packet(seqno), now)
+	b.push(packet(seqno+2), now)
+	expected := []uint16{seqno, seqno + 1, seqno + 2, seqno + 3}
+	if s := popAll(b, now); !equal(s, expected) {
+		t.Errorf("Expected %v, got %v", expected, s)
+	}
+	seqno += 4
+
+	// a lost packet is given up on after the delay
+	now += step
+	b.push(packet(seqno+1), now)
+	if s := popAll(b, now+b.delay()-1); len(s) != 0 {
+		t.Errorf("Expected nothing, got %v", s)
+	}
+	now += b.delay()
+	if s := popAll(b, now); !equal(s, []uint16{seqno + 1}) {
+		t.Errorf("Expected %v, got %v", seqno+1, s)
+	}
+
+	// and dropped if it arrives later
+	b.push(packet(seqno), now)
+	if s := popAll(b, now+b.delay()); len(s) != 0 {
+		t.Errorf("Expected nothing, got %v", s)
+	}
+	if len(b.packets) != 0 {
+		t.Errorf("Expected empty buffer, got %v", len(b.packets))
+	}
+}
+
+func TestJitterBufferFlush(t *testing.T) {
+	b := newJitterBuffer(48000, time.Second)
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	b.push(packet(3), now)
+	b.push(packet(1), now)
+	var s []uint16
+	for {
+		p := b.flush()
+		if p == nil {
+			break
+		}
+		s = append(s, p.SequenceNumber)
+	}
+	if !equal(s, []uint16{1, 3}) {
+		t.Errorf("Expected [1 3], got %v", s)
+	}
+}
+
+func TestJitterBufferDelay(t *testing.T) {
+	b := newJitterBuffer(48000, 0)
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	if d := b.delay(); d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+
+	// packets sent every 20ms, arriving alternately 10ms late
+	for i := 0; i < 200; i++ {
+		arrival := now + uint64(i)*rtptime.JiffiesPerSec/50
+		if i%2 == 1 {
+			arrival += rtptime.JiffiesPerSec / 100
+		}
+		b.push(packet(uint16(i)), arrival)
+		b.pop(arrival)
+	}
+	d := b.delay()
+	if d < rtptime.JiffiesPerSec/50 ||
+		d > maxJitterBufferDelay {
+		t.Errorf("Expected delay to follow jitter, got %v",
+			rtptime.ToDuration(d, rtptime.JiffiesPerSec))
+	}
+}
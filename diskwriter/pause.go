@@ -0,0 +1,116 @@
+package diskwriter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// A recording may be paused, for example during a break.  While paused,
+// no packets are written.  Either the current files remain open, and
+// the duration of the pause is removed from their timeline on resume, so
+// that playback doesn't contain a long period of silence, or they are
+// closed, and resuming starts new files.
+
+// Pause pauses the recording.  If split is true, the current files are
+// closed, and new files are created when the recording is resumed.
+func (client *Client) Pause(split bool) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return errors.New("disk client is closed")
+	}
+	if client.paused {
+		return nil
+	}
+	client.paused = true
+	client.split = split
+
+	now := time.Now()
+	for _, down := range client.down {
+		down.mu.Lock()
+		down.pause(split, now)
+		down.mu.Unlock()
+	}
+	return nil
+}
+
+// Resume resumes a paused recording.
+func (client *Client) Resume() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return errors.New("disk client is closed")
+	}
+	if !client.paused {
+		return nil
+	}
+	client.paused = false
+
+	now := time.Now()
+	for _, down := range client.down {
+		down.mu.Lock()
+		kf := down.resume(now)
+		down.mu.Unlock()
+		if kf {
+			down.remote.RequestKeyframe(true)
+		}
+	}
+	return nil
+}
+
+// Paused returns true if the recording is paused.
+func (client *Client) Paused() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.paused
+}
+
+// pause stops writing packets at time now.  Called locked.
+func (conn *diskConn) pause(split bool, now time.Time) {
+	if !conn.pausedAt.IsZero() {
+		return
+	}
+	for _, t := range conn.tracks {
+		// these packets were received before the pause
+		t.flush()
+	}
+	if split {
+		conn.closeWriters()
+		conn.origin = time.Time{}
+		conn.gap = 0
+		for _, t := range conn.tracks {
+			t.origin = 0
+			t.offsetValid = false
+			t.lastElapsed = 0
+			t.lastTm = 0
+		}
+	}
+	conn.pausedAt = now
+}
+
+// resume resumes writing packets at time now.  It returns true if
+// a keyframe should be requested from the sender.  Called locked.
+func (conn *diskConn) resume(now time.Time) bool {
+	if conn.pausedAt.IsZero() {
+		return false
+	}
+	if conn.file != nil {
+		conn.gap += int64(now.Sub(conn.pausedAt) / time.Millisecond)
+	}
+	conn.pausedAt = time.Time{}
+
+	// the state of the reordering logic is stale, since the sequence
+	// numbers have moved on during the pause
+	for _, t := range conn.tracks {
+		codec := t.remote.Codec()
+		t.buffer = newJitterBuffer(codec.ClockRate, Latency)
+		t.builder = newBuilder(codec)
+		t.needKf = t.writer != nil &&
+			t.remote.Kind() == webrtc.RTPCodecTypeVideo
+	}
+	return conn.hasVideo
+}
@@ -0,0 +1,58 @@
+package diskwriter
+
+import (
+	"testing"
+	"time"
+)
+
+type nullFile struct{}
+
+func (f nullFile) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f nullFile) Close() error {
+	return nil
+}
+
+func TestPauseTimestamps(t *testing.T) {
+	base := time.Now()
+	audioRTP := func(ms int) uint32 { return 1000 + uint32(48*ms) }
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	audio, _ := syncTracks()
+	c := audio.conn
+	c.tracks = []*diskTrack{audio}
+	c.file = nullFile{}
+
+	audio.timestamp(audioRTP(0), at(300))
+	a := audio.timestamp(audioRTP(980), at(1280))
+	if a != 980 {
+		t.Errorf("Expected 980, got %v", a)
+	}
+
+	// the pause doesn't appear in the recording
+	c.pause(false, at(1300))
+	c.resume(at(61300))
+	a = audio.timestamp(audioRTP(61000), at(61300))
+	if a != 1000 {
+		t.Errorf("Expected 1000, got %v", a)
+	}
+
+	// a split starts a new timeline
+	c.pause(true, at(62300))
+	if c.file != nil {
+		t.Errorf("Expected file to be closed")
+	}
+	c.resume(at(70300))
+	a = audio.timestamp(audioRTP(70000), at(70300))
+	if a != 0 {
+		t.Errorf("Expected 0, got %v", a)
+	}
+	a = audio.timestamp(audioRTP(71000), at(71300))
+	if a != 1000 {
+		t.Errorf("Expected 1000, got %v", a)
+	}
+}
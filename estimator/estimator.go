@@ -9,6 +9,9 @@ import (
 	"github.com/jech/galene/rtptime"
 )
 
+// The number of sub-intervals over which the peak rate is computed.
+const historyLength = 8
+
 type Estimator struct {
 	interval     uint64
 	time         uint64
@@ -18,13 +21,27 @@ type Estimator struct {
 	totalPackets uint32
 	rate         uint32
 	packetRate   uint32
+
+	// the bytes belonging to keyframes, and the rate excluding them
+	keyframeBytes uint32
+	steadyRate    uint32
+
+	// the bytes accumulated since the start of the current
+	// sub-interval, which is historyLength times shorter than interval
+	subBytes uint32
+	subTime  uint64
+	// a ring of the byte rates of the last few sub-intervals
+	history      [historyLength]uint32
+	historyIndex uint32
 }
 
 // New creates a new estimator that estimates rate over the last interval.
 func New(interval time.Duration) *Estimator {
+	now := rtptime.Now(rtptime.JiffiesPerSec)
 	return &Estimator{
 		interval: rtptime.FromDuration(interval, rtptime.JiffiesPerSec),
-		time:     rtptime.Now(rtptime.JiffiesPerSec),
+		time:     now,
+		subTime:  now,
 	}
 }
 
@@ -33,24 +50,55 @@ func (e *Estimator) swap(now uint64) {
 	jiffies := now - tm
 	bytes := atomic.SwapUint32(&e.bytes, 0)
 	packets := atomic.SwapUint32(&e.packets, 0)
+	keyframeBytes := atomic.SwapUint32(&e.keyframeBytes, 0)
 	atomic.AddUint32(&e.totalBytes, bytes)
 	atomic.AddUint32(&e.totalPackets, packets)
 
-	var rate, packetRate uint32
+	// keyframe bytes are accumulated before the corresponding bytes
+	if keyframeBytes > bytes {
+		keyframeBytes = bytes
+	}
+
+	var rate, packetRate, steadyRate uint32
 	if jiffies >= rtptime.JiffiesPerSec/1000 {
 		rate = uint32(uint64(bytes) * rtptime.JiffiesPerSec / jiffies)
 		packetRate =
 			uint32(uint64(packets) * rtptime.JiffiesPerSec / jiffies)
+		steadyRate = uint32(uint64(bytes-keyframeBytes) *
+			rtptime.JiffiesPerSec / jiffies)
 	}
 	atomic.StoreUint32(&e.rate, rate)
 	atomic.StoreUint32(&e.packetRate, packetRate)
+	atomic.StoreUint32(&e.steadyRate, steadyRate)
 	atomic.StoreUint64(&e.time, now)
 }
 
-// Accumulate records one packet of size bytes
-func (e *Estimator) Accumulate(bytes uint32) {
+func (e *Estimator) accumulate(bytes uint32, now uint64) {
 	atomic.AddUint32(&e.bytes, bytes)
 	atomic.AddUint32(&e.packets, 1)
+
+	tm := atomic.LoadUint64(&e.subTime)
+	if now >= tm && now-tm >= e.interval/historyLength &&
+		atomic.CompareAndSwapUint64(&e.subTime, tm, now) {
+		b := atomic.SwapUint32(&e.subBytes, 0)
+		i := atomic.AddUint32(&e.historyIndex, 1) % historyLength
+		atomic.StoreUint32(&e.history[i],
+			uint32(uint64(b)*rtptime.JiffiesPerSec/(now-tm)))
+	}
+	atomic.AddUint32(&e.subBytes, bytes)
+}
+
+// Accumulate records one packet of size bytes
+func (e *Estimator) Accumulate(bytes uint32) {
+	e.accumulate(bytes, rtptime.Now(rtptime.JiffiesPerSec))
+}
+
+// AccumulateKeyframe records one packet of size bytes that belongs to
+// a keyframe.  The packet is counted by Estimate, but not by
+// EstimateSteady.
+func (e *Estimator) AccumulateKeyframe(bytes uint32) {
+	atomic.AddUint32(&e.keyframeBytes, bytes)
+	e.Accumulate(bytes)
 }
 
 func (e *Estimator) estimate(now uint64) (uint32, uint32) {
@@ -70,7 +118,65 @@ func (e *Estimator) Estimate() (uint32, uint32) {
 	return e.estimate(rtptime.Now(rtptime.JiffiesPerSec))
 }
 
-// Totals returns the total number of bytes and packets accumulated.
+func (e *Estimator) estimateSteady(now uint64) uint32 {
+	e.estimate(now)
+	return atomic.LoadUint32(&e.steadyRate)
+}
+
+// EstimateSteady returns an estimate of the byte rate over the last
+// interval, excluding the packets recorded by AccumulateKeyframe.  Since
+// keyframes are large and infrequent, this is a better indication of the
+// rate that the sender is able to sustain.
+func (e *Estimator) EstimateSteady() uint32 {
+	return e.estimateSteady(rtptime.Now(rtptime.JiffiesPerSec))
+}
+
+func (e *Estimator) estimatePeak(now uint64) uint32 {
+	e.estimate(now)
+	tm := atomic.LoadUint64(&e.subTime)
+	if now < tm || now-tm > e.interval {
+		// nothing was sent recently
+		return 0
+	}
+	var peak uint32
+	for i := range e.history {
+		r := atomic.LoadUint32(&e.history[i])
+		if r > peak {
+			peak = r
+		}
+	}
+	return peak
+}
+
+// EstimatePeak returns the largest byte rate, in bytes per second,
+// observed over any of the last few sub-intervals, each of which is a
+// fraction of the interval passed to New.  Comparing it with the value
+// returned by Estimate gives an indication of burstiness.
+func (e *Estimator) EstimatePeak() uint32 {
+	return e.estimatePeak(rtptime.Now(rtptime.JiffiesPerSec))
+}
+
+// ResetPeak forgets the samples used by EstimatePeak.  It should be
+// called when the sender changes its rate, so that the change is not
+// mistaken for burstiness.
+func (e *Estimator) ResetPeak() {
+	for i := range e.history {
+		atomic.StoreUint32(&e.history[i], 0)
+	}
+}
+
+// Rates returns the values that Estimate, EstimateSteady and EstimatePeak
+// would return at time now, in jiffies: the byte rate, the byte rate
+// excluding keyframes, and the peak byte rate.
+func (e *Estimator) Rates(now uint64) (uint32, uint32, uint32) {
+	rate, _ := e.estimate(now)
+	return rate, atomic.LoadUint32(&e.steadyRate), e.estimatePeak(now)
+}
+
+// Totals returns the total number of packets and bytes accumulated.  The
+// counters are 32 bits wide and wrap around silently, which is what the
+// packet and octet counts of an RTCP sender report expect (RFC 3550
+// Section 6.4.1).
 func (e *Estimator) Totals() (uint32, uint32) {
 	b := atomic.LoadUint32(&e.totalBytes) + atomic.LoadUint32(&e.bytes)
 	p := atomic.LoadUint32(&e.totalPackets) + atomic.LoadUint32(&e.packets)
@@ -2,6 +2,7 @@ package estimator
 
 import (
 	"testing"
+	"time"
 
 	"github.com/jech/galene/rtptime"
 )
@@ -43,3 +44,155 @@ func TestEstimator(t *testing.T) {
 	}
 
 }
+
+func TestEstimatorPeak(t *testing.T) {
+	e := New(time.Second)
+	now := e.subTime
+	sub := uint64(rtptime.JiffiesPerSec / historyLength)
+
+	// a steady 800 bytes per second
+	for i := 0; i < historyLength; i++ {
+		e.accumulate(100, now)
+		now += sub
+	}
+	e.accumulate(100, now)
+	peak := e.estimatePeak(now)
+	if peak != 800 {
+		t.Errorf("Expected 800, got %v", peak)
+	}
+
+	// a burst within a single sub-interval
+	for i := 0; i < 8; i++ {
+		e.accumulate(100, now)
+	}
+	now += sub
+	e.accumulate(100, now)
+	peak = e.estimatePeak(now)
+	if peak != 7200 {
+		t.Errorf("Expected 7200, got %v", peak)
+	}
+
+	// old samples are ignored
+	peak = e.estimatePeak(now + 2*rtptime.JiffiesPerSec)
+	if peak != 0 {
+		t.Errorf("Expected 0, got %v", peak)
+	}
+
+	e.ResetPeak()
+	peak = e.estimatePeak(now)
+	if peak != 0 {
+		t.Errorf("Expected 0, got %v", peak)
+	}
+}
+
+func TestEstimatorTotalsWrap(t *testing.T) {
+	now := rtptime.Jiffies()
+	e := New(rtptime.JiffiesPerSec)
+
+	for i := 0; i < 5; i++ {
+		e.Accumulate(1 << 30)
+		e.estimate(now + uint64(i+1)*2*rtptime.JiffiesPerSec)
+	}
+	e.Accumulate(42)
+
+	totalP, totalB := e.Totals()
+	if totalP != 6 {
+		t.Errorf("Expected 6, got %v", totalP)
+	}
+	if totalB != (1<<30)+42 {
+		t.Errorf("Expected %v, got %v", (1<<30)+42, totalB)
+	}
+}
+
+func TestEstimatorKeyframes(t *testing.T) {
+	now := rtptime.Jiffies()
+	e := New(rtptime.JiffiesPerSec)
+	e.estimate(now)
+
+	// 30 packets per interval, with a keyframe every other interval
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			for j := 0; j < 10; j++ {
+				e.AccumulateKeyframe(1000)
+			}
+		}
+		for j := 0; j < 30; j++ {
+			e.Accumulate(1000)
+		}
+		now += rtptime.JiffiesPerSec * 1001 / 1000
+		rate, packetRate := e.estimate(now)
+		steady := e.estimateSteady(now)
+
+		expected := uint32(30 * 1000 * 1000 / 1001)
+		if steady != expected {
+			t.Errorf("%v: expected steady %v, got %v",
+				i, expected, steady)
+		}
+		if i%2 == 0 {
+			expected = 40 * 1000 * 1000 / 1001
+		}
+		if rate != expected {
+			t.Errorf("%v: expected %v, got %v", i, expected, rate)
+		}
+		if i%2 == 0 && packetRate != 39 || i%2 != 0 && packetRate != 29 {
+			t.Errorf("%v: unexpected packet rate %v", i, packetRate)
+		}
+	}
+
+	totalP, totalB := e.Totals()
+	if totalP != 350 || totalB != 350*1000 {
+		t.Errorf("Expected 350 %v, got %v %v", 350*1000, totalP, totalB)
+	}
+}
+
+func TestEstimatorWindow(t *testing.T) {
+	now := rtptime.Jiffies()
+	short := New(250 * time.Millisecond)
+	long := New(2 * time.Second)
+	short.estimate(now)
+	long.estimate(now)
+
+	step := uint64(rtptime.JiffiesPerSec / 100)
+	// 1000 bytes per second during 4s, then 5000 bytes per second
+	run := func(bytes uint32, d time.Duration) {
+		for i := 0; i < int(d/(10*time.Millisecond)); i++ {
+			short.Accumulate(bytes)
+			long.Accumulate(bytes)
+			now += step
+			short.estimate(now)
+			long.estimate(now)
+		}
+	}
+	run(10, 4*time.Second)
+	run(50, 600*time.Millisecond)
+
+	s, _ := short.estimate(now)
+	l, _ := long.estimate(now)
+	if s < 4500 || s > 5500 {
+		t.Errorf("Short window: expected 5000, got %v", s)
+	}
+	if l < 900 || l > 1100 {
+		t.Errorf("Long window: expected 1000, got %v", l)
+	}
+
+	run(50, 2*time.Second)
+	l, _ = long.estimate(now)
+	if l < 4500 || l > 5500 {
+		t.Errorf("Long window: expected 5000, got %v", l)
+	}
+}
+
+func TestEstimatorRates(t *testing.T) {
+	now := rtptime.Jiffies()
+	e := New(rtptime.JiffiesPerSec)
+	e.estimate(now)
+	e.AccumulateKeyframe(1000)
+	e.Accumulate(3000)
+	now += rtptime.JiffiesPerSec * 2
+	rate, steady, peak := e.Rates(now)
+	// nothing was sent during the last interval
+	if rate != 2000 || steady != 1500 || peak != 0 {
+		t.Errorf("Expected 2000 1500 0, got %v %v %v",
+			rate, steady, peak)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jech/galene/diskwriter"
+)
+
+func main() {
+	var keyFiles string
+	var output string
+	flag.StringVar(&keyFiles, "key", "",
+		"comma-separated list of key `files`")
+	flag.StringVar(&output, "o", "",
+		"output `file` (default: input without the "+
+			diskwriter.EncryptedSuffix+" suffix)")
+	flag.Parse()
+
+	if len(flag.Args()) != 1 || keyFiles == "" {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: %s -key file[,file...] [option...] recording\n",
+			os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	input := flag.Arg(0)
+
+	var keys [][]byte
+	for _, fn := range strings.Split(keyFiles, ",") {
+		key, err := diskwriter.ReadKey(fn)
+		if err != nil {
+			log.Fatalf("Read key %v: %v", fn, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if output == "" {
+		if !strings.HasSuffix(input, diskwriter.EncryptedSuffix) {
+			log.Fatalf("Input file doesn't end in %v, please use -o",
+				diskwriter.EncryptedSuffix)
+		}
+		output = strings.TrimSuffix(input, diskwriter.EncryptedSuffix)
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		log.Fatalf("Open: %v", err)
+	}
+	defer in.Close()
+
+	r, err := diskwriter.NewDecryptReader(in, keys)
+	if err != nil {
+		log.Fatalf("Decrypt: %v", err)
+	}
+
+	out, err := os.OpenFile(
+		output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600,
+	)
+	if err != nil {
+		log.Fatalf("Create: %v", err)
+	}
+
+	_, err = io.Copy(out, r)
+	err2 := out.Close()
+	if err == diskwriter.ErrTruncated {
+		log.Printf("Warning: %v, the output is incomplete", err)
+		os.Exit(1)
+	} else if err != nil {
+		os.Remove(output)
+		log.Fatalf("Decrypt: %v", err)
+	}
+	if err2 != nil {
+		log.Fatalf("Close: %v", err2)
+	}
+}
@@ -14,12 +14,16 @@ import (
 	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/group"
 	"github.com/jech/galene/ice"
+	"github.com/jech/galene/logger"
+	"github.com/jech/galene/ratelimitlog"
+	"github.com/jech/galene/rtpconn"
 	"github.com/jech/galene/turnserver"
 	"github.com/jech/galene/webserver"
 )
 
 func main() {
 	var cpuprofile, memprofile, mutexprofile, httpAddr, dataDir string
+	var iceFilter, dscp, logLevel, logFormat string
 
 	flag.StringVar(&httpAddr, "http", ":8443", "web server `address`")
 	flag.StringVar(&webserver.StaticRoot, "static", "./static/",
@@ -34,6 +38,11 @@ func main() {
 		"group description `directory`")
 	flag.StringVar(&diskwriter.Directory, "recordings", "./recordings/",
 		"recordings `directory`")
+	flag.StringVar(&diskwriter.KeyFile, "recordings-key", "",
+		"encrypt recordings with the key in `file`")
+	flag.DurationVar(&diskwriter.Latency, "recordings-latency",
+		diskwriter.Latency,
+		"target `latency` of the jitter buffer used for recording")
 	flag.StringVar(&cpuprofile, "cpuprofile", "",
 		"store CPU profile in `file`")
 	flag.StringVar(&memprofile, "memprofile", "",
@@ -43,10 +52,84 @@ func main() {
 	flag.BoolVar(&group.UseMDNS, "mdns", false, "gather mDNS addresses")
 	flag.BoolVar(&ice.ICERelayOnly, "relay-only", false,
 		"require use of TURN relays for all media traffic")
+	flag.StringVar(&iceFilter, "ice-filter", "",
+		"comma-separated `list` of remote ICE candidates to ignore "+
+			"(mdns, link-local, non-relay)")
+	flag.StringVar(&dscp, "dscp", "",
+		"DSCP classes of outgoing media, a `list` such as "+
+			"audio=EF,video=AF41")
 	flag.StringVar(&turnserver.Address, "turn", "auto",
 		"built-in TURN server `address` (\"\" to disable)")
+	flag.DurationVar(&ratelimitlog.Interval, "log-interval",
+		ratelimitlog.Interval,
+		"minimum `interval` between repeated media errors (0 to disable)")
+	flag.DurationVar(&rtpconn.KeepaliveInterval, "keepalive", 0,
+		"`interval` after which idle connections are sent keepalives "+
+			"(0 to disable)")
+	flag.IntVar(&rtpconn.WriterWorkers, "writer-workers", 0,
+		"`number` of goroutines shared by all media writers "+
+			"(0 for one goroutine per writer)")
+	flag.DurationVar(&rtpconn.RTCPInterval, "rtcp-interval",
+		rtpconn.RTCPInterval,
+		"`interval` between RTCP sender and receiver reports")
+	flag.DurationVar(&rtpconn.ReceiverReportTimeout,
+		"receiver-report-timeout", 0,
+		"`time` after which receiver reports are considered stale "+
+			"(0 for automatic)")
+	flag.BoolVar(&rtpconn.CorrectClockRate, "correct-clock-rate", false,
+		"use the observed clock rate of tracks whose timestamps "+
+			"don't match the declared rate")
+	flag.BoolVar(&rtpconn.RedactAddresses, "redact-addresses", false,
+		"don't show the addresses of ICE candidates in statistics")
+	flag.Uint64Var(&rtpconn.MaxBitrate, "max-bitrate", 0,
+		"largest `bitrate` that receivers may announce, in bits per "+
+			"second (0 for 1Gbit/s)")
+	flag.IntVar(&rtpconn.CacheMemory, "cache-memory", 0,
+		"`megabytes` of memory that packet caches should use "+
+			"(0 for no limit)")
+	flag.StringVar(&logLevel, "log-level", "info",
+		"minimum `level` of logged messages "+
+			"(debug, info, warn or error)")
+	flag.StringVar(&logFormat, "log-format", "text",
+		"`format` of log messages (text, keyvalue or json)")
 	flag.Parse()
 
+	level, err := logger.ParseLevel(logLevel)
+	if err != nil {
+		log.Printf("Parse -log-level: %v", err)
+		return
+	}
+	format, err := logger.ParseFormat(logFormat)
+	if err != nil {
+		log.Printf("Parse -log-format: %v", err)
+		return
+	}
+	logger.Default.SetLevel(level)
+	logger.Default.SetFormat(format)
+
+	if rtpconn.RTCPInterval <= 0 {
+		log.Printf("Invalid -rtcp-interval %v", rtpconn.RTCPInterval)
+		return
+	}
+
+	ice.CandidateFilter, err = ice.ParseFilter(iceFilter)
+	if err != nil {
+		log.Printf("Parse -ice-filter: %v", err)
+		return
+	}
+
+	if dscp != "" {
+		d, err := ice.ParseDSCP(dscp)
+		if err != nil {
+			log.Printf("Parse -dscp: %v", err)
+			return
+		}
+		group.UDPMux, err = ice.NewDSCPMux(d, group.PayloadTypeKinds())
+		if err != nil {
+			log.Printf("DSCP: %v, media will not be marked", err)
+		}
+	}
+
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
@@ -120,7 +203,7 @@ func main() {
 		case <-slowTicker.C:
 			go relayTest()
 		case <-terminate:
-			webserver.Shutdown()
+			webserver.Shutdown(5 * time.Second)
 			return
 		case <-serverDone:
 			os.Exit(1)
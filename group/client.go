@@ -8,6 +8,7 @@ import (
 	"errors"
 	"hash"
 
+	"github.com/pion/webrtc/v3"
 	"golang.org/x/crypto/pbkdf2"
 
 	"github.com/jech/galene/conn"
@@ -104,3 +105,30 @@ type Client interface {
 	PushClient(id, username string, permissions ClientPermissions, status map[string]interface{}, kind string) error
 	Kick(id, user, message string) error
 }
+
+// SubscribeRequest describes an attempt by a client to receive a track.
+type SubscribeRequest struct {
+	Group  *Group
+	Client Client
+	// the id and username of the client that published the track
+	Source   string
+	Username string
+	// the label of the stream and of the track
+	Label      string
+	TrackLabel string
+	Kind       webrtc.RTPCodecType
+}
+
+// SubscribeHook, if not nil, is called before a client starts receiving
+// a track.  The track is not sent to the client if it returns false.
+// It may be called from multiple goroutines, and must not block.
+var SubscribeHook func(r SubscribeRequest) bool
+
+// MaySubscribe returns true if the client in r is allowed to receive
+// the given track.
+func MaySubscribe(r SubscribeRequest) bool {
+	if SubscribeHook == nil {
+		return true
+	}
+	return SubscribeHook(r)
+}
@@ -0,0 +1,261 @@
+package group
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// CodecConstraints restricts the parameters of the codecs negotiated in
+// a group, so that the media can be decoded by receivers with limited,
+// typically hardware, decoders.
+type CodecConstraints struct {
+	// The H.264 profile that receivers can decode, one of
+	// "constrained-baseline" (which has no B-frames), "baseline",
+	// "main" or "high".  If empty, any profile is accepted.
+	H264Profile string `json:"h264-profile,omitempty"`
+	// The highest H.264 level that receivers can decode, such as
+	// "3.1".  If empty, any level is accepted.
+	H264Level string `json:"h264-level,omitempty"`
+	// The VP9 profile, either 0 or 2.  If nil, any profile is
+	// accepted.
+	VP9Profile *int `json:"vp9-profile,omitempty"`
+	// If true, a sender whose offer cannot satisfy the constraints is
+	// rejected.  Otherwise, it is accepted with the parameters that it
+	// offers, and a warning is logged.
+	Strict bool `json:"strict,omitempty"`
+}
+
+// h264Profiles maps the profiles that we know about to the values of
+// profile_idc and profile_iop that we advertise.
+var h264Profiles = map[string][2]byte{
+	"constrained-baseline": {0x42, 0xe0},
+	"baseline":             {0x42, 0x00},
+	"main":                 {0x4d, 0x00},
+	"high":                 {0x64, 0x00},
+}
+
+// h264Level parses a level such as "3.1", and returns the value of
+// level_idc.
+func h264Level(level string) (byte, error) {
+	f, err := strconv.ParseFloat(level, 64)
+	if err != nil || f < 1 || f > 6.2 {
+		return 0, errors.New("unknown H.264 level " + level)
+	}
+	return byte(f*10 + 0.5), nil
+}
+
+func (cc *CodecConstraints) check() error {
+	if cc.H264Profile != "" {
+		_, ok := h264Profiles[cc.H264Profile]
+		if !ok {
+			return errors.New("unknown H.264 profile " + cc.H264Profile)
+		}
+	}
+	if cc.H264Level != "" {
+		_, err := h264Level(cc.H264Level)
+		if err != nil {
+			return err
+		}
+	}
+	if cc.VP9Profile != nil && *cc.VP9Profile != 0 && *cc.VP9Profile != 2 {
+		return errors.New("unsupported VP9 profile")
+	}
+	return nil
+}
+
+// fmtpParameter returns the value of the parameter key in the fmtp line
+// fmtp.
+func fmtpParameter(fmtp, key string) (string, bool) {
+	for _, p := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], key) {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// setFmtpParameter sets the parameter key in the fmtp line fmtp.
+func setFmtpParameter(fmtp, key, value string) string {
+	var params []string
+	if fmtp != "" {
+		params = strings.Split(fmtp, ";")
+	}
+	for i, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if strings.EqualFold(kv[0], key) {
+			params[i] = key + "=" + value
+			return strings.Join(params, ";")
+		}
+	}
+	return strings.Join(append(params, key+"="+value), ";")
+}
+
+// profileLevelId parses an H.264 profile-level-id.  A missing value
+// means constrained baseline at level 1.0 (RFC 6184 Section 8.1).
+func profileLevelId(fmtp string) ([3]byte, bool) {
+	var id [3]byte
+	v, ok := fmtpParameter(fmtp, "profile-level-id")
+	if !ok {
+		return [3]byte{0x42, 0xe0, 10}, true
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != 3 {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// h264ConstrainedBaseline returns true if a profile-level-id describes
+// the constrained baseline profile, which may be signalled in a number
+// of ways (RFC 6184 Table 5).
+func h264ConstrainedBaseline(id [3]byte) bool {
+	switch id[0] {
+	case 0x42:
+		return id[1]&0x40 != 0
+	case 0x4d:
+		return id[1]&0x80 != 0
+	case 0x58:
+		return id[1]&0xc0 == 0xc0
+	}
+	return false
+}
+
+// satisfiesH264Profile returns true if a stream described by the given
+// profile-level-id can be decoded by a decoder of profile profile.
+func satisfiesH264Profile(id [3]byte, profile string) bool {
+	if h264ConstrainedBaseline(id) {
+		return true
+	}
+	switch profile {
+	case "baseline":
+		return id[0] == 0x42
+	case "main":
+		return id[0] == 0x4d
+	case "high":
+		return id[0] == 0x4d || id[0] == 0x64
+	}
+	return false
+}
+
+// apply returns a copy of codec with its parameters restricted by cc.
+func (cc *CodecConstraints) apply(codec webrtc.RTPCodecCapability) webrtc.RTPCodecCapability {
+	switch strings.ToLower(codec.MimeType) {
+	case "video/h264":
+		id, ok := profileLevelId(codec.SDPFmtpLine)
+		if !ok {
+			break
+		}
+		if p, ok := h264Profiles[cc.H264Profile]; ok {
+			id[0], id[1] = p[0], p[1]
+		}
+		if l, err := h264Level(cc.H264Level); err == nil {
+			id[2] = l
+		}
+		codec.SDPFmtpLine = setFmtpParameter(codec.SDPFmtpLine,
+			"profile-level-id", hex.EncodeToString(id[:]))
+	case "video/vp9":
+		if cc.VP9Profile != nil {
+			codec.SDPFmtpLine = setFmtpParameter(codec.SDPFmtpLine,
+				"profile-id", strconv.Itoa(*cc.VP9Profile))
+		}
+	}
+	return codec
+}
+
+// satisfies returns true if a codec offered with the given fmtp line
+// satisfies cc.
+func (cc *CodecConstraints) satisfies(mimeType, fmtp string) bool {
+	switch strings.ToLower(mimeType) {
+	case "video/h264":
+		if cc.H264Profile == "" && cc.H264Level == "" {
+			return true
+		}
+		id, ok := profileLevelId(fmtp)
+		if !ok {
+			return false
+		}
+		if cc.H264Profile != "" &&
+			!satisfiesH264Profile(id, cc.H264Profile) {
+			return false
+		}
+		if l, err := h264Level(cc.H264Level); err == nil && id[2] > l {
+			return false
+		}
+		return true
+	case "video/vp9":
+		if cc.VP9Profile == nil {
+			return true
+		}
+		p := "0"
+		if v, ok := fmtpParameter(fmtp, "profile-id"); ok {
+			p = v
+		}
+		return p == strconv.Itoa(*cc.VP9Profile)
+	}
+	return true
+}
+
+// CodecConstraints returns the codec constraints of the group, or nil if
+// there are none.
+func (g *Group) CodecConstraints() *CodecConstraints {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.CodecConstraints
+}
+
+var ErrCodecConstraints = UserError(
+	"your browser cannot send video that satisfies " +
+		"the codec constraints of this group",
+)
+
+// CheckCodecConstraints checks that every video section of the offer o
+// contains at least one codec allowed in the group whose parameters
+// satisfy the group's codec constraints.  Sections that contain no
+// allowed codec at all are left to normal negotiation.
+func (g *Group) CheckCodecConstraints(o *sdp.SessionDescription) error {
+	cc := g.CodecConstraints()
+	if cc == nil {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, c := range g.Codecs() {
+		allowed[strings.ToLower(c.MimeType)] = true
+	}
+
+	for _, m := range o.MediaDescriptions {
+		if m.MediaName.Media != "video" {
+			continue
+		}
+		found, satisfied := false, false
+		for _, f := range m.MediaName.Formats {
+			pt, err := strconv.Atoi(f)
+			if err != nil {
+				continue
+			}
+			codec, err := o.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			mime := strings.ToLower("video/" + codec.Name)
+			if !allowed[mime] {
+				continue
+			}
+			found = true
+			if cc.satisfies(mime, codec.Fmtp) {
+				satisfied = true
+				break
+			}
+		}
+		if found && !satisfied {
+			return ErrCodecConstraints
+		}
+	}
+	return nil
+}
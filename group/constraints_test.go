@@ -0,0 +1,126 @@
+package group
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+)
+
+func TestCodecConstraintsApply(t *testing.T) {
+	two := 2
+	cc := &CodecConstraints{
+		H264Profile: "constrained-baseline",
+		H264Level:   "3.1",
+		VP9Profile:  &two,
+	}
+	if err := cc.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	h264, _ := codecFromName("h264")
+	h264 = cc.apply(h264)
+	id, _ := fmtpParameter(h264.SDPFmtpLine, "profile-level-id")
+	if id != "42e01f" {
+		t.Errorf("Expected 42e01f, got %v", id)
+	}
+	pm, _ := fmtpParameter(h264.SDPFmtpLine, "packetization-mode")
+	if pm != "1" {
+		t.Errorf("Expected 1, got %v", pm)
+	}
+
+	vp9, _ := codecFromName("vp9")
+	vp9 = cc.apply(vp9)
+	if vp9.SDPFmtpLine != "profile-id=2" {
+		t.Errorf("Expected profile-id=2, got %v", vp9.SDPFmtpLine)
+	}
+
+	bad := []*CodecConstraints{
+		{H264Profile: "extended"},
+		{H264Level: "7"},
+		{H264Level: "three"},
+	}
+	for _, b := range bad {
+		if b.check() == nil {
+			t.Errorf("Expected error for %v", b)
+		}
+	}
+}
+
+func TestCodecConstraintsSatisfies(t *testing.T) {
+	cc := &CodecConstraints{
+		H264Profile: "constrained-baseline",
+		H264Level:   "3.1",
+	}
+	tests := []struct {
+		fmtp string
+		ok   bool
+	}{
+		{"packetization-mode=1;profile-level-id=42e01f", true},
+		{"packetization-mode=1;profile-level-id=42001f", false},
+		{"packetization-mode=1;profile-level-id=4d801f", true},
+		{"packetization-mode=1;profile-level-id=640c1f", false},
+		{"packetization-mode=1;profile-level-id=42e028", false},
+		{"packetization-mode=1", true},
+		{"profile-level-id=garbage", false},
+	}
+	for _, tt := range tests {
+		ok := cc.satisfies("video/H264", tt.fmtp)
+		if ok != tt.ok {
+			t.Errorf("%v: expected %v, got %v", tt.fmtp, tt.ok, ok)
+		}
+	}
+
+	cc = &CodecConstraints{H264Profile: "high"}
+	if !cc.satisfies("video/H264", "profile-level-id=640c34") {
+		t.Errorf("High profile not accepted")
+	}
+	if !cc.satisfies("video/VP8", "") {
+		t.Errorf("VP8 not accepted")
+	}
+}
+
+const constrainedOffer = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 102 104\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"a=fmtp:102 packetization-mode=1;profile-level-id=640c34\r\n" +
+	"a=rtpmap:104 H264/90000\r\n" +
+	"a=fmtp:104 packetization-mode=1;profile-level-id=%v\r\n"
+
+func TestCheckCodecConstraints(t *testing.T) {
+	g, err := Add("constraints-test", &Description{
+		Codecs: []string{"h264", "opus"},
+		CodecConstraints: &CodecConstraints{
+			H264Profile: "constrained-baseline",
+			H264Level:   "3.1",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer Delete("constraints-test")
+
+	for _, tt := range []struct {
+		id string
+		ok bool
+	}{
+		{"42e01f", true},
+		{"4d0028", false},
+	} {
+		var o sdp.SessionDescription
+		err := o.Unmarshal([]byte(
+			fmt.Sprintf(constrainedOffer, tt.id),
+		))
+		if err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		err = g.CheckCodecConstraints(&o)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: expected %v, got %v", tt.id, tt.ok, err)
+		}
+	}
+}
@@ -12,13 +12,20 @@ import (
 	"sync"
 	"time"
 
-	"github.com/pion/ice/v2"
+	pionice "github.com/pion/ice/v2"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/ice"
 )
 
 var Directory string
 var UseMDNS bool
 
+// UDPMux, if not nil, is used by all peer connections for IPv4 host
+// candidates, and IPv6 is disabled.
+var UDPMux pionice.UDPMux
+
 var ErrNotAuthorised = errors.New("not authorised")
 
 type UserError string
@@ -71,6 +78,19 @@ type Group struct {
 	clients     map[string]Client
 	history     []ChatHistoryEntry
 	timestamp   time.Time
+	// the number of joins rejected because the group was full
+	rejectedJoins uint64
+	// the handlers called when a stream becomes available or goes
+	// away, indexed by a counter
+	publisherHandlers map[uint64]PublisherHandler
+	publisherCounter  uint64
+	// the track kinds muted by an operator, indexed by client id
+	muted map[mutedTrack]struct{}
+}
+
+type mutedTrack struct {
+	id   string
+	kind webrtc.RTPCodecType
 }
 
 func (g *Group) Name() string {
@@ -115,17 +135,301 @@ func (g *Group) AllowRecording() bool {
 	return g.description.AllowRecording
 }
 
+// MaxAudioForward returns the maximum number of audio tracks that are
+// forwarded at any given time, or 0 if unlimited.
+func (g *Group) MaxAudioForward() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.MaxAudioForward
+}
+
+// MaxAudioBitrate returns the maximum bitrate that senders should use
+// for Opus audio, or 0 if unlimited.
+func (g *Group) MaxAudioBitrate() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.MaxAudioBitrate
+}
+
+// OpusStereo returns true if senders should be asked for stereo Opus
+// audio even when they don't announce it.
+func (g *Group) OpusStereo() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.OpusStereo
+}
+
+// InitialBitrate returns the initial bitrate estimate for tracks of
+// the given kind, or 0 if the default should be used.
+func (g *Group) InitialBitrate(kind webrtc.RTPCodecType) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return g.description.InitialAudioBitrate
+	case webrtc.RTPCodecTypeVideo:
+		return g.description.InitialVideoBitrate
+	}
+	return 0
+}
+
+// UplinkEstimation returns true if the bitrate requested from senders
+// should be estimated from their uplinks.
+func (g *Group) UplinkEstimation() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.UplinkEstimation
+}
+
+// WriterPacing returns the name of the strategy used for pacing the
+// forwarding of media, or the empty string if the default should be used.
+func (g *Group) WriterPacing() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.WriterPacing
+}
+
+// VideoBitrate returns the initial bitrate estimate and the maximum
+// bitrate of video tracks in streams with the given label.  The initial
+// bitrate is 0 if the default should be used, the maximum is 0 if there
+// is no limit.
+func (g *Group) VideoBitrate(label string) (uint64, uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	initial := g.description.InitialVideoBitrate
+	b, ok := g.description.VideoBitrates[label]
+	if !ok {
+		return initial, 0
+	}
+	if b.Initial != 0 {
+		initial = b.Initial
+	}
+	if b.Max != 0 && initial > b.Max {
+		initial = b.Max
+	}
+	return initial, b.Max
+}
+
+// VideoMinBitrate returns the bitrate below which video tracks in streams
+// with the given label should not be throttled, or 0 if there is no
+// floor.  The floor is never above the maximum bitrate.
+func (g *Group) VideoMinBitrate(label string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.description.VideoBitrates[label]
+	if !ok {
+		return 0
+	}
+	if b.Max != 0 && b.Min > b.Max {
+		return b.Max
+	}
+	return b.Min
+}
+
+// RTCPXR returns true if extended reports should be sent to all senders.
+func (g *Group) RTCPXR() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RTCPXR
+}
+
+// RelayOnly returns true if media must be relayed through TURN.
+func (g *Group) RelayOnly() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RelayOnly
+}
+
+// ICEServers returns the ICE servers specific to the group, which are
+// used in addition to the global ones.
+func (g *Group) ICEServers() []ice.Server {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.ICEServers
+}
+
+// LosslessForwarding returns true if media should be forwarded without
+// any adaptation to network conditions.
+func (g *Group) LosslessForwarding() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.LosslessForwarding
+}
+
+// AddCSRC returns true if the SSRC of senders should be added to the
+// contributing sources of forwarded packets.
+func (g *Group) AddCSRC() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.AddCSRC
+}
+
+// Pacing returns true if media sent to receivers should be paced.
+func (g *Group) Pacing() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.Pacing
+}
+
+// DirectAudio returns true if audio should be forwarded without loss
+// recovery.
+func (g *Group) DirectAudio() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.DirectAudio
+}
+
+// NoRetransmission returns true if lost packets should never be
+// retransmitted.
+func (g *Group) NoRetransmission() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.NoRetransmission
+}
+
+// MaxVideoResolution returns the largest video resolution accepted from
+// senders.  A value of 0 means no limit.
+func (g *Group) MaxVideoResolution() (int, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.MaxVideoWidth, g.description.MaxVideoHeight
+}
+
+// RTCPAppNames returns the names of the RTCP APP packets that may be
+// forwarded from senders to receivers.
+func (g *Group) RTCPAppNames() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RTCPAppNames
+}
+
+// ForwardedCNAME returns the policy for the CNAME of forwarded tracks.
+func (g *Group) ForwardedCNAME() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.ForwardedCNAME
+}
+
+// SenderBitratePercentile returns the percentage of receivers that
+// should be able to receive the bitrate requested from senders, between
+// 1 and 100.
+func (g *Group) SenderBitratePercentile() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p := g.description.SenderBitratePercentile
+	if p <= 0 || p > 100 {
+		return 100
+	}
+	return p
+}
+
+// KeyframeRequestInterval returns the minimum interval between two
+// keyframe requests of the given kind, either "pli" or "fir", or 0 if the
+// default should be used.
+func (g *Group) KeyframeRequestInterval(kind string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ms int
+	switch kind {
+	case "pli":
+		ms = g.description.PLIInterval
+	case "fir":
+		ms = g.description.FIRInterval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// KeyframePeriod returns the interval at which keyframes are requested
+// from senders, or 0 if they are only requested when needed.
+func (g *Group) KeyframePeriod() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Duration(g.description.KeyframePeriod) * time.Millisecond
+}
+
+// RateWindow returns the window over which the rate of tracks of the
+// given kind is estimated.
+func (g *Group) RateWindow(kind webrtc.RTPCodecType) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ms int
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		ms = g.description.AudioRateWindow
+	case webrtc.RTPCodecTypeVideo:
+		ms = g.description.VideoRateWindow
+	}
+	if ms <= 0 {
+		return time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// NetworkQuality returns the thresholds for the network quality
+// indicator, with defaults filled in.
+func (g *Group) NetworkQuality() NetworkQuality {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	q := DefaultNetworkQuality
+	d := g.description.NetworkQuality
+	if d == nil {
+		return q
+	}
+	set := func(v *int, w int) {
+		if w != 0 {
+			*v = w
+		}
+	}
+	set(&q.MediumLoss, d.MediumLoss)
+	set(&q.PoorLoss, d.PoorLoss)
+	set(&q.MediumRTT, d.MediumRTT)
+	set(&q.PoorRTT, d.PoorRTT)
+	set(&q.MediumRate, d.MediumRate)
+	set(&q.PoorRate, d.PoorRate)
+	return q
+}
+
+// maxOverflow returns the number of clients admitted as listeners once
+// a group has reached its maximum number of clients.
+func maxOverflow(desc *Description) int {
+	if desc.MaxOverflow > 0 {
+		return desc.MaxOverflow
+	}
+	return desc.MaxClients
+}
+
+// RejectedJoins returns the number of clients that were refused entry
+// because the group was full.
+func (g *Group) RejectedJoins() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rejectedJoins
+}
+
 var groups struct {
 	mu     sync.Mutex
 	groups map[string]*Group
 }
 
 func (g *Group) API() *webrtc.API {
+	return APIFromCodecs(g.Codecs())
+}
+
+// Codecs returns the codecs allowed in the group, with their parameters
+// restricted by the group's codec constraints.
+func (g *Group) Codecs() []webrtc.RTPCodecCapability {
 	g.mu.Lock()
-	codecs := g.description.Codecs
+	names := g.description.Codecs
+	cc := g.description.CodecConstraints
 	g.mu.Unlock()
 
-	return APIFromNames(codecs)
+	codecs := codecsFromNames(names)
+	if cc != nil {
+		for i := range codecs {
+			codecs[i] = cc.apply(codecs[i])
+		}
+	}
+	return codecs
 }
 
 func codecFromName(name string) (webrtc.RTPCodecCapability, error) {
@@ -198,31 +502,72 @@ func payloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, error) {
 	}
 }
 
+// PayloadTypeKinds returns the kinds of the codecs associated with each of
+// the payload types that we use.
+func PayloadTypeKinds() map[uint8]webrtc.RTPCodecType {
+	kinds := make(map[uint8]webrtc.RTPCodecType)
+	names := []string{"vp8", "vp9", "h264", "opus", "g722", "pcmu", "pcma"}
+	for _, name := range names {
+		codec, err := codecFromName(name)
+		if err != nil {
+			continue
+		}
+		pt, err := payloadType(codec)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(codec.MimeType, "video/") {
+			kinds[uint8(pt)] = webrtc.RTPCodecTypeVideo
+		} else {
+			kinds[uint8(pt)] = webrtc.RTPCodecTypeAudio
+		}
+	}
+	return kinds
+}
+
+// RTCPFeedback returns the RTCP feedback mechanisms that we offer for
+// a given codec.  The mechanisms actually used on a track are the ones
+// that were also offered by the peer.
+func RTCPFeedback(mimeType string) []webrtc.RTCPFeedback {
+	if strings.HasPrefix(strings.ToLower(mimeType), "video/") {
+		return []webrtc.RTCPFeedback{
+			{"goog-remb", ""},
+			{"nack", ""},
+			{"nack", "pli"},
+			{"ccm", "fir"},
+			{"ccm", "tmmbr"},
+		}
+	}
+	return []webrtc.RTCPFeedback{
+		{"ccm", "tmmbr"},
+	}
+}
+
 func APIFromCodecs(codecs []webrtc.RTPCodecCapability) *webrtc.API {
 	s := webrtc.SettingEngine{}
 	s.SetSRTPReplayProtectionWindow(512)
 	if !UseMDNS {
-		s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+		s.SetICEMulticastDNSMode(pionice.MulticastDNSModeDisabled)
+	}
+	if UDPMux != nil {
+		// the mux only handles IPv4
+		s.SetICEUDPMux(UDPMux)
+		s.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+		})
 	}
 	m := webrtc.MediaEngine{}
 
 	for _, codec := range codecs {
 		var tpe webrtc.RTPCodecType
-		var fb []webrtc.RTCPFeedback
 		if strings.HasPrefix(strings.ToLower(codec.MimeType), "video/") {
 			tpe = webrtc.RTPCodecTypeVideo
-			fb = []webrtc.RTCPFeedback{
-				{"goog-remb", ""},
-				{"nack", ""},
-				{"nack", "pli"},
-				{"ccm", "fir"},
-			}
 		} else if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
 			tpe = webrtc.RTPCodecTypeAudio
-			fb = []webrtc.RTCPFeedback{}
 		} else {
 			continue
 		}
+		fb := RTCPFeedback(codec.MimeType)
 
 		ptpe, err := payloadType(codec)
 		if err != nil {
@@ -243,13 +588,36 @@ func APIFromCodecs(codecs []webrtc.RTPCodecCapability) *webrtc.API {
 			tpe,
 		)
 	}
+	// the audio level is only used for selecting speakers, we
+	// don't send it downstream.
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverDirectionRecvonly,
+	)
+
+	// the MID and RID extensions allow packets to be mapped to
+	// transceivers even when their SSRC was not signalled, which is
+	// the case with simulcast.
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		for _, tpe := range []webrtc.RTPCodecType{
+			webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo,
+		} {
+			m.RegisterHeaderExtension(
+				webrtc.RTPHeaderExtensionCapability{URI: uri},
+				tpe,
+				webrtc.RTPTransceiverDirectionRecvonly,
+			)
+		}
+	}
+
 	return webrtc.NewAPI(
 		webrtc.WithSettingEngine(s),
 		webrtc.WithMediaEngine(&m),
 	)
 }
 
-func APIFromNames(names []string) *webrtc.API {
+func codecsFromNames(names []string) []webrtc.RTPCodecCapability {
 	if len(names) == 0 {
 		names = []string{"vp8", "opus"}
 	}
@@ -262,8 +630,11 @@ func APIFromNames(names []string) *webrtc.API {
 		}
 		codecs = append(codecs, codec)
 	}
+	return codecs
+}
 
-	return APIFromCodecs(codecs)
+func APIFromNames(names []string) *webrtc.API {
+	return APIFromCodecs(codecsFromNames(names))
 }
 
 func Add(name string, desc *Description) (*Group, error) {
@@ -396,6 +767,7 @@ func deleteUnlocked(g *Group) bool {
 	}
 
 	delete(groups.groups, g.name)
+	g.muted = nil
 	return true
 }
 
@@ -472,8 +844,17 @@ func AddClient(group string, c Client) (*Group, error) {
 		}
 
 		if !perms.Op && g.description.MaxClients > 0 {
-			if len(g.clients) >= g.description.MaxClients {
-				return nil, UserError("too many users")
+			n := len(g.clients)
+			max := g.description.MaxClients
+			if n >= max {
+				if !g.description.AllowOverflow ||
+					n >= max+maxOverflow(g.description) {
+					g.rejectedJoins++
+					return nil, UserError("too many users")
+				}
+				// admit the client as a listener
+				perms.Present = false
+				c.SetPermissions(perms)
 			}
 		}
 	}
@@ -590,11 +971,12 @@ func (g *Group) Range(f func(c Client) bool) {
 	}
 }
 
+// kickall kicks all clients.  It doesn't hold the group lock while
+// kicking, since some clients remove themselves synchronously.
 func kickall(g *Group, message string) {
-	g.Range(func(c Client) bool {
+	for _, c := range g.GetClients(nil) {
 		c.Kick("", "", message)
-		return true
-	})
+	}
 }
 
 func (g *Group) Shutdown(message string) {
@@ -667,6 +1049,32 @@ func discardObsoleteHistory(h []ChatHistoryEntry, duration time.Duration) []Chat
 	return h
 }
 
+// SetMuted records whether the tracks of the given kind sent by the
+// client with the given id are muted.  The state is kept by the group
+// until it is deleted, so that it persists when the client leaves and
+// joins again with the same id.
+func (g *Group) SetMuted(id string, kind webrtc.RTPCodecType, muted bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !muted {
+		delete(g.muted, mutedTrack{id, kind})
+		return
+	}
+	if g.muted == nil {
+		g.muted = make(map[mutedTrack]struct{})
+	}
+	g.muted[mutedTrack{id, kind}] = struct{}{}
+}
+
+// Muted returns true if the tracks of the given kind sent by the client
+// with the given id are muted.
+func (g *Group) Muted(id string, kind webrtc.RTPCodecType) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.muted[mutedTrack{id, kind}]
+	return ok
+}
+
 func (g *Group) GetChatHistory() []ChatHistoryEntry {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -735,6 +1143,14 @@ type Description struct {
 	// The maximum number of simultaneous clients.  Unlimited if 0.
 	MaxClients int `json:"max-clients,omitempty"`
 
+	// Whether clients are allowed to join a full group as listeners,
+	// without the right to present.
+	AllowOverflow bool `json:"allow-overflow,omitempty"`
+
+	// The maximum number of listeners admitted beyond MaxClients when
+	// AllowOverflow is set.  Defaults to MaxClients if 0.
+	MaxOverflow int `json:"max-overflow,omitempty"`
+
 	// The time for which history entries are kept.
 	MaxHistoryAge int `json:"max-history-age,omitempty"`
 
@@ -765,6 +1181,160 @@ type Description struct {
 	// Codec preferences.  If empty, a suitable default is chosen in
 	// the APIFromNames function.
 	Codecs []string `json:"codecs,omitempty"`
+
+	// Restrictions on the parameters of the video codecs, for the
+	// sake of receivers with limited decoders.
+	CodecConstraints *CodecConstraints `json:"codec-constraints,omitempty"`
+
+	// The maximum number of audio tracks forwarded at a time; only
+	// the loudest speakers are forwarded.  Unlimited if 0.
+	MaxAudioForward int `json:"max-audio-forward,omitempty"`
+
+	// The maximum bitrate, in bits per second, requested from senders
+	// of Opus audio.  Unlimited if 0.
+	MaxAudioBitrate uint64 `json:"max-audio-bitrate,omitempty"`
+
+	// Whether senders are asked for stereo Opus audio even when their
+	// offer doesn't announce it.
+	OpusStereo bool `json:"opus-stereo,omitempty"`
+
+	// The initial bitrate estimate, in bits per second, for audio and
+	// video tracks sent to clients.  If 0, a suitable default is used.
+	InitialAudioBitrate uint64 `json:"initial-audio-bitrate,omitempty"`
+	InitialVideoBitrate uint64 `json:"initial-video-bitrate,omitempty"`
+
+	// The bitrates of video tracks, indexed by the label of the
+	// stream, such as "camera" or "screenshare".  These override
+	// InitialVideoBitrate.
+	VideoBitrates map[string]VideoBitrate `json:"video-bitrates,omitempty"`
+
+	// The minimum interval, in milliseconds, between two PLI or two
+	// FIR requests sent to a given sender.  If 0, a suitable default
+	// is used.
+	PLIInterval int `json:"pli-interval,omitempty"`
+	FIRInterval int `json:"fir-interval,omitempty"`
+
+	// The interval, in milliseconds, at which keyframes are requested
+	// from senders, even if no receiver asks for one.  If 0,
+	// keyframes are only requested when needed.
+	KeyframePeriod int `json:"keyframe-period,omitempty"`
+
+	// The window, in milliseconds, over which the rate of audio and
+	// video tracks is estimated.  If 0, one second is used.
+	AudioRateWindow int `json:"audio-rate-window,omitempty"`
+	VideoRateWindow int `json:"video-rate-window,omitempty"`
+
+	// Whether to send RTCP extended reports (RFC 3611) to senders even
+	// if they didn't negotiate them.
+	RTCPXR bool `json:"rtcp-xr,omitempty"`
+
+	// Whether all media must go through a TURN relay.
+	RelayOnly bool `json:"relay-only,omitempty"`
+
+	// ICE servers used by the group's connections in addition to, and
+	// before, the global ones.
+	ICEServers []ice.Server `json:"ice-servers,omitempty"`
+
+	// Whether to forward media without pacing, dropping or loss-based
+	// rate adaptation.  Only suitable for local networks.
+	LosslessForwarding bool `json:"lossless-forwarding,omitempty"`
+
+	// Whether to pace the media sent to receivers, so that audio is
+	// not delayed behind bursts of video.
+	Pacing bool `json:"pacing,omitempty"`
+
+	// Whether to forward audio without attempting to recover lost
+	// packets, which are left for the receivers to conceal.
+	DirectAudio bool `json:"direct-audio,omitempty"`
+
+	// Whether to never retransmit lost packets, whether audio or
+	// video, which are left for the receivers to conceal.
+	NoRetransmission bool `json:"no-retransmission,omitempty"`
+
+	// The largest video resolution accepted from senders.  Video
+	// that exceeds either dimension is not forwarded.  If 0, there
+	// is no limit.
+	MaxVideoWidth  int `json:"max-video-width,omitempty"`
+	MaxVideoHeight int `json:"max-video-height,omitempty"`
+
+	// The names of the RTCP APP packets that are forwarded from
+	// senders to receivers.  If empty, no APP packets are forwarded.
+	RTCPAppNames []string `json:"rtcp-app-names,omitempty"`
+
+	// The CNAME of the tracks sent to receivers: "sender" (the
+	// default) forwards the sender's CNAME, "stream" uses the id of
+	// the stream, and "user" uses the id of the sender's client, so
+	// that all the tracks of a given sender share a CNAME.
+	ForwardedCNAME string `json:"forwarded-cname,omitempty"`
+
+	// The bitrate requested from senders is the highest bitrate that
+	// can be received by this percentage of the receivers.  If 0,
+	// all receivers are taken into account.
+	SenderBitratePercentile int `json:"sender-bitrate-percentile,omitempty"`
+
+	// Whether the bitrate requested from senders is estimated from
+	// the arrival times of their packets, rather than derived from
+	// the bitrates of the receivers.
+	UplinkEstimation bool `json:"uplink-estimation,omitempty"`
+
+	// Whether the SSRC of the sender is added to the contributing
+	// sources of the packets forwarded to receivers.
+	AddCSRC bool `json:"add-csrc,omitempty"`
+
+	// The thresholds used for computing the network quality
+	// indicator sent to clients.  If nil, the defaults are used.
+	NetworkQuality *NetworkQuality `json:"network-quality,omitempty"`
+
+	// The name under which the SDP mungers applied to the offers and
+	// answers generated for this group were registered.  If empty,
+	// descriptions are not munged.
+	SDPMunger string `json:"sdp-munger,omitempty"`
+
+	// The strategy that decides how long the forwarding of audio
+	// may wait for congested receivers: "rate" (the default),
+	// "immediate", "leaky-bucket", or the name of a strategy
+	// registered by the embedding program.
+	WriterPacing string `json:"writer-pacing,omitempty"`
+}
+
+// VideoBitrate holds the bitrates, in bits per second, of the video
+// tracks of streams with a given label.
+type VideoBitrate struct {
+	// The initial bitrate estimate.  If 0, the group's initial video
+	// bitrate is used.
+	Initial uint64 `json:"initial,omitempty"`
+	// The maximum bitrate.  If 0, there is no limit.
+	Max uint64 `json:"max,omitempty"`
+	// The bitrate below which the rate sent to a receiver is never
+	// reduced in reaction to congestion.  If 0, there is no floor.
+	Min uint64 `json:"min,omitempty"`
+}
+
+// NetworkQuality holds the thresholds above which the quality of a
+// connection is considered to be medium or poor.  Fields that are 0
+// take their value from DefaultNetworkQuality.
+type NetworkQuality struct {
+	// Loss rates, in percent.
+	MediumLoss int `json:"medium-loss,omitempty"`
+	PoorLoss   int `json:"poor-loss,omitempty"`
+
+	// Round-trip times, in milliseconds.
+	MediumRTT int `json:"medium-rtt,omitempty"`
+	PoorRTT   int `json:"poor-rtt,omitempty"`
+
+	// The bitrate allowed by congestion control, as a percentage of
+	// the bitrate being sent.  Lower values are worse.
+	MediumRate int `json:"medium-rate,omitempty"`
+	PoorRate   int `json:"poor-rate,omitempty"`
+}
+
+var DefaultNetworkQuality = NetworkQuality{
+	MediumLoss: 3,
+	PoorLoss:   10,
+	MediumRTT:  300,
+	PoorRTT:    800,
+	MediumRate: 80,
+	PoorRate:   50,
 }
 
 const DefaultMaxHistoryAge = 4 * time.Hour
@@ -844,6 +1414,18 @@ func GetDescription(name string) (*Description, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = ice.CheckServers(desc.ICEServers)
+	if err != nil {
+		return nil, errors.New("ice-servers: " + err.Error())
+	}
+	if desc.CodecConstraints != nil {
+		err = desc.CodecConstraints.check()
+		if err != nil {
+			return nil, errors.New(
+				"codec-constraints: " + err.Error(),
+			)
+		}
+	}
 	if isParent {
 		if !desc.AllowSubgroups {
 			return nil, os.ErrNotExist
@@ -3,9 +3,16 @@ package group
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
 )
 
 func TestGroup(t *testing.T) {
@@ -237,3 +244,228 @@ func TestPermissions(t *testing.T) {
 	}
 
 }
+
+func TestDescriptionICEServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { Directory = d }(Directory)
+	Directory = dir
+
+	write := func(name, content string) {
+		err := ioutil.WriteFile(
+			filepath.Join(dir, name+".json"), []byte(content), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	write("good", `{"ice-servers": [{"urls": ["stun:stun.example.org"]}]}`)
+	desc, err := GetDescription("good")
+	if err != nil {
+		t.Fatalf("GetDescription: %v", err)
+	}
+	if len(desc.ICEServers) != 1 ||
+		desc.ICEServers[0].URLs[0] != "stun:stun.example.org" {
+		t.Errorf("Unexpected servers %v", desc.ICEServers)
+	}
+
+	write("bad", `{"ice-servers": [{"urls": ["turn:turn.example.org"]}]}`)
+	_, err = GetDescription("bad")
+	if err == nil {
+		t.Errorf("Expected an error for a TURN server without credentials")
+	}
+}
+
+func TestVideoBitrate(t *testing.T) {
+	g := &Group{
+		description: &Description{
+			InitialVideoBitrate: 400000,
+			VideoBitrates: map[string]VideoBitrate{
+				"camera":      {Max: 300000},
+				"screenshare": {Initial: 1000000, Max: 3000000},
+			},
+		},
+	}
+	tests := []struct {
+		label        string
+		initial, max uint64
+	}{
+		{"camera", 300000, 300000},
+		{"screenshare", 1000000, 3000000},
+		{"video", 400000, 0},
+	}
+	for _, tt := range tests {
+		initial, max := g.VideoBitrate(tt.label)
+		if initial != tt.initial || max != tt.max {
+			t.Errorf("%v: expected %v %v, got %v %v", tt.label,
+				tt.initial, tt.max, initial, max)
+		}
+	}
+}
+
+func TestVideoMinBitrate(t *testing.T) {
+	g := &Group{
+		description: &Description{
+			VideoBitrates: map[string]VideoBitrate{
+				"camera":      {Min: 400000, Max: 300000},
+				"screenshare": {Min: 600000},
+			},
+		},
+	}
+	tests := []struct {
+		label string
+		min   uint64
+	}{
+		{"camera", 300000},
+		{"screenshare", 600000},
+		{"video", 0},
+	}
+	for _, tt := range tests {
+		min := g.VideoMinBitrate(tt.label)
+		if min != tt.min {
+			t.Errorf("%v: expected %v, got %v", tt.label, tt.min, min)
+		}
+	}
+}
+
+func TestPublisherHandler(t *testing.T) {
+	g := &Group{}
+	var events []PublisherEvent
+	remove := g.AddPublisherHandler(func(e PublisherEvent) {
+		events = append(events, e)
+	})
+	g.NotifyPublisher(PublisherEvent{Client: "c", Id: "s"})
+	if len(events) != 1 || events[0].Client != "c" || events[0].Id != "s" {
+		t.Errorf("Unexpected events %v", events)
+	}
+	remove()
+	g.NotifyPublisher(PublisherEvent{Client: "c", Id: "s"})
+	if len(events) != 1 {
+		t.Errorf("Expected 1 event, got %v", len(events))
+	}
+}
+
+func TestMuted(t *testing.T) {
+	g := &Group{}
+	if g.Muted("id1", webrtc.RTPCodecTypeAudio) {
+		t.Errorf("Unexpected mute")
+	}
+	g.SetMuted("id1", webrtc.RTPCodecTypeAudio, true)
+	if !g.Muted("id1", webrtc.RTPCodecTypeAudio) {
+		t.Errorf("Expected audio to be muted")
+	}
+	if g.Muted("id1", webrtc.RTPCodecTypeVideo) ||
+		g.Muted("id2", webrtc.RTPCodecTypeAudio) {
+		t.Errorf("Unexpected mute")
+	}
+	g.SetMuted("id1", webrtc.RTPCodecTypeAudio, false)
+	if g.Muted("id1", webrtc.RTPCodecTypeAudio) || len(g.muted) != 0 {
+		t.Errorf("Expected audio to be unmuted")
+	}
+}
+
+func TestMutedDelete(t *testing.T) {
+	groups.groups = nil
+	g, err := Add("muted", &Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	g.SetMuted("id1", webrtc.RTPCodecTypeVideo, true)
+	if !Delete("muted") {
+		t.Fatalf("Couldn't delete group")
+	}
+	if g.Muted("id1", webrtc.RTPCodecTypeVideo) {
+		t.Errorf("Expected mute to be cleared")
+	}
+}
+
+// joinClient is a client that does nothing but join a group.
+type joinClient struct {
+	testClient
+	id          string
+	permissions ClientPermissions
+}
+
+func (c *joinClient) Group() *Group {
+	return nil
+}
+
+func (c *joinClient) Id() string {
+	return c.id
+}
+
+func (c *joinClient) Permissions() ClientPermissions {
+	return c.permissions
+}
+
+func (c *joinClient) SetPermissions(p ClientPermissions) {
+	c.permissions = p
+}
+
+func (c *joinClient) Status() map[string]interface{} {
+	return nil
+}
+
+func (c *joinClient) OverridePermissions(g *Group) bool {
+	return false
+}
+
+func (c *joinClient) PushConn(g *Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	return nil
+}
+
+func (c *joinClient) PushClient(id, username string, p ClientPermissions, status map[string]interface{}, kind string) error {
+	return nil
+}
+
+func (c *joinClient) Kick(id, user, message string) error {
+	return nil
+}
+
+func TestMaxOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { Directory = d }(Directory)
+	Directory = dir
+	err = ioutil.WriteFile(filepath.Join(dir, "overflow.json"),
+		[]byte(`{"max-clients": 2, "allow-overflow": true,
+                         "max-overflow": 1, "presenter": [{}]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		c := &joinClient{
+			testClient: testClient{username: fmt.Sprintf("u%v", i)},
+			id:         fmt.Sprintf("client%v", i),
+		}
+		_, err := AddClient("overflow", c)
+		switch {
+		case i < 2:
+			if err != nil || !c.permissions.Present {
+				t.Errorf("%v: expected presenter, got %v %v",
+					i, c.permissions, err)
+			}
+		case i == 2:
+			if err != nil || c.permissions.Present {
+				t.Errorf("%v: expected listener, got %v %v",
+					i, c.permissions, err)
+			}
+		default:
+			if err == nil {
+				t.Errorf("%v: expected to be rejected", i)
+			}
+		}
+	}
+	if n := Get("overflow").RejectedJoins(); n != 2 {
+		t.Errorf("Expected 2 rejected joins, got %v", n)
+	}
+}
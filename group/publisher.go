@@ -0,0 +1,66 @@
+package group
+
+import (
+	"github.com/jech/galene/conn"
+)
+
+// A PublisherEvent describes a stream that has become available in a
+// group, or that has gone away.
+type PublisherEvent struct {
+	// the id of the client that publishes the stream
+	Client string
+	// the id of the stream
+	Id string
+	// the stream and its tracks, or nil if the stream has gone away
+	Up     conn.Up
+	Tracks []conn.UpTrack
+}
+
+// A PublisherHandler is called when a stream becomes available in a
+// group or goes away.  An available stream may be announced again when
+// its tracks change, and a stream may be announced as gone even if it
+// never had any tracks.  Handlers are called synchronously, and must not
+// block; they may subscribe to a stream by calling AddLocal on its
+// tracks.
+type PublisherHandler func(e PublisherEvent)
+
+// AddPublisherHandler registers a handler that is called whenever a
+// stream becomes available in the group or goes away.  This allows
+// consumers that are not clients, such as bots or gateways, to subscribe
+// to the streams published in the group.  It returns a function that
+// unregisters the handler.
+func (g *Group) AddPublisherHandler(h PublisherHandler) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.publisherHandlers == nil {
+		g.publisherHandlers = make(map[uint64]PublisherHandler)
+	}
+	g.publisherCounter++
+	id := g.publisherCounter
+	g.publisherHandlers[id] = h
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.publisherHandlers, id)
+	}
+}
+
+// NotifyPublisher calls the publisher handlers of the group.  It is
+// called by the code that manages streams, and must not be called
+// locked.
+func (g *Group) NotifyPublisher(e PublisherEvent) {
+	g.mu.Lock()
+	if len(g.publisherHandlers) == 0 {
+		g.mu.Unlock()
+		return
+	}
+	handlers := make([]PublisherHandler, 0, len(g.publisherHandlers))
+	for _, h := range g.publisherHandlers {
+		handlers = append(handlers, h)
+	}
+	g.mu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
@@ -0,0 +1,116 @@
+package group
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// An SDPMunger modifies a session description generated by the server
+// before it is applied and sent to the client.  This is meant for
+// interoperability fixes, such as reordering codecs or adding format
+// parameters, that are too specific to deserve an option of their own.
+type SDPMunger func(sdp string) (string, error)
+
+// SDPMungers are the mungers applied to the descriptions generated by
+// the server.  Either may be nil.
+type SDPMungers struct {
+	// Offer is applied to the offers sent to receivers.
+	Offer SDPMunger
+	// Answer is applied to the answers sent in reply to an offer,
+	// whether by a sender or by a WHEP receiver.
+	Answer SDPMunger
+}
+
+var ErrUnknownSDPMunger = errors.New("unknown SDP munger")
+
+var sdpMungers struct {
+	mu      sync.Mutex
+	mungers map[string]SDPMungers
+}
+
+// RegisterSDPMungers makes mungers available to the groups whose
+// sdp-munger field is name.  It replaces any mungers previously
+// registered under the same name.
+func RegisterSDPMungers(name string, mungers SDPMungers) {
+	sdpMungers.mu.Lock()
+	defer sdpMungers.mu.Unlock()
+	if sdpMungers.mungers == nil {
+		sdpMungers.mungers = make(map[string]SDPMungers)
+	}
+	sdpMungers.mungers[name] = mungers
+}
+
+// UnregisterSDPMungers removes the mungers registered under name.
+func UnregisterSDPMungers(name string) {
+	sdpMungers.mu.Lock()
+	defer sdpMungers.mu.Unlock()
+	delete(sdpMungers.mungers, name)
+}
+
+// MungeSDP applies the munger configured for the group to a description
+// of the given type, and checks that the result still parses and has the
+// same media sections as the original, since the transceivers are mapped
+// to the sections by position.  If the group has no munger, s is returned
+// unchanged.
+func (g *Group) MungeSDP(tpe webrtc.SDPType, s string) (string, error) {
+	g.mu.Lock()
+	name := g.description.SDPMunger
+	g.mu.Unlock()
+	if name == "" {
+		return s, nil
+	}
+
+	sdpMungers.mu.Lock()
+	mungers, ok := sdpMungers.mungers[name]
+	sdpMungers.mu.Unlock()
+	if !ok {
+		return "", ErrUnknownSDPMunger
+	}
+
+	var munger SDPMunger
+	switch tpe {
+	case webrtc.SDPTypeOffer:
+		munger = mungers.Offer
+	case webrtc.SDPTypeAnswer:
+		munger = mungers.Answer
+	}
+	if munger == nil {
+		return s, nil
+	}
+
+	m, err := munger(s)
+	if err != nil {
+		return "", err
+	}
+	err = checkMunged(s, m)
+	if err != nil {
+		return "", errors.New("munged " + tpe.String() + ": " + err.Error())
+	}
+	return m, nil
+}
+
+// checkMunged checks that the munged description m is consistent with
+// the original description s.
+func checkMunged(s, m string) error {
+	var orig, munged sdp.SessionDescription
+	err := orig.Unmarshal([]byte(s))
+	if err != nil {
+		return err
+	}
+	err = munged.Unmarshal([]byte(m))
+	if err != nil {
+		return err
+	}
+	if len(munged.MediaDescriptions) != len(orig.MediaDescriptions) {
+		return errors.New("media sections don't match")
+	}
+	for i, md := range munged.MediaDescriptions {
+		if md.MediaName.Media != orig.MediaDescriptions[i].MediaName.Media {
+			return errors.New("media sections don't match")
+		}
+	}
+	return nil
+}
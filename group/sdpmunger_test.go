@@ -0,0 +1,90 @@
+package group
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const mungerSDP = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n"
+
+func TestMungeSDP(t *testing.T) {
+	g := &Group{description: &Description{}}
+	s, err := g.MungeSDP(webrtc.SDPTypeOffer, mungerSDP)
+	if err != nil || s != mungerSDP {
+		t.Errorf("Expected unchanged SDP, got %v %v", s, err)
+	}
+
+	g.description.SDPMunger = "test"
+	_, err = g.MungeSDP(webrtc.SDPTypeOffer, mungerSDP)
+	if err != ErrUnknownSDPMunger {
+		t.Errorf("Expected %v, got %v", ErrUnknownSDPMunger, err)
+	}
+
+	fmtp := "a=fmtp:111 stereo=1\r\n"
+	RegisterSDPMungers("test", SDPMungers{
+		Answer: func(s string) (string, error) {
+			return s + fmtp, nil
+		},
+	})
+	defer UnregisterSDPMungers("test")
+
+	s, err = g.MungeSDP(webrtc.SDPTypeOffer, mungerSDP)
+	if err != nil || s != mungerSDP {
+		t.Errorf("Offer: expected unchanged SDP, got %v %v", s, err)
+	}
+	s, err = g.MungeSDP(webrtc.SDPTypeAnswer, mungerSDP)
+	if err != nil || !strings.HasSuffix(s, fmtp) {
+		t.Errorf("Answer: expected munged SDP, got %v %v", s, err)
+	}
+}
+
+func TestMungeSDPErrors(t *testing.T) {
+	g := &Group{description: &Description{SDPMunger: "test"}}
+	mungerError := errors.New("munger error")
+	RegisterSDPMungers("test", SDPMungers{
+		Offer: func(s string) (string, error) {
+			return "", mungerError
+		},
+		Answer: func(s string) (string, error) {
+			return "garbage", nil
+		},
+	})
+	defer UnregisterSDPMungers("test")
+
+	_, err := g.MungeSDP(webrtc.SDPTypeOffer, mungerSDP)
+	if err != mungerError {
+		t.Errorf("Expected %v, got %v", mungerError, err)
+	}
+	_, err = g.MungeSDP(webrtc.SDPTypeAnswer, mungerSDP)
+	if err == nil {
+		t.Errorf("Expected an error for unparseable SDP")
+	}
+}
+
+func TestCheckMunged(t *testing.T) {
+	err := checkMunged(mungerSDP, mungerSDP+"a=ptime:20\r\n")
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	video := strings.Replace(mungerSDP, "m=audio", "m=video", 1)
+	err = checkMunged(mungerSDP, video)
+	if err == nil {
+		t.Errorf("Expected an error for a changed media section")
+	}
+
+	extra := mungerSDP + "m=video 9 UDP/TLS/RTP/SAVPF 96\r\n"
+	err = checkMunged(mungerSDP, extra)
+	if err == nil {
+		t.Errorf("Expected an error for an extra media section")
+	}
+}
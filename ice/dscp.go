@@ -0,0 +1,157 @@
+package ice
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// DSCP specifies the Differentiated Services code points (RFC 2474) with
+// which outgoing media is marked, 0 meaning no marking.
+type DSCP struct {
+	Audio int
+	Video int
+}
+
+var errDSCPUnsupported = errors.New("DSCP marking is not supported on this platform")
+
+// parseCodePoint parses a code point, either by name (EF, AFxy, CSx, BE)
+// or as a number.
+func parseCodePoint(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	switch {
+	case s == "EF":
+		return 46, nil
+	case s == "BE" || s == "DF":
+		return 0, nil
+	case len(s) == 4 && strings.HasPrefix(s, "AF") &&
+		s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return 8*int(s[2]-'0') + 2*int(s[3]-'0'), nil
+	case len(s) == 3 && strings.HasPrefix(s, "CS") &&
+		s[2] >= '0' && s[2] <= '7':
+		return 8 * int(s[2]-'0'), nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, errors.New("unknown DSCP class " + s)
+	}
+	return v, nil
+}
+
+// ParseDSCP parses a comma-separated list of entries of the form
+// kind=class, where kind is "audio" or "video".
+func ParseDSCP(s string) (DSCP, error) {
+	var d DSCP
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return DSCP{}, errors.New("couldn't parse DSCP " + v)
+		}
+		cp, err := parseCodePoint(kv[1])
+		if err != nil {
+			return DSCP{}, err
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "audio":
+			d.Audio = cp
+		case "video":
+			d.Video = cp
+		default:
+			return DSCP{}, errors.New("unknown media kind " + kv[0])
+		}
+	}
+	return d, nil
+}
+
+// class returns the code point with which packet should be marked.  Only
+// RTP packets whose payload type is known are marked; since SRTP doesn't
+// encrypt the header, the payload type can be read from the wire.
+func (d DSCP) class(packet []byte, kinds map[uint8]webrtc.RTPCodecType) int {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return 0
+	}
+	if packet[1] >= 192 && packet[1] <= 223 {
+		// RTCP, see RFC 5761 Section 4
+		return 0
+	}
+	switch kinds[packet[1]&0x7F] {
+	case webrtc.RTPCodecTypeAudio:
+		return d.Audio
+	case webrtc.RTPCodecTypeVideo:
+		return d.Video
+	default:
+		return 0
+	}
+}
+
+// dscpMux is a UDP mux that marks outgoing media.
+type dscpMux struct {
+	*ice.UDPMuxDefault
+	conn  *net.UDPConn
+	dscp  DSCP
+	kinds map[uint8]webrtc.RTPCodecType
+}
+
+func (m *dscpMux) GetConn(ufrag string) (net.PacketConn, error) {
+	c, err := m.UDPMuxDefault.GetConn(ufrag)
+	if err != nil {
+		return nil, err
+	}
+	return &dscpConn{PacketConn: c, mux: m}, nil
+}
+
+// dscpConn is a muxed connection that marks outgoing media.
+type dscpConn struct {
+	net.PacketConn
+	mux *dscpMux
+}
+
+// WriteTo marks media by writing it directly to the underlying socket.
+// Other packets, notably the STUN packets that register the remote
+// address with the mux, go through the muxed connection.
+func (c *dscpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	cp := c.mux.dscp.class(b, c.mux.kinds)
+	a, ok := addr.(*net.UDPAddr)
+	if cp == 0 || !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	n, _, err := c.mux.conn.WriteMsgUDP(b, tosControl(a.IP, cp<<2), a)
+	return n, err
+}
+
+// NewDSCPMux returns a UDP mux that marks media according to d, where
+// kinds maps payload types to media kinds.  All host candidates share a
+// single socket, since we cannot otherwise get hold of the sockets that
+// ICE creates.  Server-reflexive and relay candidates are not marked.
+//
+// The mux only supports IPv4: the ICE library reads all the candidates
+// of a connection from the same muxed socket, and gets confused when a
+// connection has candidates of both families.
+func NewDSCPMux(d DSCP, kinds map[uint8]webrtc.RTPCodecType) (ice.UDPMux, error) {
+	if !dscpSupported {
+		return nil, errDSCPUnsupported
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Marking media on port %v, audio %v, video %v",
+		conn.LocalAddr().(*net.UDPAddr).Port, d.Audio, d.Video)
+	return &dscpMux{
+		UDPMuxDefault: ice.NewUDPMuxDefault(ice.UDPMuxParams{
+			UDPConn: conn,
+		}),
+		conn:  conn,
+		dscp:  d,
+		kinds: kinds,
+	}, nil
+}
@@ -0,0 +1,28 @@
+package ice
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const dscpSupported = true
+
+// tosControl returns the ancillary data that sets the traffic class of
+// a packet sent to ip.  IPv4 destinations, including IPv4-mapped
+// addresses on a dual-stack socket, use IP_TOS, IPv6 ones IPV6_TCLASS.
+func tosControl(ip net.IP, tos int) []byte {
+	b := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	if ip.To4() != nil {
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_TOS
+	} else {
+		h.Level = syscall.IPPROTO_IPV6
+		h.Type = syscall.IPV6_TCLASS
+	}
+	h.SetLen(syscall.CmsgLen(4))
+	// the kernel expects an int in host byte order
+	*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = int32(tos)
+	return b
+}
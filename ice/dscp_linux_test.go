@@ -0,0 +1,61 @@
+package ice
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTOSControl(t *testing.T) {
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer receiver.Close()
+	f, err := receiver.File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	err = syscall.SetsockoptInt(int(f.Fd()),
+		syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Setsockopt: %v", err)
+	}
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer sender.Close()
+
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	_, _, err = sender.WriteMsgUDP([]byte("hello"),
+		tosControl(addr.IP, 46<<2), addr)
+	if err != nil {
+		t.Fatalf("WriteMsgUDP: %v", err)
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	oob := make([]byte, 100)
+	_, oobn, _, _, err := receiver.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatalf("ReadMsgUDP: %v", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatalf("ParseSocketControlMessage: %v", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP &&
+			m.Header.Type == syscall.IP_TOS && len(m.Data) > 0 {
+			if m.Data[0] != 46<<2 {
+				t.Errorf("Expected %v, got %v", 46<<2, m.Data[0])
+			}
+			return
+		}
+	}
+	t.Errorf("No TOS received")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ice
+
+import (
+	"net"
+)
+
+const dscpSupported = false
+
+func tosControl(ip net.IP, tos int) []byte {
+	return nil
+}
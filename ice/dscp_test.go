@@ -0,0 +1,70 @@
+package ice
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseDSCP(t *testing.T) {
+	a := []struct {
+		value string
+		dscp  DSCP
+	}{
+		{"", DSCP{}},
+		{"audio=EF", DSCP{Audio: 46}},
+		{"audio=ef, video=AF41", DSCP{Audio: 46, Video: 34}},
+		{"video=CS3,audio=10", DSCP{Audio: 10, Video: 24}},
+		{"audio=BE", DSCP{}},
+	}
+	for _, s := range a {
+		d, err := ParseDSCP(s.value)
+		if err != nil || d != s.dscp {
+			t.Errorf("%q: expected %v, got %v %v",
+				s.value, s.dscp, d, err)
+		}
+	}
+
+	for _, v := range []string{"audio", "audio=AF44", "audio=64",
+		"data=EF", "audio=CS8"} {
+		_, err := ParseDSCP(v)
+		if err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestDSCPClass(t *testing.T) {
+	d := DSCP{Audio: 46, Video: 34}
+	kinds := map[uint8]webrtc.RTPCodecType{
+		111: webrtc.RTPCodecTypeAudio,
+		96:  webrtc.RTPCodecTypeVideo,
+	}
+	packet := func(b0, b1 byte) []byte {
+		p := make([]byte, 20)
+		p[0], p[1] = b0, b1
+		return p
+	}
+	a := []struct {
+		packet []byte
+		class  int
+	}{
+		{packet(0x80, 111), 46},
+		{packet(0x80, 0x80|111), 46},
+		{packet(0x90, 96), 34},
+		{packet(0x80, 0x80|96), 34},
+		{packet(0x80, 97), 0},
+		// RTCP receiver report
+		{packet(0x81, 201), 0},
+		// STUN
+		{packet(0x00, 0x01), 0},
+		{[]byte{0x80, 111}, 0},
+	}
+	for _, s := range a {
+		c := d.class(s.packet, kinds)
+		if c != s.class {
+			t.Errorf("%x: expected %v, got %v",
+				s.packet[:2], s.class, c)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ice
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Filter specifies which remote ICE candidates are ignored.
+type Filter struct {
+	// drop host candidates with an mDNS (.local) name
+	MDNS bool
+	// drop candidates with a link-local address
+	LinkLocal bool
+	// drop all candidates except relay candidates
+	NonRelay bool
+}
+
+// CandidateFilter is applied to the candidates sent by clients.
+var CandidateFilter Filter
+
+// ParseFilter parses a comma-separated list of the values "mdns",
+// "link-local" and "non-relay".
+func ParseFilter(s string) (Filter, error) {
+	var f Filter
+	for _, v := range strings.Split(s, ",") {
+		switch strings.TrimSpace(v) {
+		case "":
+		case "mdns":
+			f.MDNS = true
+		case "link-local":
+			f.LinkLocal = true
+		case "non-relay":
+			f.NonRelay = true
+		default:
+			return Filter{}, errors.New("unknown candidate filter " + v)
+		}
+	}
+	return f, nil
+}
+
+// Drop returns a non-empty reason if the candidate in SDP syntax should
+// be ignored.  Candidates that cannot be parsed are kept, and are left for
+// the ICE agent to deal with.
+func (f Filter) Drop(candidate string) string {
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return ""
+	}
+	address, typ := fields[4], fields[7]
+
+	if f.NonRelay && typ != "relay" {
+		return typ + " candidate"
+	}
+	if f.MDNS && strings.HasSuffix(strings.ToLower(address), ".local") {
+		return "mDNS candidate"
+	}
+	if f.LinkLocal {
+		ip := net.ParseIP(address)
+		if ip != nil && ip.IsLinkLocalUnicast() {
+			return "link-local candidate"
+		}
+	}
+	return ""
+}
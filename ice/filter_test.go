@@ -0,0 +1,57 @@
+package ice
+
+import (
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter("mdns, link-local")
+	if err != nil || !f.MDNS || !f.LinkLocal || f.NonRelay {
+		t.Errorf("Unexpected filter %v %v", f, err)
+	}
+	f, err = ParseFilter("")
+	if err != nil || f != (Filter{}) {
+		t.Errorf("Unexpected filter %v %v", f, err)
+	}
+	_, err = ParseFilter("mdns,srflx")
+	if err == nil {
+		t.Errorf("Unknown filter was accepted")
+	}
+}
+
+func TestFilterDrop(t *testing.T) {
+	mdns := "candidate:1 1 udp 2122260223 " +
+		"5a1b2c3d-0000-4000-8000-000000000000.local 54321 typ host"
+	linkLocal := "candidate:2 1 udp 2122262783 " +
+		"fe80::1 54322 typ host generation 0"
+	host := "candidate:3 1 udp 2122260223 192.0.2.1 54323 typ host"
+	srflx := "candidate:4 1 udp 1686052607 203.0.113.1 54324 typ srflx " +
+		"raddr 192.0.2.1 rport 54323"
+	relay := "candidate:5 1 udp 41885439 198.51.100.1 3478 typ relay " +
+		"raddr 203.0.113.1 rport 54324"
+
+	a := []struct {
+		filter    Filter
+		candidate string
+		drop      bool
+	}{
+		{Filter{}, mdns, false},
+		{Filter{MDNS: true}, mdns, true},
+		{Filter{MDNS: true}, linkLocal, false},
+		{Filter{MDNS: true}, host, false},
+		{Filter{LinkLocal: true}, linkLocal, true},
+		{Filter{LinkLocal: true}, host, false},
+		{Filter{NonRelay: true}, host, true},
+		{Filter{NonRelay: true}, srflx, true},
+		{Filter{NonRelay: true}, relay, false},
+		{Filter{MDNS: true, LinkLocal: true, NonRelay: true}, "", false},
+		{Filter{NonRelay: true}, "garbage", false},
+	}
+	for _, s := range a {
+		reason := s.filter.Drop(s.candidate)
+		if (reason != "") != s.drop {
+			t.Errorf("%v %v: expected %v, got %q",
+				s.filter, s.candidate, s.drop, reason)
+		}
+	}
+}
@@ -10,9 +10,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/turnserver"
@@ -149,6 +151,87 @@ func ICEConfiguration() *webrtc.Configuration {
 	return &conf.conf
 }
 
+var ErrNoRelay = errors.New("no TURN server configured")
+
+// RelayConfiguration returns an ICE configuration that only allows
+// relayed traffic.  It fails if no TURN server is configured.
+func RelayConfiguration() (*webrtc.Configuration, error) {
+	return relayConfiguration(*ICEConfiguration())
+}
+
+func relayConfiguration(conf webrtc.Configuration) (*webrtc.Configuration, error) {
+	found := false
+	for _, s := range conf.ICEServers {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") ||
+				strings.HasPrefix(u, "turns:") {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil, ErrNoRelay
+	}
+	conf.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	return &conf, nil
+}
+
+// GroupConfiguration returns the ICE configuration of a group that
+// defines its own servers, which are tried before the global ones.  If
+// relayOnly is true, only relayed traffic is allowed.
+func GroupConfiguration(servers []Server, relayOnly bool) (*webrtc.Configuration, error) {
+	global := ICEConfiguration()
+	if len(servers) == 0 && !relayOnly {
+		return global, nil
+	}
+
+	conf := *global
+	conf.ICEServers = make([]webrtc.ICEServer, 0,
+		len(servers)+len(global.ICEServers))
+	for _, s := range servers {
+		ss, err := getServer(s)
+		if err != nil {
+			log.Printf("parse ICE server: %v", err)
+			continue
+		}
+		conf.ICEServers = append(conf.ICEServers, ss)
+	}
+	conf.ICEServers = append(conf.ICEServers, global.ICEServers...)
+
+	if relayOnly {
+		return relayConfiguration(conf)
+	}
+	return &conf, nil
+}
+
+// CheckServers checks that a list of ICE servers is well-formed.
+func CheckServers(servers []Server) error {
+	for _, s := range servers {
+		if len(s.URLs) == 0 {
+			return errors.New("ICE server has no URLs")
+		}
+		_, err := getServer(s)
+		if err != nil {
+			return err
+		}
+		for _, u := range s.URLs {
+			url, err := ice.ParseURL(u)
+			if err != nil {
+				return errors.New(u + ": " + err.Error())
+			}
+			if url.Scheme != ice.SchemeTypeTURN &&
+				url.Scheme != ice.SchemeTypeTURNS {
+				continue
+			}
+			if s.Credential == nil ||
+				(s.Username == "" && s.CredentialType != "hmac-sha1") {
+				return errors.New(u + ": missing credentials")
+			}
+		}
+	}
+	return nil
+}
+
 func RelayTest(timeout time.Duration) (time.Duration, error) {
 
 	conf := ICEConfiguration()
@@ -95,3 +95,118 @@ func TestRelayTest(t *testing.T) {
 		t.Errorf("Relay test returned %v", err)
 	}
 }
+
+func TestRelayConfiguration(t *testing.T) {
+	ICEFilename = "/tmp/no/such/file"
+	turnserver.Address = ""
+
+	_, err := RelayConfiguration()
+	if err != ErrNoRelay {
+		t.Errorf("Expected %v, got %v", ErrNoRelay, err)
+	}
+
+	conf.Store(&configuration{
+		conf: webrtc.Configuration{
+			ICEServers: []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.org"}},
+				{URLs: []string{"turn:turn.example.org:443"}},
+			},
+		},
+		timestamp: time.Now(),
+	})
+	defer conf.Store(&configuration{})
+
+	c, err := RelayConfiguration()
+	if err != nil {
+		t.Fatalf("RelayConfiguration: %v", err)
+	}
+	if c.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+		t.Errorf("Expected relay, got %v", c.ICETransportPolicy)
+	}
+	if ICEConfiguration().ICETransportPolicy ==
+		webrtc.ICETransportPolicyRelay {
+		t.Errorf("Global configuration was modified")
+	}
+}
+
+func TestGroupConfiguration(t *testing.T) {
+	conf.Store(&configuration{
+		conf: webrtc.Configuration{
+			ICEServers: []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.org"}},
+			},
+		},
+		timestamp: time.Now(),
+	})
+	defer conf.Store(&configuration{})
+
+	c, err := GroupConfiguration(nil, false)
+	if err != nil || c != ICEConfiguration() {
+		t.Errorf("Expected global configuration, got %v %v", c, err)
+	}
+
+	_, err = GroupConfiguration(nil, true)
+	if err != ErrNoRelay {
+		t.Errorf("Expected %v, got %v", ErrNoRelay, err)
+	}
+
+	servers := []Server{{
+		URLs:       []string{"turn:turn.example.org:443"},
+		Username:   "jch",
+		Credential: "secret",
+	}}
+	c, err = GroupConfiguration(servers, true)
+	if err != nil {
+		t.Fatalf("GroupConfiguration: %v", err)
+	}
+	if len(c.ICEServers) != 2 ||
+		c.ICEServers[0].URLs[0] != "turn:turn.example.org:443" ||
+		c.ICEServers[1].URLs[0] != "stun:stun.example.org" {
+		t.Errorf("Unexpected servers %v", c.ICEServers)
+	}
+	if c.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+		t.Errorf("Expected relay, got %v", c.ICETransportPolicy)
+	}
+	if len(ICEConfiguration().ICEServers) != 1 {
+		t.Errorf("Global configuration was modified")
+	}
+}
+
+func TestCheckServers(t *testing.T) {
+	good := [][]Server{
+		nil,
+		{{URLs: []string{"stun:stun.example.org"}}},
+		{{
+			URLs:       []string{"turn:turn.example.org"},
+			Username:   "jch",
+			Credential: "secret",
+		}},
+		{{
+			URLs:           []string{"turns:turn.example.org:443"},
+			Credential:     "secret",
+			CredentialType: "hmac-sha1",
+		}},
+	}
+	for _, s := range good {
+		err := CheckServers(s)
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+		}
+	}
+
+	bad := [][]Server{
+		{{}},
+		{{URLs: []string{"http://stun.example.org"}}},
+		{{URLs: []string{"turn:turn.example.org"}}},
+		{{
+			URLs:           []string{"stun:stun.example.org"},
+			CredentialType: "unknown",
+		}},
+	}
+	for _, s := range bad {
+		err := CheckServers(s)
+		if err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package jitter
+
+import (
+	"sync/atomic"
+
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// the interval over which the timestamp rate is measured
+	rateWindow = 10 * rtptime.JiffiesPerSec
+	// a gap in arrivals that invalidates the current measurement
+	rateGap = 2 * rtptime.JiffiesPerSec
+	// the number of consecutive windows that must disagree with the
+	// declared rate before a mismatch is reported
+	rateMismatches = 2
+)
+
+// the clock rates in common use, which a measured rate is rounded to
+var commonRates = []uint32{
+	8000, 16000, 22050, 24000, 32000, 44100, 48000, 90000,
+}
+
+// A RateDetector compares the rate at which the timestamps of a stream
+// advance with the clock rate declared for the stream.
+type RateDetector struct {
+	hz        uint32
+	timestamp uint32
+	time      uint64
+	last      uint64
+	count     int
+
+	observed uint32 // atomic
+}
+
+// NewRateDetector creates a detector for a stream with declared clock
+// rate hz.
+func NewRateDetector(hz uint32) *RateDetector {
+	return &RateDetector{hz: hz}
+}
+
+// Accumulate records the arrival of a packet with the given timestamp at
+// time now, in jiffies.  It returns true if the observed clock rate has
+// changed, in which case Observed returns the new value.
+func (d *RateDetector) Accumulate(timestamp uint32, now uint64) bool {
+	if d.time == 0 || now < d.last || now-d.last > rateGap {
+		// first packet, or arrivals were interrupted, start
+		// a new measurement
+		d.timestamp = timestamp
+		d.time = now
+		d.last = now
+		return false
+	}
+	d.last = now
+
+	elapsed := now - d.time
+	if elapsed < rateWindow {
+		return false
+	}
+
+	delta := timestamp - d.timestamp
+	d.timestamp = timestamp
+	d.time = now
+	if delta&0x80000000 != 0 {
+		// the timestamp went backwards
+		d.count = 0
+		return false
+	}
+
+	rate := uint64(delta) * rtptime.JiffiesPerSec / elapsed
+	observed := uint32(0)
+	if !closeTo(rate, d.hz, 20) {
+		d.count++
+		if d.count < rateMismatches {
+			return false
+		}
+		observed = nominalRate(rate)
+	} else {
+		d.count = 0
+	}
+
+	if atomic.LoadUint32(&d.observed) == observed {
+		return false
+	}
+	atomic.StoreUint32(&d.observed, observed)
+	return true
+}
+
+// Observed returns the clock rate at which the timestamps advance, or 0
+// if it matches the declared rate or is unknown.
+func (d *RateDetector) Observed() uint32 {
+	return atomic.LoadUint32(&d.observed)
+}
+
+// closeTo returns true if rate is within 1/fraction of hz.
+func closeTo(rate uint64, hz uint32, fraction uint64) bool {
+	h := uint64(hz)
+	return rate+h/fraction >= h && rate <= h+h/fraction
+}
+
+// nominalRate rounds a measured rate to a common clock rate if it is
+// within 2% of one, and to a multiple of 100 otherwise.
+func nominalRate(rate uint64) uint32 {
+	for _, hz := range commonRates {
+		if closeTo(rate, hz, 50) {
+			return hz
+		}
+	}
+	r := uint32((rate + 50) / 100 * 100)
+	if r == 0 {
+		r = 100
+	}
+	return r
+}
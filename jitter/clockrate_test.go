@@ -0,0 +1,95 @@
+package jitter
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// feedRate feeds d with packets every 20ms for the given number of
+// seconds, with timestamps advancing at rate hz, and returns the number
+// of times a change was reported.
+func feedRate(d *RateDetector, now *uint64, ts *uint32, hz uint32, seconds int) int {
+	changes := 0
+	for i := 0; i < seconds*50; i++ {
+		*now += rtptime.JiffiesPerSec / 50
+		*ts += hz / 50
+		if d.Accumulate(*ts, *now) {
+			changes++
+		}
+	}
+	return changes
+}
+
+func TestRateDetector(t *testing.T) {
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	ts := uint32(0xFFFF0000)
+
+	d := NewRateDetector(90000)
+	changes := feedRate(d, &now, &ts, 90000, 60)
+	if changes != 0 || d.Observed() != 0 {
+		t.Errorf("Matching rate: expected 0, got %v %v",
+			changes, d.Observed())
+	}
+
+	// a single window is not enough
+	feedRate(d, &now, &ts, 48000, 12)
+	if d.Observed() != 0 {
+		t.Errorf("Expected 0, got %v", d.Observed())
+	}
+
+	changes = feedRate(d, &now, &ts, 48000, 30)
+	if changes != 1 || d.Observed() != 48000 {
+		t.Errorf("Mismatch: expected 1 48000, got %v %v",
+			changes, d.Observed())
+	}
+
+	feedRate(d, &now, &ts, 90000, 30)
+	if d.Observed() != 0 {
+		t.Errorf("Back to normal: expected 0, got %v", d.Observed())
+	}
+}
+
+func TestRateDetectorGap(t *testing.T) {
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	ts := uint32(0)
+
+	d := NewRateDetector(48000)
+	for i := 0; i < 10; i++ {
+		feedRate(d, &now, &ts, 48000, 5)
+		// a pause during which the timestamp is not advanced
+		now += 10 * rtptime.JiffiesPerSec
+	}
+	if d.Observed() != 0 {
+		t.Errorf("Expected 0, got %v", d.Observed())
+	}
+}
+
+func TestNominalRate(t *testing.T) {
+	tests := []struct{ rate, expected uint64 }{
+		{47600, 48000},
+		{90500, 90000},
+		{8010, 8000},
+		{12345, 12300},
+	}
+	for _, tt := range tests {
+		r := nominalRate(tt.rate)
+		if uint64(r) != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.rate, tt.expected, r)
+		}
+	}
+}
+
+func TestSetHZ(t *testing.T) {
+	e := New(90000)
+	e.accumulate(0, 0)
+	e.accumulate(1000, 1000)
+	e.accumulate(2000, 2200)
+	if e.Jitter() == 0 {
+		t.Errorf("Expected non-zero jitter")
+	}
+	e.SetHZ(48000)
+	if e.HZ() != 48000 || e.Jitter() != 0 {
+		t.Errorf("Expected 48000 0, got %v %v", e.HZ(), e.Jitter())
+	}
+}
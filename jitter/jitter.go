@@ -7,15 +7,33 @@ import (
 )
 
 type Estimator struct {
-	hz        uint32
+	hz        uint32 // atomic
+	alpha     uint32 // smoothing factor, in units of 1/65536
 	timestamp uint32
 	time      uint32
 
 	jitter uint32 // atomic
 }
 
+// New creates a new jitter estimator with the smoothing factor of 1/16
+// recommended by RFC 3550.
 func New(hz uint32) *Estimator {
-	return &Estimator{hz: hz}
+	return &Estimator{hz: hz, alpha: 65536 / 16}
+}
+
+// NewWithAlpha creates a new jitter estimator with smoothing factor
+// alpha, which must be in the interval (0, 1].  Each new interarrival
+// difference contributes a fraction alpha to the estimate, so larger
+// values cause the jitter reported in receiver reports to react faster
+// to changes in network conditions, at the cost of being noisier.
+func NewWithAlpha(hz uint32, alpha float64) *Estimator {
+	a := uint32(alpha * 65536)
+	if a < 1 {
+		a = 1
+	} else if a > 65536 {
+		a = 65536
+	}
+	return &Estimator{hz: hz, alpha: a}
 }
 
 func (e *Estimator) accumulate(timestamp, now uint32) {
@@ -29,7 +47,8 @@ func (e *Estimator) accumulate(timestamp, now uint32) {
 		d = uint32(-int32(d))
 	}
 	oldjitter := atomic.LoadUint32(&e.jitter)
-	jitter := (oldjitter*15 + d) / 16
+	jitter := uint32((uint64(oldjitter)*uint64(65536-e.alpha) +
+		uint64(d)*uint64(e.alpha)) / 65536)
 	atomic.StoreUint32(&e.jitter, jitter)
 
 	e.timestamp = timestamp
@@ -37,7 +56,13 @@ func (e *Estimator) accumulate(timestamp, now uint32) {
 }
 
 func (e *Estimator) Accumulate(timestamp uint32) {
-	e.accumulate(timestamp, uint32(rtptime.Now(e.hz)))
+	e.accumulate(timestamp, uint32(rtptime.Now(e.HZ())))
+}
+
+// AccumulateAt is like Accumulate, but takes the arrival time of the
+// packet, in units of the clock rate passed to New.
+func (e *Estimator) AccumulateAt(timestamp uint32, now uint32) {
+	e.accumulate(timestamp, now)
 }
 
 func (e *Estimator) Jitter() uint32 {
@@ -45,5 +70,13 @@ func (e *Estimator) Jitter() uint32 {
 }
 
 func (e *Estimator) HZ() uint32 {
-	return e.hz
+	return atomic.LoadUint32(&e.hz)
+}
+
+// SetHZ changes the clock rate of the estimator, which resets the
+// estimate.  It must be called by the goroutine that calls Accumulate.
+func (e *Estimator) SetHZ(hz uint32) {
+	atomic.StoreUint32(&e.hz, hz)
+	atomic.StoreUint32(&e.jitter, 0)
+	e.time = 0
 }
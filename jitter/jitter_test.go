@@ -35,3 +35,36 @@ func TestJitter(t *testing.T) {
 		t.Errorf("Expected 23, got %v", e.Jitter())
 	}
 }
+
+func TestJitterAlpha(t *testing.T) {
+	e := NewWithAlpha(48000, 0.5)
+	e.accumulate(0, 0)
+	e.accumulate(1000, 1000)
+	e.accumulate(2000, 2200)
+
+	if e.Jitter() != 100 {
+		t.Errorf("Expected 100, got %v", e.Jitter())
+	}
+
+	e.accumulate(3000, 3000)
+
+	if e.Jitter() != 150 {
+		t.Errorf("Expected 150, got %v", e.Jitter())
+	}
+
+	e.accumulate(4000, 4000)
+
+	if e.Jitter() != 75 {
+		t.Errorf("Expected 75, got %v", e.Jitter())
+	}
+
+	e = NewWithAlpha(48000, 1.0/16)
+	e.accumulate(0, 0)
+	e.accumulate(1000, 1000)
+	e.accumulate(2000, 2200)
+	e.accumulate(3000, 3000)
+
+	if e.Jitter() != 23 {
+		t.Errorf("Expected 23, got %v", e.Jitter())
+	}
+}
@@ -0,0 +1,234 @@
+// Package logger implements a leveled logger, with optional structured
+// output.  Messages below the level of a logger are discarded without
+// being formatted, so that debugging messages are cheap when disabled.
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+var ErrUnknownLevel = errors.New("unknown log level")
+
+// ParseLevel parses the name of a level, such as "warn".
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, n := range levelNames {
+		if s == n {
+			return Level(i), nil
+		}
+	}
+	return 0, ErrUnknownLevel
+}
+
+// Format is the format of the messages written by a logger.
+type Format int32
+
+const (
+	// FormatText writes plain messages, followed by key=value pairs
+	// if any.  Messages below LevelWarn are not prefixed with their
+	// level, which makes the output identical to that of the standard
+	// logger.
+	FormatText Format = iota
+	// FormatKeyValue writes every field, including the level and the
+	// message, as a key=value pair.
+	FormatKeyValue
+	// FormatJSON writes a JSON dictionary per line.
+	FormatJSON
+)
+
+var ErrUnknownFormat = errors.New("unknown log format")
+
+// ParseFormat parses the name of a format: "text", "keyvalue" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "keyvalue", "kv":
+		return FormatKeyValue, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, ErrUnknownFormat
+}
+
+// A Logger writes messages at or above a given level.  It is safe to
+// change the level and the format of a logger while it is in use.  The
+// zero value logs at LevelDebug in FormatText.
+type Logger struct {
+	level  int32
+	format int32
+	// output is replaced during testing
+	output func(string)
+}
+
+// New returns a logger that writes messages at or above level.
+func New(level Level, format Format) *Logger {
+	return &Logger{level: int32(level), format: int32(format)}
+}
+
+// Default is the logger used by the server, which may be configured from
+// the command line.
+var Default = New(LevelInfo, FormatText)
+
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) SetFormat(format Format) {
+	atomic.StoreInt32(&l.format, int32(format))
+}
+
+func (l *Logger) Format() Format {
+	return Format(atomic.LoadInt32(&l.format))
+}
+
+// Enabled returns true if messages at the given level are written.  Code
+// that runs once per packet should check this before building the
+// arguments of a debugging message.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(LevelDebug, format, v...)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf(LevelInfo, format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(LevelWarn, format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf(LevelError, format, v...)
+}
+
+func (l *Logger) logf(level Level, format string, v ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.print(l.render(time.Now(), level, fmt.Sprintf(format, v...), nil))
+}
+
+// Log writes a message with structured data, given as alternating keys
+// and values.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.print(l.render(time.Now(), level, msg, keyvals))
+}
+
+func (l *Logger) print(s string) {
+	if l.output != nil {
+		l.output(s)
+		return
+	}
+	if l.Format() == FormatJSON {
+		// the standard logger's prefix would make the line
+		// invalid JSON
+		log.Writer().Write([]byte(s + "\n"))
+		return
+	}
+	log.Output(4, s)
+}
+
+func (l *Logger) render(now time.Time, level Level, msg string, keyvals []interface{}) string {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(missing)")
+	}
+	switch l.Format() {
+	case FormatJSON:
+		m := make(map[string]interface{}, 3+len(keyvals)/2)
+		for i := 0; i < len(keyvals); i += 2 {
+			m[fmt.Sprint(keyvals[i])] = jsonValue(keyvals[i+1])
+		}
+		m["time"] = now.Format(time.RFC3339Nano)
+		m["level"] = level.String()
+		m["msg"] = msg
+		b, err := json.Marshal(m)
+		if err != nil {
+			return `{"level":"error","msg":` +
+				strconv.Quote("json: "+err.Error()) + `}`
+		}
+		return string(b)
+	case FormatKeyValue:
+		var b strings.Builder
+		b.WriteString("level=" + level.String())
+		b.WriteString(" msg=" + quote(msg))
+		writeKeyvals(&b, keyvals)
+		return b.String()
+	default:
+		var b strings.Builder
+		if level >= LevelWarn {
+			b.WriteString(strings.ToUpper(level.String()) + ": ")
+		}
+		b.WriteString(msg)
+		writeKeyvals(&b, keyvals)
+		return b.String()
+	}
+}
+
+func writeKeyvals(b *strings.Builder, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteString(" " + fmt.Sprint(keyvals[i]) + "=")
+		b.WriteString(quote(fmt.Sprint(keyvals[i+1])))
+	}
+}
+
+// quote quotes a value if it would otherwise be ambiguous.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// jsonValue returns a value that marshals sensibly: errors and other
+// values that don't have a JSON representation are converted to strings.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case nil, bool, string, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	}
+	return fmt.Sprint(v)
+}
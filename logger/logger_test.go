@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type counter int
+
+func (c *counter) String() string {
+	*c++
+	return "counter"
+}
+
+func TestLevels(t *testing.T) {
+	var out []string
+	l := New(LevelWarn, FormatText)
+	l.output = func(s string) { out = append(out, s) }
+
+	var c counter
+	l.Debugf("debug %v", &c)
+	l.Infof("info %v", &c)
+	l.Warnf("warn %v", 1)
+	l.Errorf("error %v", 2)
+	if c != 0 {
+		t.Errorf("Disabled message was formatted")
+	}
+	expected := []string{"WARN: warn 1", "ERROR: error 2"}
+	if len(out) != 2 || out[0] != expected[0] || out[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+
+	out = nil
+	l.SetLevel(LevelDebug)
+	l.Debugf("debug %v", &c)
+	if len(out) != 1 || out[0] != "debug counter" || c != 1 {
+		t.Errorf("Expected [debug counter], got %v", out)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"debug", "info", "WARN", "warning", "error"} {
+		_, err := ParseLevel(s)
+		if err != nil {
+			t.Errorf("ParseLevel %v: %v", s, err)
+		}
+	}
+	l, err := ParseLevel("warning")
+	if err != nil || l != LevelWarn {
+		t.Errorf("Expected %v, got %v %v", LevelWarn, l, err)
+	}
+	_, err = ParseLevel("verbose")
+	if err != ErrUnknownLevel {
+		t.Errorf("Expected %v, got %v", ErrUnknownLevel, err)
+	}
+	f, err := ParseFormat("json")
+	if err != nil || f != FormatJSON {
+		t.Errorf("Expected %v, got %v %v", FormatJSON, f, err)
+	}
+	_, err = ParseFormat("xml")
+	if err != ErrUnknownFormat {
+		t.Errorf("Expected %v, got %v", ErrUnknownFormat, err)
+	}
+}
+
+func TestStructured(t *testing.T) {
+	var out []string
+	l := New(LevelInfo, FormatText)
+	l.output = func(s string) { out = append(out, s) }
+
+	l.Log(LevelInfo, "got BYE", "conn", "a b", "mid", 1)
+	l.SetFormat(FormatKeyValue)
+	l.Log(LevelWarn, "got BYE", "conn", "a", "odd")
+	expected := []string{
+		`got BYE conn="a b" mid=1`,
+		`level=warn msg="got BYE" conn=a odd=(missing)`,
+	}
+	if len(out) != 2 || out[0] != expected[0] || out[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+
+	out = nil
+	l.SetFormat(FormatJSON)
+	l.Log(LevelError, "failed", "err", errors.New("oops"), "n", 3)
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(out))
+	}
+	var m map[string]interface{}
+	err := json.Unmarshal([]byte(out[0]), &m)
+	if err != nil {
+		t.Fatalf("Unmarshal %v: %v", out[0], err)
+	}
+	if m["level"] != "error" || m["msg"] != "failed" ||
+		m["err"] != "oops" || m["n"] != 3.0 || m["time"] == nil {
+		t.Errorf("Unexpected message %v", out[0])
+	}
+}
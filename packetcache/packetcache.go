@@ -6,21 +6,43 @@ package packetcache
 import (
 	"math/bits"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // The maximum size of packets stored in the cache.  Chosen to be
-// a multiple of 8.
+// a multiple of 8.  Larger packets are accounted for, but not stored.
 const BufSize = 1504
 
 // The maximum number of packets that constitute a keyframe.
 const maxFrame = 1024
 
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([BufSize]byte)
+	},
+}
+
+// GetBuffer returns a buffer of size BufSize from a shared pool.  The
+// buffer should be returned with PutBuffer once it is no longer
+// referenced; it must not be returned while it may still be in use.
+func GetBuffer() *[BufSize]byte {
+	return bufferPool.Get().(*[BufSize]byte)
+}
+
+// PutBuffer returns a buffer obtained with GetBuffer to the pool.
+func PutBuffer(buf *[BufSize]byte) {
+	bufferPool.Put(buf)
+}
+
 // entry represents a cached packet.
 type entry struct {
 	seqno           uint16
 	lengthAndMarker uint16 // 1 bit of marker, 15 bits of length
 	timestamp       uint32
-	buf             [BufSize]byte
+	// the time at which the packet arrived, in arbitrary monotonic units
+	arrival uint64
+	buf     [BufSize]byte
 }
 
 func (e *entry) length() uint16 {
@@ -31,11 +53,47 @@ func (e *entry) marker() bool {
 	return (e.lengthAndMarker & 0x8000) != 0
 }
 
-// bitmap keeps track of recent loss history
+// bitmap keeps track of the loss history of the last 64 seqnos
 type bitmap struct {
 	valid  bool
 	first  uint16
-	bitmap uint32
+	bitmap uint64
+}
+
+// The number of recent seqnos for which we remember whether they were
+// received.  This must be larger than the horizon of seqnoInvalid.
+const seenSize = 512
+
+// seenWindow records which of the recent seqnos were received.
+type seenWindow [seenSize / 64]uint64
+
+func (w *seenWindow) get(seqno uint16) bool {
+	i := seqno % seenSize
+	return (w[i/64] & (1 << (i % 64))) != 0
+}
+
+func (w *seenWindow) set(seqno uint16) {
+	i := seqno % seenSize
+	w[i/64] |= 1 << (i % 64)
+}
+
+func (w *seenWindow) reset(seqno uint16) {
+	*w = seenWindow{}
+	w.set(seqno)
+}
+
+// advance clears the seqnos after last, up to but excluding seqno, and
+// marks seqno as received.
+func (w *seenWindow) advance(last, seqno uint16) {
+	if seqno-last >= seenSize {
+		w.reset(seqno)
+		return
+	}
+	for s := last + 1; s != seqno; s++ {
+		i := s % seenSize
+		w[i/64] &^= 1 << (i % 64)
+	}
+	w.set(seqno)
 }
 
 // frame is used for storing the last keyframe
@@ -56,11 +114,36 @@ type Cache struct {
 	totalLost uint32
 	// bitmap
 	bitmap bitmap
+	// duplicate detection
+	seen seenWindow
+	// the last stray seqno, the sequence is taken to have restarted
+	// if the next packet follows it
+	stray      uint16
+	strayValid bool
 	// buffered keyframe
 	keyframe frame
 	// the actual cache
 	tail    uint16
 	entries []entry
+	// set by Close
+	closed bool
+}
+
+// the size of the memory allocated for each packet in a cache
+const entrySize = int64(unsafe.Sizeof(entry{}))
+
+// the memory allocated to the packet histories of all live caches
+var allocated int64
+
+// Memory returns the amount of memory, in bytes, allocated to the packet
+// histories of all live caches.  The memory used by a cache is released
+// when it is closed.
+func Memory() int64 {
+	return atomic.LoadInt64(&allocated)
+}
+
+func account(capacity int) {
+	atomic.AddInt64(&allocated, int64(capacity)*entrySize)
 }
 
 // New creates a cache with the given capacity.
@@ -68,9 +151,27 @@ func New(capacity int) *Cache {
 	if capacity > int(^uint16(0)) {
 		return nil
 	}
-	return &Cache{
+	cache := &Cache{
 		entries: make([]entry, capacity),
 	}
+	account(capacity)
+	return cache
+}
+
+// Close releases the memory used by the cache.  A closed cache doesn't
+// store any more packets, but it is still safe to query.
+func (cache *Cache) Close() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.closed {
+		return
+	}
+	cache.closed = true
+	account(-len(cache.entries))
+	cache.entries = nil
+	cache.tail = 0
+	cache.keyframe.entries = nil
 }
 
 // compare performs comparison modulo 2^16.
@@ -97,6 +198,24 @@ func seqnoInvalid(seqno, reference uint16) bool {
 	return false
 }
 
+// The largest forward jump in seqnos that is taken to be a loss rather
+// than a restart of the sender's sequence, as suggested by RFC 3550
+// Appendix A.1.
+const maxDropout = 3000
+
+// restart returns true if seqno indicates that the sender might have
+// restarted its sequence, typically because its encoder was restarted.
+// This is either a jump too far in the past to be a reordered packet, or
+// too far in the future to be a loss.  Since a single such packet might
+// just be garbage, the restart is only confirmed by the packet that
+// follows it, as suggested by RFC 3550 Appendix A.1.
+func restart(seqno, last uint16) bool {
+	if seqnoInvalid(seqno, last) {
+		return true
+	}
+	return compare(last, seqno) < 0 && seqno-last > maxDropout
+}
+
 // set sets a bit in the bitmap, shifting if necessary
 func (bitmap *bitmap) set(seqno uint16) {
 	if !bitmap.valid || seqnoInvalid(seqno, bitmap.first) {
@@ -110,14 +229,14 @@ func (bitmap *bitmap) set(seqno uint16) {
 		return
 	}
 
-	if seqno-bitmap.first >= 32 {
-		shift := seqno - bitmap.first - 31
+	if seqno-bitmap.first >= 64 {
+		shift := seqno - bitmap.first - 63
 		bitmap.bitmap >>= shift
 		bitmap.first += shift
 	}
 
 	if (bitmap.bitmap & 1) == 1 {
-		ones := bits.TrailingZeros32(^bitmap.bitmap)
+		ones := bits.TrailingZeros64(^bitmap.bitmap)
 		bitmap.bitmap >>= ones
 		bitmap.first += uint16(ones)
 	}
@@ -135,6 +254,34 @@ func (cache *Cache) BitmapGet(next uint16) (bool, uint16, uint16) {
 	return cache.bitmap.get(next)
 }
 
+// A BitmapEntry describes a set of missing packets, in the format of
+// RTCP NACKs: First is missing, as are the packets among the 16 that
+// follow it whose bit is set in Bitmap.
+type BitmapEntry struct {
+	First  uint16
+	Bitmap uint16
+}
+
+// BitmapGetAll shifts all the bits before next out of the bitmap, and
+// returns the missing packets among them, which allows a burst of losses
+// wider than 17 packets to be reported at once.
+func (cache *Cache) BitmapGetAll(next uint16) []BitmapEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if compare(next, cache.bitmap.first+64) > 0 {
+		// don't report packets beyond the bitmap as missing
+		next = cache.bitmap.first + 64
+	}
+	var entries []BitmapEntry
+	for compare(cache.bitmap.first, next) < 0 {
+		found, first, bitmap := cache.bitmap.get(next)
+		if found {
+			entries = append(entries, BitmapEntry{first, bitmap})
+		}
+	}
+	return entries
+}
+
 func (bitmap *bitmap) get(next uint16) (bool, uint16, uint16) {
 	first := bitmap.first
 	if compare(first, next) >= 0 {
@@ -144,7 +291,7 @@ func (bitmap *bitmap) get(next uint16) (bool, uint16, uint16) {
 	if count > 17 {
 		count = 17
 	}
-	bm := (^bitmap.bitmap) & ^((^uint32(0)) << count)
+	bm := (^bitmap.bitmap) & ^((^uint64(0)) << count)
 	bitmap.bitmap >>= count
 	bitmap.first += count
 
@@ -153,7 +300,7 @@ func (bitmap *bitmap) get(next uint16) (bool, uint16, uint16) {
 	}
 
 	if (bm & 1) == 0 {
-		count := bits.TrailingZeros32(bm)
+		count := bits.TrailingZeros64(bm)
 		bm >>= count
 		first += uint16(count)
 	}
@@ -162,7 +309,7 @@ func (bitmap *bitmap) get(next uint16) (bool, uint16, uint16) {
 }
 
 // insert inserts a packet into a frame.
-func (frame *frame) insert(seqno uint16, timestamp uint32, marker bool, data []byte) bool {
+func (frame *frame) insert(seqno uint16, timestamp uint32, marker bool, arrival uint64, data []byte) bool {
 	n := len(frame.entries)
 	i := 0
 	if n == 0 || seqno > frame.entries[n-1].seqno {
@@ -182,7 +329,7 @@ func (frame *frame) insert(seqno uint16, timestamp uint32, marker bool, data []b
 		}
 	}
 
-	if n >= maxFrame {
+	if n >= maxFrame || len(data) > BufSize {
 		// overflow
 		return false
 	}
@@ -195,6 +342,7 @@ func (frame *frame) insert(seqno uint16, timestamp uint32, marker bool, data []b
 		seqno:           seqno,
 		lengthAndMarker: lam,
 		timestamp:       timestamp,
+		arrival:         arrival,
 	}
 	copy(e.buf[:], data)
 
@@ -210,7 +358,7 @@ func (frame *frame) insert(seqno uint16, timestamp uint32, marker bool, data []b
 
 // store checks whether a packet is part of the current keyframe and, if
 // so, inserts it.
-func (frame *frame) store(seqno uint16, timestamp uint32, first bool, marker bool, data []byte) bool {
+func (frame *frame) store(seqno uint16, timestamp uint32, first bool, marker bool, arrival uint64, data []byte) bool {
 	if first {
 		if frame.timestamp != timestamp {
 			frame.timestamp = timestamp
@@ -230,7 +378,7 @@ func (frame *frame) store(seqno uint16, timestamp uint32, first bool, marker boo
 		return false
 	}
 
-	done := frame.insert(seqno, timestamp, marker, data)
+	done := frame.insert(seqno, timestamp, marker, arrival, data)
 	if done && !frame.complete {
 		marker := false
 		fst := frame.entries[0].seqno
@@ -249,19 +397,83 @@ func (frame *frame) store(seqno uint16, timestamp uint32, first bool, marker boo
 	return done
 }
 
+// Seen returns true if a packet with the given seqno was recently
+// stored.  Since this is cheap, it is suitable for detecting duplicates
+// before forwarding a packet.
+func (cache *Cache) Seen(seqno uint16) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.seenLocked(seqno)
+}
+
+func (cache *Cache) seenLocked(seqno uint16) bool {
+	if !cache.lastValid || seqnoInvalid(seqno, cache.last) ||
+		compare(cache.last, seqno) < 0 {
+		return false
+	}
+	return cache.seen.get(seqno)
+}
+
+// indexLocked returns the index of the packet with the given seqno, or
+// an index that GetAt rejects if it is not in the cache.
+func (cache *Cache) indexLocked(seqno uint16) uint16 {
+	for i := range cache.entries {
+		e := &cache.entries[i]
+		if e.lengthAndMarker != 0 && e.seqno == seqno {
+			return uint16(i)
+		}
+	}
+	return uint16(len(cache.entries))
+}
+
 // Store stores a packet in the cache.  It returns the first seqno in the
-// bitmap, and the index at which the packet was stored.
+// bitmap, and the index at which the packet was stored.  A duplicate of
+// a recent packet is not stored again.
 func (cache *Cache) Store(seqno uint16, timestamp uint32, keyframe bool, marker bool, buf []byte) (uint16, uint16) {
+	return cache.StoreAt(seqno, timestamp, keyframe, marker, 0, buf)
+}
+
+// StoreAt is like Store, but additionally records the packet's arrival
+// time, which may be in any monotonic unit.
+func (cache *Cache) StoreAt(seqno uint16, timestamp uint32, keyframe bool, marker bool, arrival uint64, buf []byte) (uint16, uint16) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
-	if !cache.lastValid || seqnoInvalid(seqno, cache.last) {
+	if cache.closed {
+		return 0, 0
+	}
+
+	if cache.seenLocked(seqno) {
+		// don't store the packet twice, and don't count it twice
+		// in the statistics
+		return cache.bitmap.first, cache.indexLocked(seqno)
+	}
+
+	if !cache.lastValid {
+		cache.seen.reset(seqno)
 		cache.last = seqno
 		cache.lastValid = true
 		cache.expected++
+	} else if restart(seqno, cache.last) {
+		if cache.strayLocked(seqno) {
+			return 0, 0
+		}
+		// the sender has restarted its sequence.  Bump the cycle
+		// count if necessary, so that the extended sequence number
+		// remains monotonic.
+		if seqno < cache.last {
+			cache.cycle++
+		}
+		cache.flushLocked()
+		cache.seen.reset(seqno)
+		cache.last = seqno
+		cache.expected++
+		cache.strayValid = false
 	} else {
+		cache.strayValid = false
 		cmp := compare(cache.last, seqno)
 		if cmp < 0 {
+			cache.seen.advance(cache.last, seqno)
 			cache.expected += uint32(seqno - cache.last)
 			cache.lost += uint32(seqno - cache.last - 1)
 			if seqno < cache.last {
@@ -269,6 +481,7 @@ func (cache *Cache) Store(seqno uint16, timestamp uint32, keyframe bool, marker
 			}
 			cache.last = seqno
 		} else if cmp > 0 {
+			cache.seen.set(seqno)
 			if cache.lost > 0 {
 				cache.lost--
 			}
@@ -276,25 +489,80 @@ func (cache *Cache) Store(seqno uint16, timestamp uint32, keyframe bool, marker
 	}
 	cache.bitmap.set(seqno)
 
-	done := cache.keyframe.store(seqno, timestamp, keyframe, marker, buf)
+	done := cache.keyframe.store(
+		seqno, timestamp, keyframe, marker, arrival, buf,
+	)
 	if done && !cache.keyframe.complete {
 		completeKeyframe(cache)
 	}
 
 	i := cache.tail
 	cache.entries[i].seqno = seqno
-	copy(cache.entries[i].buf[:], buf)
-	lam := uint16(len(buf))
-	if marker {
-		lam |= 0x8000
+	if len(buf) <= BufSize {
+		copy(cache.entries[i].buf[:], buf)
+		lam := uint16(len(buf))
+		if marker {
+			lam |= 0x8000
+		}
+		cache.entries[i].lengthAndMarker = lam
+	} else {
+		// too large, record the slot as empty rather than storing
+		// a truncated packet.
+		cache.entries[i].lengthAndMarker = 0
 	}
-	cache.entries[i].lengthAndMarker = lam
 	cache.entries[i].timestamp = timestamp
+	cache.entries[i].arrival = arrival
 	cache.tail = (i + 1) % uint16(len(cache.entries))
 
 	return cache.bitmap.first, i
 }
 
+// Discontinuous returns true if storing a packet with the given seqno
+// would be treated as a restart of the sender's sequence.  In that case,
+// the cache is flushed, and the packets between the last seqno and the
+// new one are not counted as lost.
+func (cache *Cache) Discontinuous(seqno uint16) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.lastValid && restart(seqno, cache.last) &&
+		cache.strayValid && seqno == cache.stray+1
+}
+
+// Stray returns true if a packet with the given seqno is too far from the
+// previous ones, and doesn't follow the previous such packet.  Stray
+// packets are not stored, and should be dropped; if the next packet
+// follows a stray packet, the sender's sequence is taken to have
+// restarted.
+func (cache *Cache) Stray(seqno uint16) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.lastValid && restart(seqno, cache.last) &&
+		cache.strayLocked(seqno)
+}
+
+// strayLocked returns false if seqno follows the last stray seqno.
+// Otherwise, it records seqno as the last stray seqno and returns true.
+func (cache *Cache) strayLocked(seqno uint16) bool {
+	if cache.strayValid && seqno == cache.stray+1 {
+		return false
+	}
+	cache.stray = seqno
+	cache.strayValid = true
+	return true
+}
+
+// flushLocked discards the packets from before a restart, since their
+// seqnos may be reused, as well as the loss history.
+func (cache *Cache) flushLocked() {
+	for i := range cache.entries {
+		cache.entries[i].lengthAndMarker = 0
+	}
+	cache.tail = 0
+	cache.keyframe.complete = false
+	cache.keyframe.entries = cache.keyframe.entries[:0]
+	cache.bitmap = bitmap{}
+}
+
 // completeKeyFrame attempts to complete the current keyframe.
 func completeKeyframe(cache *Cache) {
 	l := len(cache.keyframe.entries)
@@ -308,16 +576,13 @@ func completeKeyframe(cache *Cache) {
 		// this shouldn't happen
 		return
 	}
-	var buf []byte
 	if count > 1 {
-		if buf == nil {
-			buf = make([]byte, BufSize)
-		}
 		for i := uint16(1); i < count; i++ {
-			n, ts, marker := get(first+i, cache.entries, buf)
-			if n > 0 {
+			e := find(first+i, cache.entries)
+			if e != nil {
 				cache.keyframe.store(
-					first+i, ts, false, marker, buf,
+					first+i, e.timestamp, false, e.marker(),
+					e.arrival, e.buf[:e.length()],
 				)
 			}
 		}
@@ -329,18 +594,16 @@ func completeKeyframe(cache *Cache) {
 			if cache.keyframe.entries[l-1].marker() {
 				break
 			}
-			if buf == nil {
-				buf = make([]byte, BufSize)
-			}
 			seqno := cache.keyframe.entries[l-1].seqno + 1
-			n, ts, marker := get(seqno, cache.entries, buf)
-			if n <= 0 {
+			e := find(seqno, cache.entries)
+			if e == nil {
 				break
 			}
 			done := cache.keyframe.store(
-				seqno, ts, false, marker, buf,
+				seqno, e.timestamp, false, e.marker(),
+				e.arrival, e.buf[:e.length()],
 			)
-			if !done || marker {
+			if !done || e.marker() {
 				break
 			}
 		}
@@ -358,27 +621,38 @@ func (cache *Cache) Expect(n int) {
 	cache.lost += uint32(n)
 }
 
-// get retrieves a packet from a slice of entries.
-func get(seqno uint16, entries []entry, result []byte) (uint16, uint32, bool) {
+// find returns the entry with the given seqno, or nil.
+func find(seqno uint16, entries []entry) *entry {
 	for i := range entries {
-		if entries[i].lengthAndMarker == 0 || entries[i].seqno != seqno {
-			continue
+		if entries[i].lengthAndMarker != 0 && entries[i].seqno == seqno {
+			return &entries[i]
 		}
-		var n uint16
-		if len(result) > 0 {
-			n = uint16(copy(
-				result[:entries[i].length()],
-				entries[i].buf[:]))
-		} else {
-			n = entries[i].length()
+	}
+	return nil
+}
+
+// get retrieves a packet from a slice of entries.
+func get(seqno uint16, entries []entry, result []byte) (uint16, uint32, bool) {
+	e := find(seqno, entries)
+	if e == nil {
+		return 0, 0, false
+	}
+	var n uint16
+	if len(result) > 0 {
+		if len(result) < int(e.length()) {
+			return 0, 0, false
 		}
-		return n, entries[i].timestamp, entries[i].marker()
+		n = uint16(copy(result[:e.length()], e.buf[:]))
+	} else {
+		n = e.length()
 	}
-	return 0, 0, false
+	return n, e.timestamp, e.marker()
 }
 
 // Get retrieves a packet from the cache, returns the number of bytes
-// copied.  If result is of length 0, returns the size of the packet.
+// copied.  If result is of length 0, returns the size of the packet.  If
+// result is too small to hold the packet, nothing is copied and Get
+// returns 0.
 func (cache *Cache) Get(seqno uint16, result []byte) uint16 {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
@@ -396,6 +670,21 @@ func (cache *Cache) Get(seqno uint16, result []byte) uint16 {
 	return 0
 }
 
+// Arrival returns the arrival time of a packet, as passed to StoreAt.
+func (cache *Cache) Arrival(seqno uint16) (uint64, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	e := find(seqno, cache.keyframe.entries)
+	if e == nil {
+		e = find(seqno, cache.entries)
+	}
+	if e == nil {
+		return 0, false
+	}
+	return e.arrival, true
+}
+
 func (cache *Cache) Last() (bool, uint16, uint32) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
@@ -420,6 +709,9 @@ func (cache *Cache) GetAt(seqno uint16, index uint16, result []byte) uint16 {
 	if cache.entries[index].seqno != seqno {
 		return 0
 	}
+	if len(result) < int(cache.entries[index].length()) {
+		return 0
+	}
 	return uint16(copy(
 		result[:cache.entries[index].length()],
 		cache.entries[index].buf[:]),
@@ -443,6 +735,27 @@ func (cache *Cache) Keyframe() (uint32, bool, []uint16) {
 	return cache.keyframe.timestamp, cache.keyframe.complete, seqnos
 }
 
+// GetKeyframe returns a copy of the packets of the last keyframe, in
+// order, together with the keyframe's timestamp.  Since the keyframe is
+// buffered separately, it survives the eviction of its packets from the
+// cache.  It returns nil if the keyframe is not complete.
+func (cache *Cache) GetKeyframe() (uint32, [][]byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.keyframe.entries) == 0 || !cache.keyframe.complete {
+		return 0, nil
+	}
+
+	packets := make([][]byte, len(cache.keyframe.entries))
+	for i := range cache.keyframe.entries {
+		e := &cache.keyframe.entries[i]
+		packets[i] = make([]byte, e.length())
+		copy(packets[i], e.buf[:])
+	}
+	return cache.keyframe.timestamp, packets
+}
+
 func (cache *Cache) KeyframeSeqno() (bool, uint16, uint32) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
@@ -455,11 +768,12 @@ func (cache *Cache) KeyframeSeqno() (bool, uint16, uint32) {
 }
 
 func (cache *Cache) resize(capacity int) {
-	if len(cache.entries) == capacity {
+	if cache.closed || len(cache.entries) == capacity {
 		return
 	}
 
 	entries := make([]entry, capacity)
+	account(capacity - len(cache.entries))
 
 	if capacity > len(cache.entries) {
 		copy(entries, cache.entries[:cache.tail])
@@ -493,6 +807,10 @@ func (cache *Cache) ResizeCond(capacity int) bool {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
+	if cache.closed {
+		return false
+	}
+
 	current := len(cache.entries)
 
 	if current >= capacity*3/4 && current < capacity*2 {
@@ -510,6 +828,25 @@ func (cache *Cache) ResizeCond(capacity int) bool {
 	return true
 }
 
+// Occupancy returns the capacity of the cache and the number of packets
+// that it currently holds.
+func (cache *Cache) Occupancy() (int, int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	count := 0
+	for i := range cache.entries {
+		if cache.entries[i].length() > 0 {
+			count++
+		}
+	}
+	return len(cache.entries), count
+}
+
+// The cumulative number of packets lost is a signed 24-bit quantity in
+// receiver reports.
+const maxTotalLost = 0x7FFFFF
+
 // GetStats returns statistics about received packets.  If reset is true,
 // the statistics are reset.
 func (cache *Cache) GetStats(reset bool) (uint32, uint32, uint32, uint32) {
@@ -519,6 +856,9 @@ func (cache *Cache) GetStats(reset bool) (uint32, uint32, uint32, uint32) {
 	expected := cache.expected
 	lost := cache.lost
 	totalLost := cache.totalLost + cache.lost
+	if totalLost > maxTotalLost {
+		totalLost = maxTotalLost
+	}
 	eseqno := uint32(cache.cycle)<<16 | uint32(cache.last)
 
 	if reset {
@@ -100,6 +100,30 @@ func TestCacheOverflow(t *testing.T) {
 	}
 }
 
+func TestOccupancy(t *testing.T) {
+	cache := New(16)
+	capacity, count := cache.Occupancy()
+	if capacity != 16 || count != 0 {
+		t.Errorf("Expected 16 0, got %v %v", capacity, count)
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
+	}
+	capacity, count = cache.Occupancy()
+	if capacity != 16 || count != 10 {
+		t.Errorf("Expected 16 10, got %v %v", capacity, count)
+	}
+
+	for i := 10; i < 32; i++ {
+		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
+	}
+	capacity, count = cache.Occupancy()
+	if capacity != 16 || count != 16 {
+		t.Errorf("Expected 16 16, got %v %v", capacity, count)
+	}
+}
+
 func TestCacheGrow(t *testing.T) {
 	cache := New(16)
 
@@ -222,6 +246,72 @@ func TestKeyframe(t *testing.T) {
 	}
 }
 
+func TestGetKeyframe(t *testing.T) {
+	cache := New(16)
+
+	ts, packets := cache.GetKeyframe()
+	if packets != nil {
+		t.Errorf("Got keyframe in empty cache")
+	}
+
+	cache.Store(7, 57, true, false, []byte{7})
+	cache.Store(9, 57, false, true, []byte{9, 9})
+	ts, packets = cache.GetKeyframe()
+	if packets != nil {
+		t.Errorf("Got incomplete keyframe")
+	}
+
+	cache.Store(8, 57, false, false, []byte{8})
+	// evict the keyframe from the ring
+	for i := 0; i < 32; i++ {
+		cache.Store(uint16(10+i), uint32(58+i), false, false, []byte{0})
+	}
+
+	ts, packets = cache.GetKeyframe()
+	if ts != 57 || len(packets) != 3 {
+		t.Fatalf("Got %v %v, expected 57 3", ts, len(packets))
+	}
+	for i, p := range packets {
+		if p[0] != byte(7+i) || len(p) != 1+i/2 {
+			t.Errorf("Packet %v: got %v", i, p)
+		}
+	}
+
+	// the result is a copy
+	packets[0][0] = 42
+	_, packets = cache.GetKeyframe()
+	if packets[0][0] != 7 {
+		t.Errorf("Keyframe was modified")
+	}
+}
+
+func TestArrival(t *testing.T) {
+	cache := New(4)
+	packet := make([]byte, 1)
+
+	cache.StoreAt(7, 57, true, false, 1000, packet)
+	cache.StoreAt(9, 57, false, true, 3000, packet)
+	cache.StoreAt(8, 57, false, false, 2000, packet)
+	for i := 0; i < 4; i++ {
+		cache.StoreAt(uint16(10+i), 58, false, false,
+			uint64(4000+1000*i), packet)
+	}
+
+	// 7, 8 and 9 were evicted, but are part of the keyframe
+	for i := uint16(7); i < 14; i++ {
+		a, ok := cache.Arrival(i)
+		if !ok || a != 1000*(uint64(i)-6) {
+			t.Errorf("%v: expected %v, got %v %v",
+				i, 1000*(i-6), a, ok)
+		}
+	}
+
+	_, ok := cache.Arrival(42)
+	if ok {
+		t.Errorf("Found arrival for unknown packet")
+	}
+}
+
 func TestKeyframeUnsorted(t *testing.T) {
 	cache := New(16)
 	packet := make([]byte, 1)
@@ -262,7 +352,7 @@ func TestBitmap(t *testing.T) {
 	}
 
 	value >>= uint16(first - 42)
-	if uint32(value) != cache.bitmap.bitmap {
+	if value != cache.bitmap.bitmap {
 		t.Errorf("Got %b, expected %b", cache.bitmap.bitmap, value)
 	}
 }
@@ -284,7 +374,7 @@ func TestBitmapWrap(t *testing.T) {
 	}
 
 	value >>= uint16(first - 42)
-	if uint32(value) != cache.bitmap.bitmap {
+	if value != cache.bitmap.bitmap {
 		t.Errorf("Got %b, expected %b", cache.bitmap.bitmap, value)
 	}
 }
@@ -360,6 +450,42 @@ func TestBitmapPacket(t *testing.T) {
 	})
 }
 
+func TestBitmapGetAll(t *testing.T) {
+	packet := make([]byte, 1)
+	cache := New(16)
+
+	// a burst of 50 losses
+	for i := 0; i < 10; i++ {
+		cache.Store(uint16(42+i), 0, false, false, packet)
+	}
+	for i := 60; i < 70; i++ {
+		cache.Store(uint16(42+i), 0, false, false, packet)
+	}
+
+	entries := cache.BitmapGetAll(42 + 70)
+	var missing []uint16
+	for _, e := range entries {
+		p := rtcp.NackPair{e.First, rtcp.PacketBitmap(e.Bitmap)}
+		missing = append(missing, p.PacketList()...)
+	}
+	if len(missing) != 50 {
+		t.Errorf("Expected 50 missing packets, got %v", len(missing))
+	}
+	for i, s := range missing {
+		if s != uint16(42+10+i) {
+			t.Errorf("Expected %v, got %v", 42+10+i, s)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 entries, got %v", len(entries))
+	}
+
+	entries = cache.BitmapGetAll(42 + 70)
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries, got %v", entries)
+	}
+}
+
 func BenchmarkCachePutGet(b *testing.B) {
 	n := 10
 	chans := make([]chan uint16, n)
@@ -564,3 +690,258 @@ func TestCacheStatsNack(t *testing.T) {
 			expected, lost, totalLost, eseqno)
 	}
 }
+
+func TestCacheStatsWraparound(t *testing.T) {
+	cache := New(16)
+	start := 65000
+	count := 4*65536 + 1000
+	dropped := uint32(0)
+	var totalExpected, totalLost uint32
+	for i := 0; i < count; i++ {
+		seqno := uint16(start + i)
+		if i%1000 == 999 {
+			dropped++
+			continue
+		}
+		if seqno == 0xFFFF {
+			// reorder across the wraparound
+			continue
+		}
+		cache.Store(seqno, 0, false, false, []byte{uint8(i)})
+		if seqno == 1 {
+			cache.Store(0xFFFF, 0, false, false, []byte{0})
+		}
+		if i%5000 == 0 {
+			expected, lost, _, _ := cache.GetStats(true)
+			totalExpected += expected
+			totalLost += lost
+		}
+	}
+	expected, lost, tl, eseqno := cache.GetStats(true)
+	totalExpected += expected
+	totalLost += lost
+
+	last := uint32(start + count - 1)
+	if totalExpected != uint32(count) ||
+		totalLost != dropped ||
+		tl != dropped ||
+		eseqno != last {
+		t.Errorf("Expected %v, %v, %v, %v, got %v, %v, %v, %v",
+			count, dropped, dropped, last,
+			totalExpected, totalLost, tl, eseqno)
+	}
+}
+
+func TestCacheStatsResync(t *testing.T) {
+	cache := New(16)
+	for i := 0; i < 32; i++ {
+		cache.Store(uint16(1000+i), 0, false, false, []byte{uint8(i)})
+	}
+	_, _, _, eseqno1 := cache.GetStats(false)
+	// the restart is confirmed by the second packet
+	cache.Store(uint16(10), 0, false, false, []byte{10})
+	cache.Store(uint16(11), 0, false, false, []byte{11})
+	_, _, _, eseqno2 := cache.GetStats(false)
+	if eseqno1 != 1031 || eseqno2 != (1<<16)+11 {
+		t.Errorf("Expected 1031, %v, got %v, %v",
+			(1<<16)+11, eseqno1, eseqno2)
+	}
+}
+
+func TestCacheRestart(t *testing.T) {
+	// the encoder restarts with a seqno that is either too far in the
+	// future or too far in the past
+	for _, seqno := range []uint16{500, 10000} {
+		cache := New(16)
+		for i := 0; i < 32; i++ {
+			cache.Store(uint16(1000+i), 0, false, false,
+				[]byte{uint8(i)})
+		}
+		cache.GetStats(true)
+
+		if cache.Discontinuous(seqno) {
+			t.Errorf("Expected %v to need confirmation", seqno)
+		}
+		if !cache.Stray(seqno) {
+			t.Errorf("Expected %v to be stray", seqno)
+		}
+		if !cache.Discontinuous(seqno + 1) {
+			t.Errorf("Expected %v to be a restart", seqno+1)
+		}
+		for i := uint16(1); i < 9; i++ {
+			cache.Store(seqno+i, 0, false, false, []byte{1})
+		}
+
+		expected, lost, _, _ := cache.GetStats(false)
+		if expected != 8 || lost != 0 {
+			t.Errorf("Expected 8, 0, got %v, %v", expected, lost)
+		}
+		if n := cache.Get(1031, nil); n != 0 {
+			t.Errorf("Expected packet from before the restart " +
+				"to be flushed")
+		}
+		entries := cache.BitmapGetAll(seqno + 9)
+		if len(entries) != 0 {
+			t.Errorf("Expected no losses, got %v", entries)
+		}
+	}
+
+	// reordering and small losses are not restarts
+	cache := New(16)
+	cache.Store(1000, 0, false, false, []byte{1})
+	if cache.Discontinuous(999) || cache.Discontinuous(1100) ||
+		cache.Stray(999) || cache.Stray(1100) {
+		t.Errorf("Unexpected restart")
+	}
+}
+
+func TestCacheStray(t *testing.T) {
+	cache := New(16)
+	for i := 0; i < 32; i++ {
+		cache.Store(uint16(1000+i), 0, false, false, []byte{uint8(i)})
+	}
+	cache.GetStats(true)
+
+	// an isolated packet far in the future doesn't cause a restart
+	cache.Store(20000, 0, false, false, []byte{42})
+	for i := 32; i < 40; i++ {
+		cache.Store(uint16(1000+i), 0, false, false, []byte{uint8(i)})
+	}
+	if cache.Discontinuous(20001) {
+		t.Errorf("Unexpected restart")
+	}
+
+	expected, lost, _, eseqno := cache.GetStats(false)
+	if expected != 8 || lost != 0 || eseqno != 1039 {
+		t.Errorf("Expected 8, 0, 1039, got %v, %v, %v",
+			expected, lost, eseqno)
+	}
+	if n := cache.Get(20000, nil); n != 0 {
+		t.Errorf("Stray packet was stored")
+	}
+	if n := cache.Get(1031, nil); n == 0 {
+		t.Errorf("Packet from before the stray packet was flushed")
+	}
+}
+
+func TestOversizedPacket(t *testing.T) {
+	cache := New(16)
+	large := make([]byte, BufSize+1)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	_, index := cache.Store(13, 42, true, true, large)
+	cache.Store(14, 43, false, true, []byte{1, 2, 3})
+
+	buf := make([]byte, BufSize)
+	if n := cache.Get(13, buf); n != 0 {
+		t.Errorf("Got %v bytes of an oversized packet", n)
+	}
+	if n := cache.GetAt(13, index, buf); n != 0 {
+		t.Errorf("Got %v bytes of an oversized packet", n)
+	}
+	if _, packets := cache.GetKeyframe(); packets != nil {
+		t.Errorf("Oversized packet was stored in keyframe")
+	}
+	if n := cache.Get(14, buf); n != 3 {
+		t.Errorf("Expected 3, got %v", n)
+	}
+	if expected, lost, _, _ := cache.GetStats(false); expected != 2 ||
+		lost != 0 {
+		t.Errorf("Expected 2 0, got %v %v", expected, lost)
+	}
+
+	// a buffer that is too small is detected
+	if n := cache.Get(14, buf[:2]); n != 0 {
+		t.Errorf("Expected 0, got %v", n)
+	}
+	_, index = cache.Store(15, 44, false, true, large[:BufSize])
+	if n := cache.GetAt(15, index, buf[:BufSize-1]); n != 0 {
+		t.Errorf("Expected 0, got %v", n)
+	}
+	if n := cache.GetAt(15, index, buf); n != BufSize {
+		t.Errorf("Expected %v, got %v", BufSize, n)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	cache := New(64)
+	seqnos := []uint16{
+		65530, 65531, 65531, 65533, 65532, 65533, 65535, 65530,
+		1, 0, 1, 65534, 2, 2, 0,
+	}
+	var forwarded []uint16
+	for _, seqno := range seqnos {
+		if cache.Seen(seqno) {
+			continue
+		}
+		forwarded = append(forwarded, seqno)
+		cache.Store(seqno, 0, false, false, []byte{byte(seqno)})
+	}
+
+	expected := []uint16{65530, 65531, 65533, 65532, 65535, 1, 0, 65534, 2}
+	if len(forwarded) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, forwarded)
+	}
+	for i := range expected {
+		if forwarded[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, forwarded)
+			break
+		}
+	}
+
+	// storing a duplicate doesn't affect the statistics
+	cache.Store(1, 0, false, false, []byte{1})
+	exp, lost, _, _ := cache.GetStats(false)
+	if exp != 9 || lost != 0 {
+		t.Errorf("Expected 9 0, got %v %v", exp, lost)
+	}
+
+	// and doesn't store the packet twice
+	count := 0
+	for i := range cache.entries {
+		if cache.entries[i].lengthAndMarker != 0 &&
+			cache.entries[i].seqno == 1 {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected 1, got %v", count)
+	}
+
+	// a jump larger than the window forgets about old packets
+	cache.Store(1000, 0, false, false, []byte{0})
+	if cache.Seen(999) || !cache.Seen(1000) {
+		t.Errorf("Unexpected state after jump")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	before := Memory()
+	cache := New(16)
+	if d := Memory() - before; d != 16*entrySize {
+		t.Errorf("Expected %v, got %v", 16*entrySize, d)
+	}
+	cache.Resize(32)
+	if d := Memory() - before; d != 32*entrySize {
+		t.Errorf("Expected %v, got %v", 32*entrySize, d)
+	}
+	cache.Resize(8)
+	if d := Memory() - before; d != 8*entrySize {
+		t.Errorf("Expected %v, got %v", 8*entrySize, d)
+	}
+	cache.Close()
+	if d := Memory() - before; d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+	cache.Close()
+	cache.Resize(16)
+	cache.Store(42, 0, false, false, []byte{1})
+	if d := Memory() - before; d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+	if cache.Get(42, make([]byte, BufSize)) != 0 {
+		t.Errorf("Closed cache returned a packet")
+	}
+}
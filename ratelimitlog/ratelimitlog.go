@@ -0,0 +1,151 @@
+// Package ratelimitlog implements a logger that coalesces repeated
+// messages.  It is meant to be used in code that runs once per packet,
+// where a persistent error would otherwise flood the logs.  Messages are
+// written to logger.Default at warning level.
+package ratelimitlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/logger"
+)
+
+// Interval is the minimum time between two identical messages.  A zero
+// value disables rate limiting.
+var Interval = 10 * time.Second
+
+// the maximum number of distinct messages that are tracked
+const maxMessages = 1024
+
+type message struct {
+	msg        string
+	keyvals    []interface{}
+	last       time.Time
+	suppressed uint64
+}
+
+// A Logger logs a given message at most once per Interval, and records
+// the number of times that it was suppressed.  The zero value is ready
+// to use.
+type Logger struct {
+	mu       sync.Mutex
+	messages map[string]*message
+	swept    time.Time
+	// output is replaced during testing
+	output func(msg string, keyvals []interface{})
+}
+
+var defaultLogger Logger
+
+// Printf logs a message using the default logger.
+func Printf(format string, v ...interface{}) {
+	defaultLogger.Printf(format, v...)
+}
+
+// Log logs a message with structured data, given as alternating keys and
+// values, using the default logger.
+func Log(msg string, keyvals ...interface{}) {
+	defaultLogger.Log(msg, keyvals...)
+}
+
+// Printf logs a message unless an identical message was logged less than
+// Interval ago.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	if !l.enabled() {
+		return
+	}
+	l.log(time.Now(), Interval, fmt.Sprintf(format, v...), nil)
+}
+
+// Log logs a message with structured data unless a message with the same
+// text and data was logged less than Interval ago.
+func (l *Logger) Log(msg string, keyvals ...interface{}) {
+	if !l.enabled() {
+		return
+	}
+	l.log(time.Now(), Interval, msg, keyvals)
+}
+
+func (l *Logger) enabled() bool {
+	return l.output != nil || logger.Default.Enabled(logger.LevelWarn)
+}
+
+func (l *Logger) print(msg string, keyvals []interface{}, suppressed uint64) {
+	if suppressed > 0 {
+		kv := make([]interface{}, 0, len(keyvals)+2)
+		kv = append(kv, keyvals...)
+		keyvals = append(kv, "suppressed", suppressed)
+	}
+	if l.output != nil {
+		l.output(msg, keyvals)
+		return
+	}
+	logger.Default.Log(logger.LevelWarn, msg, keyvals...)
+}
+
+func (l *Logger) printf(now time.Time, interval time.Duration, format string, v ...interface{}) {
+	l.log(now, interval, fmt.Sprintf(format, v...), nil)
+}
+
+func (l *Logger) log(now time.Time, interval time.Duration, msg string, keyvals []interface{}) {
+	if interval <= 0 {
+		l.print(msg, keyvals, 0)
+		return
+	}
+
+	key := msg
+	if len(keyvals) > 0 {
+		key = msg + " " + fmt.Sprint(keyvals...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.record(now, interval, key, msg, keyvals)
+	if now.Sub(l.swept) >= interval {
+		l.sweep(now, interval)
+	}
+}
+
+// record logs a message unless it was logged recently.  Called locked.
+func (l *Logger) record(now time.Time, interval time.Duration, key string, msg string, keyvals []interface{}) {
+	m := l.messages[key]
+	if m != nil && now.Sub(m.last) < interval {
+		m.suppressed++
+		return
+	}
+
+	if m != nil {
+		l.print(msg, keyvals, m.suppressed)
+		m.last = now
+		m.suppressed = 0
+		return
+	}
+	l.print(msg, keyvals, 0)
+
+	if len(l.messages) >= maxMessages {
+		// too many distinct messages, don't track this one
+		return
+	}
+	if l.messages == nil {
+		l.messages = make(map[string]*message)
+	}
+	l.messages[key] = &message{msg: msg, keyvals: keyvals, last: now}
+}
+
+// sweep forgets about messages that have expired, logging the number of
+// times they were suppressed.  Called locked.
+func (l *Logger) sweep(now time.Time, interval time.Duration) {
+	for key, m := range l.messages {
+		if now.Sub(m.last) < interval {
+			continue
+		}
+		if m.suppressed > 0 {
+			l.print(m.msg, m.keyvals, m.suppressed)
+		}
+		delete(l.messages, key)
+	}
+	l.swept = now
+}
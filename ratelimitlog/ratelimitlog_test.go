@@ -0,0 +1,102 @@
+package ratelimitlog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func capture(out *[]string) func(string, []interface{}) {
+	return func(msg string, keyvals []interface{}) {
+		s := msg
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			s += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+		}
+		*out = append(*out, s)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var out []string
+	l := Logger{output: capture(&out)}
+	now := time.Now()
+	interval := 10 * time.Second
+
+	for i := 0; i < 5; i++ {
+		l.printf(now, interval, "error %v", 1)
+	}
+	l.printf(now, interval, "error %v", 2)
+	expected := []string{"error 1", "error 2"}
+	if len(out) != 2 || out[0] != expected[0] || out[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+
+	out = nil
+	l.printf(now.Add(interval/2), interval, "error %v", 1)
+	l.printf(now.Add(interval), interval, "error %v", 1)
+	s := "error 1 suppressed=5"
+	if len(out) != 1 || out[0] != s {
+		t.Errorf("Expected [%v], got %v", s, out)
+	}
+
+	// the count of a message that doesn't come back is logged
+	// eventually
+	out = nil
+	l.printf(now.Add(interval+1), interval, "error %v", 1)
+	l.printf(now.Add(3*interval), interval, "error %v", 3)
+	expected = []string{
+		"error 3", "error 1 suppressed=1",
+	}
+	if len(out) != 2 || out[0] != expected[0] || out[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+	if len(l.messages) != 1 {
+		t.Errorf("Expected 1 message, got %v", len(l.messages))
+	}
+}
+
+func TestLoggerKeyvals(t *testing.T) {
+	var out []string
+	l := Logger{output: capture(&out)}
+	now := time.Now()
+	interval := 10 * time.Second
+
+	for i := 0; i < 3; i++ {
+		l.log(now, interval, "NACK", []interface{}{"conn", "a"})
+	}
+	l.log(now, interval, "NACK", []interface{}{"conn", "b"})
+	l.log(now.Add(interval), interval, "NACK", []interface{}{"conn", "a"})
+	expected := []string{
+		"NACK conn=a", "NACK conn=b", "NACK conn=a suppressed=2",
+	}
+	if fmt.Sprint(out) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+}
+
+func TestLoggerDisabled(t *testing.T) {
+	var out []string
+	l := Logger{output: capture(&out)}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		l.printf(now, 0, "error")
+	}
+	if len(out) != 3 {
+		t.Errorf("Expected 3 messages, got %v", len(out))
+	}
+}
+
+func TestLoggerMaxMessages(t *testing.T) {
+	var out []string
+	l := Logger{output: capture(&out)}
+	now := time.Now()
+	for i := 0; i < maxMessages+10; i++ {
+		l.printf(now, time.Second, "error %v", i)
+	}
+	if len(l.messages) != maxMessages {
+		t.Errorf("Expected %v, got %v", maxMessages, len(l.messages))
+	}
+	if len(out) != maxMessages+10 {
+		t.Errorf("Expected %v, got %v", maxMessages+10, len(out))
+	}
+}
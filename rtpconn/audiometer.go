@@ -0,0 +1,120 @@
+package rtpconn
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// Audio meters give operators a continuous view of the level of every
+// publisher, unlike the audio selector, which only cares about the
+// loudest few.  Levels are taken from the audio level header extension,
+// and are therefore unknown for senders that didn't negotiate it.
+
+const (
+	// how often operators are sent the audio levels
+	audioMeterInterval = 500 * time.Millisecond
+	// a track that has not sent a level for this long is silent
+	audioMeterTimeout = rtptime.JiffiesPerSec
+)
+
+// meterLevel computes the new value of a meter given its old value and
+// the level of a packet.  Like a VU meter, it rises quickly and falls
+// slowly; at 50 packets per second, it decays with a time constant of
+// roughly 300ms.
+func meterLevel(old, level uint32) uint32 {
+	if level > old {
+		return old + (level-old+1)/2
+	}
+	return old - (old-level+15)/16
+}
+
+// updateMeter updates the audio meter of a track.  The loudness is 127
+// minus the level in dBov.
+func (up *rtpUpTrack) updateMeter(loudness uint32, now uint64) {
+	old := atomic.LoadUint32(&up.atomics.meter)
+	if now-atomic.LoadUint64(&up.atomics.meterTime) > audioMeterTimeout {
+		old = 0
+	}
+	atomic.StoreUint32(&up.atomics.meter, meterLevel(old, loudness))
+	atomic.StoreUint64(&up.atomics.meterTime, now)
+}
+
+// getMeter returns the current level of a track in dBov, and false if
+// the level is unknown.
+func (up *rtpUpTrack) getMeter(now uint64) (int, bool) {
+	if up.audioLevelId == 0 {
+		return 0, false
+	}
+	if now-atomic.LoadUint64(&up.atomics.meterTime) > audioMeterTimeout {
+		return -127, true
+	}
+	return int(atomic.LoadUint32(&up.atomics.meter)) - 127, true
+}
+
+// audioLevels returns a snapshot of the levels of all the audio tracks
+// published in group g.  The level is nil if it is unknown.
+func audioLevels(g *group.Group, now uint64) []map[string]interface{} {
+	var ups []*rtpUpConnection
+	for _, c := range g.GetClients(nil) {
+		switch c := c.(type) {
+		case *webClient:
+			ups = append(ups, getUpConns(c)...)
+		case *WhipClient:
+			c.mu.Lock()
+			up := c.connection
+			c.mu.Unlock()
+			if up != nil {
+				ups = append(ups, up)
+			}
+		}
+	}
+	sort.Slice(ups, func(i, j int) bool {
+		return ups[i].id < ups[j].id
+	})
+
+	var levels []map[string]interface{}
+	for _, up := range ups {
+		for _, t := range up.getTracks() {
+			if t.Kind() != webrtc.RTPCodecTypeAudio {
+				continue
+			}
+			var level interface{}
+			if l, ok := t.getMeter(now); ok {
+				level = l
+			}
+			levels = append(levels, map[string]interface{}{
+				"id":       up.id,
+				"source":   up.userId,
+				"username": up.username,
+				"level":    level,
+			})
+		}
+	}
+	return levels
+}
+
+// sendAudioLevels sends the audio levels of the group to c if it is an
+// operator.
+func sendAudioLevels(c *webClient) error {
+	g := c.group
+	if g == nil || !c.permissions.Op {
+		return nil
+	}
+	levels := audioLevels(g, rtptime.Jiffies())
+	if len(levels) == 0 {
+		return nil
+	}
+	return c.write(clientMessage{
+		Type:       "usermessage",
+		Kind:       "audiolevels",
+		Dest:       c.id,
+		Privileged: true,
+		Value:      levels,
+	})
+}
@@ -0,0 +1,61 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestMeterLevel(t *testing.T) {
+	m := uint32(0)
+	m = meterLevel(m, 100)
+	if m != 50 {
+		t.Errorf("Expected 50, got %v", m)
+	}
+	for i := 0; i < 10; i++ {
+		m = meterLevel(m, 100)
+	}
+	if m != 100 {
+		t.Errorf("Expected 100, got %v", m)
+	}
+	m = meterLevel(m, 0)
+	if m < 90 || m >= 100 {
+		t.Errorf("Expected slow decay, got %v", m)
+	}
+	for i := 0; i < 100; i++ {
+		m = meterLevel(m, 0)
+	}
+	if m != 0 {
+		t.Errorf("Expected 0, got %v", m)
+	}
+}
+
+func TestGetMeter(t *testing.T) {
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	track := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	if _, ok := track.getMeter(now); ok {
+		t.Errorf("Expected unknown level")
+	}
+
+	track.audioLevelId = 1
+	if l, ok := track.getMeter(now); !ok || l != -127 {
+		t.Errorf("Expected -127, got %v %v", l, ok)
+	}
+
+	for i := 0; i < 20; i++ {
+		track.updateMeter(127-20, now)
+	}
+	if l, ok := track.getMeter(now); !ok || l != -20 {
+		t.Errorf("Expected -20, got %v %v", l, ok)
+	}
+
+	later := now + 2*audioMeterTimeout
+	if l, ok := track.getMeter(later); !ok || l != -127 {
+		t.Errorf("Expected -127, got %v %v", l, ok)
+	}
+	// a stale meter restarts from silence
+	track.updateMeter(127-20, later)
+	if l, _ := track.getMeter(later); l != -127+(127-20+1)/2 {
+		t.Errorf("Expected %v, got %v", -127+(127-20+1)/2, l)
+	}
+}
@@ -0,0 +1,320 @@
+package rtpconn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// A bandwidth test measures the capacity of the path from the server to
+// a client.  The server creates a dedicated down connection with a single
+// video track, sends padding-only packets at an increasing rate, and
+// watches the loss announced in the client's receiver reports.
+
+var (
+	// BandwidthTestMaxRate is the highest rate at which a bandwidth
+	// test sends, in bits per second.
+	BandwidthTestMaxRate uint64 = 20 * 1000 * 1000
+
+	// BandwidthTestInterval is the minimum time between two tests
+	// requested by the same client.
+	BandwidthTestInterval = time.Minute
+)
+
+const (
+	bandwidthTestLabel     = "bandwidth-test"
+	bandwidthTestStartRate = 256 * 1000
+	// the duration of a step at a given rate
+	bandwidthTestStep = 2 * time.Second
+	// how long we wait for a receiver report at the end of a step
+	bandwidthTestReportTimeout = 2 * time.Second
+	// how long we wait for the client to accept the connection
+	bandwidthTestSetupTimeout = 10 * time.Second
+	// the loss, in units of 1/256, above which a rate is not sustainable
+	bandwidthTestMaxLoss = 26
+	// the maximum number of tests running at the same time
+	maxBandwidthTests = 4
+	// a padding-only packet carries at most 255 bytes of padding
+	bandwidthTestPadding = 255
+)
+
+var ErrBandwidthTestBusy = group.UserError("too many bandwidth tests, please try again later")
+var ErrBandwidthTestTooSoon = group.UserError("bandwidth test requested too soon")
+var errBandwidthTestTimeout = errors.New("bandwidth test timed out")
+var errBandwidthTestNoFeedback = errors.New("no receiver reports during bandwidth test")
+
+var bandwidthTests struct {
+	mu      sync.Mutex
+	running int
+}
+
+func acquireBandwidthTest() bool {
+	bandwidthTests.mu.Lock()
+	defer bandwidthTests.mu.Unlock()
+	if bandwidthTests.running >= maxBandwidthTests {
+		return false
+	}
+	bandwidthTests.running++
+	return true
+}
+
+func releaseBandwidthTest() {
+	bandwidthTests.mu.Lock()
+	defer bandwidthTests.mu.Unlock()
+	bandwidthTests.running--
+}
+
+// bandwidthTestUp is the synthetic sender of a bandwidth test.
+type bandwidthTestUp struct {
+	id    string
+	codec webrtc.RTPCodecCapability
+	// receives the down track once connected, or an error
+	result chan interface{}
+}
+
+func newBandwidthTestUp(codec webrtc.RTPCodecCapability) *bandwidthTestUp {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &bandwidthTestUp{
+		id:     hex.EncodeToString(b),
+		codec:  codec,
+		result: make(chan interface{}, 1),
+	}
+}
+
+func (up *bandwidthTestUp) done(v interface{}) {
+	select {
+	case up.result <- v:
+	default:
+	}
+}
+
+func (up *bandwidthTestUp) AddLocal(conn.Down) error {
+	return nil
+}
+
+func (up *bandwidthTestUp) DelLocal(conn.Down) bool {
+	return false
+}
+
+func (up *bandwidthTestUp) Id() string {
+	return up.id
+}
+
+func (up *bandwidthTestUp) Label() string {
+	return bandwidthTestLabel
+}
+
+func (up *bandwidthTestUp) User() (string, string) {
+	return "", ""
+}
+
+func (up *bandwidthTestUp) RequestKeyframe(force bool) bool {
+	return false
+}
+
+func (up *bandwidthTestUp) SetMuted(kind webrtc.RTPCodecType, muted bool) {
+}
+
+// bandwidthTestTrack is the only track of a bandwidthTestUp.
+type bandwidthTestTrack struct {
+	up *bandwidthTestUp
+}
+
+// AddLocal is called when the down connection is established.
+func (t *bandwidthTestTrack) AddLocal(local conn.DownTrack) error {
+	down, ok := local.(*rtpDownTrack)
+	if !ok {
+		return errUnexpectedTrackType
+	}
+	t.up.done(down)
+	return nil
+}
+
+func (t *bandwidthTestTrack) DelLocal(conn.DownTrack) bool {
+	return false
+}
+
+func (t *bandwidthTestTrack) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (t *bandwidthTestTrack) Codec() webrtc.RTPCodecCapability {
+	return t.up.codec
+}
+
+func (t *bandwidthTestTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	return 0
+}
+
+func (t *bandwidthTestTrack) Nack(conn conn.Up, seqnos []uint16) error {
+	return nil
+}
+
+// bandwidthTestCodec returns the codec used for the test track.  The
+// packets carry no media, but the codec needs to be accepted by the
+// client.
+func bandwidthTestCodec(codecs []webrtc.RTPCodecCapability) (webrtc.RTPCodecCapability, bool) {
+	for _, c := range codecs {
+		if strings.HasPrefix(strings.ToLower(c.MimeType), "video/") {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// bandwidthTestNext returns the rate of the step that follows a step at
+// rate that suffered the given loss, and the throughput achieved during
+// that step.  A next rate of 0 means that the test is over.
+func bandwidthTestNext(rate uint64, loss uint8, maxRate uint64) (uint64, uint64) {
+	achieved := rate * uint64(256-uint32(loss)) / 256
+	if loss > bandwidthTestMaxLoss || rate >= maxRate {
+		return 0, achieved
+	}
+	next := rate * 2
+	if next > maxRate {
+		next = maxRate
+	}
+	return next, achieved
+}
+
+// StartBandwidthTest measures the capacity of the path to a client and
+// returns it in bits per second.  It blocks until the test is over.
+func StartBandwidthTest(c group.Client) (uint64, error) {
+	wc, ok := c.(*webClient)
+	if !ok {
+		return 0, errors.New("bandwidth test not supported")
+	}
+	g := wc.Group()
+	if g == nil {
+		return 0, group.UserError("join a group first")
+	}
+
+	if !wc.startBandwidthTest(time.Now()) {
+		return 0, ErrBandwidthTestTooSoon
+	}
+	defer wc.endBandwidthTest()
+
+	if !acquireBandwidthTest() {
+		return 0, ErrBandwidthTestBusy
+	}
+	defer releaseBandwidthTest()
+
+	codec, ok := bandwidthTestCodec(g.Codecs())
+	if !ok {
+		return 0, errors.New("no video codec in group")
+	}
+
+	up := newBandwidthTestUp(codec)
+	err := wc.action(bandwidthTestAction{up: up})
+	if err != nil {
+		return 0, err
+	}
+	defer wc.action(bandwidthTestAction{up: up, done: true})
+
+	timer := time.NewTimer(bandwidthTestSetupTimeout)
+	defer timer.Stop()
+
+	var track *rtpDownTrack
+	select {
+	case v := <-up.result:
+		switch v := v.(type) {
+		case *rtpDownTrack:
+			track = v
+		case error:
+			return 0, v
+		}
+	case <-timer.C:
+		return 0, errBandwidthTestTimeout
+	case <-wc.done:
+		return 0, conn.ErrConnectionClosed
+	}
+
+	return runBandwidthTest(wc.done, track, BandwidthTestMaxRate)
+}
+
+// runBandwidthTest sends padding to track at an increasing rate until
+// the receiver reports loss or maxRate is reached.
+func runBandwidthTest(done <-chan struct{}, track *rtpDownTrack, maxRate uint64) (uint64, error) {
+	payload := make([]byte, bandwidthTestPadding)
+	payload[len(payload)-1] = bandwidthTestPadding
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version: 2,
+			Padding: true,
+		},
+		Payload: payload,
+	}
+	size := uint64(12 + len(payload))
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	var best uint64
+	rate := uint64(bandwidthTestStartRate)
+	for rate > 0 {
+		start := time.Now()
+		// the first report after the middle of the step mostly
+		// covers this step
+		middle := rtptime.Jiffies() +
+			rtptime.FromDuration(bandwidthTestStep/2,
+				rtptime.JiffiesPerSec)
+		last := start
+		var credit uint64
+		for {
+			var now time.Time
+			select {
+			case <-done:
+				return 0, conn.ErrConnectionClosed
+			case now = <-ticker.C:
+			}
+			elapsed := now.Sub(last)
+			last = now
+			credit += rate * uint64(elapsed) /
+				(8 * uint64(time.Second))
+			for credit >= size {
+				packet.SequenceNumber++
+				packet.Timestamp = uint32(rtptime.Now(90000))
+				err := track.track.WriteRTP(&packet)
+				if err != nil {
+					return 0, err
+				}
+				track.Accumulate(uint32(size))
+				credit -= size
+			}
+
+			if now.Sub(start) < bandwidthTestStep {
+				continue
+			}
+			if atomic.LoadUint64(&track.stats.jiffies) > middle {
+				break
+			}
+			if now.Sub(start) >
+				bandwidthTestStep+bandwidthTestReportTimeout {
+				if best == 0 {
+					return 0, errBandwidthTestNoFeedback
+				}
+				return best, nil
+			}
+		}
+
+		loss, _ := track.stats.Get(rtptime.Jiffies())
+		var achieved uint64
+		rate, achieved = bandwidthTestNext(rate, loss, maxRate)
+		if achieved > best {
+			best = achieved
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,88 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestBandwidthTestNext(t *testing.T) {
+	max := uint64(1000000)
+	rate := uint64(100000)
+	var steps []uint64
+	for rate > 0 {
+		steps = append(steps, rate)
+		rate, _ = bandwidthTestNext(rate, 0, max)
+	}
+	expected := []uint64{100000, 200000, 400000, 800000, 1000000}
+	if len(steps) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, steps)
+	}
+	for i := range steps {
+		if steps[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, steps)
+			break
+		}
+	}
+
+	next, achieved := bandwidthTestNext(400000, 128, max)
+	if next != 0 || achieved != 200000 {
+		t.Errorf("Expected 0 200000, got %v %v", next, achieved)
+	}
+
+	next, achieved = bandwidthTestNext(400000, bandwidthTestMaxLoss, max)
+	if next != 800000 || achieved >= 400000 {
+		t.Errorf("Expected 800000 and less than 400000, got %v %v",
+			next, achieved)
+	}
+}
+
+func TestBandwidthTestCodec(t *testing.T) {
+	opus := webrtc.RTPCodecCapability{MimeType: "audio/opus"}
+	vp8 := webrtc.RTPCodecCapability{MimeType: "video/VP8"}
+	c, ok := bandwidthTestCodec([]webrtc.RTPCodecCapability{opus, vp8})
+	if !ok || c.MimeType != "video/VP8" {
+		t.Errorf("Expected video/VP8, got %v %v", ok, c.MimeType)
+	}
+	_, ok = bandwidthTestCodec([]webrtc.RTPCodecCapability{opus})
+	if ok {
+		t.Errorf("Got codec for audio-only group")
+	}
+}
+
+func TestBandwidthTestRateLimit(t *testing.T) {
+	c := &webClient{}
+	now := time.Now()
+	if !c.startBandwidthTest(now) {
+		t.Fatalf("First test was refused")
+	}
+	if c.startBandwidthTest(now.Add(2 * BandwidthTestInterval)) {
+		t.Errorf("Concurrent test was accepted")
+	}
+	c.endBandwidthTest()
+	if c.startBandwidthTest(now.Add(BandwidthTestInterval / 2)) {
+		t.Errorf("Test was accepted too soon")
+	}
+	if !c.startBandwidthTest(now.Add(BandwidthTestInterval)) {
+		t.Errorf("Test was refused after the interval")
+	}
+}
+
+func TestBandwidthTestConcurrency(t *testing.T) {
+	for i := 0; i < maxBandwidthTests; i++ {
+		if !acquireBandwidthTest() {
+			t.Fatalf("Test %v was refused", i)
+		}
+	}
+	if acquireBandwidthTest() {
+		t.Errorf("Too many tests were accepted")
+	}
+	for i := 0; i < maxBandwidthTests; i++ {
+		releaseBandwidthTest()
+	}
+	if !acquireBandwidthTest() {
+		t.Errorf("Test was refused after release")
+	}
+	releaseBandwidthTest()
+}
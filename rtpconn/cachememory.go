@@ -0,0 +1,40 @@
+package rtpconn
+
+import (
+	"github.com/jech/galene/packetcache"
+)
+
+// CacheMemory is the amount of memory, in megabytes, that packet caches
+// should use.  If it is exceeded, the caches of up tracks are shrunk,
+// which reduces the number of packets that can be retransmitted.  0
+// means no limit.
+var CacheMemory int
+
+// the size of the cache of an up track when there is no memory pressure
+const maxPacketCache = 1024
+
+// the size below which caches are never shrunk
+const minCacheCeiling = 16
+
+// cacheCeiling returns the largest number of packets that the cache of an
+// up track may hold, given the memory used by all caches and the budget,
+// both in bytes.  Caches grow freely up to 3/4 of the budget, above which
+// the ceiling decreases linearly until the budget is exhausted.
+func cacheCeiling(used, budget int64) int {
+	if budget <= 0 || used <= budget*3/4 {
+		return maxPacketCache
+	}
+	c := int64(maxPacketCache) * (budget - used) * 4 / budget
+	if c < minCacheCeiling {
+		return minCacheCeiling
+	}
+	return int(c)
+}
+
+// currentCacheCeiling returns the value of cacheCeiling for the current
+// memory usage.
+func currentCacheCeiling() int {
+	return cacheCeiling(
+		packetcache.Memory(), int64(CacheMemory)*1024*1024,
+	)
+}
@@ -0,0 +1,31 @@
+package rtpconn
+
+import (
+	"testing"
+)
+
+func TestCacheCeiling(t *testing.T) {
+	budget := int64(100 * 1024 * 1024)
+	tests := []struct {
+		used     int64
+		expected int
+	}{
+		{0, maxPacketCache},
+		{budget / 2, maxPacketCache},
+		{budget * 3 / 4, maxPacketCache},
+		{budget * 7 / 8, maxPacketCache / 2},
+		{budget, minCacheCeiling},
+		{budget * 2, minCacheCeiling},
+	}
+	for _, tt := range tests {
+		c := cacheCeiling(tt.used, budget)
+		if c != tt.expected {
+			t.Errorf("Expected %v, got %v", tt.expected, c)
+		}
+	}
+
+	// no budget means no limit
+	if c := cacheCeiling(budget*2, 0); c != maxPacketCache {
+		t.Errorf("Expected %v, got %v", maxPacketCache, c)
+	}
+}
@@ -0,0 +1,81 @@
+package rtpconn
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/stats"
+)
+
+// RedactAddresses, if true, causes the addresses of ICE candidates to be
+// omitted from the statistics, so that they don't reveal the location of
+// users.
+var RedactAddresses bool
+
+// candidatePairState tracks the ICE candidate pair selected for a peer
+// connection.  It is updated by the ICE agent and read concurrently.
+type candidatePairState struct {
+	pair atomic.Value
+}
+
+// watch arranges for s to follow the candidate pair selected for pc.
+func (s *candidatePairState) watch(pc *webrtc.PeerConnection) {
+	sctp := pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return
+	}
+	ice := sctp.Transport().ICETransport()
+	if ice == nil {
+		return
+	}
+	ice.OnSelectedCandidatePairChange(func(p *webrtc.ICECandidatePair) {
+		s.set(p)
+	})
+}
+
+func (s *candidatePairState) set(p *webrtc.ICECandidatePair) {
+	if p == nil || p.Local == nil || p.Remote == nil {
+		return
+	}
+	address := func(c *webrtc.ICECandidate) string {
+		return net.JoinHostPort(c.Address, strconv.Itoa(int(c.Port)))
+	}
+	s.pair.Store(&stats.CandidatePair{
+		Protocol:      p.Local.Protocol.String(),
+		LocalType:     p.Local.Typ.String(),
+		LocalAddress:  address(p.Local),
+		RemoteType:    p.Remote.Typ.String(),
+		RemoteAddress: address(p.Remote),
+	})
+}
+
+// get returns the selected candidate pair, or nil if none has been
+// selected yet.
+func (s *candidatePairState) get() *stats.CandidatePair {
+	p, ok := s.pair.Load().(*stats.CandidatePair)
+	if !ok {
+		return nil
+	}
+	if RedactAddresses {
+		q := *p
+		q.LocalAddress = ""
+		q.RemoteAddress = ""
+		return &q
+	}
+	return p
+}
+
+// CandidatePair returns the ICE candidate pair selected for the
+// connection, or nil if none has been selected yet.
+func (up *rtpUpConnection) CandidatePair() *stats.CandidatePair {
+	return up.candidatePair.get()
+}
+
+// CandidatePair returns the ICE candidate pair selected for the
+// connection, or nil if none has been selected yet.
+func (down *rtpDownConnection) CandidatePair() *stats.CandidatePair {
+	return down.candidatePair.get()
+}
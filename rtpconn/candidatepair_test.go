@@ -0,0 +1,52 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCandidatePair(t *testing.T) {
+	var s candidatePairState
+	if s.get() != nil {
+		t.Errorf("Expected nil, got %v", s.get())
+	}
+
+	s.set(&webrtc.ICECandidatePair{
+		Local: &webrtc.ICECandidate{
+			Address:  "192.0.2.1",
+			Port:     1234,
+			Protocol: webrtc.ICEProtocolUDP,
+			Typ:      webrtc.ICECandidateTypeHost,
+		},
+		Remote: &webrtc.ICECandidate{
+			Address:  "2001:db8::1",
+			Port:     3478,
+			Protocol: webrtc.ICEProtocolUDP,
+			Typ:      webrtc.ICECandidateTypeRelay,
+		},
+	})
+	p := s.get()
+	if p == nil {
+		t.Fatalf("Expected candidate pair, got nil")
+	}
+	if p.Protocol != "udp" || p.LocalType != "host" ||
+		p.LocalAddress != "192.0.2.1:1234" ||
+		p.RemoteType != "relay" ||
+		p.RemoteAddress != "[2001:db8::1]:3478" {
+		t.Errorf("Unexpected candidate pair %v", p)
+	}
+
+	RedactAddresses = true
+	defer func() {
+		RedactAddresses = false
+	}()
+	q := s.get()
+	if q.LocalAddress != "" || q.RemoteAddress != "" ||
+		q.RemoteType != "relay" {
+		t.Errorf("Addresses not redacted: %v", q)
+	}
+	if p.LocalAddress == "" {
+		t.Errorf("Redaction modified the stored pair")
+	}
+}
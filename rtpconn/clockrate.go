@@ -0,0 +1,48 @@
+package rtpconn
+
+// CorrectClockRate causes the clock rate observed on tracks whose
+// timestamps don't advance at the declared rate to be used for computing
+// jitter and for timing sender reports.  Mismatches are logged whether
+// or not this is set.
+var CorrectClockRate bool
+
+// checkClockRate is called by the reader loop for every received packet.
+func (up *rtpUpTrack) checkClockRate(timestamp uint32, now uint64) {
+	if !up.clock.Accumulate(timestamp, now) {
+		return
+	}
+	declared := up.track.Codec().ClockRate
+	observed := up.clock.Observed()
+	if observed == 0 {
+		Logger.Infof("Track %v: timestamps back to declared clock rate %v",
+			up.track.ID(), declared)
+		observed = declared
+	} else {
+		Logger.Infof("Track %v: declared clock rate %v, "+
+			"timestamps advance at %v",
+			up.track.ID(), declared, observed)
+	}
+	if CorrectClockRate {
+		up.jitter.SetHZ(observed)
+	}
+}
+
+// clockRate returns the rate at which the timestamps of the track are
+// assumed to advance.
+func (up *rtpUpTrack) clockRate() uint32 {
+	if CorrectClockRate {
+		if observed := up.clock.Observed(); observed != 0 {
+			return observed
+		}
+	}
+	return up.track.Codec().ClockRate
+}
+
+// clockRate returns the rate at which the timestamps of the track are
+// assumed to advance, which is that of the remote track.
+func (down *rtpDownTrack) clockRate() uint32 {
+	if remote, ok := down.remote.(*rtpUpTrack); ok && remote != nil {
+		return remote.clockRate()
+	}
+	return down.track.Codec().ClockRate
+}
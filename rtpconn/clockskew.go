@@ -0,0 +1,93 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// the weight of a new sample in the smoothed clock offset is
+	// 2^-clockOffsetShift
+	clockOffsetShift = 3
+	// a change in the offset larger than this is a step of the
+	// sender's clock rather than drift, and resets the estimate
+	clockOffsetStep = int64(2) << 32
+)
+
+// clockOffset estimates the offset between the local clock and the
+// clock of a sender, in NTP units, from the NTP times carried by its
+// sender reports.  Every sample includes the network delay, which
+// varies, so the estimate is smoothed, which also tracks the slow drift
+// between the two clocks.  Protected by the mutex of the up track.
+type clockOffset struct {
+	offset int64
+	valid  bool
+}
+
+// update records a sender report carrying remote that was received at
+// local time local.
+func (o *clockOffset) update(local, remote uint64) {
+	sample := int64(local - remote)
+	delta := sample - o.offset
+	if !o.valid || delta > clockOffsetStep || delta < -clockOffsetStep {
+		o.offset = sample
+		o.valid = true
+		return
+	}
+	o.offset += delta >> clockOffsetShift
+}
+
+// clockOffset returns the estimated offset between the local clock and
+// the sender's clock, in NTP units.
+func (up *rtpUpTrack) clockOffset() (int64, bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.offset.offset, up.offset.valid
+}
+
+// srTimestamp returns the RTP timestamp corresponding to the local time
+// now for a clock running at clockrate, computed from the last sender
+// report of the remote track.  The NTP time of the sender report is
+// converted to local time using the estimated clock offset, so that skew
+// between the sender's clock and ours doesn't cause the timestamps to
+// jump.  The result never goes backwards with respect to the last sender
+// report sent.
+func (down *rtpDownTrack) srTimestamp(now time.Time, clockrate uint32) (uint32, bool) {
+	remoteNTP, remoteRTP := down.getTimeOffset()
+	if remoteNTP == 0 {
+		return 0, false
+	}
+
+	if remote, ok := down.remote.(*rtpUpTrack); ok && remote != nil {
+		offset, valid := remote.clockOffset()
+		if valid {
+			remoteNTP = uint64(int64(remoteNTP) + offset)
+		}
+	}
+
+	d := now.Sub(rtptime.NTPToTime(remoteNTP))
+	if d <= -time.Hour || d >= time.Hour {
+		return 0, false
+	}
+	var ts uint32
+	if d >= 0 {
+		delay := rtptime.FromDuration(d, clockrate)
+		ts = remoteRTP + uint32(delay)
+	} else {
+		// the smoothed offset may put the sender report slightly
+		// in the future
+		delay := rtptime.FromDuration(-d, clockrate)
+		ts = remoteRTP - uint32(delay)
+	}
+	ts = down.translator.timestamp(ts)
+
+	_, srNTP := down.getSRTime()
+	last := atomic.LoadUint32(&down.atomics.srRTP)
+	if srNTP != 0 && int32(ts-last) < 0 {
+		ts = last
+	}
+	atomic.StoreUint32(&down.atomics.srRTP, ts)
+	return ts, true
+}
@@ -0,0 +1,78 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestClockOffset(t *testing.T) {
+	var o clockOffset
+	second := uint64(1) << 32
+	o.update(100*second, 90*second)
+	if !o.valid || o.offset != int64(10*second) {
+		t.Errorf("Expected %v, got %v %v", 10*second, o.valid, o.offset)
+	}
+
+	// a delayed report only moves the estimate a little
+	o.update(201*second, 190*second)
+	if o.offset != int64(10*second+second/8) {
+		t.Errorf("Expected %v, got %v", 10*second+second/8, o.offset)
+	}
+
+	// a step of the sender's clock resets the estimate
+	o.update(300*second, 250*second)
+	if o.offset != int64(50*second) {
+		t.Errorf("Expected %v, got %v", 50*second, o.offset)
+	}
+}
+
+func TestSRClockSkew(t *testing.T) {
+	for _, skew := range []time.Duration{
+		0, 5 * time.Second, -5 * time.Second, 10 * time.Minute,
+	} {
+		up := &rtpUpTrack{}
+		down := &rtpDownTrack{
+			remote:  up,
+			atomics: &downTrackAtomics{},
+		}
+
+		start := time.Now()
+		// the sender's clock is off by skew, and its reports take
+		// between 10 and 50ms to arrive
+		expected := func(tm time.Time) uint32 {
+			return uint32(rtptime.FromDuration(tm.Sub(start), 90000))
+		}
+		var last uint32
+		for i := 0; i < 30; i++ {
+			sent := start.Add(time.Duration(i) * time.Second)
+			delay := time.Duration(10+(i*17)%40) * time.Millisecond
+			received := sent.Add(delay)
+			remoteNTP := rtptime.TimeToNTP(sent.Add(skew))
+			up.mu.Lock()
+			up.offset.update(rtptime.TimeToNTP(received), remoteNTP)
+			up.mu.Unlock()
+			down.SetTimeOffset(remoteNTP, expected(sent))
+
+			now := received.Add(500 * time.Millisecond)
+			ts, ok := down.srTimestamp(now, 90000)
+			if !ok {
+				t.Fatalf("Skew %v: no timestamp", skew)
+			}
+			if i > 0 && int32(ts-last) < 0 {
+				t.Errorf("Skew %v: timestamp went backwards, "+
+					"%v after %v", skew, ts, last)
+			}
+			// within 50ms of the correct value
+			e := expected(now)
+			if int32(ts-e) > 4500 || int32(e-ts) > 4500 {
+				t.Errorf("Skew %v: expected %v, got %v",
+					skew, e, ts)
+			}
+			last = ts
+			down.setSRTime(rtptime.TimeToJiffies(now),
+				rtptime.TimeToNTP(now))
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package rtpconn
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/rtptime"
+)
+
+// rtcpRecorder is an rtcpWriter that records the packets written to it.
+type rtcpRecorder struct {
+	packets []rtcp.Packet
+}
+
+func (r *rtcpRecorder) WriteRTCP(pkts []rtcp.Packet) error {
+	r.packets = append(r.packets, pkts...)
+	return nil
+}
+
+// simLink simulates a bottleneck link between a down track that always
+// sends at its target rate and a receiver that sends a receiver report
+// every second.  The reports are processed by handleReport, as they would
+// be by the RTCP listener.
+type simLink struct {
+	capacity uint64  // bottleneck capacity, in bits per second
+	loss     float64 // random loss, independent of the rate
+	jitter   float64 // relative variation of the capacity
+	delay    int     // feedback delay, in intervals
+	initial  uint64  // initial rate, 0 for the default
+	maxRate  uint64  // the maximum rate configured for the label
+	rand     *rand.Rand
+}
+
+// run simulates the link for the given number of intervals, and returns
+// the sequence of target rates computed by the sender.
+func (l *simLink) run(intervals int) []uint64 {
+	track := &rtpDownTrack{
+		initialRate: l.initial,
+		maxRate:     l.maxRate,
+		maxBitrate:  new(bitrate),
+		rate:        estimator.New(time.Second / 2),
+		stats:       new(receiverStats),
+		atomics:     &downTrackAtomics{},
+	}
+	receiver := &rtcpRecorder{}
+	var inflight [][]rtcp.Packet
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	track.rate.Rates(now)
+	// the rate at which the sender sends, the initial rate until the
+	// first report has been processed
+	target := func() uint64 {
+		rate := track.maxBitrate.Get(now)
+		if rate != ^uint64(0) {
+			return rate
+		}
+		if l.initial > 0 {
+			return l.initial
+		}
+		return initLossRate
+	}
+	rates := make([]uint64, 0, intervals)
+
+	for i := 0; i < intervals; i++ {
+		rate := target()
+		track.rate.Accumulate(uint32(rate / 8))
+		now += rtptime.JiffiesPerSec
+
+		capacity := float64(l.capacity) *
+			(1 + l.jitter*(2*l.rand.Float64()-1))
+		lost := l.loss
+		if float64(rate) > capacity {
+			lost += (1 - lost) * (1 - capacity/float64(rate))
+		}
+		fraction := lost * 256
+		if fraction > 255 {
+			fraction = 255
+		}
+		receiver.WriteRTCP([]rtcp.Packet{
+			&rtcp.ReceiverReport{
+				Reports: []rtcp.ReceptionReport{{
+					SSRC:         1,
+					FractionLost: uint8(fraction),
+				}},
+			},
+		})
+		inflight = append(inflight, receiver.packets)
+		receiver.packets = nil
+
+		if len(inflight) > l.delay {
+			for _, p := range inflight[0] {
+				rr, ok := p.(*rtcp.ReceiverReport)
+				if !ok {
+					continue
+				}
+				for _, r := range rr.Reports {
+					handleReport(track, r, now)
+				}
+			}
+			inflight = inflight[1:]
+		}
+		rates = append(rates, target())
+	}
+	return rates
+}
+
+func TestCongestionConvergence(t *testing.T) {
+	link := &simLink{
+		capacity: 2000000,
+		loss:     0.005,
+		delay:    1,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+	rates := link.run(300)
+
+	var sum uint64
+	for _, r := range rates[200:] {
+		sum += r
+	}
+	avg := sum / 100
+	if avg < link.capacity*8/10 || avg > link.capacity*5/4 {
+		t.Errorf("Expected about %v, got %v", link.capacity, avg)
+	}
+}
+
+func TestCongestionOscillation(t *testing.T) {
+	link := &simLink{
+		capacity: 1000000,
+		loss:     0.01,
+		jitter:   0.1,
+		delay:    2,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+	rates := link.run(400)
+
+	min, max := ^uint64(0), uint64(0)
+	for _, r := range rates[200:] {
+		if r < min {
+			min = r
+		}
+		if r > max {
+			max = r
+		}
+	}
+	if min < link.capacity/2 {
+		t.Errorf("Rate collapsed to %v", min)
+	}
+	if max > 2*min {
+		t.Errorf("Rate oscillates between %v and %v", min, max)
+	}
+}
+
+func TestCongestionStartup(t *testing.T) {
+	link := &simLink{
+		capacity: 1000000,
+		loss:     0.005,
+		delay:    1,
+		initial:  8000000,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+	rates := link.run(100)
+
+	// heavy loss at least halves the rate at every report
+	if rates[5] > 2*link.capacity {
+		t.Errorf("Slow backoff, rate is still %v", rates[5])
+	}
+	for _, r := range rates[5:] {
+		if r < link.capacity/2 {
+			t.Errorf("Rate collapsed to %v", r)
+		}
+	}
+}
+
+func TestCongestionMaxRate(t *testing.T) {
+	link := &simLink{
+		capacity: 4000000,
+		loss:     0.005,
+		delay:    1,
+		maxRate:  1500000,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+	rates := link.run(100)
+	for i, r := range rates {
+		if r > link.maxRate {
+			t.Fatalf("%v: rate %v exceeds %v", i, r, link.maxRate)
+		}
+	}
+	if r := rates[len(rates)-1]; r < link.maxRate*9/10 {
+		t.Errorf("Expected about %v, got %v", link.maxRate, r)
+	}
+}
+
+func TestLossBasedRateKeyframes(t *testing.T) {
+	rate := uint64(1000000)
+
+	// a sender that uses 80% of its budget, plus a keyframe that
+	// brings it to the ceiling
+	r := lossBasedRate(rate, 0, 0, rate, rate*8/10, rate)
+	if r != rate {
+		t.Errorf("Expected %v, got %v", rate, r)
+	}
+
+	// a sender that is near the ceiling even without keyframes
+	r = lossBasedRate(rate, 0, 0, rate, rate*9/10, rate)
+	if r <= rate {
+		t.Errorf("Expected more than %v, got %v", rate, r)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	capacity := uint64(3000000)
+	loss := func(rate uint64) uint8 {
+		if rate <= capacity {
+			return 0
+		}
+		return uint8((rate - capacity) * 256 / rate)
+	}
+
+	// no recent feedback: the rate is reset, and held for one report
+	rate, slowStart := slowStartRate(0, 0, false, 0,
+		initLossRate, initLossRate, initLossRate)
+	if rate != initLossRate || !slowStart {
+		t.Errorf("Expected %v true, got %v %v",
+			initLossRate, rate, slowStart)
+	}
+
+	last := rate
+	steps := 0
+	for slowStart {
+		steps++
+		if steps > 40 {
+			t.Fatalf("Didn't leave slow start")
+		}
+		l := loss(rate)
+		rate, slowStart = slowStartRate(rate, 0, slowStart, l,
+			rate, rate, rate)
+		if rate > last*slowStartGrowth/256 {
+			t.Errorf("Growth is too fast: %v after %v", rate, last)
+		}
+		if l < 5 && !slowStart {
+			t.Errorf("Left slow start without a loss")
+		}
+		last = rate
+	}
+
+	// slow start ended at the first loss, and went back to a rate
+	// that doesn't cause loss
+	if loss(rate) >= 5 {
+		t.Errorf("Rate %v after slow start is still lossy", rate)
+	}
+	if rate < capacity*3/4 {
+		t.Errorf("Expected about %v, got %v", capacity, rate)
+	}
+	// it is faster than congestion avoidance alone
+	ca := uint64(initLossRate)
+	for i := 0; i < steps; i++ {
+		ca = lossBasedRate(ca, 0, loss(ca), ca, ca, ca)
+	}
+	if ca >= rate {
+		t.Errorf("Slow start is slower than congestion avoidance: "+
+			"%v < %v", rate, ca)
+	}
+}
@@ -0,0 +1,40 @@
+package rtpconn
+
+import (
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+)
+
+// the largest number of CSRCs that fit in an RTP header
+const maxCSRCs = 15
+
+// addCSRC returns true if the SSRC of senders should be added to the
+// contributing sources of the packets forwarded in group g.
+func addCSRC(g *group.Group) bool {
+	return g != nil && g.AddCSRC()
+}
+
+// contributingSource returns the SSRC that identifies the sender of t in
+// the CSRC lists of forwarded packets, or 0 if none.
+func contributingSource(t conn.UpTrack) uint32 {
+	up, ok := t.(*rtpUpTrack)
+	if !ok || up.track == nil {
+		return 0
+	}
+	return uint32(up.track.SSRC())
+}
+
+// withCSRC returns the list of contributing sources csrcs with ssrc
+// appended, unless it is already present or the list is full.  Since
+// packets are shared between down tracks, csrcs is never modified.
+func withCSRC(csrcs []uint32, ssrc uint32) []uint32 {
+	if ssrc == 0 || len(csrcs) >= maxCSRCs {
+		return csrcs
+	}
+	for _, c := range csrcs {
+		if c == ssrc {
+			return csrcs
+		}
+	}
+	return append(csrcs[:len(csrcs):len(csrcs)], ssrc)
+}
@@ -0,0 +1,109 @@
+package rtpconn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestWithCSRC(t *testing.T) {
+	csrcs := []uint32{1, 2}
+	tests := []struct {
+		csrcs    []uint32
+		ssrc     uint32
+		expected []uint32
+	}{
+		{nil, 0, nil},
+		{nil, 42, []uint32{42}},
+		{csrcs, 0, []uint32{1, 2}},
+		{csrcs, 42, []uint32{1, 2, 42}},
+		{csrcs, 2, []uint32{1, 2}},
+		{make([]uint32, maxCSRCs), 42, make([]uint32, maxCSRCs)},
+	}
+	for _, tt := range tests {
+		v := withCSRC(tt.csrcs, tt.ssrc)
+		if !reflect.DeepEqual(v, tt.expected) {
+			t.Errorf("Expected %v, got %v", tt.expected, v)
+		}
+	}
+
+	// the original slice must not be modified, even if it has room
+	shared := make([]uint32, 2, 4)
+	shared[0], shared[1] = 1, 2
+	a := withCSRC(shared, 42)
+	b := withCSRC(shared, 43)
+	if a[2] != 42 || b[2] != 43 {
+		t.Errorf("Expected 42 and 43, got %v and %v", a[2], b[2])
+	}
+	if len(shared) != 2 {
+		t.Errorf("Expected %v, got %v", 2, len(shared))
+	}
+}
+
+func TestCSRCForwarding(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	// the pacer allows observing the packets that are sent
+	p := newPacer()
+	newDown := func(csrc uint32) *rtpDownTrack {
+		return &rtpDownTrack{
+			track:   local,
+			rate:    estimator.New(time.Second),
+			atomics: &downTrackAtomics{},
+			pacer:   p,
+			csrc:    csrc,
+		}
+	}
+	preserving := newDown(0)
+	injecting := newDown(42)
+
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: 10,
+			Timestamp:      1000,
+			Marker:         true,
+			CSRC:           []uint32{1, 2},
+		},
+		Payload: []byte{1},
+	}
+	for _, down := range []*rtpDownTrack{preserving, injecting} {
+		err := down.WriteRTP(packet)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+
+	var sent []*rtp.Packet
+	for {
+		_, packet, _ := p.pop(rtptime.Jiffies(), 100000000)
+		if packet == nil {
+			break
+		}
+		sent = append(sent, packet)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", sent)
+	}
+	if !reflect.DeepEqual(sent[0].CSRC, []uint32{1, 2}) {
+		t.Errorf("Expected [1 2], got %v", sent[0].CSRC)
+	}
+	if !reflect.DeepEqual(sent[1].CSRC, []uint32{1, 2, 42}) {
+		t.Errorf("Expected [1 2 42], got %v", sent[1].CSRC)
+	}
+	if !reflect.DeepEqual(packet.CSRC, []uint32{1, 2}) {
+		t.Errorf("Expected shared packet to be unchanged, got %v",
+			packet.CSRC)
+	}
+}
@@ -0,0 +1,141 @@
+package rtpconn
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// A DebugTrack is a snapshot of the internal state of a track.  It is
+// more detailed than the statistics, and meant for troubleshooting.
+type DebugTrack struct {
+	SSRC  uint32
+	Kind  string
+	Codec string
+	// the estimated rate, in bytes and packets per second
+	Rate       uint32
+	PacketRate uint32
+	// the total number of packets and bytes, modulo 2^32
+	TotalPackets uint32
+	TotalBytes   uint32
+	// the capacity of the packet cache, and the number of packets
+	// that it holds
+	CacheCapacity int `json:",omitempty"`
+	CachePackets  int `json:",omitempty"`
+	// the jitter, in units of the clock rate, measured locally for
+	// up tracks and reported by the receiver for down tracks
+	Jitter    uint32
+	ClockRate uint32
+	// the bitrate allowed by congestion control, 0 if unknown
+	MaxBitrate uint64        `json:",omitempty"`
+	Rtt        time.Duration `json:",omitempty"`
+	// the time at which the last sender report was received or sent,
+	// and the NTP time that it carried
+	LastSR    *time.Time `json:",omitempty"`
+	LastSRNTP uint64     `json:",omitempty"`
+	// true if the timing of an up track is estimated because its
+	// sender doesn't send sender reports
+	EstimatedSR bool `json:",omitempty"`
+}
+
+type DebugConn struct {
+	Id     string
+	Label  string `json:",omitempty"`
+	Tracks []DebugTrack
+}
+
+type DebugClient struct {
+	Id       string
+	Up, Down []DebugConn
+}
+
+// DebugSnapshot returns a snapshot of the internal state of the tracks of
+// a client.  It returns false if c is not a client that sends or receives
+// media over WebRTC.  It is safe to call while media is flowing.
+func DebugSnapshot(c group.Client) (*DebugClient, bool) {
+	wc, ok := c.(*webClient)
+	if !ok {
+		return nil, false
+	}
+	return wc.debugSnapshot(time.Now()), true
+}
+
+func (c *webClient) debugSnapshot(wall time.Time) *DebugClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jiffies := rtptime.TimeToJiffies(wall)
+	dc := &DebugClient{Id: c.id}
+
+	for _, up := range c.up {
+		conn := DebugConn{Id: up.id, Label: up.label}
+		rtt := rtptime.ToDuration(up.xr.getRTT(), rtptime.JiffiesPerSec)
+		for _, t := range up.getTracks() {
+			rate, packetRate := t.rate.Estimate()
+			packets, bytes := t.rate.Totals()
+			capacity, count := t.cache.Occupancy()
+			srTime, srNTP, _ := t.SenderReport()
+			conn.Tracks = append(conn.Tracks, DebugTrack{
+				SSRC:          uint32(t.track.SSRC()),
+				Kind:          t.track.Kind().String(),
+				Codec:         t.track.Codec().MimeType,
+				Rate:          rate,
+				PacketRate:    packetRate,
+				TotalPackets:  packets,
+				TotalBytes:    bytes,
+				CacheCapacity: capacity,
+				CachePackets:  count,
+				Jitter:        t.jitter.Jitter(),
+				ClockRate:     t.jitter.HZ(),
+				Rtt:           rtt,
+				LastSR:        jiffiesToTime(srTime, jiffies, wall),
+				LastSRNTP:     srNTP,
+				EstimatedSR:   t.hasSyntheticSR(),
+			})
+		}
+		dc.Up = append(dc.Up, conn)
+	}
+	sort.Slice(dc.Up, func(i, j int) bool {
+		return dc.Up[i].Id < dc.Up[j].Id
+	})
+
+	for _, down := range c.down {
+		conn := DebugConn{Id: down.id}
+		for _, t := range down.getTracks() {
+			rate, packetRate := t.rate.Estimate()
+			packets, bytes := t.rate.Totals()
+			_, jitter := t.stats.Get(jiffies)
+			maxBitrate := t.maxBitrate.Get(jiffies)
+			if maxBitrate == ^uint64(0) {
+				maxBitrate = 0
+			}
+			srTime, srNTP := t.getSRTime()
+			dt := DebugTrack{
+				SSRC:         uint32(t.ssrc),
+				Kind:         t.track.Kind().String(),
+				Codec:        t.track.Codec().MimeType,
+				Rate:         rate,
+				PacketRate:   packetRate,
+				TotalPackets: packets,
+				TotalBytes:   bytes,
+				Jitter:       jitter,
+				ClockRate:    t.clockRate(),
+				MaxBitrate:   maxBitrate,
+				Rtt: rtptime.ToDuration(
+					t.getRTT(), rtptime.JiffiesPerSec,
+				),
+				LastSR:    jiffiesToTime(srTime, jiffies, wall),
+				LastSRNTP: srNTP,
+			}
+			conn.Tracks = append(conn.Tracks, dt)
+		}
+		dc.Down = append(dc.Down, conn)
+	}
+	sort.Slice(dc.Down, func(i, j int) bool {
+		return dc.Down[i].Id < dc.Down[j].Id
+	})
+
+	return dc
+}
@@ -0,0 +1,66 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestDebugSnapshot(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	track := &rtpDownTrack{
+		track:      local,
+		ssrc:       42,
+		maxBitrate: new(bitrate),
+		stats:      new(receiverStats),
+		rate:       estimator.New(time.Second),
+		atomics:    &downTrackAtomics{},
+	}
+	c := &webClient{
+		id: "client",
+		down: map[string]*rtpDownConnection{
+			"b": {id: "b"},
+			"a": {id: "a", tracks: []*rtpDownTrack{track}},
+		},
+	}
+
+	now := time.Now()
+	jiffies := rtptime.TimeToJiffies(now)
+	track.maxBitrate.Set(500000, jiffies)
+	track.setSRTime(jiffies-rtptime.JiffiesPerSec, 1234)
+
+	d, ok := DebugSnapshot(c)
+	if !ok {
+		t.Fatalf("DebugSnapshot failed")
+	}
+	if d.Id != "client" || len(d.Up) != 0 || len(d.Down) != 2 {
+		t.Fatalf("Unexpected snapshot %v", d)
+	}
+	if d.Down[0].Id != "a" || d.Down[1].Id != "b" {
+		t.Errorf("Expected a and b, got %v and %v",
+			d.Down[0].Id, d.Down[1].Id)
+	}
+	if len(d.Down[0].Tracks) != 1 {
+		t.Fatalf("Expected 1 track, got %v", len(d.Down[0].Tracks))
+	}
+	dt := d.Down[0].Tracks[0]
+	if dt.SSRC != 42 || dt.Kind != "video" || dt.ClockRate != 90000 {
+		t.Errorf("Unexpected track %v", dt)
+	}
+	if dt.MaxBitrate != 500000 {
+		t.Errorf("Expected %v, got %v", 500000, dt.MaxBitrate)
+	}
+	if dt.LastSR == nil || dt.LastSRNTP != 1234 {
+		t.Errorf("Unexpected sender report %v %v", dt.LastSR, dt.LastSRNTP)
+	}
+}
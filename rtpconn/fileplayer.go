@@ -0,0 +1,697 @@
+package rtpconn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/rtptime"
+)
+
+// File playback publishes the contents of a WebM file in a group, as if
+// it had been sent by a client, which is useful for hold music and
+// announcements.  The file is read into memory and packetised on the
+// fly; Opus audio and VP8 video are supported.  Files are taken from the
+// recordings directory of the group.
+
+const (
+	// the largest file that may be played
+	maxPlaybackFileSize = 64 * 1024 * 1024
+	// the label of the stream, the same as a file played by a client
+	playbackLabel = "video"
+	playbackMTU   = 1200
+	// the silence inserted between two iterations of a loop
+	playbackLoopGap = 20 * time.Millisecond
+)
+
+var ErrAlreadyPlaying = group.UserError("already playing a file")
+var ErrNotPlaying = group.UserError("not playing a file")
+var ErrBadPlaybackFile = group.UserError("bad file name")
+var errNoPlaybackTracks = errors.New("no playable tracks in file")
+
+// playbackFrame is a frame of a file.
+type playbackFrame struct {
+	// the index of the frame's track
+	track    int
+	time     time.Duration
+	keyframe bool
+	data     []byte
+}
+
+// loadWebM reads a WebM file, and returns the MIME types of its tracks
+// and its frames sorted by time.  Tracks in unsupported formats are
+// ignored.
+func loadWebM(r io.Reader) ([]string, []playbackFrame, error) {
+	var file struct {
+		Segment struct {
+			Info    webm.Info      `ebml:"Info"`
+			Tracks  webm.Tracks    `ebml:"Tracks"`
+			Cluster []webm.Cluster `ebml:"Cluster"`
+		} `ebml:"Segment"`
+	}
+	err := ebml.Unmarshal(r, &file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scale := int64(file.Segment.Info.TimecodeScale)
+	if scale == 0 {
+		scale = 1000000
+	}
+
+	var mimes []string
+	tracks := make(map[uint64]int)
+	for _, t := range file.Segment.Tracks.TrackEntry {
+		var mime string
+		switch t.CodecID {
+		case "A_OPUS":
+			mime = "audio/opus"
+		case "V_VP8":
+			mime = "video/VP8"
+		default:
+			continue
+		}
+		tracks[t.TrackNumber] = len(mimes)
+		mimes = append(mimes, mime)
+	}
+	if len(mimes) == 0 {
+		return nil, nil, errNoPlaybackTracks
+	}
+
+	var frames []playbackFrame
+	for _, c := range file.Segment.Cluster {
+		add := func(b ebml.Block) {
+			i, ok := tracks[b.TrackNumber]
+			if !ok {
+				return
+			}
+			tm := time.Duration(
+				(int64(c.Timecode) + int64(b.Timecode)) * scale,
+			)
+			for _, data := range b.Data {
+				if len(data) == 0 {
+					continue
+				}
+				frames = append(frames, playbackFrame{
+					track: i,
+					time:  tm,
+					// the flag is not reliable in block
+					// groups, look at the VP8 frame tag
+					keyframe: mimes[i] == "video/VP8" &&
+						data[0]&1 == 0,
+					data: data,
+				})
+			}
+		}
+		for _, b := range c.SimpleBlock {
+			add(b)
+		}
+		for _, bg := range c.BlockGroup {
+			add(bg.Block)
+		}
+	}
+	if len(frames) == 0 {
+		return nil, nil, errNoPlaybackTracks
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].time < frames[j].time
+	})
+	return mimes, frames, nil
+}
+
+// playbackCodec returns the codec of the group with the given MIME type.
+func playbackCodec(g *group.Group, mime string) (webrtc.RTPCodecCapability, bool) {
+	for _, c := range g.Codecs() {
+		if strings.EqualFold(c.MimeType, mime) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// playbackPath returns the path of the file called name in the recordings
+// directory of group g.
+func playbackPath(g *group.Group, name string) (string, error) {
+	if name == "" || filepath.Base(name) != name ||
+		strings.HasPrefix(name, ".") ||
+		!strings.HasSuffix(name, ".webm") {
+		return "", ErrBadPlaybackFile
+	}
+	return filepath.Join(diskwriter.Directory, g.Name(), name), nil
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// fileUp is the up connection of a file being played.
+type fileUp struct {
+	id       string
+	userId   string
+	username string
+	tracks   []*fileTrack
+	frames   []playbackFrame
+	loop     bool
+	// closed when playback must stop
+	done chan struct{}
+	// set to 1 when a keyframe is requested, accessed atomically
+	keyframe int32
+
+	mu    sync.Mutex
+	local []conn.Down
+}
+
+func (up *fileUp) AddLocal(local conn.Down) error {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	for _, l := range up.local {
+		if l == local {
+			return nil
+		}
+	}
+	up.local = append(up.local, local)
+	return nil
+}
+
+func (up *fileUp) DelLocal(local conn.Down) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	for i, l := range up.local {
+		if l == local {
+			up.local = append(up.local[:i], up.local[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (up *fileUp) Id() string {
+	return up.id
+}
+
+func (up *fileUp) Label() string {
+	return playbackLabel
+}
+
+func (up *fileUp) User() (string, string) {
+	return up.userId, up.username
+}
+
+// RequestKeyframe causes playback to go back to the last keyframe.
+func (up *fileUp) RequestKeyframe(force bool) bool {
+	atomic.StoreInt32(&up.keyframe, 1)
+	return true
+}
+
+// SetMuted mutes or unmutes all tracks of the given kind.  When video is
+// unmuted, playback goes back to the last keyframe.
+func (up *fileUp) SetMuted(kind webrtc.RTPCodecType, muted bool) {
+	var v uint32
+	if muted {
+		v = 1
+	}
+	found := false
+	for _, t := range up.tracks {
+		if t.kind == kind {
+			atomic.StoreUint32(&t.muted, v)
+			found = true
+		}
+	}
+	if found && !muted && kind == webrtc.RTPCodecTypeVideo {
+		up.RequestKeyframe(true)
+	}
+}
+
+func (up *fileUp) getTracks() []conn.UpTrack {
+	tracks := make([]conn.UpTrack, len(up.tracks))
+	for i, t := range up.tracks {
+		tracks[i] = t
+	}
+	return tracks
+}
+
+// lastKeyframe returns the index of the last video keyframe before the
+// i-th frame, or -1 if there is none.
+func (up *fileUp) lastKeyframe(i int) int {
+	for k := i - 1; k >= 0; k-- {
+		if up.frames[k].keyframe {
+			return k
+		}
+	}
+	return -1
+}
+
+// fileTrack is a track of a file being played.
+type fileTrack struct {
+	up    *fileUp
+	codec webrtc.RTPCodecCapability
+	kind  webrtc.RTPCodecType
+	cache *packetcache.Cache
+	ssrc  uint32
+	// the RTP timestamp at the start of playback
+	base  uint32
+	start time.Time
+
+	// only accessed by the playback loop
+	seqno uint16
+	// set to 1 when muted by an operator, accessed atomically
+	muted uint32
+
+	mu    sync.Mutex
+	local []conn.DownTrack
+}
+
+func (t *fileTrack) AddLocal(local conn.DownTrack) error {
+	t.mu.Lock()
+	for _, l := range t.local {
+		if l == local {
+			t.mu.Unlock()
+			return nil
+		}
+	}
+	t.local = append(t.local, local)
+	t.mu.Unlock()
+
+	local.SetTimeOffset(rtptime.TimeToNTP(t.start), t.base)
+	local.SetCname(t.up.id)
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		t.up.RequestKeyframe(true)
+	}
+	return nil
+}
+
+func (t *fileTrack) DelLocal(local conn.DownTrack) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, l := range t.local {
+		if l == local {
+			t.local = append(t.local[:i], t.local[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fileTrack) getLocal() []conn.DownTrack {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	local := make([]conn.DownTrack, len(t.local))
+	copy(local, t.local)
+	return local
+}
+
+func (t *fileTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *fileTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *fileTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	return t.cache.Get(seqno, result)
+}
+
+func (t *fileTrack) Nack(conn conn.Up, seqnos []uint16) error {
+	// everything we sent is in the cache
+	return nil
+}
+
+// writeFrame packetises a frame and writes it to all local tracks.
+func (t *fileTrack) writeFrame(f *playbackFrame, ts uint32) {
+	if atomic.LoadUint32(&t.muted) != 0 {
+		return
+	}
+
+	var payloads [][]byte
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		var vp8 codecs.VP8Payloader
+		payloads = vp8.Payload(playbackMTU, f.data)
+	} else {
+		payloads = [][]byte{f.data}
+	}
+
+	local := t.getLocal()
+	for i, payload := range payloads {
+		last := i == len(payloads)-1
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         last && t.kind == webrtc.RTPCodecTypeVideo,
+				SequenceNumber: t.seqno,
+				Timestamp:      ts,
+				SSRC:           t.ssrc,
+			},
+			Payload: payload,
+		}
+		t.seqno++
+		buf, err := packet.Marshal()
+		if err != nil {
+			continue
+		}
+		t.cache.Store(
+			packet.SequenceNumber, ts,
+			f.keyframe && i == 0, packet.Marker, buf,
+		)
+		for _, l := range local {
+			err := l.WriteRTP(&packet)
+			if err != nil {
+				if err == conn.ErrKeyframeNeeded {
+					t.up.RequestKeyframe(false)
+				}
+				continue
+			}
+			accumulate(l, uint32(len(buf)), f.keyframe)
+		}
+	}
+}
+
+// playbackLoop plays the frames of up in real time.  It returns when the
+// file has been played, or when up.done is closed.
+func playbackLoop(up *fileUp, start time.Time) {
+	first := up.frames[0].time
+	// the time at which the first frame is played, relative to start,
+	// minus the time of the current frame in the file
+	var shift time.Duration
+	// the last keyframe we went back to, so that each group of
+	// pictures is only replayed once
+	rewound := -1
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	i := 0
+	for {
+		if i >= len(up.frames) {
+			if !up.loop {
+				return
+			}
+			shift += up.frames[len(up.frames)-1].time - first +
+				playbackLoopGap
+			i = 0
+			rewound = -1
+		}
+
+		if atomic.SwapInt32(&up.keyframe, 0) != 0 {
+			k := up.lastKeyframe(i)
+			if k >= 0 && k != rewound {
+				shift += up.frames[i].time - up.frames[k].time
+				i = k
+				rewound = k
+			}
+		}
+
+		f := &up.frames[i]
+		offset := shift + f.time - first
+		wait := time.Until(start.Add(offset))
+		if wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-up.done:
+				return
+			}
+		} else {
+			select {
+			case <-up.done:
+				return
+			default:
+			}
+		}
+
+		t := up.tracks[f.track]
+		ts := t.base + uint32(rtptime.FromDuration(offset, t.codec.ClockRate))
+		t.writeFrame(f, ts)
+		i++
+	}
+}
+
+// A fileClient is a client that publishes the contents of a file.  It
+// does not receive any media.
+type fileClient struct {
+	group *group.Group
+	id    string
+	up    *fileUp
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fileClient) Group() *group.Group {
+	return c.group
+}
+
+func (c *fileClient) Id() string {
+	return c.id
+}
+
+func (c *fileClient) Username() string {
+	return c.up.username
+}
+
+func (c *fileClient) Challenge(group string, creds group.ClientCredentials) bool {
+	return true
+}
+
+func (c *fileClient) OverridePermissions(g *group.Group) bool {
+	return true
+}
+
+func (c *fileClient) SetPermissions(perms group.ClientPermissions) {
+}
+
+func (c *fileClient) Permissions() group.ClientPermissions {
+	return group.ClientPermissions{}
+}
+
+func (c *fileClient) Status() map[string]interface{} {
+	return nil
+}
+
+func (c *fileClient) PushClient(id, username string, permissions group.ClientPermissions, status map[string]interface{}, kind string) error {
+	return nil
+}
+
+func (c *fileClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	return nil
+}
+
+// pushConns pushes the up connection of c to client cc.
+func (c *fileClient) upConns() []conn.Up {
+	return []conn.Up{c.up}
+}
+
+func (c *fileClient) pushConns(g *group.Group, cc group.Client) {
+	if g != c.group {
+		return
+	}
+	err := cc.PushConn(g, c.up.id, c.up, c.up.getTracks(), "")
+	if err != nil {
+		Logger.Warnf("PushConn: %v", err)
+	}
+}
+
+// stop stops playback, and tells the other clients that the stream is
+// gone.  It returns false if playback was already stopped, in which case
+// the caller must not remove the client from the group.
+func (c *fileClient) stop() bool {
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return false
+	}
+
+	close(c.up.done)
+	g := c.group
+	for _, cc := range g.GetClients(c) {
+		err := cc.PushConn(g, c.up.id, nil, nil, "")
+		if err != nil {
+			Logger.Warnf("PushConn: %v", err)
+		}
+	}
+	g.NotifyPublisher(group.PublisherEvent{Client: c.id, Id: c.up.id})
+	return true
+}
+
+func (c *fileClient) Kick(id, user, message string) error {
+	if c.stop() {
+		group.DelClient(c)
+	}
+	return nil
+}
+
+// playbackMu makes checking that a group is not playing a file and
+// adding the new fileClient atomic.
+var playbackMu sync.Mutex
+
+// playing returns true if group g is playing a file.
+func playing(g *group.Group) bool {
+	for _, cc := range g.GetClients(nil) {
+		if _, ok := cc.(*fileClient); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// StartPlayback plays the file called name from the recordings directory
+// of group g.  If loop is true, the file is played until StopPlayback is
+// called; otherwise, playback stops at the end of the file.
+func StartPlayback(g *group.Group, name string, loop bool) error {
+	if playing(g) {
+		return ErrAlreadyPlaying
+	}
+
+	path, err := playbackPath(g, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return group.UserError("file not found")
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > maxPlaybackFileSize {
+		return group.UserError("file is too large")
+	}
+
+	mimes, frames, err := loadWebM(f)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	c := &fileClient{group: g, id: randomId()}
+	up := &fileUp{
+		id:       randomId(),
+		userId:   c.id,
+		username: name,
+		loop:     loop,
+		done:     make(chan struct{}),
+	}
+	c.up = up
+
+	// drop the frames of tracks that the group cannot carry
+	index := make([]int, len(mimes))
+	for i, mime := range mimes {
+		codec, ok := playbackCodec(g, mime)
+		if !ok {
+			index[i] = -1
+			continue
+		}
+		index[i] = len(up.tracks)
+		up.tracks = append(up.tracks, &fileTrack{
+			up:    up,
+			codec: codec,
+			kind:  webrtc.NewRTPCodecType(strings.SplitN(mime, "/", 2)[0]),
+			cache: packetcache.New(128),
+			ssrc:  randomUint32(),
+			base:  randomUint32(),
+			start: start,
+			seqno: uint16(randomUint32()),
+		})
+	}
+	for _, fr := range frames {
+		if index[fr.track] >= 0 {
+			fr.track = index[fr.track]
+			up.frames = append(up.frames, fr)
+		}
+	}
+	closeCaches := func() {
+		for _, t := range up.tracks {
+			t.cache.Close()
+		}
+	}
+	if len(up.frames) == 0 {
+		closeCaches()
+		return group.UserError("the group's codecs cannot carry this file")
+	}
+
+	// check again, another playback might have been started while we
+	// were loading the file
+	playbackMu.Lock()
+	if playing(g) {
+		playbackMu.Unlock()
+		closeCaches()
+		return ErrAlreadyPlaying
+	}
+	_, err = group.AddClient(g.Name(), c)
+	playbackMu.Unlock()
+	if err != nil {
+		closeCaches()
+		return err
+	}
+	for _, cc := range g.GetClients(c) {
+		c.pushConns(g, cc)
+	}
+	tracks := make([]conn.UpTrack, len(up.tracks))
+	for i, t := range up.tracks {
+		tracks[i] = t
+	}
+	g.NotifyPublisher(group.PublisherEvent{
+		Client: c.id, Id: up.id, Up: up, Tracks: tracks,
+	})
+
+	spawn(func() {
+		playbackLoop(up, start)
+		closeCaches()
+		if c.stop() {
+			group.DelClient(c)
+		}
+	})
+	return nil
+}
+
+// StopPlayback stops playing files in group g.
+func StopPlayback(g *group.Group) error {
+	found := false
+	for _, cc := range g.GetClients(nil) {
+		c, ok := cc.(*fileClient)
+		if ok {
+			if c.stop() {
+				group.DelClient(c)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotPlaying
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package rtpconn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+// newTestWebM returns a short WebM file with an audio and a video track.
+func newTestWebM(t *testing.T) *bufferCloser {
+	var buf bufferCloser
+	ws, err := webm.NewSimpleBlockWriter(&buf, []webm.TrackEntry{
+		{
+			Name:        "Audio",
+			TrackNumber: 1,
+			TrackUID:    1,
+			CodecID:     "A_OPUS",
+			TrackType:   2,
+			Audio: &webm.Audio{
+				SamplingFrequency: 48000,
+				Channels:          2,
+			},
+		},
+		{
+			Name:        "Video",
+			TrackNumber: 2,
+			TrackUID:    2,
+			CodecID:     "V_VP8",
+			TrackType:   1,
+			Video: &webm.Video{
+				PixelWidth:  320,
+				PixelHeight: 240,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSimpleBlockWriter: %v", err)
+	}
+	ws[0].Write(true, 0, []byte{1})
+	ws[1].Write(true, 0, []byte{0x10, 0})
+	ws[0].Write(true, 20, []byte{2})
+	ws[1].Write(false, 33, []byte{0x11, 0})
+	ws[0].Write(true, 40, []byte{3})
+	for _, w := range ws {
+		w.Close()
+	}
+	return &buf
+}
+
+func TestLoadWebM(t *testing.T) {
+	mimes, frames, err := loadWebM(newTestWebM(t))
+	if err != nil {
+		t.Fatalf("loadWebM: %v", err)
+	}
+	if len(mimes) != 2 || mimes[0] != "audio/opus" || mimes[1] != "video/VP8" {
+		t.Errorf("Unexpected tracks %v", mimes)
+	}
+	expected := []playbackFrame{
+		{0, 0, false, nil},
+		{1, 0, true, nil},
+		{0, 20 * time.Millisecond, false, nil},
+		{1, 33 * time.Millisecond, false, nil},
+		{0, 40 * time.Millisecond, false, nil},
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("Expected %v frames, got %v", len(expected), len(frames))
+	}
+	for i, f := range frames {
+		e := expected[i]
+		if f.track != e.track || f.time != e.time ||
+			f.keyframe != e.keyframe {
+			t.Errorf("Frame %v: expected %v %v %v, got %v %v %v",
+				i, e.track, e.time, e.keyframe,
+				f.track, f.time, f.keyframe)
+		}
+	}
+
+	_, _, err = loadWebM(bytes.NewReader([]byte("garbage")))
+	if err == nil {
+		t.Errorf("Expected an error for garbage")
+	}
+}
+
+func TestPlaybackPath(t *testing.T) {
+	g := &group.Group{}
+	for _, name := range []string{
+		"", "music.ogg", "../music.webm", "dir/music.webm", ".webm",
+	} {
+		_, err := playbackPath(g, name)
+		if err != ErrBadPlaybackFile {
+			t.Errorf("%v: expected %v, got %v",
+				name, ErrBadPlaybackFile, err)
+		}
+	}
+	_, err := playbackPath(g, "music.webm")
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// playbackRecorder is a down track that records the packets written to
+// it, and asks for a keyframe once after a given number of packets.
+type playbackRecorder struct {
+	packets  []rtp.Packet
+	keyframe int
+}
+
+func (r *playbackRecorder) WriteRTP(p *rtp.Packet) error {
+	r.packets = append(r.packets, *p)
+	if len(r.packets) == r.keyframe {
+		return conn.ErrKeyframeNeeded
+	}
+	return nil
+}
+
+func (r *playbackRecorder) Accumulate(bytes uint32) {}
+
+func (r *playbackRecorder) SetTimeOffset(ntp uint64, rtp uint32) {}
+
+func (r *playbackRecorder) SetCname(string) {}
+
+func newTestFileUp(loop bool) *fileUp {
+	up := &fileUp{
+		loop: loop,
+		done: make(chan struct{}),
+	}
+	codecs := []webrtc.RTPCodecCapability{
+		{MimeType: "audio/opus", ClockRate: 48000},
+		{MimeType: "video/VP8", ClockRate: 90000},
+	}
+	kinds := []webrtc.RTPCodecType{
+		webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo,
+	}
+	for i := range codecs {
+		up.tracks = append(up.tracks, &fileTrack{
+			up:    up,
+			codec: codecs[i],
+			kind:  kinds[i],
+			cache: packetcache.New(32),
+			base:  1000,
+		})
+	}
+	ms := time.Millisecond
+	up.frames = []playbackFrame{
+		{1, 0, true, []byte{0x10}},
+		{0, 0, false, []byte{1}},
+		{1, 10 * ms, false, []byte{0x11}},
+		{0, 20 * ms, false, []byte{2}},
+		{1, 20 * ms, false, []byte{0x11}},
+	}
+	return up
+}
+
+func TestPlaybackLoop(t *testing.T) {
+	up := newTestFileUp(false)
+	audio := &playbackRecorder{}
+	video := &playbackRecorder{}
+	up.tracks[0].local = []conn.DownTrack{audio}
+	up.tracks[1].local = []conn.DownTrack{video}
+
+	playbackLoop(up, time.Now().Add(-time.Hour))
+
+	if len(audio.packets) != 2 || len(video.packets) != 3 {
+		t.Fatalf("Expected 2 and 3 packets, got %v and %v",
+			len(audio.packets), len(video.packets))
+	}
+	for i, ts := range []uint32{1000, 1000 + 960} {
+		if audio.packets[i].Timestamp != ts {
+			t.Errorf("Expected %v, got %v",
+				ts, audio.packets[i].Timestamp)
+		}
+	}
+	for i, ts := range []uint32{1000, 1000 + 900, 1000 + 1800} {
+		if video.packets[i].Timestamp != ts {
+			t.Errorf("Expected %v, got %v",
+				ts, video.packets[i].Timestamp)
+		}
+		if !video.packets[i].Marker {
+			t.Errorf("Expected marker")
+		}
+	}
+	if video.packets[1].SequenceNumber != video.packets[0].SequenceNumber+1 {
+		t.Errorf("Non-consecutive seqnos")
+	}
+}
+
+func TestPlaybackRewind(t *testing.T) {
+	up := newTestFileUp(false)
+	audio := &playbackRecorder{}
+	// ask for a keyframe after the second video frame
+	video := &playbackRecorder{keyframe: 2}
+	up.tracks[0].local = []conn.DownTrack{audio}
+	up.tracks[1].local = []conn.DownTrack{video}
+
+	playbackLoop(up, time.Now().Add(-time.Hour))
+
+	// the first two video frames are played again, with fresh
+	// timestamps
+	expected := []uint32{1000, 1900, 2800, 3700, 4600}
+	if len(video.packets) != len(expected) {
+		t.Fatalf("Expected %v packets, got %v",
+			len(expected), len(video.packets))
+	}
+	for i, ts := range expected {
+		if video.packets[i].Timestamp != ts {
+			t.Errorf("Expected %v, got %v",
+				ts, video.packets[i].Timestamp)
+		}
+	}
+	if video.packets[2].Payload[1] != 0x10 {
+		t.Errorf("Expected a keyframe, got %v", video.packets[2].Payload)
+	}
+}
+
+func TestPlaybackStop(t *testing.T) {
+	up := newTestFileUp(true)
+	done := make(chan struct{})
+	go func() {
+		playbackLoop(up, time.Now())
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(up.done)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Playback didn't stop")
+	}
+}
+
+func TestRequestKeyframes(t *testing.T) {
+	newTrack := func(mimeType string) *rtpDownTrack {
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{MimeType: mimeType},
+			"track", "stream",
+		)
+		if err != nil {
+			t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+		}
+		return &rtpDownTrack{
+			track:   local,
+			atomics: &downTrackAtomics{},
+		}
+	}
+	up := newTestFileUp(false)
+	audio := newTrack("audio/opus")
+	video := newTrack("video/VP8")
+	down := &rtpDownConnection{
+		remote: up,
+		tracks: []*rtpDownTrack{audio, video},
+	}
+
+	video.setPaused(true)
+	down.requestKeyframes()
+	if atomic.LoadInt32(&up.keyframe) != 0 {
+		t.Errorf("Keyframe requested for a paused track")
+	}
+
+	video.setPaused(false)
+	down.requestKeyframes()
+	if atomic.LoadInt32(&up.keyframe) == 0 {
+		t.Errorf("Keyframe not requested")
+	}
+}
+
+func TestConcurrentStartPlayback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { diskwriter.Directory = d }(diskwriter.Directory)
+	diskwriter.Directory = dir
+	defer func(d string) { group.Directory = d }(group.Directory)
+	group.Directory = dir
+	err = ioutil.WriteFile(filepath.Join(dir, "playback-test.json"),
+		[]byte("{}"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	g, err := group.Add("playback-test", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, g.Name()), 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, g.Name(), "test.webm"),
+		newTestWebM(t).Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const n = 8
+	start := make(chan struct{})
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			<-start
+			errs <- StartPlayback(g, "test.webm", true)
+		}()
+	}
+	close(start)
+	started := 0
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if err == nil {
+			started++
+		} else if err != ErrAlreadyPlaying {
+			t.Errorf("StartPlayback: %v", err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("Expected 1 playback, got %v", started)
+	}
+
+	err = StopPlayback(g)
+	if err != nil {
+		t.Errorf("StopPlayback: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package rtpconn
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// KeepaliveInterval is the time after which a connection that carries no
+// media is sent a small RTCP packet, in order to prevent NAT bindings
+// from expiring, for example during a long silence with all microphones
+// muted.  If 0, no keepalives are sent.
+var KeepaliveInterval time.Duration
+
+// keepaliveState tracks the activity of a connection.  It is only
+// accessed by the connection's RTCP sender, and therefore not protected.
+type keepaliveState struct {
+	lastActive    uint64
+	lastKeepalive uint64
+}
+
+// update records whether media flowed recently, and returns true if a
+// keepalive should be sent now.
+func (k *keepaliveState) update(active bool, interval time.Duration, now uint64) bool {
+	if active || k.lastActive == 0 {
+		k.lastActive = now
+	}
+	if interval <= 0 || active {
+		return false
+	}
+	i := rtptime.FromDuration(interval, rtptime.JiffiesPerSec)
+	last := k.lastActive
+	if k.lastKeepalive > last {
+		last = k.lastKeepalive
+	}
+	if now-last < i {
+		return false
+	}
+	k.lastKeepalive = now
+	return true
+}
+
+// keepalivePacket is the packet sent on idle connections: an empty
+// receiver report, which is valid in both directions.
+func keepalivePacket(ssrc uint32) []rtcp.Packet {
+	return []rtcp.Packet{&rtcp.ReceiverReport{SSRC: ssrc}}
+}
+
+// downKeepalive sends a keepalive on a down connection if no media was
+// sent recently.
+func downKeepalive(conn *rtpDownConnection, now uint64) error {
+	tracks := conn.getTracks()
+	active := false
+	for _, t := range tracks {
+		r, _ := t.rate.Estimate()
+		if r > 0 {
+			active = true
+			break
+		}
+	}
+	if !conn.keepalive.update(active, KeepaliveInterval, now) {
+		return nil
+	}
+	var ssrc uint32
+	if len(tracks) > 0 {
+		ssrc = uint32(tracks[0].ssrc)
+	}
+	return conn.rtcpOut.WriteRTCP(keepalivePacket(ssrc))
+}
+
+// upKeepalive sends a keepalive on an up connection if no media was
+// received recently.
+func upKeepalive(conn *rtpUpConnection, now uint64) error {
+	active := false
+	for _, t := range conn.getTracks() {
+		r, _ := t.rate.Estimate()
+		if r > 0 {
+			active = true
+			break
+		}
+	}
+	if !conn.keepalive.update(active, KeepaliveInterval, now) {
+		return nil
+	}
+	return conn.rtcpOut.WriteRTCP(keepalivePacket(0))
+}
@@ -0,0 +1,49 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestKeepalive(t *testing.T) {
+	var k keepaliveState
+	sec := uint64(rtptime.JiffiesPerSec)
+	now := 1000 * sec
+	interval := 10 * time.Second
+
+	if k.update(false, interval, now) {
+		t.Errorf("Keepalive sent at start")
+	}
+	if k.update(false, interval, now+5*sec) {
+		t.Errorf("Keepalive sent too early")
+	}
+	if !k.update(false, interval, now+10*sec) {
+		t.Errorf("Keepalive not sent after interval")
+	}
+	if k.update(false, interval, now+15*sec) {
+		t.Errorf("Keepalive sent twice in an interval")
+	}
+	if !k.update(false, interval, now+20*sec) {
+		t.Errorf("Keepalive not sent after second interval")
+	}
+
+	if k.update(true, interval, now+21*sec) {
+		t.Errorf("Keepalive sent while active")
+	}
+	if k.update(false, interval, now+30*sec) {
+		t.Errorf("Keepalive sent too soon after activity")
+	}
+	if !k.update(false, interval, now+31*sec) {
+		t.Errorf("Keepalive not sent after activity stopped")
+	}
+
+	var d keepaliveState
+	for i := uint64(0); i < 100; i++ {
+		if d.update(false, 0, now+i*sec) {
+			t.Errorf("Keepalive sent while disabled")
+			break
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package rtpconn
+
+import (
+	"github.com/jech/galene/logger"
+)
+
+// Logger is used for the messages of this package.  It may be replaced,
+// for example in order to log at a different level than the rest of the
+// server.
+var Logger = logger.Default
@@ -0,0 +1,113 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/jech/galene/logger"
+	"github.com/jech/galene/rtptime"
+)
+
+// One-way media is media that we receive from a sender but that doesn't
+// reach a receiver, the cause of the common complaint "I can hear them
+// but they can't hear me".  We detect it for every down track by
+// checking that media received from the sender is actually forwarded,
+// and that the receiver acknowledges it in its receiver reports; since
+// a receiver only sends reports for the streams that it receives, the
+// absence of reports means that nothing is getting through.
+
+const (
+	// how long the receiver may go without sending reports
+	oneWayReportTimeout = 5 * rtptime.JiffiesPerSec
+	// how long the condition must persist before it is reported
+	oneWayDelay = 10 * rtptime.JiffiesPerSec
+)
+
+// oneWayState is only accessed by rtcpDownSender, and therefore not
+// protected.
+type oneWayState struct {
+	since   uint64
+	flagged bool
+}
+
+// oneWaySample returns true if a track looks like it is not reaching its
+// receiver.  Suppressed is true if the track is intentionally not being
+// forwarded, lastReport is the time of the last receiver report, or 0 if
+// none was received.
+func oneWaySample(upRate, downRate uint32, suppressed bool, lastReport, now uint64) bool {
+	if upRate == 0 || suppressed {
+		return false
+	}
+	if downRate == 0 {
+		return true
+	}
+	return lastReport == 0 || now < lastReport ||
+		now-lastReport > oneWayReportTimeout
+}
+
+// update feeds a sample to the state.  It returns the new value of the
+// flag, and true if it just changed.
+func (s *oneWayState) update(bad bool, now uint64) (bool, bool) {
+	if !bad {
+		s.since = 0
+		if s.flagged {
+			s.flagged = false
+			return false, true
+		}
+		return false, false
+	}
+	if s.since == 0 {
+		s.since = now
+	}
+	if !s.flagged && now-s.since >= oneWayDelay {
+		s.flagged = true
+		return true, true
+	}
+	return s.flagged, false
+}
+
+// suppressed returns true if the track is intentionally not forwarded.
+func (down *rtpDownTrack) suppressed(remote *rtpUpTrack) bool {
+	return down.getPaused() || down.getWaitingKeyframe() ||
+		remote.getMuted() || remote.selector != nil ||
+		remote.gotGoodbye() ||
+		atomic.LoadUint32(&remote.atomics.oversize) != 0
+}
+
+// checkOneWay checks the tracks of a down connection for one-way media,
+// and logs any change.
+func (down *rtpDownConnection) checkOneWay(now uint64) {
+	for _, t := range down.getTracks() {
+		remote, ok := t.remote.(*rtpUpTrack)
+		if !ok {
+			continue
+		}
+		upRate, _ := remote.rate.Estimate()
+		downRate, _ := t.rate.Estimate()
+		bad := oneWaySample(
+			upRate, downRate, t.suppressed(remote),
+			atomic.LoadUint64(&t.stats.jiffies), now,
+		)
+		flagged, changed := t.oneWay.update(bad, now)
+		if !changed {
+			continue
+		}
+		var v uint32
+		if flagged {
+			v = 1
+			Logger.Log(logger.LevelWarn,
+				"media is not reaching the receiver",
+				"conn", down.id, "track", t.track.ID())
+		} else {
+			Logger.Log(logger.LevelInfo,
+				"media is reaching the receiver again",
+				"conn", down.id, "track", t.track.ID())
+		}
+		atomic.StoreUint32(&t.atomics.oneWay, v)
+	}
+}
+
+// getOneWay returns true if media on the track doesn't reach the
+// receiver.
+func (down *rtpDownTrack) getOneWay() bool {
+	return atomic.LoadUint32(&down.atomics.oneWay) != 0
+}
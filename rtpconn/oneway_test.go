@@ -0,0 +1,68 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestOneWaySample(t *testing.T) {
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	recent := now - rtptime.JiffiesPerSec
+	old := now - 10*rtptime.JiffiesPerSec
+	a := []struct {
+		up, down   uint32
+		suppressed bool
+		lastReport uint64
+		bad        bool
+	}{
+		{0, 0, false, 0, false},
+		{1000, 1000, false, recent, false},
+		{1000, 0, false, recent, true},
+		{1000, 0, true, recent, false},
+		{1000, 1000, false, old, true},
+		{1000, 1000, false, 0, true},
+		{0, 1000, false, 0, false},
+	}
+	for _, s := range a {
+		bad := oneWaySample(s.up, s.down, s.suppressed, s.lastReport, now)
+		if bad != s.bad {
+			t.Errorf("%v %v %v %v: expected %v, got %v",
+				s.up, s.down, s.suppressed, s.lastReport,
+				s.bad, bad)
+		}
+	}
+}
+
+func TestOneWayState(t *testing.T) {
+	var s oneWayState
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	sec := uint64(rtptime.JiffiesPerSec)
+
+	for i := uint64(0); i < 10; i++ {
+		flagged, changed := s.update(true, now+i*sec)
+		if flagged || changed {
+			t.Fatalf("Flagged too early at %vs", i)
+		}
+	}
+	flagged, changed := s.update(true, now+10*sec)
+	if !flagged || !changed {
+		t.Errorf("Expected true true, got %v %v", flagged, changed)
+	}
+	flagged, changed = s.update(true, now+11*sec)
+	if !flagged || changed {
+		t.Errorf("Expected true false, got %v %v", flagged, changed)
+	}
+	flagged, changed = s.update(false, now+12*sec)
+	if flagged || !changed {
+		t.Errorf("Expected false true, got %v %v", flagged, changed)
+	}
+
+	// a transient condition is not reported
+	s.update(true, now+13*sec)
+	s.update(false, now+14*sec)
+	flagged, changed = s.update(true, now+20*sec)
+	if flagged || changed {
+		t.Errorf("Expected false false, got %v %v", flagged, changed)
+	}
+}
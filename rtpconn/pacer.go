@@ -0,0 +1,265 @@
+package rtpconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// A pacer smooths the media sent on a down connection.  Without it, the
+// burst of packets that makes up a video keyframe is written to the
+// network at once, and any audio that follows it waits in the bottleneck
+// queue until the whole keyframe has drained.  The pacer keeps the queue
+// on our side, where audio can jump ahead of it: audio packets are sent
+// as soon as they arrive, while video packets are sent at the pacing
+// rate, taking turns between tracks.
+
+const (
+	// the minimum pacing rate, in bits per second
+	minPacingRate = 512 * 1024
+	// the largest burst sent at once, in jiffies at the pacing rate
+	pacerBurst = rtptime.JiffiesPerSec / 100
+	// the pacing rate is raised so that the queue drains in this time
+	pacerMaxDelay = rtptime.JiffiesPerSec / 2
+	// the maximum number of packets queued for a single track
+	pacerQueueLength = 512
+	// how often the pacing rate is recomputed
+	pacerRateInterval = rtptime.JiffiesPerSec / 10
+)
+
+var errPacerFull = errors.New("pacer queue is full")
+
+// pacedPacket is a packet waiting in a pacer.
+type pacedPacket struct {
+	packet rtp.Packet
+	size   int
+}
+
+// pacerQueue holds the packets of a single track.
+type pacerQueue struct {
+	track   *rtpDownTrack
+	audio   bool
+	packets []pacedPacket
+}
+
+type pacer struct {
+	// signalled when a packet is queued
+	wake chan struct{}
+
+	mu     sync.Mutex
+	queues []*pacerQueue
+	// the next queue to serve, for video and audio respectively
+	next [2]int
+	// the number of bytes of video queued
+	videoBytes int
+	// the number of bytes that may be sent now, may be negative
+	budget int64
+	// the time at which the budget was last updated
+	last uint64
+}
+
+func newPacer() *pacer {
+	return &pacer{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// push queues a copy of packet for sending on track.  The packet is
+// copied, since the caller's buffers are reused.
+func (p *pacer) push(track *rtpDownTrack, packet *rtp.Packet, audio bool) error {
+	buf, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	var pp pacedPacket
+	err = pp.packet.Unmarshal(buf)
+	if err != nil {
+		return err
+	}
+	pp.size = len(buf)
+
+	p.mu.Lock()
+	var q *pacerQueue
+	for _, qq := range p.queues {
+		if qq.track == track {
+			q = qq
+			break
+		}
+	}
+	if q == nil {
+		q = &pacerQueue{track: track, audio: audio}
+		p.queues = append(p.queues, q)
+	}
+	if len(q.packets) >= pacerQueueLength {
+		p.mu.Unlock()
+		return errPacerFull
+	}
+	q.packets = append(q.packets, pp)
+	if !audio {
+		p.videoBytes += pp.size
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// nextQueue returns the index of the next non-empty queue of the given
+// kind in round-robin order, or -1 if there is none.  Called locked.
+func (p *pacer) nextQueue(audio bool) int {
+	class := 0
+	if audio {
+		class = 1
+	}
+	n := len(p.queues)
+	for i := 0; i < n; i++ {
+		j := (p.next[class] + i) % n
+		q := p.queues[j]
+		if q.audio == audio && len(q.packets) > 0 {
+			return j
+		}
+	}
+	return -1
+}
+
+// take removes the first packet of the i-th queue.  Called locked.
+func (p *pacer) take(i int) (*rtpDownTrack, *rtp.Packet) {
+	q := p.queues[i]
+	pp := q.packets[0]
+	q.packets[0] = pacedPacket{}
+	q.packets = q.packets[1:]
+
+	class := 0
+	if q.audio {
+		class = 1
+	} else {
+		p.videoBytes -= pp.size
+	}
+	p.budget -= int64(pp.size)
+
+	if len(q.packets) == 0 {
+		// drop empty queues, so that we don't keep removed tracks
+		// around
+		p.queues = append(p.queues[:i], p.queues[i+1:]...)
+		p.next[class] = i
+	} else {
+		p.next[class] = i + 1
+	}
+	return q.track, &pp.packet
+}
+
+// refill updates the budget at the given pacing rate.  Called locked.
+func (p *pacer) refill(now uint64, rate uint64) {
+	burst := int64(rate * pacerBurst / (8 * rtptime.JiffiesPerSec))
+	if burst < 3000 {
+		burst = 3000
+	}
+	if p.last == 0 || now-p.last > rtptime.JiffiesPerSec {
+		p.budget = burst
+		p.last = now
+		return
+	}
+	add := int64(rate * (now - p.last) / (8 * rtptime.JiffiesPerSec))
+	if add > 0 {
+		p.budget += add
+		p.last = now
+	}
+	if p.budget > burst {
+		p.budget = burst
+	}
+}
+
+// pop returns the next packet to send at time now, given a pacing rate in
+// bits per second.  If no packet may be sent now, it returns the time to
+// wait, or 0 if the pacer is empty.
+func (p *pacer) pop(now uint64, rate uint64) (*rtpDownTrack, *rtp.Packet, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// make sure that the queue drains in a bounded time
+	drain := uint64(p.videoBytes) * 8 * rtptime.JiffiesPerSec /
+		pacerMaxDelay
+	if rate < drain {
+		rate = drain
+	}
+	p.refill(now, rate)
+
+	// audio is sent immediately, but counts against the budget
+	if i := p.nextQueue(true); i >= 0 {
+		track, packet := p.take(i)
+		return track, packet, 0
+	}
+
+	i := p.nextQueue(false)
+	if i < 0 {
+		return nil, nil, 0
+	}
+	if p.budget <= 0 {
+		wait := uint64(-p.budget+1) * 8 * rtptime.JiffiesPerSec / rate
+		if wait == 0 {
+			wait = 1
+		}
+		return nil, nil, wait
+	}
+	track, packet := p.take(i)
+	return track, packet, 0
+}
+
+// pacingRate returns the rate at which a connection is paced.
+func pacingRate(down *rtpDownConnection, now uint64) uint64 {
+	rate := down.GetMaxBitrate(now)
+	// leave some headroom above the estimate
+	rate += rate / 2
+	if rate < minPacingRate {
+		rate = minPacingRate
+	}
+	return rate
+}
+
+// pacerLoop sends the packets queued in the pacer of a down connection.
+func pacerLoop(ctx context.Context, down *rtpDownConnection) {
+	p := down.pacer
+	var rate, rateTime uint64
+	for {
+		now := rtptime.Jiffies()
+		if rate == 0 || now-rateTime >= pacerRateInterval {
+			rate = pacingRate(down, now)
+			rateTime = now
+		}
+
+		track, packet, wait := p.pop(now, rate)
+		if packet != nil {
+			track.track.WriteRTP(packet)
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(
+				rtptime.ToDuration(wait, rtptime.JiffiesPerSec),
+			)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-p.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
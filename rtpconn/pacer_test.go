@@ -0,0 +1,212 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func pacerTestPacket(seqno uint16, size int) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seqno},
+		Payload: make([]byte, size-12),
+	}
+}
+
+func TestPacerPriority(t *testing.T) {
+	p := newPacer()
+	audio := &rtpDownTrack{}
+	video1 := &rtpDownTrack{}
+	video2 := &rtpDownTrack{}
+
+	for i := 0; i < 3; i++ {
+		p.push(video1, pacerTestPacket(uint16(i), 1200), false)
+		p.push(video2, pacerTestPacket(uint16(100+i), 1200), false)
+	}
+	p.push(audio, pacerTestPacket(1000, 100), true)
+
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	rate := uint64(10000000)
+	var tracks []*rtpDownTrack
+	var seqnos []uint16
+	for {
+		track, packet, wait := p.pop(now, rate)
+		if packet == nil {
+			if wait == 0 {
+				break
+			}
+			now += wait
+			continue
+		}
+		tracks = append(tracks, track)
+		seqnos = append(seqnos, packet.SequenceNumber)
+	}
+
+	expected := []uint16{1000, 0, 100, 1, 101, 2, 102}
+	if len(seqnos) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, seqnos)
+	}
+	for i := range expected {
+		if seqnos[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, seqnos)
+			break
+		}
+	}
+	if tracks[0] != audio || tracks[1] != video1 || tracks[2] != video2 {
+		t.Errorf("Unexpected tracks")
+	}
+	if len(p.queues) != 0 || p.videoBytes != 0 {
+		t.Errorf("Pacer not empty: %v %v", len(p.queues), p.videoBytes)
+	}
+}
+
+func TestPacerRate(t *testing.T) {
+	p := newPacer()
+	track := &rtpDownTrack{}
+	for i := 0; i < 100; i++ {
+		p.push(track, pacerTestPacket(uint16(i), 1000), false)
+	}
+
+	start := uint64(1000 * rtptime.JiffiesPerSec)
+	now := start
+	rate := uint64(8000000)
+	n := 0
+	for {
+		_, packet, wait := p.pop(now, rate)
+		if packet == nil {
+			if wait == 0 {
+				break
+			}
+			now += wait
+			continue
+		}
+		n++
+	}
+	if n != 100 {
+		t.Errorf("Expected 100, got %v", n)
+	}
+	// 100kB at 1MB/s, minus the initial burst
+	d := now - start
+	if d < 80*rtptime.JiffiesPerSec/1000 ||
+		d > 100*rtptime.JiffiesPerSec/1000 {
+		t.Errorf("Expected 90ms, got %vms",
+			d*1000/rtptime.JiffiesPerSec)
+	}
+}
+
+func TestPacerFull(t *testing.T) {
+	p := newPacer()
+	track := &rtpDownTrack{}
+	for i := 0; i < pacerQueueLength; i++ {
+		err := p.push(track, pacerTestPacket(uint16(i), 100), false)
+		if err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	err := p.push(track, pacerTestPacket(0, 100), false)
+	if err != errPacerFull {
+		t.Errorf("Expected %v, got %v", errPacerFull, err)
+	}
+}
+
+type pacerArrival struct {
+	time  uint64
+	audio bool
+	size  int
+}
+
+// simulateAudioLatency simulates sending arrivals over a bottleneck link
+// of the given rate, with or without a pacer, and returns the worst
+// latency experienced by audio packets, in jiffies.
+func simulateAudioLatency(arrivals []pacerArrival, linkRate uint64, paced bool) uint64 {
+	var linkFree, worst uint64
+	// send puts a packet on the bottleneck link at time now
+	send := func(now uint64, a pacerArrival) {
+		if linkFree < now {
+			linkFree = now
+		}
+		linkFree += uint64(a.size) * 8 * rtptime.JiffiesPerSec / linkRate
+		if a.audio && linkFree-a.time > worst {
+			worst = linkFree - a.time
+		}
+	}
+
+	if !paced {
+		for _, a := range arrivals {
+			send(a.time, a)
+		}
+		return worst
+	}
+
+	p := newPacer()
+	audio := &rtpDownTrack{}
+	video := &rtpDownTrack{}
+	// the arrival of each queued packet, indexed by seqno
+	queued := make(map[uint16]pacerArrival)
+	now := arrivals[0].time
+	i := 0
+	for {
+		for i < len(arrivals) && arrivals[i].time <= now {
+			a := arrivals[i]
+			track := video
+			if a.audio {
+				track = audio
+			}
+			queued[uint16(i)] = a
+			p.push(track, pacerTestPacket(uint16(i), a.size), a.audio)
+			i++
+		}
+		_, packet, wait := p.pop(now, linkRate)
+		if packet != nil {
+			send(now, queued[packet.SequenceNumber])
+			continue
+		}
+		next := now + wait
+		if i < len(arrivals) && (wait == 0 || arrivals[i].time < next) {
+			next = arrivals[i].time
+		} else if wait == 0 {
+			break
+		}
+		now = next
+	}
+	return worst
+}
+
+// TestPacerAudioLatency measures the latency of audio sent during a video
+// keyframe over a 2Mbit/s link.
+func TestPacerAudioLatency(t *testing.T) {
+	ms := uint64(rtptime.JiffiesPerSec / 1000)
+	start := 1000 * 1000 * ms
+	var arrivals []pacerArrival
+	// a 120kB keyframe, which takes 480ms to drain
+	for i := 0; i < 100; i++ {
+		arrivals = append(arrivals, pacerArrival{start, false, 1200})
+	}
+	// audio every 20ms
+	for i := uint64(0); i < 40; i++ {
+		arrivals = append(arrivals,
+			pacerArrival{start + i*20*ms + 1, true, 120},
+		)
+	}
+	// keep the arrivals sorted
+	for i := 1; i < len(arrivals); i++ {
+		for j := i; j > 0 && arrivals[j].time < arrivals[j-1].time; j-- {
+			arrivals[j], arrivals[j-1] = arrivals[j-1], arrivals[j]
+		}
+	}
+
+	linkRate := uint64(2000000)
+	unpaced := simulateAudioLatency(arrivals, linkRate, false)
+	paced := simulateAudioLatency(arrivals, linkRate, true)
+	t.Logf("Worst audio latency: %vms unpaced, %vms paced",
+		unpaced/ms, paced/ms)
+	if unpaced < 400*ms {
+		t.Errorf("Expected at least 400ms unpaced, got %vms",
+			unpaced/ms)
+	}
+	if paced > 20*ms {
+		t.Errorf("Expected at most 20ms paced, got %vms", paced/ms)
+	}
+}
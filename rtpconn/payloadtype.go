@@ -0,0 +1,68 @@
+package rtpconn
+
+import (
+	"github.com/jech/galene/rtptime"
+)
+
+// the time during which a sender may keep sending an unexpected payload
+// type before we ask it to renegotiate
+const payloadTypeTimeout = 2 * rtptime.JiffiesPerSec
+
+// payloadTypeCheck detects packets whose payload type differs from the
+// one that the track started with.  Some encoders switch payload types
+// without renegotiating, and forwarding such packets would only feed
+// garbage to the receivers' decoders.  Only accessed by the reader loop.
+type payloadTypeCheck struct {
+	expected uint8
+	// the time at which the current run of mismatched packets
+	// started, 0 if none
+	since uint64
+	// true if we have asked for renegotiation during this run
+	renegotiated bool
+}
+
+// check is called for every packet.  It returns true if the packet
+// should be forwarded, and whether the sender should be asked to
+// renegotiate.
+func (c *payloadTypeCheck) check(pt uint8, now uint64) (bool, bool) {
+	if pt == c.expected {
+		c.since = 0
+		c.renegotiated = false
+		return true, false
+	}
+	if c.since == 0 {
+		c.since = now
+		return false, false
+	}
+	if !c.renegotiated && now-c.since >= payloadTypeTimeout {
+		c.renegotiated = true
+		return false, true
+	}
+	return false, false
+}
+
+// checkPayloadType is called by the reader loop for every packet, and
+// returns false if the packet must be dropped.  It logs the start of
+// every run of mismatched packets, and asks the sender to renegotiate if
+// the run lasts.
+func (up *rtpUpTrack) checkPayloadType(conn *rtpUpConnection, c *payloadTypeCheck, pt uint8, now uint64) bool {
+	start := c.since == 0
+	ok, renegotiate := c.check(pt, now)
+	if ok {
+		return true
+	}
+	if start {
+		Logger.Warnf("Track %v/%v: unexpected payload type %v "+
+			"(expected %v), dropping",
+			conn.id, up.getMid(), pt, c.expected)
+	}
+	if renegotiate {
+		Logger.Warnf("Track %v/%v: payload type is still %v, "+
+			"asking sender to renegotiate",
+			conn.id, up.getMid(), pt)
+		if conn.reconnect != nil {
+			conn.reconnect()
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestPayloadTypeChange(t *testing.T) {
+	reconnects := 0
+	conn := &rtpUpConnection{
+		reconnect: func() {
+			reconnects++
+		},
+	}
+	up := &rtpUpTrack{}
+	c := payloadTypeCheck{expected: 96}
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+
+	if !up.checkPayloadType(conn, &c, 96, now) {
+		t.Errorf("Expected packet to be forwarded")
+	}
+
+	// the encoder switches payload type mid-stream
+	for i := 0; i < 100; i++ {
+		now += rtptime.JiffiesPerSec / 20
+		if up.checkPayloadType(conn, &c, 98, now) {
+			t.Errorf("Expected packet %v to be dropped", i)
+		}
+	}
+	if reconnects != 1 {
+		t.Errorf("Expected 1 renegotiation, got %v", reconnects)
+	}
+
+	// and goes back to normal
+	now += rtptime.JiffiesPerSec / 20
+	if !up.checkPayloadType(conn, &c, 96, now) {
+		t.Errorf("Expected packet to be forwarded")
+	}
+	if c.since != 0 || c.renegotiated {
+		t.Errorf("Expected reset, got %v %v", c.since, c.renegotiated)
+	}
+
+	// a short glitch doesn't cause renegotiation
+	now += rtptime.JiffiesPerSec / 20
+	up.checkPayloadType(conn, &c, 98, now)
+	now += rtptime.JiffiesPerSec / 20
+	up.checkPayloadType(conn, &c, 96, now)
+	if reconnects != 1 {
+		t.Errorf("Expected 1 renegotiation, got %v", reconnects)
+	}
+}
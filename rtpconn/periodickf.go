@@ -0,0 +1,67 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// keyframePeriod returns the interval, in jiffies, at which keyframes
+// are requested from the sender, or 0 if they are only requested on
+// demand.
+func (up *rtpUpConnection) keyframePeriod() uint64 {
+	if up.group == nil {
+		return 0
+	}
+	d := up.group.KeyframePeriod()
+	if d <= 0 {
+		return 0
+	}
+	return rtptime.FromDuration(d, rtptime.JiffiesPerSec)
+}
+
+// requestPeriodicKeyframes requests a keyframe on every video track that
+// hasn't produced one for a whole period, so that receivers that join
+// a broadcast get a picture promptly without each of them having to ask.
+// Requests are subject to the usual rate limiting.  It is called by
+// rtcpUpSender, so the period is only checked once per RTCPInterval.
+func (up *rtpUpConnection) requestPeriodicKeyframes(now uint64) {
+	period := up.keyframePeriod()
+	if period == 0 {
+		return
+	}
+	for _, t := range up.getTracks() {
+		if t.Kind() != webrtc.RTPCodecTypeVideo || t.gotGoodbye() ||
+			len(t.getLocal()) == 0 {
+			continue
+		}
+		if !periodicKeyframeDue(now,
+			atomic.LoadUint64(&t.atomics.lastKeyframe),
+			atomic.LoadUint64(&t.atomics.periodicKF),
+			period) {
+			continue
+		}
+		atomic.StoreUint64(&t.atomics.periodicKF, now)
+		err := up.sendFIR(t, true, false)
+		if err == ErrUnsupportedFeedback {
+			err = up.sendPLI(t, false)
+		}
+		if err != nil && err != ErrRateLimited &&
+			err != ErrUnsupportedFeedback {
+			Logger.Warnf("periodic keyframe: %v", err)
+		}
+	}
+}
+
+// periodicKeyframeDue returns true if a keyframe should be requested at
+// time now, given the times at which the last keyframe was received and
+// the last periodic request was sent, either of which may be 0.
+func periodicKeyframeDue(now, keyframe, request, period uint64) bool {
+	last := keyframe
+	if request > last {
+		last = request
+	}
+	return last == 0 || now < last || now-last >= period
+}
@@ -0,0 +1,31 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestPeriodicKeyframeDue(t *testing.T) {
+	period := uint64(2 * rtptime.JiffiesPerSec)
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	tests := []struct {
+		keyframe, request uint64
+		due               bool
+	}{
+		{0, 0, true},
+		{now - rtptime.JiffiesPerSec, 0, false},
+		{now - 3*rtptime.JiffiesPerSec, 0, true},
+		{0, now - rtptime.JiffiesPerSec, false},
+		// the keyframe that we requested hasn't arrived yet
+		{now - 3*rtptime.JiffiesPerSec, now - rtptime.JiffiesPerSec, false},
+		{now - 5*rtptime.JiffiesPerSec, now - 3*rtptime.JiffiesPerSec, true},
+	}
+	for _, tt := range tests {
+		due := periodicKeyframeDue(now, tt.keyframe, tt.request, period)
+		if due != tt.due {
+			t.Errorf("Expected %v, got %v (%v %v)",
+				tt.due, due, tt.keyframe, tt.request)
+		}
+	}
+}
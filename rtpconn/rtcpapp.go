@@ -0,0 +1,146 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/ratelimitlog"
+	"github.com/jech/galene/rtptime"
+)
+
+// Application-defined RTCP packets (RFC 3550 Section 6.7).  Some clients
+// use them to coordinate among themselves, so we optionally forward them
+// from a sender to the receivers of its tracks.  Since pion only delivers
+// a packet to the readers of the SSRCs it concerns, an APP packet is only
+// seen when it is part of a compound packet that starts with a report.
+//
+// APP packets are never interpreted by the server, but they might be
+// interpreted by receivers.  In order to avoid letting senders spoof
+// anything else, we only forward packets whose name has been explicitly
+// allowed in the group, we limit their size and rate, and we re-encode
+// them with the SSRC of the down track, so that they cannot impersonate
+// another stream.
+
+const rtcpTypeAPP = 204
+
+const (
+	// the maximum size of the application-dependent data
+	maxAPPData = 256
+	// the minimum interval between two forwarded APP packets
+	minAPPInterval = rtptime.JiffiesPerSec / 50
+)
+
+var errAPPMalformed = errors.New("malformed APP packet")
+
+// appPacket is an RTCP APP packet.
+type appPacket struct {
+	Subtype uint8
+	SSRC    uint32
+	Name    string
+	Data    []byte
+}
+
+func (a *appPacket) DestinationSSRC() []uint32 {
+	return []uint32{a.SSRC}
+}
+
+func (a *appPacket) Marshal() ([]byte, error) {
+	if a.Subtype > 31 || len(a.Name) != 4 || len(a.Data)%4 != 0 {
+		return nil, errAPPMalformed
+	}
+	b := make([]byte, 12+len(a.Data))
+	b[0] = 2<<6 | a.Subtype
+	b[1] = rtcpTypeAPP
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)/4-1))
+	binary.BigEndian.PutUint32(b[4:], a.SSRC)
+	copy(b[8:12], a.Name)
+	copy(b[12:], a.Data)
+	return b, nil
+}
+
+func (a *appPacket) Unmarshal(b []byte) error {
+	if len(b) < 12 || b[0]>>6 != 2 || b[1] != rtcpTypeAPP {
+		return errAPPMalformed
+	}
+	length := (int(binary.BigEndian.Uint16(b[2:])) + 1) * 4
+	if length < 12 || length > len(b) {
+		return errAPPMalformed
+	}
+	b = b[:length]
+	if (b[0] & 0x20) != 0 {
+		// padding
+		pad := int(b[length-1])
+		if pad == 0 || 12+pad > length {
+			return errAPPMalformed
+		}
+		b = b[:length-pad]
+	}
+	a.Subtype = b[0] & 0x1F
+	a.SSRC = binary.BigEndian.Uint32(b[4:])
+	a.Name = string(b[8:12])
+	a.Data = append([]byte(nil), b[12:]...)
+	return nil
+}
+
+// parseAPP returns the APP packet contained in p, if any.
+func parseAPP(p *rtcp.RawPacket) (*appPacket, bool) {
+	if p.Header().Type != rtcpTypeAPP {
+		return nil, false
+	}
+	var a appPacket
+	err := a.Unmarshal(*p)
+	if err != nil {
+		return nil, false
+	}
+	return &a, true
+}
+
+// appAllowed returns true if an APP packet may be forwarded.
+func appAllowed(a *appPacket, names []string) bool {
+	if len(a.Data) > maxAPPData || len(a.Data)%4 != 0 {
+		return false
+	}
+	for _, n := range names {
+		if n == a.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardAPP forwards an APP packet received from the sender of track to
+// the receivers of that track.
+func forwardAPP(conn *rtpUpConnection, track *rtpUpTrack, a *appPacket, jiffies uint64) {
+	if conn.group == nil || !appAllowed(a, conn.group.RTCPAppNames()) {
+		return
+	}
+
+	last := atomic.LoadUint64(&track.atomics.lastAPP)
+	if jiffies >= last && jiffies-last < minAPPInterval {
+		return
+	}
+	atomic.StoreUint64(&track.atomics.lastAPP, jiffies)
+
+	forEachDownTrack(conn, track,
+		func(down *rtpDownConnection, t *rtpDownTrack) {
+			if down.rtcpOut == nil {
+				return
+			}
+			err := down.rtcpOut.WriteRTCP([]rtcp.Packet{
+				&appPacket{
+					Subtype: a.Subtype,
+					SSRC:    uint32(t.ssrc),
+					Name:    a.Name,
+					Data:    a.Data,
+				},
+			})
+			if err != nil {
+				ratelimitlog.Log("Forward APP",
+					"conn", down.id, "error", err)
+			}
+		},
+	)
+}
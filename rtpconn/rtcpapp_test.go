@@ -0,0 +1,126 @@
+package rtpconn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestAPPMarshal(t *testing.T) {
+	a := &appPacket{
+		Subtype: 3,
+		SSRC:    42,
+		Name:    "GALE",
+		Data:    []byte{1, 2, 3, 4},
+	}
+	buf, err := a.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	ps, err := rtcp.Unmarshal(buf)
+	if err != nil || len(ps) != 1 {
+		t.Fatalf("Unmarshal: %v %v", ps, err)
+	}
+	raw, ok := ps[0].(*rtcp.RawPacket)
+	if !ok {
+		t.Fatalf("Expected raw packet, got %T", ps[0])
+	}
+	b, ok := parseAPP(raw)
+	if !ok {
+		t.Fatalf("parseAPP failed")
+	}
+	if b.Subtype != 3 || b.SSRC != 42 || b.Name != "GALE" ||
+		!bytes.Equal(b.Data, a.Data) {
+		t.Errorf("Expected %v, got %v", a, b)
+	}
+
+	// padded
+	buf = append(buf, 0, 0, 0, 4)
+	buf[0] |= 0x20
+	buf[3]++
+	var c appPacket
+	err = c.Unmarshal(buf)
+	if err != nil || !bytes.Equal(c.Data, a.Data) {
+		t.Errorf("Unmarshal padded: %v %v", c.Data, err)
+	}
+
+	_, err = (&appPacket{Name: "ABC"}).Marshal()
+	if err == nil {
+		t.Errorf("Marshalled bad name")
+	}
+
+	xr, _ := (&extendedReport{SSRC: 1, RRTR: 2}).Marshal()
+	rawXR := rtcp.RawPacket(xr)
+	if _, ok := parseAPP(&rawXR); ok {
+		t.Errorf("Parsed XR as APP")
+	}
+}
+
+func TestAPPAllowed(t *testing.T) {
+	names := []string{"GALE"}
+	a := []struct {
+		packet  appPacket
+		allowed bool
+	}{
+		{appPacket{Name: "GALE"}, true},
+		{appPacket{Name: "GALE", Data: make([]byte, 8)}, true},
+		{appPacket{Name: "OTHR"}, false},
+		{appPacket{Name: "GALE", Data: make([]byte, maxAPPData+4)}, false},
+	}
+	for _, s := range a {
+		if appAllowed(&s.packet, names) != s.allowed {
+			t.Errorf("%v: expected %v", s.packet.Name, s.allowed)
+		}
+	}
+	if appAllowed(&appPacket{Name: "GALE"}, nil) {
+		t.Errorf("Allowed APP without configuration")
+	}
+}
+
+func TestForwardAPP(t *testing.T) {
+	g, err := group.Add("test-forward-app", &group.Description{
+		RTCPAppNames: []string{"GALE"},
+	})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete("test-forward-app")
+
+	up := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	other := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	recorder := &rtcpRecorder{}
+	down := &rtpDownConnection{
+		tracks: []*rtpDownTrack{
+			{ssrc: 5, remote: up},
+			{ssrc: 6, remote: other},
+		},
+		rtcpOut: newRTCPSizeWriter(recorder),
+	}
+	upConn := &rtpUpConnection{
+		group: g,
+		local: []conn.Down{down},
+	}
+
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	forwardAPP(upConn, up, &appPacket{SSRC: 99, Name: "GALE"}, now)
+	forwardAPP(upConn, up, &appPacket{SSRC: 99, Name: "OTHR"},
+		now+rtptime.JiffiesPerSec)
+	// too soon
+	forwardAPP(upConn, up, &appPacket{SSRC: 99, Name: "GALE"}, now+1)
+
+	var apps []*appPacket
+	for _, p := range recorder.packets {
+		if a, ok := p.(*appPacket); ok {
+			apps = append(apps, a)
+		}
+	}
+	if len(apps) != 1 || apps[0].SSRC != 5 || apps[0].Name != "GALE" {
+		t.Errorf("Unexpected packets %v", recorder.packets)
+	}
+}
@@ -0,0 +1,79 @@
+package rtpconn
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/ratelimitlog"
+)
+
+// The interval during which NACKs are coalesced.
+const rtcpBatchInterval = 5 * time.Millisecond
+
+// Flush immediately once this many packets are queued, so that the
+// compound packet stays well below the MTU.
+const rtcpBatchMax = 32
+
+// An rtcpBatcher coalesces the RTCP packets written within a short
+// interval into a single compound packet, which reduces the number of
+// writes in busy groups.  Latency-sensitive feedback, such as PLI, should
+// be written to the underlying writer directly.
+type rtcpBatcher struct {
+	w        rtcpWriter
+	interval time.Duration
+
+	mu      sync.Mutex
+	packets []rtcp.Packet
+	timer   *time.Timer
+}
+
+func newRTCPBatcher(w rtcpWriter, interval time.Duration) *rtcpBatcher {
+	return &rtcpBatcher{w: w, interval: interval}
+}
+
+// WriteRTCP queues packets for sending.  Since the actual write usually
+// happens asynchronously, errors are logged rather than returned.
+func (b *rtcpBatcher) WriteRTCP(pkts []rtcp.Packet) error {
+	b.mu.Lock()
+	b.packets = append(b.packets, pkts...)
+	if len(b.packets) >= rtcpBatchMax {
+		packets := b.take()
+		b.mu.Unlock()
+		return b.w.WriteRTCP(packets)
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.flush)
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// take returns the queued packets and cancels any pending flush.  It is
+// called with b.mu held.
+func (b *rtcpBatcher) take() []rtcp.Packet {
+	packets := b.packets
+	b.packets = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return packets
+}
+
+// flush writes out any queued packets.
+func (b *rtcpBatcher) flush() {
+	b.mu.Lock()
+	packets := b.take()
+	b.mu.Unlock()
+
+	if len(packets) == 0 {
+		return
+	}
+	err := b.w.WriteRTCP(packets)
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		ratelimitlog.Log("WriteRTCP", "error", err)
+	}
+}
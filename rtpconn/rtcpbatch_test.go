@@ -0,0 +1,53 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+type rtcpCounter struct {
+	writes  int
+	packets int
+}
+
+func (w *rtcpCounter) WriteRTCP(pkts []rtcp.Packet) error {
+	w.writes++
+	w.packets += len(pkts)
+	return nil
+}
+
+func TestRTCPBatcher(t *testing.T) {
+	w := &rtcpCounter{}
+	b := newRTCPBatcher(w, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		err := sendNACKs(b, 42, []rtcp.NackPair{{PacketID: uint16(i)}})
+		if err != nil {
+			t.Fatalf("sendNACKs: %v", err)
+		}
+	}
+	if w.writes != 0 {
+		t.Errorf("Expected 0 writes, got %v", w.writes)
+	}
+	b.flush()
+	if w.writes != 1 || w.packets != 3 {
+		t.Errorf("Expected 1 3, got %v %v", w.writes, w.packets)
+	}
+	b.flush()
+	if w.writes != 1 {
+		t.Errorf("Expected 1 write, got %v", w.writes)
+	}
+
+	for i := 0; i < rtcpBatchMax; i++ {
+		sendNACKs(b, 42, []rtcp.NackPair{{PacketID: uint16(i)}})
+	}
+	if w.writes != 2 || w.packets != 3+rtcpBatchMax {
+		t.Errorf("Expected 2 %v, got %v %v",
+			3+rtcpBatchMax, w.writes, w.packets)
+	}
+	if b.timer != nil {
+		t.Errorf("Timer was not cancelled")
+	}
+}
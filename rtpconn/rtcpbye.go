@@ -0,0 +1,70 @@
+package rtpconn
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/ratelimitlog"
+)
+
+// forEachDownTrack calls f for each down track that forwards track.
+func forEachDownTrack(conn *rtpUpConnection, track *rtpUpTrack, f func(*rtpDownConnection, *rtpDownTrack)) {
+	for _, l := range conn.getLocal() {
+		down, ok := l.(*rtpDownConnection)
+		if !ok {
+			continue
+		}
+		for _, t := range down.getTracks() {
+			if t.remote == track {
+				f(down, t)
+			}
+		}
+	}
+}
+
+// sendBye tells the receiver of conn that tracks will no longer be sent
+// (RFC 3550 Section 6.6), so that it doesn't keep waiting for packets.
+func sendBye(conn *rtpDownConnection, tracks []*rtpDownTrack) error {
+	if conn.rtcpOut == nil || len(tracks) == 0 {
+		return nil
+	}
+	sources := make([]uint32, 0, len(tracks))
+	for _, t := range tracks {
+		sources = append(sources, uint32(t.ssrc))
+	}
+	err := conn.rtcpOut.WriteRTCP([]rtcp.Packet{
+		&rtcp.Goodbye{Sources: sources},
+	})
+	if err == io.ErrClosedPipe {
+		// the connection is already gone
+		return nil
+	}
+	return err
+}
+
+// gotBye is called when the sender of track announces that it has
+// stopped sending.  We stop requesting retransmissions and keyframes,
+// and propagate the BYE to the receivers.
+func gotBye(conn *rtpUpConnection, track *rtpUpTrack) {
+	if !atomic.CompareAndSwapUint32(&track.atomics.bye, 0, 1) {
+		return
+	}
+	Logger.Infof("Track %v/%v: got BYE", conn.id, track.getMid())
+	forEachDownTrack(conn, track,
+		func(down *rtpDownConnection, t *rtpDownTrack) {
+			err := sendBye(down, []*rtpDownTrack{t})
+			if err != nil {
+				ratelimitlog.Log("sendBye",
+					"conn", down.id, "error", err)
+			}
+		},
+	)
+}
+
+// gotGoodbye returns true if the sender of track has announced that it
+// stopped sending, and hasn't sent any packets since.
+func (up *rtpUpTrack) gotGoodbye() bool {
+	return atomic.LoadUint32(&up.atomics.bye) != 0
+}
@@ -0,0 +1,71 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/conn"
+)
+
+func TestSendBye(t *testing.T) {
+	recorder := &rtcpRecorder{}
+	down := &rtpDownConnection{rtcpOut: newRTCPSizeWriter(recorder)}
+	tracks := []*rtpDownTrack{{ssrc: 1}, {ssrc: 2}}
+
+	err := sendBye(down, nil)
+	if err != nil || len(recorder.packets) != 0 {
+		t.Errorf("Expected nothing, got %v %v", recorder.packets, err)
+	}
+
+	err = sendBye(down, tracks)
+	if err != nil {
+		t.Fatalf("sendBye: %v", err)
+	}
+	if len(recorder.packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", recorder.packets)
+	}
+	if _, ok := recorder.packets[0].(*rtcp.ReceiverReport); !ok {
+		t.Errorf("Expected receiver report, got %T",
+			recorder.packets[0])
+	}
+	bye, ok := recorder.packets[1].(*rtcp.Goodbye)
+	if !ok || len(bye.Sources) != 2 ||
+		bye.Sources[0] != 1 || bye.Sources[1] != 2 {
+		t.Errorf("Unexpected BYE %v", recorder.packets[1])
+	}
+}
+
+func TestGotBye(t *testing.T) {
+	up := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	other := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	recorder := &rtcpRecorder{}
+	down := &rtpDownConnection{
+		tracks: []*rtpDownTrack{
+			{ssrc: 5, remote: up},
+			{ssrc: 6, remote: other},
+		},
+		rtcpOut: newRTCPSizeWriter(recorder),
+	}
+	upConn := &rtpUpConnection{local: []conn.Down{down}}
+
+	gotBye(upConn, up)
+	// a duplicate BYE is not propagated again
+	gotBye(upConn, up)
+
+	if !up.gotGoodbye() || other.gotGoodbye() {
+		t.Errorf("Unexpected state %v %v",
+			up.gotGoodbye(), other.gotGoodbye())
+	}
+
+	var byes []*rtcp.Goodbye
+	for _, p := range recorder.packets {
+		if b, ok := p.(*rtcp.Goodbye); ok {
+			byes = append(byes, b)
+		}
+	}
+	if len(byes) != 1 || len(byes[0].Sources) != 1 ||
+		byes[0].Sources[0] != 5 {
+		t.Errorf("Unexpected packets %v", recorder.packets)
+	}
+}
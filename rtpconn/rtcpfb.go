@@ -0,0 +1,88 @@
+package rtpconn
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+// Feedback describes the RTCP feedback mechanisms that are in use on
+// a track.
+type Feedback struct {
+	NACK        bool
+	PLI         bool
+	FIR         bool
+	REMB        bool
+	TransportCC bool
+	TMMBR       bool
+}
+
+// negotiatedFeedback returns the mechanisms that appear in both remote
+// and local.  Pion records the feedback announced by the peer, which
+// is not necessarily a subset of what we offered.
+func negotiatedFeedback(remote, local []webrtc.RTCPFeedback) Feedback {
+	has := func(tpe, parameter string) bool {
+		for _, r := range remote {
+			if r.Type != tpe || r.Parameter != parameter {
+				continue
+			}
+			for _, l := range local {
+				if l.Type == tpe && l.Parameter == parameter {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return Feedback{
+		NACK:        has("nack", ""),
+		PLI:         has("nack", "pli"),
+		FIR:         has("ccm", "fir"),
+		REMB:        has("goog-remb", ""),
+		TransportCC: has("transport-cc", ""),
+		TMMBR:       has("ccm", "tmmbr"),
+	}
+}
+
+// Names returns the SDP names of the mechanisms in f.
+func (f Feedback) Names() []string {
+	var names []string
+	add := func(v bool, name string) {
+		if v {
+			names = append(names, name)
+		}
+	}
+	add(f.NACK, "nack")
+	add(f.PLI, "nack pli")
+	add(f.FIR, "ccm fir")
+	add(f.REMB, "goog-remb")
+	add(f.TransportCC, "transport-cc")
+	add(f.TMMBR, "ccm tmmbr")
+	return names
+}
+
+// FeedbackMechanisms returns the RTCP feedback negotiated with the
+// sender of the track.
+func (up *rtpUpTrack) FeedbackMechanisms() Feedback {
+	codec := up.track.Codec()
+	return negotiatedFeedback(
+		codec.RTCPFeedback, group.RTCPFeedback(codec.MimeType),
+	)
+}
+
+// FeedbackMechanisms returns the RTCP feedback negotiated with the
+// receiver of the track.  Before the answer is received, this is what
+// we offered.
+func (down *rtpDownTrack) FeedbackMechanisms() Feedback {
+	codec := down.track.Codec()
+	local := group.RTCPFeedback(codec.MimeType)
+	for _, c := range down.sender.GetParameters().Codecs {
+		if strings.EqualFold(c.MimeType, codec.MimeType) &&
+			c.ClockRate == codec.ClockRate {
+			return negotiatedFeedback(c.RTCPFeedback, local)
+		}
+	}
+	return Feedback{}
+}
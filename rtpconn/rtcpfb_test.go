@@ -0,0 +1,37 @@
+package rtpconn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+func TestNegotiatedFeedback(t *testing.T) {
+	remote := []webrtc.RTCPFeedback{
+		{Type: "goog-remb"},
+		{Type: "transport-cc"},
+		{Type: "ccm", Parameter: "fir"},
+		{Type: "nack"},
+	}
+
+	fb := negotiatedFeedback(remote, group.RTCPFeedback("video/VP8"))
+	expected := Feedback{NACK: true, FIR: true, REMB: true}
+	if fb != expected {
+		t.Errorf("Expected %v, got %v", expected, fb)
+	}
+	names := []string{"nack", "ccm fir", "goog-remb"}
+	if !reflect.DeepEqual(fb.Names(), names) {
+		t.Errorf("Expected %v, got %v", names, fb.Names())
+	}
+
+	fb = negotiatedFeedback(remote, group.RTCPFeedback("audio/opus"))
+	if fb != (Feedback{}) {
+		t.Errorf("Expected nothing, got %v", fb)
+	}
+	if fb.Names() != nil {
+		t.Errorf("Expected nil, got %v", fb.Names())
+	}
+}
@@ -0,0 +1,79 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+)
+
+// reducedSizeRTCP returns true if the session description s negotiates
+// reduced-size RTCP (RFC 5506) on all of its media sections.
+func reducedSizeRTCP(s string) bool {
+	var d sdp.SessionDescription
+	err := d.Unmarshal([]byte(s))
+	if err != nil {
+		return false
+	}
+
+	found := false
+	for _, m := range d.MediaDescriptions {
+		if m.MediaName.Media == "application" {
+			continue
+		}
+		_, ok := m.Attribute(sdp.AttrKeyRTCPRsize)
+		if !ok {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// An rtcpSizeWriter writes RTCP packets to an underlying writer.  Unless
+// the peer has negotiated reduced-size RTCP, it makes sure that every
+// packet it writes is a valid compound packet, which RFC 3550 requires to
+// start with a sender or receiver report.
+type rtcpSizeWriter struct {
+	w rtcpWriter
+	// set to 1 if reduced-size RTCP was negotiated, accessed atomically
+	reducedSize int32
+}
+
+func newRTCPSizeWriter(w rtcpWriter) *rtcpSizeWriter {
+	return &rtcpSizeWriter{w: w}
+}
+
+func (w *rtcpSizeWriter) setReducedSize(reduced bool) {
+	var v int32
+	if reduced {
+		v = 1
+	}
+	atomic.StoreInt32(&w.reducedSize, v)
+}
+
+func (w *rtcpSizeWriter) getReducedSize() bool {
+	return atomic.LoadInt32(&w.reducedSize) != 0
+}
+
+func (w *rtcpSizeWriter) WriteRTCP(pkts []rtcp.Packet) error {
+	if !w.getReducedSize() {
+		pkts = compoundRTCP(pkts)
+	}
+	return w.w.WriteRTCP(pkts)
+}
+
+// compoundRTCP prepends an empty receiver report to pkts if it does not
+// already start with a report.
+func compoundRTCP(pkts []rtcp.Packet) []rtcp.Packet {
+	if len(pkts) == 0 {
+		return pkts
+	}
+	switch pkts[0].(type) {
+	case *rtcp.SenderReport, *rtcp.ReceiverReport:
+		return pkts
+	}
+	p := make([]rtcp.Packet, 0, len(pkts)+1)
+	p = append(p, &rtcp.ReceiverReport{})
+	return append(p, pkts...)
+}
@@ -0,0 +1,85 @@
+package rtpconn
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtcp"
+)
+
+const rsizeSDP = `v=0
+o=- 1 1 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+c=IN IP4 0.0.0.0
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:111 opus/48000/2
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=rtcp-mux
+%s
+a=rtpmap:96 VP8/90000
+m=application 9 UDP/DTLS/SCTP webrtc-datachannel
+c=IN IP4 0.0.0.0
+`
+
+func TestReducedSizeRTCP(t *testing.T) {
+	sdp := func(rsize string) string {
+		s := fmt.Sprintf(rsizeSDP, rsize)
+		return strings.Replace(s, "\n", "\r\n", -1)
+	}
+
+	if !reducedSizeRTCP(sdp("a=rtcp-rsize")) {
+		t.Errorf("Expected reduced size")
+	}
+	if reducedSizeRTCP(sdp("a=sendrecv")) {
+		t.Errorf("Expected full size when a section lacks rtcp-rsize")
+	}
+	if reducedSizeRTCP("garbage") {
+		t.Errorf("Expected full size for invalid SDP")
+	}
+}
+
+func TestRTCPSizeWriter(t *testing.T) {
+	r := &rtcpRecorder{}
+	w := newRTCPSizeWriter(r)
+
+	err := sendPLI(w, 42)
+	if err != nil {
+		t.Fatalf("sendPLI: %v", err)
+	}
+	if len(r.packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(r.packets))
+	}
+	if _, ok := r.packets[0].(*rtcp.ReceiverReport); !ok {
+		t.Errorf("Expected ReceiverReport, got %T", r.packets[0])
+	}
+
+	r.packets = nil
+	err = w.WriteRTCP([]rtcp.Packet{
+		&rtcp.SenderReport{SSRC: 42},
+		&rtcp.PictureLossIndication{MediaSSRC: 42},
+	})
+	if err != nil {
+		t.Fatalf("WriteRTCP: %v", err)
+	}
+	if len(r.packets) != 2 {
+		t.Errorf("Expected 2 packets, got %v", len(r.packets))
+	}
+
+	r.packets = nil
+	w.setReducedSize(true)
+	err = sendPLI(w, 42)
+	if err != nil {
+		t.Fatalf("sendPLI: %v", err)
+	}
+	if len(r.packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %v", len(r.packets))
+	}
+	if _, ok := r.packets[0].(*rtcp.PictureLossIndication); !ok {
+		t.Errorf("Expected PictureLossIndication, got %T", r.packets[0])
+	}
+}
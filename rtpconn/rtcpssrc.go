@@ -0,0 +1,74 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// the time without a sender report carrying the known SSRC after which a
+// different SSRC is taken to be the new SSRC of the sender
+const rtcpSSRCTimeout = 10 * rtptime.JiffiesPerSec
+
+// rtcpSSRC returns the SSRC that the sender of a track uses in its RTCP
+// packets.  This is the SSRC of the track, unless the sender has been
+// seen to change it.
+func (up *rtpUpTrack) rtcpSSRC() uint32 {
+	v := atomic.LoadUint64(&up.atomics.rtcpSSRC)
+	if v&(1<<32) != 0 {
+		return uint32(v)
+	}
+	return uint32(up.track.SSRC())
+}
+
+// isSibling returns true if ssrc is used by a different track of conn.
+// The RTCP of all the simulcast layers of a track is read from the same
+// receiver, so that the sender reports of the other layers must not be
+// mistaken for an SSRC change.
+func (up *rtpUpTrack) isSibling(conn *rtpUpConnection, ssrc uint32) bool {
+	if conn == nil {
+		return false
+	}
+	for _, t := range conn.getTracks() {
+		if t == up {
+			continue
+		}
+		if uint32(t.track.SSRC()) == ssrc || t.rtcpSSRC() == ssrc {
+			return true
+		}
+	}
+	return false
+}
+
+// srApplies is called by the RTCP listener for every sender report, and
+// returns true if the report applies to the track.  A report with a
+// zero SSRC is assumed to apply, since some senders don't fill it in.
+// A report with an unknown SSRC is ignored until no report with the
+// known SSRC has been received for a while, at which point the new SSRC
+// is learned, so that a sender that rotates its SSRC is followed rather
+// than ignored forever.
+func (up *rtpUpTrack) srApplies(conn *rtpUpConnection, ssrc uint32, now uint64) bool {
+	if ssrc == 0 {
+		return true
+	}
+	old := up.rtcpSSRC()
+	if ssrc == old {
+		up.rtcpSSRCTime = now
+		return true
+	}
+	if up.isSibling(conn, ssrc) {
+		return false
+	}
+	if up.rtcpSSRCTime == 0 {
+		// start the timeout at the first report
+		up.rtcpSSRCTime = now
+	}
+	if now-up.rtcpSSRCTime < rtcpSSRCTimeout {
+		return false
+	}
+	atomic.StoreUint64(&up.atomics.rtcpSSRC, uint64(ssrc)|(1<<32))
+	up.rtcpSSRCTime = now
+	Logger.Infof("Track %v: RTCP SSRC changed from %v to %v",
+		up.track.ID(), old, ssrc)
+	return true
+}
@@ -0,0 +1,71 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestRTCPSSRCChange(t *testing.T) {
+	up := &rtpUpTrack{
+		track:   &webrtc.TrackRemote{},
+		atomics: &upTrackAtomics{},
+	}
+	atomic.StoreUint64(&up.atomics.rtcpSSRC, 42|(1<<32))
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+
+	if !up.srApplies(nil, 42, now) {
+		t.Errorf("Expected report with known SSRC to apply")
+	}
+	if !up.srApplies(nil, 0, now) {
+		t.Errorf("Expected report with zero SSRC to apply")
+	}
+
+	// a different SSRC is ignored while the known one is still alive
+	now += rtptime.JiffiesPerSec
+	if up.srApplies(nil, 43, now) {
+		t.Errorf("Expected report with new SSRC to be ignored")
+	}
+	if up.rtcpSSRC() != 42 {
+		t.Errorf("Expected %v, got %v", 42, up.rtcpSSRC())
+	}
+
+	// and learned once the known one has gone quiet
+	now += rtcpSSRCTimeout
+	if !up.srApplies(nil, 43, now) {
+		t.Errorf("Expected report with new SSRC to apply")
+	}
+	if up.rtcpSSRC() != 43 {
+		t.Errorf("Expected %v, got %v", 43, up.rtcpSSRC())
+	}
+	if up.srApplies(nil, 42, now+rtptime.JiffiesPerSec) {
+		t.Errorf("Expected report with old SSRC to be ignored")
+	}
+}
+
+func TestRTCPSSRCSibling(t *testing.T) {
+	up := &rtpUpTrack{
+		track:   &webrtc.TrackRemote{},
+		atomics: &upTrackAtomics{},
+	}
+	sibling := &rtpUpTrack{
+		track:   &webrtc.TrackRemote{},
+		atomics: &upTrackAtomics{},
+	}
+	atomic.StoreUint64(&up.atomics.rtcpSSRC, 42|(1<<32))
+	atomic.StoreUint64(&sibling.atomics.rtcpSSRC, 43|(1<<32))
+	conn := &rtpUpConnection{tracks: []*rtpUpTrack{up, sibling}}
+
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	up.srApplies(conn, 42, now)
+	now += 2 * rtcpSSRCTimeout
+	if up.srApplies(conn, 43, now) {
+		t.Errorf("Expected report of another layer to be ignored")
+	}
+	if up.rtcpSSRC() != 42 {
+		t.Errorf("Expected %v, got %v", 42, up.rtcpSSRC())
+	}
+}
@@ -0,0 +1,136 @@
+package rtpconn
+
+import (
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// RTCP is received from untrusted peers.  Pion checks that packets are
+// well-formed, but not that the values that they carry are sensible, so
+// we bound the amount of work done for each compound packet, clamp the
+// values that we store, and limit the rate at which a listener accepts
+// packets.
+
+const (
+	// the maximum number of packets handled in a compound packet
+	maxRTCPPackets = 16
+	// the maximum number of reports, chunks or sources handled in
+	// a single packet; the count field of RTCP is 5 bits wide
+	maxRTCPItems = 31
+	// the maximum number of NACK pairs handled in a single packet,
+	// this covers 1088 packets
+	maxNACKPairs = 64
+	// the largest bitrate that a peer may announce, in bits per
+	// second, unless MaxBitrate is set
+	maxFeedbackBitrate = 1000 * 1000 * 1000
+	// the rate at which a listener accepts compound packets, in
+	// packets per second, and the size of the allowed burst
+	rtcpRate  = 200
+	rtcpBurst = 200
+)
+
+// MaxBitrate is the largest bitrate, in bits per second, that a peer may
+// announce in its feedback.  0 means 1Gbit/s.
+var MaxBitrate uint64
+
+func maxBitrate() uint64 {
+	if MaxBitrate == 0 {
+		return maxFeedbackBitrate
+	}
+	return MaxBitrate
+}
+
+// clampBitrate clamps a bitrate announced by a peer.
+func clampBitrate(bitrate uint64) uint64 {
+	max := maxBitrate()
+	if bitrate > max {
+		return max
+	}
+	return bitrate
+}
+
+// rembBitrate returns the bitrate that should be stored for a REMB
+// announcing bitrate, and false if the REMB should be ignored.  A value
+// of 0 doesn't make sense, and pion returns all ones when the exponent
+// overflows; neither are taken as an estimate.  Other values are
+// clamped between MinBitrate, below which we never ask senders to go,
+// and the configured maximum.
+func rembBitrate(bitrate uint64) (uint64, bool) {
+	if bitrate == 0 || bitrate == ^uint64(0) {
+		return 0, false
+	}
+	if bitrate < group.MinBitrate {
+		return group.MinBitrate, true
+	}
+	return clampBitrate(bitrate), true
+}
+
+// sanitizeRTCP bounds the size of the compound packet ps.  The packets
+// are modified in place.
+func sanitizeRTCP(ps []rtcp.Packet) []rtcp.Packet {
+	if len(ps) > maxRTCPPackets {
+		ps = ps[:maxRTCPPackets]
+	}
+	for _, p := range ps {
+		switch p := p.(type) {
+		case *rtcp.SenderReport:
+			if len(p.Reports) > maxRTCPItems {
+				p.Reports = p.Reports[:maxRTCPItems]
+			}
+		case *rtcp.ReceiverReport:
+			if len(p.Reports) > maxRTCPItems {
+				p.Reports = p.Reports[:maxRTCPItems]
+			}
+		case *rtcp.SourceDescription:
+			if len(p.Chunks) > maxRTCPItems {
+				p.Chunks = p.Chunks[:maxRTCPItems]
+			}
+		case *rtcp.Goodbye:
+			if len(p.Sources) > maxRTCPItems {
+				p.Sources = p.Sources[:maxRTCPItems]
+			}
+		case *rtcp.FullIntraRequest:
+			if len(p.FIR) > maxRTCPItems {
+				p.FIR = p.FIR[:maxRTCPItems]
+			}
+		case *rtcp.TransportLayerNack:
+			if len(p.Nacks) > maxNACKPairs {
+				p.Nacks = p.Nacks[:maxNACKPairs]
+			}
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			// the bitrate is checked by rembBitrate
+			if len(p.SSRCs) > maxRTCPItems {
+				p.SSRCs = p.SSRCs[:maxRTCPItems]
+			}
+		}
+	}
+	return ps
+}
+
+// rtcpLimiter limits the rate at which an RTCP listener accepts packets
+// using a token bucket.  It is only accessed by the listener.
+type rtcpLimiter struct {
+	tokens uint64
+	last   uint64
+}
+
+// allow returns true if a compound packet received at time now should be
+// handled.
+func (l *rtcpLimiter) allow(now uint64) bool {
+	if l.last == 0 || now < l.last {
+		l.tokens = rtcpBurst * rtptime.JiffiesPerSec
+	} else {
+		l.tokens += (now - l.last) * rtcpRate
+		if l.tokens > rtcpBurst*rtptime.JiffiesPerSec {
+			l.tokens = rtcpBurst * rtptime.JiffiesPerSec
+		}
+	}
+	l.last = now
+	if l.tokens < rtptime.JiffiesPerSec {
+		return false
+	}
+	l.tokens -= rtptime.JiffiesPerSec
+	return true
+}
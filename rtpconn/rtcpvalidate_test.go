@@ -0,0 +1,158 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestAbsurdREMB(t *testing.T) {
+	buf, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: 1 << 60,
+			SSRCs:   []uint32{1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	ps, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	ps = sanitizeRTCP(ps)
+
+	track := &rtpDownTrack{ssrc: 1, atomics: &downTrackAtomics{}}
+	conn := &rtpDownConnection{
+		maxREMBBitrate: new(bitrate),
+		tracks:         []*rtpDownTrack{track},
+		ssrcs:          map[webrtc.SSRC]*rtpDownTrack{1: track},
+	}
+	now := rtptime.Jiffies()
+	var fir firState
+	for _, p := range ps {
+		handleDownRTCP(conn, track, &fir, p, now)
+	}
+	rate := conn.maxREMBBitrate.Get(now)
+	if rate != maxFeedbackBitrate {
+		t.Errorf("Expected %v, got %v", maxFeedbackBitrate, rate)
+	}
+}
+
+func TestSanitizeRTCP(t *testing.T) {
+	var ps []rtcp.Packet
+	for i := 0; i < 2*maxRTCPPackets; i++ {
+		ps = append(ps, &rtcp.TransportLayerNack{
+			Nacks: make([]rtcp.NackPair, 2*maxNACKPairs),
+		})
+	}
+	ps = sanitizeRTCP(ps)
+	if len(ps) != maxRTCPPackets {
+		t.Errorf("Expected %v, got %v", maxRTCPPackets, len(ps))
+	}
+	for _, p := range ps {
+		nacks := p.(*rtcp.TransportLayerNack).Nacks
+		if len(nacks) != maxNACKPairs {
+			t.Errorf("Expected %v, got %v", maxNACKPairs, len(nacks))
+		}
+	}
+}
+
+func TestRTCPLimiter(t *testing.T) {
+	var l rtcpLimiter
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	count := 0
+	for i := 0; i < 2*rtcpBurst; i++ {
+		if l.allow(now) {
+			count++
+		}
+	}
+	if count != rtcpBurst {
+		t.Errorf("Expected %v, got %v", rtcpBurst, count)
+	}
+
+	// the bucket refills at the configured rate
+	now += rtptime.JiffiesPerSec / 10
+	count = 0
+	for i := 0; i < rtcpRate; i++ {
+		if l.allow(now) {
+			count++
+		}
+	}
+	if count != rtcpRate/10 {
+		t.Errorf("Expected %v, got %v", rtcpRate/10, count)
+	}
+}
+
+func TestREMBClamp(t *testing.T) {
+	newConn := func() *rtpDownConnection {
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{
+				MimeType: "video/VP8", ClockRate: 90000,
+			},
+			"track", "stream",
+		)
+		if err != nil {
+			t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+		}
+		track := &rtpDownTrack{
+			track:      local,
+			ssrc:       1,
+			maxBitrate: new(bitrate),
+			atomics:    &downTrackAtomics{},
+		}
+		return &rtpDownConnection{
+			maxREMBBitrate: new(bitrate),
+			tracks:         []*rtpDownTrack{track},
+			ssrcs:          map[webrtc.SSRC]*rtpDownTrack{1: track},
+		}
+	}
+	remb := func(conn *rtpDownConnection, rate uint64, now uint64) {
+		var fir firState
+		handleDownRTCP(conn, conn.tracks[0], &fir,
+			&rtcp.ReceiverEstimatedMaximumBitrate{
+				Bitrate: rate, SSRCs: []uint32{1},
+			}, now)
+	}
+
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	conn := newConn()
+	conn.tracks[0].maxBitrate.Set(10000000, now)
+
+	remb(conn, 1000000, now)
+	if r := conn.GetMaxBitrate(now); r != 1000000 {
+		t.Errorf("Expected %v, got %v", 1000000, r)
+	}
+
+	// bogus values are ignored
+	remb(conn, 0, now)
+	if r := conn.GetMaxBitrate(now); r != 1000000 {
+		t.Errorf("Expected %v, got %v", 1000000, r)
+	}
+	remb(conn, ^uint64(0), now)
+	if r := conn.GetMaxBitrate(now); r != 1000000 {
+		t.Errorf("Expected %v, got %v", 1000000, r)
+	}
+
+	// out of range values are clamped
+	remb(conn, 1000, now)
+	if r := conn.GetMaxBitrate(now); r != group.MinBitrate {
+		t.Errorf("Expected %v, got %v", group.MinBitrate, r)
+	}
+
+	MaxBitrate = 5000000
+	defer func() {
+		MaxBitrate = 0
+	}()
+	remb(conn, 1<<50, now)
+	if r := conn.maxREMBBitrate.Get(now); r != MaxBitrate {
+		t.Errorf("Expected %v, got %v", MaxBitrate, r)
+	}
+	if r := conn.GetMaxBitrate(now); r != MaxBitrate {
+		t.Errorf("Expected %v, got %v", MaxBitrate, r)
+	}
+}
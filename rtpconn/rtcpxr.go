@@ -0,0 +1,450 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// RTCP Extended Reports (RFC 3611).  The version of pion/rtcp that we use
+// doesn't know about them, so they are returned as raw packets, which we
+// parse ourselves.  Note that pion only delivers a packet to the readers
+// of the SSRCs it concerns, so a standalone XR packet is dropped; in
+// practice, XR is sent as part of a compound packet that starts with
+// a sender or receiver report, which is delivered as a whole.
+
+const rtcpTypeXR = 207
+
+const (
+	xrBlockLossRLE = 1
+	xrBlockRRTR    = 4
+	xrBlockDLRR    = 5
+)
+
+var errXRMalformed = errors.New("malformed extended report")
+
+// xrDLRR is a sub-block of a DLRR report block.
+type xrDLRR struct {
+	SSRC uint32
+	// the middle 32 bits of the NTP time of the last RRTR block
+	LastRR uint32
+	// the delay since the last RRTR block, in units of 1/65536s
+	DLRR uint32
+}
+
+// xrLossRLE is a Loss RLE report block.
+type xrLossRLE struct {
+	SSRC     uint32
+	Thinning uint8
+	Begin    uint16
+	// one past the last seqno covered
+	End    uint16
+	Chunks []uint16
+}
+
+// extendedReport is an RTCP XR packet.  Only the blocks that we use are
+// represented, other blocks are ignored when parsing.
+type extendedReport struct {
+	SSRC uint32
+	// the NTP time of a receiver reference time block, 0 if absent
+	RRTR    uint64
+	DLRR    []xrDLRR
+	LossRLE []xrLossRLE
+}
+
+func (xr *extendedReport) DestinationSSRC() []uint32 {
+	var ssrcs []uint32
+	for _, d := range xr.DLRR {
+		ssrcs = append(ssrcs, d.SSRC)
+	}
+	for _, l := range xr.LossRLE {
+		ssrcs = append(ssrcs, l.SSRC)
+	}
+	return ssrcs
+}
+
+func (xr *extendedReport) Marshal() ([]byte, error) {
+	b := make([]byte, 8, 64)
+	binary.BigEndian.PutUint32(b[4:], xr.SSRC)
+
+	block := func(bt, specific uint8, length int) []byte {
+		var h [4]byte
+		h[0] = bt
+		h[1] = specific
+		binary.BigEndian.PutUint16(h[2:], uint16(length/4))
+		return append(b, h[:]...)
+	}
+
+	for _, l := range xr.LossRLE {
+		chunks := l.Chunks
+		if len(chunks)%2 != 0 {
+			// pad with a null chunk
+			chunks = append(chunks[:len(chunks):len(chunks)], 0)
+		}
+		b = block(xrBlockLossRLE, l.Thinning&0x0F, 8+2*len(chunks))
+		var d [8]byte
+		binary.BigEndian.PutUint32(d[0:], l.SSRC)
+		binary.BigEndian.PutUint16(d[4:], l.Begin)
+		binary.BigEndian.PutUint16(d[6:], l.End)
+		b = append(b, d[:]...)
+		for _, c := range chunks {
+			var d [2]byte
+			binary.BigEndian.PutUint16(d[:], c)
+			b = append(b, d[:]...)
+		}
+	}
+
+	if xr.RRTR != 0 {
+		b = block(xrBlockRRTR, 0, 8)
+		var d [8]byte
+		binary.BigEndian.PutUint64(d[:], xr.RRTR)
+		b = append(b, d[:]...)
+	}
+
+	if len(xr.DLRR) > 0 {
+		b = block(xrBlockDLRR, 0, 12*len(xr.DLRR))
+		for _, s := range xr.DLRR {
+			var d [12]byte
+			binary.BigEndian.PutUint32(d[0:], s.SSRC)
+			binary.BigEndian.PutUint32(d[4:], s.LastRR)
+			binary.BigEndian.PutUint32(d[8:], s.DLRR)
+			b = append(b, d[:]...)
+		}
+	}
+
+	if len(b)/4-1 > 0xFFFF {
+		return nil, errors.New("extended report too large")
+	}
+	h := rtcp.Header{
+		Type:   rtcpTypeXR,
+		Length: uint16(len(b)/4 - 1),
+	}
+	hb, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, hb)
+	return b, nil
+}
+
+func (xr *extendedReport) Unmarshal(b []byte) error {
+	var h rtcp.Header
+	err := h.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	if h.Type != rtcpTypeXR {
+		return errXRMalformed
+	}
+	length := 4 * (int(h.Length) + 1)
+	if len(b) < length || length < 8 {
+		return errXRMalformed
+	}
+	b = b[:length]
+	if h.Padding {
+		p := int(b[len(b)-1])
+		if p == 0 || p > len(b)-8 {
+			return errXRMalformed
+		}
+		b = b[:len(b)-p]
+	}
+
+	*xr = extendedReport{SSRC: binary.BigEndian.Uint32(b[4:])}
+	b = b[8:]
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errXRMalformed
+		}
+		bt := b[0]
+		l := 4 * int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return errXRMalformed
+		}
+		d := b[4 : 4+l]
+		switch bt {
+		case xrBlockLossRLE:
+			if len(d) < 8 {
+				return errXRMalformed
+			}
+			chunks := make([]uint16, 0, (len(d)-8)/2)
+			for i := 8; i+1 < len(d); i += 2 {
+				chunks = append(chunks,
+					binary.BigEndian.Uint16(d[i:]))
+			}
+			xr.LossRLE = append(xr.LossRLE, xrLossRLE{
+				SSRC:     binary.BigEndian.Uint32(d[0:]),
+				Thinning: b[1] & 0x0F,
+				Begin:    binary.BigEndian.Uint16(d[4:]),
+				End:      binary.BigEndian.Uint16(d[6:]),
+				Chunks:   chunks,
+			})
+		case xrBlockRRTR:
+			if len(d) < 8 {
+				return errXRMalformed
+			}
+			xr.RRTR = binary.BigEndian.Uint64(d)
+		case xrBlockDLRR:
+			for i := 0; i+12 <= len(d); i += 12 {
+				xr.DLRR = append(xr.DLRR, xrDLRR{
+					SSRC:   binary.BigEndian.Uint32(d[i:]),
+					LastRR: binary.BigEndian.Uint32(d[i+4:]),
+					DLRR:   binary.BigEndian.Uint32(d[i+8:]),
+				})
+			}
+		}
+		b = b[4+l:]
+	}
+	return nil
+}
+
+// parseXR returns the extended report contained in p, if any.
+func parseXR(p *rtcp.RawPacket) (*extendedReport, bool) {
+	if p.Header().Type != rtcpTypeXR {
+		return nil, false
+	}
+	var xr extendedReport
+	err := xr.Unmarshal(*p)
+	if err != nil {
+		return nil, false
+	}
+	return &xr, true
+}
+
+// rtcpXR returns true if the session description s negotiates extended
+// reports (RFC 3611 Section 5.1) on any of its media sections.
+func rtcpXR(s string) bool {
+	var d sdp.SessionDescription
+	err := d.Unmarshal([]byte(s))
+	if err != nil {
+		return false
+	}
+	if _, ok := d.Attribute("rtcp-xr"); ok {
+		return true
+	}
+	for _, m := range d.MediaDescriptions {
+		if _, ok := m.Attribute("rtcp-xr"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lossRLEChunks encodes the reception of the packets in [begin, end) as
+// a sequence of run-length chunks.
+func lossRLEChunks(begin, end uint16, received func(uint16) bool) []uint16 {
+	var chunks []uint16
+	seqno := begin
+	for seqno != end {
+		r := received(seqno)
+		n := uint16(0)
+		for seqno != end && received(seqno) == r && n < 0x3FFF {
+			seqno++
+			n++
+		}
+		c := n
+		if r {
+			c |= 0x4000
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+// lossRLEStats decodes a Loss RLE block, and returns the number of
+// packets received and lost, and the length of the longest burst of
+// consecutive losses.
+func lossRLEStats(l xrLossRLE) (received, lost, burst uint32) {
+	var run uint32
+	count := uint32(l.End - l.Begin)
+	n := uint32(0)
+	account := func(r bool) {
+		if n >= count {
+			return
+		}
+		n++
+		if r {
+			received++
+			run = 0
+		} else {
+			lost++
+			run++
+			if run > burst {
+				burst = run
+			}
+		}
+	}
+	for _, c := range l.Chunks {
+		if c == 0 {
+			// null chunk
+			break
+		}
+		if c&0x8000 == 0 {
+			r := c&0x4000 != 0
+			for i := uint16(0); i < c&0x3FFF; i++ {
+				account(r)
+			}
+		} else {
+			for i := 14; i >= 0; i-- {
+				account(c&(1<<uint(i)) != 0)
+			}
+		}
+	}
+	return
+}
+
+// xrMaxPackets is the number of packets covered by a lossHistory.
+const xrMaxPackets = 2048
+
+// A lossHistory records which packets were received since the last
+// report, for building Loss RLE blocks.
+type lossHistory struct {
+	mu    sync.Mutex
+	valid bool
+	begin uint16
+	end   uint16
+	bits  [xrMaxPackets / 64]uint64
+}
+
+func (h *lossHistory) set(seqno uint16, v bool) {
+	i := seqno % xrMaxPackets
+	if v {
+		h.bits[i/64] |= 1 << (i % 64)
+	} else {
+		h.bits[i/64] &^= 1 << (i % 64)
+	}
+}
+
+func (h *lossHistory) get(seqno uint16) bool {
+	i := seqno % xrMaxPackets
+	return h.bits[i/64]&(1<<(i%64)) != 0
+}
+
+// received records the reception of a packet.
+func (h *lossHistory) received(seqno uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.valid {
+		h.valid = true
+		h.begin = seqno
+		h.end = seqno
+	}
+	if int16(seqno-h.begin) < 0 {
+		// older than the interval being reported
+		return
+	}
+	if int16(seqno-h.end) >= 0 {
+		for h.end != seqno+1 {
+			h.set(h.end, false)
+			h.end++
+		}
+		if h.end-h.begin > xrMaxPackets {
+			h.begin = h.end - xrMaxPackets
+		}
+	}
+	h.set(seqno, true)
+}
+
+// report returns a Loss RLE block describing the packets received since
+// the last report, and starts a new interval.
+func (h *lossHistory) report(ssrc uint32) (xrLossRLE, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.valid || h.begin == h.end {
+		return xrLossRLE{}, false
+	}
+	l := xrLossRLE{
+		SSRC:   ssrc,
+		Begin:  h.begin,
+		End:    h.end,
+		Chunks: lossRLEChunks(h.begin, h.end, h.get),
+	}
+	h.begin = h.end
+	return l, true
+}
+
+// xrState remembers the last receiver reference time block, sent on an
+// up connection or received on a down connection, and, for up
+// connections, the round-trip time computed from the DLRR replies.
+type xrState struct {
+	mu sync.Mutex
+	// set to true once the peer has been replied to (down) or the reply
+	// has been accounted (up)
+	done bool
+	ssrc uint32
+	lrr  uint32
+	time uint64
+	rtt  uint64
+}
+
+// setRRTR records a receiver reference time block with the given NTP
+// time, sent or received at time now.
+func (s *xrState) setRRTR(ssrc uint32, ntp uint64, now uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lrr := uint32(ntp >> 16)
+	if s.time != 0 && s.ssrc == ssrc && s.lrr == lrr {
+		// the same block delivered to multiple tracks
+		return
+	}
+	s.done = false
+	s.ssrc = ssrc
+	s.lrr = lrr
+	s.time = now
+}
+
+// dlrr returns the DLRR sub-block replying to the last RRTR received,
+// if it has not been replied to yet.
+func (s *xrState) dlrr(now uint64) (xrDLRR, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.time == 0 || s.done || now < s.time ||
+		now-s.time > 8*rtptime.JiffiesPerSec {
+		return xrDLRR{}, false
+	}
+	s.done = true
+	return xrDLRR{
+		SSRC:   s.ssrc,
+		LastRR: s.lrr,
+		DLRR: uint32((now - s.time) /
+			(rtptime.JiffiesPerSec / 0x10000)),
+	}, true
+}
+
+// gotDLRR updates the round-trip time from a DLRR sub-block received at
+// time now.
+func (s *xrState) gotDLRR(d xrDLRR, now uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.time == 0 || s.done || d.LastRR != s.lrr ||
+		now < s.time || now-s.time > 8*rtptime.JiffiesPerSec {
+		return
+	}
+	delay := uint64(d.DLRR) * (rtptime.JiffiesPerSec / 0x10000)
+	if delay > now-s.time {
+		return
+	}
+	s.done = true
+	s.rtt = smoothRTT(s.rtt, (now-s.time)-delay)
+}
+
+func (s *xrState) getRTT() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+// smoothRTT combines a new round-trip time sample with the previous
+// estimate.
+func smoothRTT(old, rtt uint64) uint64 {
+	if old == 0 {
+		return rtt
+	}
+	return (3*old + rtt) / 4
+}
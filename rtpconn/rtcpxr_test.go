@@ -0,0 +1,207 @@
+package rtpconn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestExtendedReportMarshal(t *testing.T) {
+	xr := &extendedReport{
+		SSRC: 42,
+		RRTR: 0x0123456789ABCDEF,
+		DLRR: []xrDLRR{{SSRC: 1, LastRR: 2, DLRR: 3}},
+		LossRLE: []xrLossRLE{{
+			SSRC:   7,
+			Begin:  65530,
+			End:    10,
+			Chunks: []uint16{0x4003, 0x0002, 0x400B},
+		}},
+	}
+
+	buf, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: 42}, xr,
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if len(buf)%4 != 0 {
+		t.Errorf("Length %v is not a multiple of 4", len(buf))
+	}
+
+	ps, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(ps))
+	}
+	raw, ok := ps[1].(*rtcp.RawPacket)
+	if !ok {
+		t.Fatalf("Expected raw packet, got %T", ps[1])
+	}
+	xr2, ok := parseXR(raw)
+	if !ok {
+		t.Fatalf("Couldn't parse XR")
+	}
+
+	// the odd number of chunks was padded with a null chunk
+	xr.LossRLE[0].Chunks = append(xr.LossRLE[0].Chunks, 0)
+	if !reflect.DeepEqual(xr, xr2) {
+		t.Errorf("Expected %v, got %v", xr, xr2)
+	}
+}
+
+func TestExtendedReportUnknownBlock(t *testing.T) {
+	xr := &extendedReport{SSRC: 42, RRTR: 17}
+	buf, err := xr.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	// prepend a block of unknown type (VoIP metrics)
+	block := make([]byte, 36)
+	block[0] = 7
+	block[3] = 8
+	buf = append(buf[:8:8], append(block, buf[8:]...)...)
+	buf[3] += 9
+
+	var xr2 extendedReport
+	err = xr2.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if xr2.SSRC != 42 || xr2.RRTR != 17 {
+		t.Errorf("Expected 42 17, got %v %v", xr2.SSRC, xr2.RRTR)
+	}
+
+	err = xr2.Unmarshal(buf[:len(buf)-4])
+	if err == nil {
+		t.Errorf("Truncated packet was accepted")
+	}
+}
+
+func TestLossRLE(t *testing.T) {
+	received := func(seqno uint16) bool {
+		return seqno%10 != 3 && seqno != 65535 && seqno != 0
+	}
+	chunks := lossRLEChunks(65500, 100, received)
+	l := xrLossRLE{Begin: 65500, End: 100, Chunks: chunks}
+	r, lost, burst := lossRLEStats(l)
+	if r+lost != 136 {
+		t.Errorf("Expected 136 packets, got %v", r+lost)
+	}
+	if lost != 16 {
+		t.Errorf("Expected 16 lost, got %v", lost)
+	}
+	if burst != 2 {
+		t.Errorf("Expected burst 2, got %v", burst)
+	}
+
+	// bit vector chunk: 1 1 0 0 0 1 ... then a run of 3 losses
+	l = xrLossRLE{
+		Begin:  0,
+		End:    18,
+		Chunks: []uint16{0x8000 | 0x6000 | 0x0FFF, 0x0003},
+	}
+	r, lost, burst = lossRLEStats(l)
+	if r != 14 || lost != 4 || burst != 3 {
+		t.Errorf("Expected 14 4 3, got %v %v %v", r, lost, burst)
+	}
+}
+
+func TestLossHistory(t *testing.T) {
+	var h lossHistory
+	if _, ok := h.report(1); ok {
+		t.Errorf("Got report with no packets")
+	}
+
+	for _, s := range []uint16{65534, 65535, 2, 1, 4} {
+		h.received(s)
+	}
+	l, ok := h.report(1)
+	if !ok {
+		t.Fatalf("Got no report")
+	}
+	if l.Begin != 65534 || l.End != 5 {
+		t.Errorf("Expected [65534, 5), got [%v, %v)", l.Begin, l.End)
+	}
+	r, lost, burst := lossRLEStats(l)
+	if r != 5 || lost != 2 || burst != 1 {
+		t.Errorf("Expected 5 2 1, got %v %v %v", r, lost, burst)
+	}
+
+	// a late packet from the previous interval is ignored
+	h.received(0)
+	h.received(5)
+	l, ok = h.report(1)
+	if !ok || l.Begin != 5 || l.End != 6 {
+		t.Errorf("Expected [5, 6), got %v [%v, %v)", ok, l.Begin, l.End)
+	}
+
+	// a large gap is limited to the size of the history
+	h.received(10000)
+	l, ok = h.report(1)
+	if !ok || l.End-l.Begin != xrMaxPackets || l.End != 10001 {
+		t.Errorf("Expected %v packets ending at 10001, got [%v, %v)",
+			xrMaxPackets, l.Begin, l.End)
+	}
+	r, lost, _ = lossRLEStats(l)
+	if r != 1 || lost != xrMaxPackets-1 {
+		t.Errorf("Expected 1 %v, got %v %v", xrMaxPackets-1, r, lost)
+	}
+}
+
+func TestXRState(t *testing.T) {
+	var up xrState
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	ntp := uint64(0x0123456789ABCDEF)
+	up.setRRTR(0, ntp, now)
+
+	// the peer held the RRTR for 100ms, and the RTT is 50ms
+	d := xrDLRR{
+		LastRR: uint32(ntp >> 16),
+		DLRR:   0x10000 / 10,
+	}
+	up.gotDLRR(d, now+rtptime.JiffiesPerSec*3/20)
+	rtt := up.getRTT()
+	if rtt < rtptime.JiffiesPerSec/20-1000 ||
+		rtt > rtptime.JiffiesPerSec/20+1000 {
+		t.Errorf("Expected 50ms, got %v",
+			rtptime.ToDuration(rtt, rtptime.JiffiesPerSec))
+	}
+
+	// the same reply delivered to another track is ignored
+	up.gotDLRR(d, now+rtptime.JiffiesPerSec)
+	if up.getRTT() != rtt {
+		t.Errorf("Duplicate DLRR was accounted")
+	}
+
+	var down xrState
+	down.setRRTR(7, ntp, now)
+	down.setRRTR(7, ntp, now+100)
+	d, ok := down.dlrr(now + rtptime.JiffiesPerSec/2)
+	if !ok {
+		t.Fatalf("Got no DLRR")
+	}
+	if d.SSRC != 7 || d.LastRR != uint32(ntp>>16) || d.DLRR != 0x8000 {
+		t.Errorf("Unexpected DLRR %v", d)
+	}
+	if _, ok := down.dlrr(now + rtptime.JiffiesPerSec); ok {
+		t.Errorf("Got DLRR twice")
+	}
+}
+
+func TestRTCPXRNegotiated(t *testing.T) {
+	sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"c=IN IP4 0.0.0.0\r\na=mid:0\r\n"
+	if rtcpXR(sdp) {
+		t.Errorf("Expected false")
+	}
+	if !rtcpXR(sdp + "a=rtcp-xr:rcvr-rtt=all\r\n") {
+		t.Errorf("Expected true")
+	}
+}
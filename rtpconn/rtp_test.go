@@ -1,9 +1,24 @@
 package rtpconn
 
 import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/rtptime"
 )
 
 func TestVP8Keyframe(t *testing.T) {
@@ -127,3 +142,1519 @@ func TestH264Keyframe(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyframeRateLimited(t *testing.T) {
+	var last uint64
+	now := uint64(rtptime.JiffiesPerSec)
+	interval := uint64(keyframeRequestInterval)
+
+	if keyframeRateLimited(&last, now, interval, false) {
+		t.Errorf("First request was rate limited")
+	}
+	if !keyframeRateLimited(&last, now+rtptime.JiffiesPerSec/4, interval, false) {
+		t.Errorf("Second request was not rate limited")
+	}
+	if keyframeRateLimited(&last, now+rtptime.JiffiesPerSec/4, interval, true) {
+		t.Errorf("Forced request was rate limited")
+	}
+	if last != now+rtptime.JiffiesPerSec/4 {
+		t.Errorf("Forced request didn't update time")
+	}
+	if keyframeRateLimited(&last, now+rtptime.JiffiesPerSec, interval, false) {
+		t.Errorf("Late request was rate limited")
+	}
+}
+
+func TestKeyframeInterval(t *testing.T) {
+	up := &rtpUpConnection{}
+	if i := up.keyframeInterval("pli"); i != keyframeRequestInterval {
+		t.Errorf("Expected %v, got %v", keyframeRequestInterval, i)
+	}
+
+	g, err := group.Add("keyframe-interval-test",
+		&group.Description{PLIInterval: 100, FIRInterval: 2000})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	up.group = g
+
+	pli := up.keyframeInterval("pli")
+	if pli != rtptime.JiffiesPerSec/10 {
+		t.Errorf("Expected %v, got %v", rtptime.JiffiesPerSec/10, pli)
+	}
+	fir := up.keyframeInterval("fir")
+	if fir != 2*rtptime.JiffiesPerSec {
+		t.Errorf("Expected %v, got %v", 2*rtptime.JiffiesPerSec, fir)
+	}
+
+	var last uint64
+	now := uint64(rtptime.JiffiesPerSec)
+	keyframeRateLimited(&last, now, pli, false)
+	if keyframeRateLimited(&last, now+rtptime.JiffiesPerSec/8, pli, false) {
+		t.Errorf("PLI was rate limited")
+	}
+	keyframeRateLimited(&last, now, fir, true)
+	if !keyframeRateLimited(&last, now+rtptime.JiffiesPerSec, fir, false) {
+		t.Errorf("FIR was not rate limited")
+	}
+}
+
+func TestTrackLess(t *testing.T) {
+	tracks := []*rtpUpTrack{
+		{mid: "10"},
+		{label: "b", mid: "0"},
+		{mid: "2"},
+		{label: "a", mid: "1"},
+		{mid: "1"},
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return trackLess(tracks[i], tracks[j])
+	})
+	expected := []string{"/1", "/2", "/10", "a/1", "b/0"}
+	for i, tr := range tracks {
+		if tr.label+"/"+tr.mid != expected[i] {
+			t.Errorf("Expected %v, got %v/%v",
+				expected[i], tr.label, tr.mid)
+		}
+	}
+}
+
+func TestTrackLessLabels(t *testing.T) {
+	// the labels are the track ids of the msid, the order of the
+	// mids doesn't matter
+	tracks := []*rtpUpTrack{
+		{label: "f3a1-video", mid: "0"},
+		{label: "0b7c-audio", mid: "1"},
+		{label: "9d2e-screen", mid: "2"},
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return trackLess(tracks[i], tracks[j])
+	})
+	expected := []string{"0b7c-audio", "9d2e-screen", "f3a1-video"}
+	for i, tr := range tracks {
+		if tr.label != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], tr.label)
+		}
+	}
+}
+
+func TestPacketMid(t *testing.T) {
+	var packet rtp.Packet
+	if mid := packetMid(&packet, 3); mid != "" {
+		t.Errorf("Expected empty mid, got %v", mid)
+	}
+	err := packet.SetExtension(3, []byte("1"))
+	if err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+	if mid := packetMid(&packet, 3); mid != "1" {
+		t.Errorf("Expected 1, got %v", mid)
+	}
+	if mid := packetMid(&packet, 0); mid != "" {
+		t.Errorf("Expected empty mid, got %v", mid)
+	}
+}
+
+func TestSetTrackMid(t *testing.T) {
+	t0 := &rtpUpTrack{mid: "0"}
+	t1 := &rtpUpTrack{}
+	up := &rtpUpConnection{tracks: []*rtpUpTrack{t1, t0}}
+	up.setTrackMid(t1, "1")
+	if up.tracks[0] != t0 || up.tracks[1] != t1 || t1.getMid() != "1" {
+		t.Errorf("Expected 0 1, got %v %v",
+			up.tracks[0].getMid(), up.tracks[1].getMid())
+	}
+}
+
+func TestEarlyTrack(t *testing.T) {
+	t0 := &rtpUpTrack{mid: "0"}
+	up := &rtpUpConnection{tracks: []*rtpUpTrack{t0}}
+
+	// a track whose mid is not known yet is published immediately,
+	// and its mid is learnt from a packet while other tracks are
+	// being added and the track list is being read.
+	t1 := &rtpUpTrack{}
+	up.mu.Lock()
+	up.tracks = append(up.tracks, t1)
+	up.mu.Unlock()
+
+	if tracks := up.getTracks(); len(tracks) != 2 || tracks[1] != t1 {
+		t.Fatalf("Track with unknown mid was not published")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			up.getTracks()
+		}
+	}()
+	t2 := &rtpUpTrack{mid: "2"}
+	up.mu.Lock()
+	up.tracks = append(up.tracks, t2)
+	up.mu.Unlock()
+	up.setTrackMid(t1, "1")
+	<-done
+
+	tracks := up.getTracks()
+	if len(tracks) != 3 ||
+		tracks[0] != t0 || tracks[1] != t1 || tracks[2] != t2 {
+		t.Errorf("Unexpected track order")
+	}
+}
+
+const renegotiatedOffer = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"a=mid:0\r\n" +
+	"a=sendonly\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"a=mid:1\r\n" +
+	"a=inactive\r\n" +
+	"m=video 0 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"a=mid:2\r\n" +
+	"a=sendonly\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"a=mid:3\r\n"
+
+func TestActiveMids(t *testing.T) {
+	mids, err := activeMids(renegotiatedOffer)
+	if err != nil {
+		t.Fatalf("activeMids: %v", err)
+	}
+	if len(mids) != 2 || !mids["0"] || !mids["3"] {
+		t.Errorf("Expected 0 3, got %v", mids)
+	}
+}
+
+func TestUpdateInactiveTracks(t *testing.T) {
+	newTrack := func(mid string) *rtpUpTrack {
+		return &rtpUpTrack{
+			mid:        mid,
+			localCh:    make(chan localTrackAction, 2),
+			readerDone: make(chan struct{}),
+			atomics:    &upTrackAtomics{},
+		}
+	}
+	audio := newTrack("0")
+	video := newTrack("1")
+	unknown := newTrack("")
+	video.AddLocal(&rtpDownTrack{})
+	up := &rtpUpConnection{
+		tracks: []*rtpUpTrack{audio, video, unknown},
+	}
+
+	changed, err := up.updateInactiveTracks(renegotiatedOffer)
+	if err != nil || !changed {
+		t.Fatalf("Expected change, got %v %v", changed, err)
+	}
+	tracks := up.getTracks()
+	if len(tracks) != 2 || tracks[0] != audio || tracks[1] != unknown {
+		t.Errorf("Expected audio and unknown, got %v", tracks)
+	}
+	if all := up.getAllTracks(); len(all) != 3 {
+		t.Errorf("Expected 3 tracks, got %v", all)
+	}
+	if l := video.getLocal(); len(l) != 0 {
+		t.Errorf("Expected no local tracks, got %v", l)
+	}
+
+	changed, err = up.updateInactiveTracks(renegotiatedOffer)
+	if err != nil || changed {
+		t.Errorf("Expected no change, got %v %v", changed, err)
+	}
+
+	// the video track becomes active again
+	offer := strings.Replace(renegotiatedOffer,
+		"a=mid:1\r\na=inactive", "a=mid:1\r\na=sendonly", 1)
+	changed, err = up.updateInactiveTracks(offer)
+	if err != nil || !changed {
+		t.Fatalf("Expected change, got %v %v", changed, err)
+	}
+	tracks = up.getTracks()
+	if len(tracks) != 3 || tracks[1] != video {
+		t.Errorf("Expected 3 tracks, got %v", tracks)
+	}
+}
+
+type rtpRecorder struct {
+	packets []*rtp.Packet
+}
+
+func (r *rtpRecorder) WriteRTP(p *rtp.Packet) error {
+	q := *p
+	r.packets = append(r.packets, &q)
+	return nil
+}
+
+func TestSendRecovery(t *testing.T) {
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	for _, seqno := range []uint16{42, 44} {
+		p := rtp.Packet{Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: seqno,
+		}}
+		buf, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		up.cache.Store(seqno, 0, false, false, buf)
+	}
+
+	w := &rtpRecorder{}
+	unhandled := sendRecovery(w, up, estimator.New(time.Second),
+		[]rtcp.NackPair{{PacketID: 42, LostPackets: 0x3}},
+	)
+	if len(unhandled) != 1 || unhandled[0] != 43 {
+		t.Errorf("Expected [43], got %v", unhandled)
+	}
+	if len(w.packets) != 2 ||
+		w.packets[0].SequenceNumber != 42 ||
+		w.packets[1].SequenceNumber != 44 {
+		t.Errorf("Expected 42 and 44, got %v", w.packets)
+	}
+}
+
+func TestForwardingStats(t *testing.T) {
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	p := rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 42}}
+	buf, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	up.cache.Store(42, 0, false, false, buf)
+
+	wp := &rtpWriterPool{track: up}
+	wp.write(42, 0, 0, false, true, false)
+	received, last := up.getReceived()
+	if received != 1 || last == 0 {
+		t.Errorf("Expected 1 packet received, got %v %v",
+			received, last)
+	}
+
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "audio/opus"},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	down := &rtpDownTrack{
+		track:   local,
+		rate:    estimator.New(time.Second),
+		atomics: &downTrackAtomics{},
+	}
+	accumulate(down, uint32(len(buf)), false)
+	sendRecovery(down, up, down.rate,
+		[]rtcp.NackPair{{PacketID: 42, LostPackets: 0}},
+	)
+	forwarded, recovered, last := down.getForwarded()
+	if forwarded != 2 || recovered != 1 || last == 0 {
+		t.Errorf("Expected 2 and 1, got %v %v %v",
+			forwarded, recovered, last)
+	}
+}
+
+func TestSendNACKs(t *testing.T) {
+	w := &rtcpRecorder{}
+	nacks := []rtcp.NackPair{{PacketID: 42, LostPackets: 0x5}}
+	err := sendNACKs(w, 1234, nacks)
+	if err != nil {
+		t.Fatalf("sendNACKs: %v", err)
+	}
+	if len(w.packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %v", len(w.packets))
+	}
+	p, ok := w.packets[0].(*rtcp.TransportLayerNack)
+	if !ok {
+		t.Fatalf("Expected NACK, got %T", w.packets[0])
+	}
+	if p.MediaSSRC != 1234 || len(p.Nacks) != 1 || p.Nacks[0] != nacks[0] {
+		t.Errorf("Expected %v, got %v", nacks, p)
+	}
+}
+
+func TestHandleReport(t *testing.T) {
+	track := &rtpDownTrack{
+		maxBitrate: new(bitrate),
+		rate:       estimator.New(time.Second),
+		stats:      new(receiverStats),
+		atomics:    &downTrackAtomics{},
+	}
+	now := rtptime.Jiffies()
+	handleReport(track, rtcp.ReceptionReport{FractionLost: 128}, now)
+	loss, _ := track.stats.Get(now)
+	if loss != 128 {
+		t.Errorf("Expected 128, got %v", loss)
+	}
+	rate := track.maxBitrate.Get(now)
+	if rate != initLossRate*(512-128)/512 {
+		t.Errorf("Expected %v, got %v",
+			initLossRate*(512-128)/512, rate)
+	}
+}
+
+func TestReportResetsPeak(t *testing.T) {
+	track := &rtpDownTrack{
+		maxBitrate: new(bitrate),
+		rate:       estimator.New(80 * time.Millisecond),
+		stats:      new(receiverStats),
+		atomics:    &downTrackAtomics{},
+	}
+	track.rate.Accumulate(10000)
+	time.Sleep(15 * time.Millisecond)
+	track.rate.Accumulate(100)
+	if track.rate.EstimatePeak() == 0 {
+		t.Fatalf("Expected a peak")
+	}
+
+	// the rate is reduced, the peak was caused by the old rate
+	now := rtptime.Jiffies()
+	handleReport(track, rtcp.ReceptionReport{FractionLost: 128}, now)
+	if peak := track.rate.EstimatePeak(); peak != 0 {
+		t.Errorf("Expected 0, got %v", peak)
+	}
+}
+
+func TestReceiverReportTimeout(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		RTCPInterval = interval
+		ReceiverReportTimeout = timeout
+	}(RTCPInterval, ReceiverReportTimeout)
+
+	sec := uint64(rtptime.JiffiesPerSec)
+	now := 1000 * sec
+	var br bitrate
+	var stats receiverStats
+	check := func(reports uint64, expected bool) {
+		br.Set(100000, now)
+		stats.Set(10, 20, now)
+		for i := uint64(1); i <= reports; i++ {
+			later := now + i*sec*uint64(RTCPInterval/time.Second)
+			rate := br.Get(later)
+			loss, _ := stats.Get(later)
+			fresh := rate != ^uint64(0) && loss == 10
+			if i < reports && !fresh {
+				t.Errorf("Interval %v, report %v: spurious timeout",
+					RTCPInterval, i)
+			}
+			if i == reports && fresh != expected {
+				t.Errorf("Interval %v, report %v: "+
+					"expected %v, got %v",
+					RTCPInterval, i, expected, fresh)
+			}
+		}
+	}
+
+	// a slow RTCP cadence, up to 7 missed reports are tolerated
+	RTCPInterval = 10 * time.Second
+	check(8, true)
+	check(9, false)
+
+	// the default is never shorter than 30s
+	RTCPInterval = time.Second
+	check(30, true)
+	check(31, false)
+
+	ReceiverReportTimeout = 5 * time.Second
+	check(5, true)
+	check(6, false)
+}
+
+func TestLosslessReport(t *testing.T) {
+	track := &rtpDownTrack{
+		maxBitrate: new(bitrate),
+		rate:       estimator.New(time.Second),
+		stats:      new(receiverStats),
+		atomics:    &downTrackAtomics{},
+		lossless:   true,
+	}
+	now := rtptime.Jiffies()
+	handleReport(track, rtcp.ReceptionReport{FractionLost: 128}, now)
+	rate := track.maxBitrate.Get(now)
+	if rate != maxLossRate {
+		t.Errorf("Expected %v, got %v", maxLossRate, rate)
+	}
+}
+
+func TestLosslessWrite(t *testing.T) {
+	congested := func(lossless bool) (*rtpWriterPool, *rtpWriter) {
+		w := &rtpWriter{
+			ch:   make(chan packetIndex),
+			done: make(chan struct{}),
+		}
+		return &rtpWriterPool{
+			track:    &rtpUpTrack{atomics: &upTrackAtomics{}},
+			writers:  []*rtpWriter{w},
+			lossless: lossless,
+		}, w
+	}
+
+	wp, w := congested(false)
+	wp.write(1, 1, 0, true, false, false)
+	if w.drop == 0 {
+		t.Errorf("Expected drop")
+	}
+
+	wp, w = congested(true)
+	received := make(chan packetIndex, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		received <- <-w.ch
+	}()
+	wp.write(2, 1, 0, true, false, false)
+	if w.drop != 0 {
+		t.Errorf("Expected no drop, got %v", w.drop)
+	}
+	if pi := <-received; pi.seqno != 2 {
+		t.Errorf("Expected 2, got %v", pi.seqno)
+	}
+}
+
+func TestWriterSkip(t *testing.T) {
+	w := &rtpWriter{
+		ch:   make(chan packetIndex, 1),
+		done: make(chan struct{}),
+	}
+	wp := &rtpWriterPool{
+		track:   &rtpUpTrack{atomics: &upTrackAtomics{}},
+		writers: []*rtpWriter{w},
+	}
+
+	wp.skip()
+	wp.write(1, 1, 0, false, true, false)
+	if pi := <-w.ch; !pi.resync {
+		t.Errorf("Expected resync")
+	}
+	wp.write(2, 2, 0, false, true, false)
+	if pi := <-w.ch; pi.resync {
+		t.Errorf("Unexpected resync")
+	}
+
+	// the writer is congested, the resync is carried over
+	wp.skip()
+	w.ch <- packetIndex{}
+	wp.write(4, 4, 0, false, true, false)
+	<-w.ch
+	wp.write(5, 5, 0, false, true, false)
+	if pi := <-w.ch; pi.seqno != 5 || !pi.resync {
+		t.Errorf("Expected 5 true, got %v %v", pi.seqno, pi.resync)
+	}
+
+	// packets received while muted are skipped
+	wp.track.setMuted(true)
+	wp.write(6, 6, 0, false, true, false)
+	wp.track.setMuted(false)
+	wp.write(7, 7, 0, false, true, false)
+	if pi := <-w.ch; pi.seqno != 7 || !pi.resync {
+		t.Errorf("Expected 7 true, got %v %v", pi.seqno, pi.resync)
+	}
+}
+
+func TestPauseResync(t *testing.T) {
+	opus := webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000}
+	local, err := webrtc.NewTrackLocalStaticRTP(opus, "track", "stream")
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	// the pacer allows observing the packets that are sent
+	p := newPacer()
+	down := &rtpDownTrack{
+		track:   local,
+		rate:    estimator.New(time.Second),
+		atomics: &downTrackAtomics{},
+		pacer:   p,
+	}
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	s := &writerState{
+		track: up,
+		codec: webrtc.RTPCodecParameters{RTPCodecCapability: opus},
+		b:     packetcache.GetBuffer(),
+		local: []conn.DownTrack{down},
+	}
+	defer packetcache.PutBuffer(s.b)
+
+	write := func(seqno uint16) {
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seqno,
+				Timestamp:      uint32(seqno) * 960,
+			},
+			Payload: []byte{1},
+		}
+		buf, err := packet.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		_, index := up.cache.Store(
+			seqno, packet.Timestamp, false, false, buf,
+		)
+		s.handlePacket(packetIndex{seqno: seqno, index: index})
+	}
+
+	write(100)
+	write(101)
+	down.setPaused(true)
+	write(102)
+	write(103)
+	down.setPaused(false)
+	write(104)
+
+	var sent []*rtp.Packet
+	for {
+		_, packet, _ := p.pop(rtptime.Jiffies(), 100000000)
+		if packet == nil {
+			break
+		}
+		sent = append(sent, packet)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 packets, got %v", sent)
+	}
+	// the seqnos are continuous, the timestamps reflect the pause
+	if sent[2].SequenceNumber != 102 || sent[2].Timestamp != 104*960 {
+		t.Errorf("Expected 102 %v, got %v %v", 104*960,
+			sent[2].SequenceNumber, sent[2].Timestamp)
+	}
+}
+
+func TestSenderReportWrap(t *testing.T) {
+	track := &rtpDownTrack{
+		ssrc: 1234,
+		rate: estimator.New(time.Second),
+	}
+	for i := 0; i < 5; i++ {
+		track.rate.Accumulate(1 << 30)
+	}
+	sr := senderReport(track, 42, 43)
+	if sr.SSRC != 1234 || sr.NTPTime != 42 || sr.RTPTime != 43 {
+		t.Errorf("Bad sender report %v", sr)
+	}
+	if sr.PacketCount != 5 {
+		t.Errorf("Expected 5, got %v", sr.PacketCount)
+	}
+	if sr.OctetCount != 1<<30 {
+		t.Errorf("Expected %v, got %v", 1<<30, sr.OctetCount)
+	}
+}
+
+func TestSetFmtp(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"", "stereo=1;useinbandfec=1"},
+		{"minptime=10;useinbandfec=0", "minptime=10;useinbandfec=1;stereo=1"},
+		{"stereo=0;usedtx=1", "stereo=1;usedtx=1;useinbandfec=1"},
+	}
+	for _, test := range tests {
+		out := setFmtp(test.in, opusParameters(true))
+		if out != test.out {
+			t.Errorf("Expected %v, got %v", test.out, out)
+		}
+	}
+}
+
+func TestOpusStereoAnswer(t *testing.T) {
+	offerer := group.APIFromCodecs([]webrtc.RTPCodecCapability{{
+		MimeType:    "audio/opus",
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;sprop-stereo=1;usedtx=1",
+	}})
+	opc, err := offerer.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer opc.Close()
+	_, err = opc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		},
+	)
+	if err != nil {
+		t.Fatalf("AddTransceiver: %v", err)
+	}
+	offer, err := opc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	err = opc.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+
+	apc, err := group.APIFromNames([]string{"opus"}).
+		NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer apc.Close()
+	_, err = apc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		},
+	)
+	if err != nil {
+		t.Fatalf("AddTransceiver: %v", err)
+	}
+	err = apc.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatalf("SetRemoteDescription: %v", err)
+	}
+	answer, err := apc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("CreateAnswer: %v", err)
+	}
+	var o sdp.SessionDescription
+	err = o.Unmarshal([]byte(offer.SDP))
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !opusStereo(&o) {
+		t.Errorf("Expected stereo offer")
+	}
+	mono, err := fixOpusAnswer(answer.SDP, false, 0)
+	if err != nil {
+		t.Fatalf("fixOpusAnswer: %v", err)
+	}
+	if strings.Contains(mono, ";stereo=1") ||
+		strings.Contains(mono, " stereo=1") {
+		t.Errorf("Unexpected stereo in %v", mono)
+	}
+	answer.SDP, err = fixOpusAnswer(answer.SDP, true, 32000)
+	if err != nil {
+		t.Fatalf("fixOpusAnswer: %v", err)
+	}
+
+	var s sdp.SessionDescription
+	err = s.Unmarshal([]byte(answer.SDP))
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(s.MediaDescriptions) != 1 {
+		t.Fatalf("Expected 1 media, got %v", len(s.MediaDescriptions))
+	}
+	fmtp, ok := s.MediaDescriptions[0].Attribute("fmtp")
+	if !ok {
+		t.Fatalf("No fmtp in answer")
+	}
+	for _, p := range []string{
+		"stereo=1", "useinbandfec=1", "usedtx=1",
+		"maxaveragebitrate=32000",
+	} {
+		if !strings.Contains(fmtp, p) {
+			t.Errorf("Expected %v in %v", p, fmtp)
+		}
+	}
+
+	err = opc.SetRemoteDescription(answer)
+	if err != nil {
+		t.Errorf("SetRemoteDescription: %v", err)
+	}
+}
+
+func TestOpusStereo(t *testing.T) {
+	tests := []struct {
+		fmtp   string
+		stereo bool
+	}{
+		{"minptime=10;useinbandfec=1", false},
+		{"minptime=10;sprop-stereo=0", false},
+		{"minptime=10; sprop-stereo=1", true},
+		{"stereo=1", true},
+	}
+	for _, test := range tests {
+		var s sdp.SessionDescription
+		err := s.Unmarshal([]byte("v=0\r\n" +
+			"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+			"s=-\r\n" +
+			"t=0 0\r\n" +
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+			"a=rtpmap:111 opus/48000/2\r\n" +
+			"a=fmtp:111 " + test.fmtp + "\r\n"))
+		if err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if st := opusStereo(&s); st != test.stereo {
+			t.Errorf("%v: expected %v, got %v",
+				test.fmtp, test.stereo, st)
+		}
+	}
+}
+
+func TestPauseTracks(t *testing.T) {
+	newTrack := func(mimeType string) *rtpDownTrack {
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{MimeType: mimeType},
+			"track", "stream",
+		)
+		if err != nil {
+			t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+		}
+		return &rtpDownTrack{
+			track:   local,
+			atomics: &downTrackAtomics{},
+		}
+	}
+	audio := newTrack("audio/opus")
+	video := newTrack("video/VP8")
+	down := &rtpDownConnection{
+		tracks: []*rtpDownTrack{audio, video},
+	}
+
+	err := down.pauseTracks("video", true)
+	if err != nil || audio.getPaused() || !video.getPaused() {
+		t.Errorf("Pause video: %v %v %v",
+			err, audio.getPaused(), video.getPaused())
+	}
+	err = down.pauseTracks("", true)
+	if err != nil || !audio.getPaused() || !video.getPaused() {
+		t.Errorf("Pause all: %v %v %v",
+			err, audio.getPaused(), video.getPaused())
+	}
+	err = down.pauseTracks("", false)
+	if err != nil || audio.getPaused() || video.getPaused() {
+		t.Errorf("Resume all: %v %v %v",
+			err, audio.getPaused(), video.getPaused())
+	}
+	if audio.getWaitingKeyframe() || !video.getWaitingKeyframe() {
+		t.Errorf("Expected video waiting for keyframe")
+	}
+	err = down.pauseTracks("data", true)
+	if err == nil {
+		t.Errorf("Expected error for unknown kind")
+	}
+}
+
+func TestKeyframeRequested(t *testing.T) {
+	track := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	track.keyframeRequested(42)
+	track.keyframeRequested(43)
+	if r := track.atomics.kfRequested; r != 42 {
+		t.Errorf("Expected 42, got %v", r)
+	}
+	track.atomics.kfStage = 1
+	track.gotKeyframe(44)
+	if track.atomics.kfRequested != 0 || track.atomics.kfStage != 0 ||
+		track.atomics.lastKeyframe != 44 {
+		t.Errorf("Expected 0 0 44, got %v %v %v",
+			track.atomics.kfRequested, track.atomics.kfStage,
+			track.atomics.lastKeyframe)
+	}
+}
+
+func TestKeyframeOverdue(t *testing.T) {
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	requested := now - 3*rtptime.JiffiesPerSec
+	tests := []struct {
+		requested, lastReceived uint64
+		overdue                 bool
+	}{
+		{0, now, false},
+		{now - rtptime.JiffiesPerSec, now, false},
+		// the sender is idle
+		{requested, requested - rtptime.JiffiesPerSec, false},
+		// a low frame rate sender that sent a frame since
+		{requested, requested + rtptime.JiffiesPerSec, false},
+		// media is flowing, but no keyframe
+		{requested, now, true},
+	}
+	for _, tt := range tests {
+		o := keyframeOverdue(now, tt.requested, tt.lastReceived)
+		if o != tt.overdue {
+			t.Errorf("%v %v: expected %v, got %v",
+				tt.requested, tt.lastReceived, tt.overdue, o)
+		}
+	}
+}
+
+type nullWriter struct{}
+
+func (w nullWriter) WriteRTP(p *rtp.Packet) error {
+	return nil
+}
+
+func BenchmarkSendRecovery(b *testing.B) {
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	p := rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: 42},
+		Payload: make([]byte, 1200),
+	}
+	buf, err := p.Marshal()
+	if err != nil {
+		b.Fatalf("Marshal: %v", err)
+	}
+	up.cache.Store(42, 0, false, false, buf)
+	rate := estimator.New(time.Second)
+	nacks := []rtcp.NackPair{{PacketID: 42}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendRecovery(nullWriter{}, up, rate, nacks)
+	}
+}
+
+// garbageReader returns an unparseable packet at every call, and never
+// fails.
+type garbageReader struct{}
+
+func (r garbageReader) Read(buf []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	buf[0] = 0
+	return 1, nil
+}
+
+func TestListenerCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{}, 3)
+	go func() {
+		rtcpUpListener(ctx, &rtpUpConnection{}, &rtpUpTrack{},
+			garbageReader{})
+		done <- struct{}{}
+	}()
+	go func() {
+		rtcpDownListener(ctx, &rtpDownConnection{}, &rtpDownTrack{},
+			garbageReader{})
+		done <- struct{}{}
+	}()
+	go func() {
+		rtcpUpSender(ctx, &rtpUpConnection{})
+		done <- struct{}{}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Goroutine didn't terminate")
+		}
+	}
+}
+
+// blockingReader blocks in Read until it is closed.
+type blockingReader struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *blockingReader) Read(buf []byte) (int, error) {
+	<-r.closed
+	return 0, io.EOF
+}
+
+func (r *blockingReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestListenerCancelBlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	up := &blockingReader{closed: make(chan struct{})}
+	down := &blockingReader{closed: make(chan struct{})}
+	closeOnCancel(ctx, up)
+	closeOnCancel(ctx, down)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		rtcpUpListener(ctx, &rtpUpConnection{}, &rtpUpTrack{}, up)
+		done <- struct{}{}
+	}()
+	go func() {
+		rtcpDownListener(ctx, &rtpDownConnection{}, &rtpDownTrack{},
+			down)
+		done <- struct{}{}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Goroutine terminated before cancel")
+	default:
+	}
+
+	cancel()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Goroutine didn't terminate")
+		}
+	}
+}
+
+func TestHandleDownRTCP(t *testing.T) {
+	newTrack := func(ssrc webrtc.SSRC) *rtpDownTrack {
+		return &rtpDownTrack{
+			ssrc:       ssrc,
+			maxBitrate: new(bitrate),
+			rate:       estimator.New(time.Second),
+			stats:      new(receiverStats),
+			atomics:    &downTrackAtomics{},
+		}
+	}
+	t1 := newTrack(1)
+	t2 := newTrack(2)
+	conn := &rtpDownConnection{
+		maxREMBBitrate: new(bitrate),
+		tracks:         []*rtpDownTrack{t1, t2},
+		ssrcs: map[webrtc.SSRC]*rtpDownTrack{
+			1: t1,
+			2: t2,
+		},
+	}
+
+	now := rtptime.Jiffies()
+	var fir firState
+	handleDownRTCP(conn, t1, &fir, &rtcp.ReceiverReport{
+		Reports: []rtcp.ReceptionReport{
+			{SSRC: 1, FractionLost: 10},
+			{SSRC: 2, FractionLost: 20},
+			{SSRC: 3, FractionLost: 30},
+		},
+	}, now)
+
+	if loss, _ := t1.stats.Get(now); loss != 10 {
+		t.Errorf("Expected 10, got %v", loss)
+	}
+	if loss, _ := t2.stats.Get(now); loss != 0 {
+		t.Errorf("Report was routed to the wrong track (%v)", loss)
+	}
+
+	// these would crash if they were routed to t1, which has no remote
+	handleDownRTCP(conn, t1, &fir, &rtcp.TransportLayerNack{
+		MediaSSRC: 3,
+		Nacks:     []rtcp.NackPair{{PacketID: 42}},
+	}, now)
+	handleDownRTCP(conn, t1, &fir, &rtcp.FullIntraRequest{
+		FIR: []rtcp.FIREntry{{SSRC: 2, SequenceNumber: 1}},
+	}, now)
+	if fir.got {
+		t.Errorf("FIR for another track was handled")
+	}
+}
+
+type recordingDownTrack struct {
+	packets []uint16
+}
+
+func (t *recordingDownTrack) WriteRTP(p *rtp.Packet) error {
+	t.packets = append(t.packets, p.SequenceNumber)
+	return nil
+}
+
+func (t *recordingDownTrack) Accumulate(bytes uint32) {
+}
+
+func (t *recordingDownTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+}
+
+func (t *recordingDownTrack) SetCname(string) {
+}
+
+func TestReplayKeyframe(t *testing.T) {
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	vp8 := webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000}
+	store := func(seqno uint16, ts uint32, kf, marker bool) {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seqno,
+				Timestamp:      ts,
+				Marker:         marker,
+			},
+			Payload: []byte{0},
+		}
+		buf, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		up.gotPacket(seqno)
+		up.cache.Store(seqno, ts, kf, marker, buf)
+	}
+
+	var track recordingDownTrack
+	sent, stale := replayKeyframe(&track, up, vp8)
+	if sent || stale {
+		t.Errorf("Expected false false, got %v %v", sent, stale)
+	}
+
+	store(1, 1000, true, false)
+	store(2, 1000, false, true)
+	store(3, 4000, false, true)
+	sent, stale = replayKeyframe(&track, up, vp8)
+	if !sent || stale {
+		t.Errorf("Expected true false, got %v %v", sent, stale)
+	}
+	if len(track.packets) != 2 ||
+		track.packets[0] != 1 || track.packets[1] != 2 {
+		t.Errorf("Expected [1 2], got %v", track.packets)
+	}
+
+	// only VP8 is replayed
+	track.packets = nil
+	h264 := webrtc.RTPCodecCapability{MimeType: "video/H264", ClockRate: 90000}
+	sent, _ = replayKeyframe(&track, up, h264)
+	if sent || len(track.packets) != 0 {
+		t.Errorf("H.264 keyframe was sent: %v", track.packets)
+	}
+
+	track.packets = nil
+	store(4, 1000+2*90000, false, true)
+	sent, stale = replayKeyframe(&track, up, vp8)
+	if sent || !stale {
+		t.Errorf("Expected false true, got %v %v", sent, stale)
+	}
+	if len(track.packets) != 0 {
+		t.Errorf("Stale keyframe was sent: %v", track.packets)
+	}
+}
+
+func TestReplayKeyframeMuted(t *testing.T) {
+	up := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	vp8 := webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000}
+	store := func(seqno uint16, kf, marker bool) {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seqno,
+				Timestamp:      1000,
+				Marker:         marker,
+			},
+			Payload: []byte{0},
+		}
+		buf, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		up.gotPacket(seqno)
+		up.cache.Store(seqno, 1000, kf, marker, buf)
+	}
+
+	// the reader still stores packets while the track is muted
+	up.setMuted(true)
+	store(1, true, false)
+	store(2, false, true)
+
+	var track recordingDownTrack
+	sent, _ := replayKeyframe(&track, up, vp8)
+	if sent || len(track.packets) != 0 {
+		t.Errorf("Muted keyframe was sent: %v", track.packets)
+	}
+
+	// a keyframe received while muted is not replayed after unmuting
+	up.setMuted(false)
+	sent, _ = replayKeyframe(&track, up, vp8)
+	if sent || len(track.packets) != 0 {
+		t.Errorf("Muted keyframe was sent: %v", track.packets)
+	}
+}
+
+func TestPLIReplayKeyframe(t *testing.T) {
+	track := &rtpDownTrack{
+		ssrc:       1,
+		maxBitrate: new(bitrate),
+		rate:       estimator.New(time.Second),
+		stats:      new(receiverStats),
+		atomics:    &downTrackAtomics{},
+	}
+	conn := &rtpDownConnection{
+		maxREMBBitrate: new(bitrate),
+		tracks:         []*rtpDownTrack{track},
+		ssrcs:          map[webrtc.SSRC]*rtpDownTrack{1: track},
+	}
+	now := rtptime.Jiffies()
+	var fir firState
+
+	handleDownRTCP(conn, track, &fir,
+		&rtcp.PictureLossIndication{MediaSSRC: 1}, now)
+	if track.takeReplayKeyframe() {
+		t.Errorf("Replay requested for a track not waiting")
+	}
+
+	track.setWaitingKeyframe(true)
+	handleDownRTCP(conn, track, &fir,
+		&rtcp.PictureLossIndication{MediaSSRC: 1}, now)
+	if !track.takeReplayKeyframe() {
+		t.Errorf("Replay not requested")
+	}
+	if track.takeReplayKeyframe() {
+		t.Errorf("Replay requested twice")
+	}
+}
+
+func TestAggregateBitrate(t *testing.T) {
+	tests := []struct {
+		rates      []uint64
+		percentile int
+		expected   uint64
+	}{
+		{nil, 90, ^uint64(0)},
+		{[]uint64{300, 100, 200}, 100, 100},
+		{[]uint64{300, 100, 200}, 90, 100},
+		{[]uint64{300, 100, 200}, 50, 200},
+		{[]uint64{300, 100, 200}, 1, 300},
+		{
+			[]uint64{10, 900, 800, 1000, 700, 950, 850, 750, 990, 980},
+			90, 700,
+		},
+	}
+	for _, test := range tests {
+		rate := aggregateBitrate(test.rates, test.percentile)
+		if rate != test.expected {
+			t.Errorf("%v %v: expected %v, got %v",
+				test.rates, test.percentile, test.expected, rate)
+		}
+	}
+}
+
+func TestDataChannelOnlyOffer(t *testing.T) {
+	opc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer opc.Close()
+	_, err = opc.CreateDataChannel("chat", nil)
+	if err != nil {
+		t.Fatalf("CreateDataChannel: %v", err)
+	}
+	offer, err := opc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+
+	var o sdp.SessionDescription
+	err = o.Unmarshal([]byte(offer.SDP))
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	apc, err := group.APIFromNames([]string{"vp8", "opus"}).
+		NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer apc.Close()
+	err = addRecvTransceivers(apc, &o)
+	if err != nil {
+		t.Fatalf("addRecvTransceivers: %v", err)
+	}
+	if n := len(apc.GetTransceivers()); n != 0 {
+		t.Errorf("Expected no transceivers, got %v", n)
+	}
+	err = apc.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatalf("SetRemoteDescription: %v", err)
+	}
+	answer, err := apc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("CreateAnswer: %v", err)
+	}
+	if !strings.Contains(answer.SDP, "m=application") {
+		t.Errorf("Data channel was not accepted")
+	}
+}
+
+func TestRelayOnlyCandidates(t *testing.T) {
+	g, err := group.Add("relay-only-test",
+		&group.Description{RelayOnly: true})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete("relay-only-test")
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer pc.Close()
+
+	candidates := []string{
+		"candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host",
+		"candidate:2 1 udp 1686052607 203.0.113.1 54322 typ srflx " +
+			"raddr 192.0.2.1 rport 54321",
+		"candidate:3 1 udp 41885439 198.51.100.1 3478 typ relay " +
+			"raddr 203.0.113.1 rport 54322",
+	}
+
+	up := &rtpUpConnection{pc: pc, group: g}
+	down := &rtpDownConnection{pc: pc, group: g}
+	for _, c := range []iceConnection{up, down} {
+		for _, cand := range candidates {
+			err := c.addICECandidate(
+				&webrtc.ICECandidateInit{Candidate: cand},
+			)
+			if err != nil {
+				t.Errorf("addICECandidate: %v", err)
+			}
+		}
+	}
+
+	if len(up.iceCandidates) != 1 || up.droppedCandidates != 2 {
+		t.Errorf("Expected 1 2, got %v %v",
+			len(up.iceCandidates), up.droppedCandidates)
+	}
+	if len(down.iceCandidates) != 1 || down.droppedCandidates != 2 {
+		t.Errorf("Expected 1 2, got %v %v",
+			len(down.iceCandidates), down.droppedCandidates)
+	}
+	if len(up.iceCandidates) > 0 &&
+		up.iceCandidates[0].Candidate != candidates[2] {
+		t.Errorf("Expected relay candidate, got %v",
+			up.iceCandidates[0].Candidate)
+	}
+}
+
+func TestDirectAudioNACK(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	remote := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	packet := rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: 42},
+		Payload: []byte{1},
+	}
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	remote.cache.Store(42, 0, false, false, buf)
+
+	p := newPacer()
+	down := &rtpDownTrack{
+		track:   local,
+		remote:  remote,
+		rate:    estimator.New(time.Second),
+		atomics: &downTrackAtomics{},
+		pacer:   p,
+	}
+	conn := &rtpDownConnection{tracks: []*rtpDownTrack{down}}
+	nack := &rtcp.TransportLayerNack{
+		Nacks: []rtcp.NackPair{{PacketID: 42}},
+	}
+
+	for _, direct := range []bool{false, true} {
+		remote.direct = direct
+		gotNACK(conn, down, nack)
+		_, resent, _ := p.pop(rtptime.Jiffies(), 100000000)
+		if direct && resent != nil {
+			t.Errorf("Direct audio was resent")
+		} else if !direct && resent == nil {
+			t.Errorf("Audio was not resent")
+		}
+	}
+	if remote.nackEnabled() {
+		t.Errorf("NACKs enabled for direct audio")
+	}
+}
+
+func TestNoRetransmission(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	remote := &rtpUpTrack{
+		cache:            packetcache.New(16),
+		atomics:          &upTrackAtomics{},
+		noRetransmission: true,
+	}
+	packet := rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: 42},
+		Payload: []byte{1},
+	}
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	remote.cache.Store(42, 0, false, false, buf)
+
+	p := newPacer()
+	down := &rtpDownTrack{
+		track:   local,
+		remote:  remote,
+		rate:    estimator.New(time.Second),
+		atomics: &downTrackAtomics{},
+		pacer:   p,
+	}
+	conn := &rtpDownConnection{tracks: []*rtpDownTrack{down}}
+	gotNACK(conn, down, &rtcp.TransportLayerNack{
+		Nacks: []rtcp.NackPair{{PacketID: 42, LostPackets: 1}},
+	})
+	_, resent, _ := p.pop(rtptime.Jiffies(), 100000000)
+	if resent != nil {
+		t.Errorf("Packet was resent")
+	}
+	if remote.nackEnabled() {
+		t.Errorf("NACKs enabled")
+	}
+	forwarded, recovered, _ := down.getForwarded()
+	if forwarded != 0 || recovered != 0 {
+		t.Errorf("Expected 0 and 0, got %v and %v",
+			forwarded, recovered)
+	}
+}
+
+func TestVideoBitrates(t *testing.T) {
+	g, err := group.Add("video-bitrates-test", &group.Description{
+		VideoBitrates: map[string]group.VideoBitrate{
+			"camera":      {Max: 300000},
+			"screenshare": {Initial: 1000000, Max: 3000000},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete(g.Name())
+
+	newConn := func(label string) *rtpDownConnection {
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{
+				MimeType: "video/VP8", ClockRate: 90000,
+			},
+			"track", "stream",
+		)
+		if err != nil {
+			t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+		}
+		initial, max := g.VideoBitrate(label)
+		return &rtpDownConnection{
+			maxREMBBitrate: new(bitrate),
+			tracks: []*rtpDownTrack{{
+				track:       local,
+				initialRate: initial,
+				maxRate:     max,
+				maxBitrate:  new(bitrate),
+				rate:        estimator.New(time.Second),
+				atomics:     &downTrackAtomics{},
+				lossless:    true,
+			}},
+		}
+	}
+	camera := newConn("camera")
+	screen := newConn("screenshare")
+
+	// late enough that the initial bitrates are not recent feedback
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	// no limit from REMB
+	camera.maxREMBBitrate.Set(100000000, now)
+	screen.maxREMBBitrate.Set(100000000, now)
+	if r := camera.GetMaxBitrate(now); r != 300000 {
+		t.Errorf("Expected %v, got %v", 300000, r)
+	}
+	if r := screen.GetMaxBitrate(now); r != 1000000 {
+		t.Errorf("Expected %v, got %v", 1000000, r)
+	}
+
+	// plenty of bandwidth
+	camera.tracks[0].updateRate(0, now)
+	screen.tracks[0].updateRate(0, now)
+	if r := camera.GetMaxBitrate(now); r != 300000 {
+		t.Errorf("Expected %v, got %v", 300000, r)
+	}
+	if r := screen.GetMaxBitrate(now); r != 3000000 {
+		t.Errorf("Expected %v, got %v", 3000000, r)
+	}
+	if labelBitrateLimit(g, "camera", nil) != 300000 ||
+		labelBitrateLimit(g, "video", nil) != 0 {
+		t.Errorf("Unexpected sender limits")
+	}
+}
+
+func TestScreenshareFloor(t *testing.T) {
+	newTrack := func(min uint64) *rtpDownTrack {
+		return &rtpDownTrack{
+			initialRate: 1000000,
+			minRate:     min,
+			maxBitrate:  new(bitrate),
+			rate:        estimator.New(time.Second),
+			atomics:     &downTrackAtomics{},
+		}
+	}
+	camera := newTrack(0)
+	screen := newTrack(600000)
+
+	// heavy congestion
+	now := rtptime.Jiffies() + 1000*rtptime.JiffiesPerSec
+	for i := 0; i < 50; i++ {
+		now += rtptime.JiffiesPerSec
+		camera.updateRate(128, now)
+		screen.updateRate(128, now)
+		if r := screen.maxBitrate.Get(now); r < 600000 {
+			t.Fatalf("Expected at least %v, got %v", 600000, r)
+		}
+	}
+	if r := camera.maxBitrate.Get(now); r >= 600000 {
+		t.Errorf("Expected camera to be throttled, got %v", r)
+	}
+
+	// the receiver's limit takes precedence over the floor
+	screen.atomics.sdpLimit = 300000
+	screen.updateRate(128, now)
+	if r := screen.maxBitrate.Get(now); r != 300000 {
+		t.Errorf("Expected %v, got %v", 300000, r)
+	}
+}
+
+func TestPublisherEvents(t *testing.T) {
+	g, err := group.Add("publisher-events-test", &group.Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete(g.Name())
+
+	var events []group.PublisherEvent
+	remove := g.AddPublisherHandler(func(e group.PublisherEvent) {
+		events = append(events, e)
+	})
+	defer remove()
+
+	up := &rtpUpConnection{
+		id:     "stream",
+		userId: "client",
+		tracks: []*rtpUpTrack{{}, {}},
+	}
+	pushConnNow(up, g, nil)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %v", len(events))
+	}
+	e := events[0]
+	if e.Client != "client" || e.Id != "stream" || e.Up != up ||
+		len(e.Tracks) != 2 {
+		t.Errorf("Unexpected event %v", e)
+	}
+}
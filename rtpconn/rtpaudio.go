@@ -0,0 +1,147 @@
+package rtpconn
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// how long a track keeps being forwarded after it has dropped out
+	// of the set of loudest tracks.
+	audioHangover = rtptime.JiffiesPerSec / 2
+	// how often we check whether a forwarded track is still among the
+	// loudest tracks.
+	audioRankInterval = rtptime.JiffiesPerSec / 10
+	// tracks quieter than this are never selected for forwarding.
+	// This is 127 minus the level in dBov.
+	audioMinLoudness = 127 - 70
+)
+
+// audioLevelId returns the negotiated id of the audio level header
+// extension, or 0 if it was not negotiated.
+func audioLevelId(receiver *webrtc.RTPReceiver) uint8 {
+	return headerExtensionId(receiver, sdp.AudioLevelURI)
+}
+
+// gotAudioLevel updates the loudness of a track from the audio level
+// extension of a packet.  Loudness increases immediately, but decays
+// slowly, in order to avoid cutting off speakers between words.
+func (up *rtpUpTrack) gotAudioLevel(packet *rtp.Packet) {
+	ext := packet.GetExtension(up.audioLevelId)
+	if ext == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	err := level.Unmarshal(ext)
+	if err != nil {
+		return
+	}
+	l := uint32(127 - level.Level)
+	up.updateMeter(l, rtptime.Jiffies())
+	old := atomic.LoadUint32(&up.atomics.loudness)
+	if l < old {
+		l = old - (old-l+7)/8
+	}
+	atomic.StoreUint32(&up.atomics.loudness, l)
+}
+
+func (up *rtpUpTrack) getLoudness() uint32 {
+	return atomic.LoadUint32(&up.atomics.loudness)
+}
+
+// An audioSelector limits the number of audio tracks forwarded within
+// a group to the loudest few.
+type audioSelector struct {
+	group *group.Group
+
+	mu     sync.Mutex
+	tracks map[*rtpUpTrack]struct{}
+}
+
+var audioSelectors struct {
+	mu        sync.Mutex
+	selectors map[*group.Group]*audioSelector
+}
+
+// addAudioSelector registers an audio track with the selector of its
+// group, creating the latter if necessary.
+func addAudioSelector(g *group.Group, track *rtpUpTrack) *audioSelector {
+	audioSelectors.mu.Lock()
+	defer audioSelectors.mu.Unlock()
+
+	if audioSelectors.selectors == nil {
+		audioSelectors.selectors = make(map[*group.Group]*audioSelector)
+	}
+	s := audioSelectors.selectors[g]
+	if s == nil {
+		s = &audioSelector{
+			group:  g,
+			tracks: make(map[*rtpUpTrack]struct{}),
+		}
+		audioSelectors.selectors[g] = s
+	}
+	s.mu.Lock()
+	s.tracks[track] = struct{}{}
+	s.mu.Unlock()
+	return s
+}
+
+// del unregisters a track, and discards the selector if it is empty.
+func (s *audioSelector) del(track *rtpUpTrack) {
+	audioSelectors.mu.Lock()
+	defer audioSelectors.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.tracks, track)
+	empty := len(s.tracks) == 0
+	s.mu.Unlock()
+
+	if empty && audioSelectors.selectors[s.group] == s {
+		delete(audioSelectors.selectors, s.group)
+	}
+}
+
+// rank returns the number of tracks that are strictly louder than track.
+func (s *audioSelector) rank(track *rtpUpTrack) int {
+	loudness := track.getLoudness()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for t := range s.tracks {
+		if t.getLoudness() > loudness {
+			n++
+		}
+	}
+	return n
+}
+
+// forward returns true if the packets of track received at time now
+// should be forwarded.
+func (s *audioSelector) forward(track *rtpUpTrack, now uint64) bool {
+	max := s.group.MaxAudioForward()
+	if max <= 0 {
+		return true
+	}
+
+	until := atomic.LoadUint64(&track.atomics.forwardUntil)
+	if now < until && now+audioHangover-until < audioRankInterval {
+		// selected recently, no need to recompute
+		return true
+	}
+
+	// A new speaker is checked at every packet, so that we don't
+	// clip the beginning of their speech.
+	if track.getLoudness() >= audioMinLoudness && s.rank(track) < max {
+		atomic.StoreUint64(&track.atomics.forwardUntil,
+			now+audioHangover)
+		return true
+	}
+	return now < until
+}
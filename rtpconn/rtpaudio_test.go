@@ -0,0 +1,106 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestGotAudioLevel(t *testing.T) {
+	track := &rtpUpTrack{
+		audioLevelId: 1,
+		atomics:      &upTrackAtomics{},
+	}
+	level := func(l uint8) {
+		var packet rtp.Packet
+		ext := rtp.AudioLevelExtension{Level: l}
+		buf, err := ext.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		err = packet.SetExtension(1, buf)
+		if err != nil {
+			t.Fatalf("SetExtension: %v", err)
+		}
+		track.gotAudioLevel(&packet)
+	}
+
+	level(30)
+	if l := track.getLoudness(); l != 97 {
+		t.Errorf("Expected 97, got %v", l)
+	}
+	level(127)
+	if l := track.getLoudness(); l >= 97 || l < 80 {
+		t.Errorf("Expected slow decay, got %v", l)
+	}
+	level(10)
+	if l := track.getLoudness(); l != 117 {
+		t.Errorf("Expected 117, got %v", l)
+	}
+}
+
+func TestAudioSelector(t *testing.T) {
+	g, err := group.Add("audio-selector-test",
+		&group.Description{MaxAudioForward: 2})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete("audio-selector-test")
+
+	tracks := make([]*rtpUpTrack, 4)
+	var s *audioSelector
+	for i := range tracks {
+		tracks[i] = &rtpUpTrack{atomics: &upTrackAtomics{}}
+		s = addAudioSelector(g, tracks[i])
+	}
+	defer func() {
+		for _, tr := range tracks {
+			s.del(tr)
+		}
+		if audioSelectors.selectors[g] != nil {
+			t.Errorf("Selector was not discarded")
+		}
+	}()
+
+	loudness := []uint32{100, 90, 80, 10}
+	for i, l := range loudness {
+		tracks[i].atomics.loudness = l
+	}
+
+	now := rtptime.Jiffies()
+	expected := []bool{true, true, false, false}
+	for i, tr := range tracks {
+		f := s.forward(tr, now)
+		if f != expected[i] {
+			t.Errorf("Track %v: expected %v, got %v",
+				i, expected[i], f)
+		}
+	}
+
+	// a new speaker is forwarded immediately, and the previous
+	// speakers during the hangover
+	tracks[2].atomics.loudness = 120
+	now += rtptime.JiffiesPerSec / 50
+	expected = []bool{true, true, true, false}
+	for i, tr := range tracks {
+		f := s.forward(tr, now)
+		if f != expected[i] {
+			t.Errorf("Track %v: expected %v, got %v",
+				i, expected[i], f)
+		}
+	}
+
+	// after the hangover, only the loudest are forwarded
+	now += audioHangover + audioRankInterval
+	expected = []bool{true, false, true, false}
+	for i, tr := range tracks {
+		f := s.forward(tr, now)
+		if f != expected[i] {
+			t.Errorf("Track %v: expected %v, got %v",
+				i, expected[i], f)
+		}
+	}
+}
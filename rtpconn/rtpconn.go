@@ -1,10 +1,12 @@
 package rtpconn
 
 import (
+	"context"
 	"errors"
 	"io"
-	"log"
-	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,7 +21,9 @@ import (
 	"github.com/jech/galene/group"
 	"github.com/jech/galene/ice"
 	"github.com/jech/galene/jitter"
+	"github.com/jech/galene/logger"
 	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/ratelimitlog"
 	"github.com/jech/galene/rtptime"
 )
 
@@ -35,29 +39,97 @@ func (br *bitrate) Set(bitrate uint64, now uint64) {
 
 func (br *bitrate) Get(now uint64) uint64 {
 	ts := atomic.LoadUint64(&br.jiffies)
-	if now < ts || now-ts > receiverReportTimeout {
+	if now < ts || now-ts > receiverReportTimeout() {
 		return ^uint64(0)
 	}
 	return atomic.LoadUint64(&br.bitrate)
 }
 
+// the number of loss samples remembered by receiverStats
+const lossHistorySize = 32
+
 type receiverStats struct {
 	loss    uint32
 	jitter  uint32
 	jiffies uint64
+	// the last values of loss, a ring buffer indexed by the number of
+	// samples.  There is a single writer, the RTCP listener, so a
+	// reader might at worst see a sample being overwritten.
+	history [lossHistorySize]uint32
+	samples uint32
 }
 
 func (s *receiverStats) Set(loss uint8, jitter uint32, now uint64) {
 	atomic.StoreUint32(&s.loss, uint32(loss))
 	atomic.StoreUint32(&s.jitter, jitter)
 	atomic.StoreUint64(&s.jiffies, now)
+	n := atomic.LoadUint32(&s.samples)
+	atomic.StoreUint32(&s.history[n%lossHistorySize], uint32(loss))
+	atomic.StoreUint32(&s.samples, n+1)
+}
+
+// History returns the last values of loss, oldest first.
+func (s *receiverStats) History() []uint8 {
+	n := atomic.LoadUint32(&s.samples)
+	count := n
+	if count > lossHistorySize {
+		count = lossHistorySize
+	}
+	h := make([]uint8, count)
+	for i := range h {
+		j := (n - count + uint32(i)) % lossHistorySize
+		h[i] = uint8(atomic.LoadUint32(&s.history[j]))
+	}
+	return h
+}
+
+// steadyLoss returns true if a loss history shows persistent loss, as
+// opposed to isolated bursts: at least half of the recent samples
+// report more than 2% loss.
+func steadyLoss(history []uint8) bool {
+	const recent = 8
+	if len(history) > recent {
+		history = history[len(history)-recent:]
+	}
+	if len(history) == 0 {
+		return false
+	}
+	count := 0
+	for _, l := range history {
+		if l > 5 {
+			count++
+		}
+	}
+	return 2*count >= len(history)
 }
 
-const receiverReportTimeout = 30 * rtptime.JiffiesPerSec
+// RTCPInterval is the interval at which sender and receiver reports are
+// sent.
+var RTCPInterval = time.Second
+
+// ReceiverReportTimeout is the time after which the information carried
+// by receiver reports and bandwidth estimates is considered stale.  If 0,
+// it is the larger of 30s and 8 times RTCPInterval.
+var ReceiverReportTimeout time.Duration
+
+const minReceiverReportTimeout = 30 * time.Second
+
+// receiverReportTimeout returns the value of ReceiverReportTimeout in
+// jiffies.
+func receiverReportTimeout() uint64 {
+	d := ReceiverReportTimeout
+	if d <= 0 {
+		d = 8 * RTCPInterval
+		if d < minReceiverReportTimeout {
+			d = minReceiverReportTimeout
+		}
+	}
+	return rtptime.FromDuration(d, rtptime.JiffiesPerSec)
+}
 
 func (s *receiverStats) Get(now uint64) (uint8, uint32) {
 	ts := atomic.LoadUint64(&s.jiffies)
-	if now < ts || now > ts+receiverReportTimeout {
+	if now < ts || now > ts+receiverReportTimeout() {
 		return 0, 0
 	}
 	return uint8(atomic.LoadUint32(&s.loss)), atomic.LoadUint32(&s.jitter)
@@ -68,27 +140,131 @@ type iceConnection interface {
 	flushICECandidates() error
 }
 
+// rtcpWriter is the subset of *webrtc.PeerConnection used for sending
+// RTCP feedback.  It allows the feedback code to be tested without a
+// real peer connection.
+type rtcpWriter interface {
+	WriteRTCP(pkts []rtcp.Packet) error
+}
+
+// rtpPacketWriter is the subset of *webrtc.TrackLocalStaticRTP used for
+// sending RTP.
+type rtpPacketWriter interface {
+	WriteRTP(p *rtp.Packet) error
+}
+
+// senderReader adapts an RTPSender to io.Reader, for reading RTCP.
+type senderReader struct {
+	sender *webrtc.RTPSender
+}
+
+func (r senderReader) Read(b []byte) (int, error) {
+	n, _, err := r.sender.Read(b)
+	return n, err
+}
+
+// receiverReader adapts an RTPReceiver to io.Reader, for reading RTCP.
+type receiverReader struct {
+	receiver *webrtc.RTPReceiver
+}
+
+func (r receiverReader) Read(b []byte) (int, error) {
+	n, _, err := r.receiver.Read(b)
+	return n, err
+}
+
 type downTrackAtomics struct {
-	rtt       uint64
-	sr        uint64
-	srNTP     uint64
-	remoteNTP uint64
-	remoteRTP uint32
+	rtt             uint64
+	sr              uint64
+	srNTP           uint64
+	remoteNTP       uint64
+	remoteRTP       uint32
+	waitingKeyframe uint32
+	paused          uint32
+	// the longest burst of losses in the last extended report
+	lossBurst uint32
+	// set when the receiver should be sent the cached keyframe
+	replayKeyframe uint32
+	// the bitrate requested by the receiver in a TMMBR, 0 if none
+	tmmbr uint64
+	// set when media doesn't reach the receiver
+	oneWay uint32
+	// the bandwidth limit of the media section in the answer, 0 if none
+	sdpLimit uint64
+	// the number of packets forwarded, the number of packets resent
+	// in reply to a NACK, and the time of the last forwarded packet
+	forwarded   uint64
+	recovered   uint64
+	lastForward uint64
+	// the RTP time of the last sender report sent
+	srRTP uint32
+	// set while in slow start, after the rate was reset and before
+	// the first loss
+	slowStart uint32
 }
 
 type rtpDownTrack struct {
-	track      *webrtc.TrackLocalStaticRTP
-	sender     *webrtc.RTPSender
-	remote     conn.UpTrack
-	ssrc       webrtc.SSRC
-	maxBitrate *bitrate
-	rate       *estimator.Estimator
-	stats      *receiverStats
-	atomics    *downTrackAtomics
-	cname      atomic.Value
+	track       *webrtc.TrackLocalStaticRTP
+	sender      *webrtc.RTPSender
+	remote      conn.UpTrack
+	ssrc        webrtc.SSRC
+	initialRate uint64
+	maxBitrate  *bitrate
+	rate        *estimator.Estimator
+	stats       *receiverStats
+	atomics     *downTrackAtomics
+	cname       atomic.Value
+	translator  rtpTranslator
+	// if true, cname was set at creation and is not taken from the
+	// sender
+	fixedCname bool
+	// only accessed by rtcpDownSender
+	oneWay oneWayState
+	// if true, the rate is pinned to the maximum rather than adapted
+	// to the loss reported by the receiver
+	lossless bool
+	// the pacer of the connection, nil if pacing is disabled
+	pacer *pacer
+	// the maximum bitrate configured for the label of the stream, 0
+	// if none
+	maxRate uint64
+	// the minimum bitrate configured for the label of the stream,
+	// 0 if none
+	minRate uint64
+	// the SSRC added to the contributing sources of the packets
+	// sent, 0 if none
+	csrc uint32
 }
 
 func (down *rtpDownTrack) WriteRTP(packet *rtp.Packet) error {
+	seqno, ts := packet.SequenceNumber, packet.Timestamp
+	s, t, ok := down.translator.translate(
+		seqno, ts, packet.Marker,
+		down.track.Kind() == webrtc.RTPCodecTypeVideo,
+		down.track.Codec().ClockRate, rtptime.Jiffies(),
+	)
+	if !ok {
+		return nil
+	}
+	// the packet is shared with other down tracks, restore it
+	csrcs := packet.CSRC
+	packet.SequenceNumber, packet.Timestamp = s, t
+	packet.CSRC = withCSRC(csrcs, down.csrc)
+	err := down.send(packet)
+	packet.SequenceNumber, packet.Timestamp = seqno, ts
+	packet.CSRC = csrcs
+	return err
+}
+
+// send sends a packet whose seqno and timestamp have already been
+// translated.
+func (down *rtpDownTrack) send(packet *rtp.Packet) error {
+	if down.pacer != nil {
+		return down.pacer.push(
+			down, packet,
+			down.track.Kind() == webrtc.RTPCodecTypeAudio,
+		)
+	}
 	return down.track.WriteRTP(packet)
 }
 
@@ -127,9 +303,72 @@ func (down *rtpDownTrack) setSRTime(tm uint64, ntp uint64) {
 }
 
 func (down *rtpDownTrack) SetCname(cname string) {
+	if down.fixedCname {
+		return
+	}
 	down.cname.Store(cname)
 }
 
+// setWaitingKeyframe records whether the receiver is waiting for
+// a keyframe, in which case retransmissions are useless.
+func (down *rtpDownTrack) setWaitingKeyframe(waiting bool) {
+	var v uint32
+	if waiting {
+		v = 1
+	}
+	atomic.StoreUint32(&down.atomics.waitingKeyframe, v)
+}
+
+func (down *rtpDownTrack) getWaitingKeyframe() bool {
+	return atomic.LoadUint32(&down.atomics.waitingKeyframe) != 0
+}
+
+// requestReplayKeyframe asks the writer to send the cached keyframe to
+// this track before the next packet.
+func (down *rtpDownTrack) requestReplayKeyframe() {
+	atomic.StoreUint32(&down.atomics.replayKeyframe, 1)
+}
+
+// takeReplayKeyframe returns true, and resets the request, if a replay of
+// the cached keyframe was requested.
+func (down *rtpDownTrack) takeReplayKeyframe() bool {
+	return atomic.CompareAndSwapUint32(&down.atomics.replayKeyframe, 1, 0)
+}
+
+// setPaused records whether forwarding to this track is paused.  Only
+// media is affected: sender reports are still sent, so that the receiver
+// keeps accurate timing across a pause.  The seqnos of the packets not
+// forwarded are skipped by the translator.
+func (down *rtpDownTrack) setPaused(paused bool) {
+	var v uint32
+	if paused {
+		v = 1
+	}
+	atomic.StoreUint32(&down.atomics.paused, v)
+}
+
+func (down *rtpDownTrack) getPaused() bool {
+	return atomic.LoadUint32(&down.atomics.paused) != 0
+}
+
+// setForwarded records that a packet was forwarded at time now.
+// Recovered is true if the packet was resent in reply to a NACK.
+func (down *rtpDownTrack) setForwarded(now uint64, recovered bool) {
+	atomic.AddUint64(&down.atomics.forwarded, 1)
+	if recovered {
+		atomic.AddUint64(&down.atomics.recovered, 1)
+	}
+	atomic.StoreUint64(&down.atomics.lastForward, now)
+}
+
+// getForwarded returns the number of packets forwarded, the number of
+// packets resent, and the time of the last forwarded packet, 0 if none.
+func (down *rtpDownTrack) getForwarded() (uint64, uint64, uint64) {
+	return atomic.LoadUint64(&down.atomics.forwarded),
+		atomic.LoadUint64(&down.atomics.recovered),
+		atomic.LoadUint64(&down.atomics.lastForward)
+}
+
 const (
 	negotiationUnneeded = iota
 	negotiationNeeded
@@ -140,12 +379,51 @@ type rtpDownConnection struct {
 	id                string
 	pc                *webrtc.PeerConnection
 	remote            conn.Up
+	group             *group.Group
 	maxREMBBitrate    *bitrate
 	iceCandidates     []*webrtc.ICECandidateInit
 	negotiationNeeded int
+	quality           qualityTracker
+	// used for sending RTCP, compound unless reduced-size was negotiated
+	rtcpOut *rtcpSizeWriter
+	// called by rtcpDownSender when the network quality changes
+	onQuality func(networkQuality)
+	// the last receiver reference time received, for replying with DLRR
+	xr xrState
+	// the number of remote candidates ignored by the candidate filter
+	droppedCandidates int
+	// used for detecting idle connections
+	keepalive keepaliveState
+	// smooths the media sent on the connection, nil if disabled
+	pacer *pacer
+	// the ICE candidate pair in use
+	candidatePair candidatePairState
+
+	// cancelled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	mu     sync.Mutex
 	tracks []*rtpDownTrack
+	// maps the SSRCs of the tracks to the tracks, for routing RTCP
+	ssrcs map[webrtc.SSRC]*rtpDownTrack
+	// the session-level bandwidth limit in the answer, 0 if none
+	sdpLimit uint64
+}
+
+// getTrackBySSRC returns the track with the given SSRC, or nil if there
+// is none.
+func (down *rtpDownConnection) getTrackBySSRC(ssrc uint32) *rtpDownTrack {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	return down.ssrcs[webrtc.SSRC(ssrc)]
+}
+
+// close signals the connection's goroutines to terminate, and closes
+// the peer connection.
+func (down *rtpDownConnection) close() error {
+	down.cancel()
+	return down.pc.Close()
 }
 
 func (down *rtpDownConnection) getTracks() []*rtpDownTrack {
@@ -156,27 +434,118 @@ func (down *rtpDownConnection) getTracks() []*rtpDownTrack {
 	return tracks
 }
 
-func newDownConn(c group.Client, id string, remote conn.Up) (*rtpDownConnection, error) {
+func newDownConn(ctx context.Context, c group.Client, id string, remote conn.Up) (*rtpDownConnection, error) {
+	conf, err := iceConfiguration(c.Group())
+	if err != nil {
+		return nil, err
+	}
 	api := c.Group().API()
-	pc, err := api.NewPeerConnection(*ice.ICEConfiguration())
+	pc, err := api.NewPeerConnection(*conf)
 	if err != nil {
 		return nil, err
 	}
 
 	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Got track on downstream connection")
+		Logger.Warnf("Got track on downstream connection")
 	})
 
 	conn := &rtpDownConnection{
 		id:             id,
 		pc:             pc,
 		remote:         remote,
+		group:          c.Group(),
 		maxREMBBitrate: new(bitrate),
+		rtcpOut:        newRTCPSizeWriter(pc),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	closeOnCancel(conn.ctx, pc)
+	conn.candidatePair.watch(pc)
+
+	if pacing(conn.group) {
+		conn.pacer = newPacer()
+		spawn(func() { pacerLoop(conn.ctx, conn) })
 	}
 
 	return conn, nil
 }
 
+// pauseTracks pauses or resumes forwarding to the tracks of the given
+// kind, or to all tracks if kind is empty.  When a video track is
+// resumed, a keyframe is requested from the sender.
+func (down *rtpDownConnection) pauseTracks(kind string, paused bool) error {
+	var tpe webrtc.RTPCodecType
+	if kind != "" {
+		tpe = webrtc.NewRTPCodecType(kind)
+		if tpe == 0 {
+			return group.ProtocolError("unknown kind")
+		}
+	}
+
+	for _, t := range down.getTracks() {
+		if tpe != 0 && t.track.Kind() != tpe {
+			continue
+		}
+		if paused || !t.getPaused() {
+			t.setPaused(paused)
+			continue
+		}
+		if t.track.Kind() != webrtc.RTPCodecTypeVideo {
+			t.setPaused(false)
+			continue
+		}
+
+		// the receiver cannot decode anything until the next
+		// keyframe, no point in honouring NACKs until then.
+		t.setWaitingKeyframe(true)
+		t.setPaused(false)
+
+		err := down.requestKeyframe(t)
+		if err != nil && err != ErrRateLimited {
+			Logger.Warnf("pauseTracks: %v", err)
+		}
+	}
+	return nil
+}
+
+// requestKeyframe asks the sender of a down track for a keyframe, using
+// FIR if the track supports it and PLI otherwise.  The keyframe is shared
+// by all the receivers of the track.
+func (down *rtpDownConnection) requestKeyframe(t *rtpDownTrack) error {
+	remote, ok := down.remote.(*rtpUpConnection)
+	if !ok {
+		// a synthetic sender, such as a file
+		if down.remote != nil {
+			down.remote.RequestKeyframe(false)
+		}
+		return nil
+	}
+	rt, ok := t.remote.(*rtpUpTrack)
+	if !ok {
+		return nil
+	}
+	err := remote.sendFIR(rt, true, false)
+	if err == ErrUnsupportedFeedback {
+		err = remote.sendPLI(rt, false)
+	}
+	return err
+}
+
+// requestKeyframes is called when the receiver asks for a keyframe
+// explicitly, for example because its decoder is in a bad state.  Paused
+// tracks are ignored, since they will get a keyframe when resumed.
+func (down *rtpDownConnection) requestKeyframes() {
+	for _, t := range down.getTracks() {
+		if t.track.Kind() != webrtc.RTPCodecTypeVideo || t.getPaused() {
+			continue
+		}
+		err := down.requestKeyframe(t)
+		if err != nil && err != ErrRateLimited {
+			ratelimitlog.Log("requestKeyframe",
+				"conn", down.id, "error", err)
+		}
+	}
+}
+
 func (down *rtpDownConnection) GetMaxBitrate(now uint64) uint64 {
 	rate := down.maxREMBBitrate.Get(now)
 	var trackRate uint64
@@ -184,21 +553,110 @@ func (down *rtpDownConnection) GetMaxBitrate(now uint64) uint64 {
 	for _, t := range tracks {
 		r := t.maxBitrate.Get(now)
 		if r == ^uint64(0) {
-			if t.track.Kind() == webrtc.RTPCodecTypeAudio {
+			if t.initialRate > 0 {
+				r = t.initialRate
+			} else if t.track.Kind() == webrtc.RTPCodecTypeAudio {
 				r = 128 * 1024
 			} else {
 				r = 512 * 1024
 			}
 		}
+		tr := atomic.LoadUint64(&t.atomics.tmmbr)
+		if tr != 0 && tr < r {
+			r = tr
+		}
+		r = minLimit(r, atomic.LoadUint64(&t.atomics.sdpLimit))
+		r = minLimit(r, t.maxRate)
 		trackRate += r
 	}
+	trackRate = minLimit(trackRate, down.getBandwidthLimit())
 	if trackRate < rate {
 		return trackRate
 	}
 	return rate
 }
 
+// rateWindow returns the window of the rate estimators of tracks of the
+// given kind.
+func rateWindow(g *group.Group, kind webrtc.RTPCodecType) time.Duration {
+	if g == nil {
+		return time.Second
+	}
+	return g.RateWindow(kind)
+}
+
+// lossless returns true if media in group g should be forwarded without
+// adapting to network conditions.
+func lossless(g *group.Group) bool {
+	return g != nil && g.LosslessForwarding()
+}
+
+// directAudio returns true if audio in group g should be forwarded
+// without attempting to recover losses.
+func directAudio(g *group.Group) bool {
+	return g != nil && g.DirectAudio() && !g.LosslessForwarding()
+}
+
+// noRetransmission returns true if lost packets in group g should never
+// be retransmitted.
+func noRetransmission(g *group.Group) bool {
+	return g != nil && g.NoRetransmission() && !g.LosslessForwarding()
+}
+
+// mungeSDP applies the SDP munger of group g, if any, to the description d
+// generated by the server.
+func mungeSDP(g *group.Group, d *webrtc.SessionDescription) error {
+	if g == nil {
+		return nil
+	}
+	s, err := g.MungeSDP(d.Type, d.SDP)
+	if err != nil {
+		return err
+	}
+	d.SDP = s
+	return nil
+}
+
+// pacing returns true if media sent in group g should be paced.
+func pacing(g *group.Group) bool {
+	return g != nil && g.Pacing() && !g.LosslessForwarding()
+}
+
+// iceConfiguration returns the ICE configuration used for connections
+// in group g.
+func iceConfiguration(g *group.Group) (*webrtc.Configuration, error) {
+	if g == nil {
+		return ice.ICEConfiguration(), nil
+	}
+	return ice.GroupConfiguration(g.ICEServers(), g.RelayOnly())
+}
+
+// candidateFilter returns the filter applied to the remote candidates
+// of connections in group g.
+func candidateFilter(g *group.Group) ice.Filter {
+	f := ice.CandidateFilter
+	if g != nil && g.RelayOnly() {
+		f.NonRelay = true
+	}
+	return f
+}
+
+// dropICECandidate returns true if a remote candidate of a connection in
+// group g should be ignored.
+func dropICECandidate(g *group.Group, candidate *webrtc.ICECandidateInit) bool {
+	reason := candidateFilter(g).Drop(candidate.Candidate)
+	if reason == "" {
+		return false
+	}
+	ratelimitlog.Log("ICE: ignoring remote candidate", "reason", reason)
+	return true
+}
+
 func (down *rtpDownConnection) addICECandidate(candidate *webrtc.ICECandidateInit) error {
+	if dropICECandidate(down.group, candidate) {
+		down.droppedCandidates++
+		return nil
+	}
 	if down.pc.RemoteDescription() != nil {
 		return down.pc.AddICECandidate(*candidate)
 	}
@@ -231,26 +689,104 @@ type upTrackAtomics struct {
 	lastPLI  uint64
 	lastFIR  uint64
 	firSeqno uint32
+	muted    uint32
+	// the last seqno received while muted, bit 16 indicates validity
+	mutedSeqno uint32
+	// smoothed loudness, from the audio level extension
+	loudness uint32
+	// the time until which an audio track is forwarded
+	forwardUntil uint64
+	// keyframe tracking, used for detecting frozen video
+	kfKnown      uint32
+	lastKeyframe uint64
+	kfRequested  uint64
+	kfStage      uint32
+	// the bitrate last acknowledged by the sender in a TMMBN
+	tmmbn uint64
+	// the last known video resolution, as width << 16 | height
+	resolution uint32
+	// the time at which an APP packet was last forwarded
+	lastAPP uint64
+	// set when the sender has sent a BYE, reset by the next packet
+	bye uint32
+	// set when video exceeds the group's maximum resolution
+	oversize uint32
+	// the audio meter, and the time at which it was last updated
+	meter     uint32
+	meterTime uint64
+	// the number of packets received, and the time at which the last
+	// one was received
+	received     uint64
+	lastReceived uint64
+	// set when the timing of the track is estimated because the
+	// sender doesn't send sender reports
+	syntheticSR uint32
+	// the queuing delay on the path from the sender, in jiffies
+	queueDelay uint64
+	// the SSRC used by the sender in its RTCP packets, if different
+	// from that of the track; bit 32 indicates validity
+	rtcpSSRC uint64
+	// the time at which a periodic keyframe was last requested
+	periodicKF uint64
 }
 
 type rtpUpTrack struct {
 	track   *webrtc.TrackRemote
 	label   string
+	mid     string
 	rate    *estimator.Estimator
 	cache   *packetcache.Cache
 	jitter  *jitter.Estimator
 	atomics *upTrackAtomics
 	cname   atomic.Value
 
+	// detects timestamps that don't advance at the declared clock rate
+	clock *jitter.RateDetector
+	// if true, losses are not recovered, but left for the receivers
+	// to conceal
+	direct bool
+	// if true, lost packets are neither requested nor resent, whatever
+	// the kind of the track
+	noRetransmission bool
+
+	// the id of the audio level extension, and the selector that
+	// decides whether this track is forwarded.  Both are only set for
+	// audio tracks that carry the audio level extension.
+	audioLevelId uint8
+	selector     *audioSelector
+	// the id of the MID header extension, or 0 if not negotiated
+	midId uint8
+	// the Opus parameters requested from the sender, nil if the
+	// track is not Opus
+	opus [][2]string
+
 	localCh    chan localTrackAction
 	readerDone chan struct{}
 
+	// the packets that are missing, used for re-sending NACKs
+	nacks nackState
+	// the packets received, used for building Loss RLE reports
+	xrLoss lossHistory
+	// estimates timing when the sender doesn't send sender reports
+	synthetic syntheticSR
+	// measures the queuing delay on the path from the sender
+	uplink uplinkDelay
+	// the time at which a sender report with the known SSRC was last
+	// received, only accessed by the RTCP listener
+	rtcpSSRCTime uint64
+
 	mu            sync.Mutex
 	srTime        uint64
 	srNTPTime     uint64
 	srRTPTime     uint32
+	offset        clockOffset
 	local         []conn.DownTrack
 	bufferedNACKs []uint16
+	// the estimated timing, used until a sender report is received
+	syntheticNTPTime uint64
+	syntheticRTPTime uint32
+	// set when the sender has stopped sending after a renegotiation
+	inactive bool
 }
 
 type localTrackAction struct {
@@ -305,20 +841,172 @@ func (up *rtpUpTrack) getLocal() []conn.DownTrack {
 	return local
 }
 
+// allWaitingKeyframe returns true if the track has local tracks, and all
+// of them are waiting for a keyframe.  In that case, nobody is able to
+// use retransmitted packets.
+func (up *rtpUpTrack) allWaitingKeyframe() bool {
+	local := up.getLocal()
+	if len(local) == 0 {
+		return false
+	}
+	for _, l := range local {
+		ll, ok := l.(*rtpDownTrack)
+		if !ok || !ll.getWaitingKeyframe() {
+			return false
+		}
+	}
+	return true
+}
+
 func (up *rtpUpTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	if up.mutedPacket(seqno) {
+		return 0
+	}
 	return up.cache.Get(seqno, result)
 }
 
+func (up *rtpUpTrack) setInactive(inactive bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.inactive = inactive
+}
+
+func (up *rtpUpTrack) getInactive() bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.inactive
+}
+
+// setMuted sets whether the track has been muted by an operator.  Packets
+// received on a muted track are not forwarded.
+func (up *rtpUpTrack) setMuted(muted bool) {
+	var v uint32
+	if muted {
+		v = 1
+	}
+	atomic.StoreUint32(&up.atomics.muted, v)
+}
+
+func (up *rtpUpTrack) getMuted() bool {
+	return atomic.LoadUint32(&up.atomics.muted) != 0
+}
+
+// setReceived records that a packet was received at time now.
+func (up *rtpUpTrack) setReceived(now uint64) {
+	atomic.AddUint64(&up.atomics.received, 1)
+	atomic.StoreUint64(&up.atomics.lastReceived, now)
+}
+
+// getReceived returns the number of packets received and the time at
+// which the last one was received, 0 if none.
+func (up *rtpUpTrack) getReceived() (uint64, uint64) {
+	return atomic.LoadUint64(&up.atomics.received),
+		atomic.LoadUint64(&up.atomics.lastReceived)
+}
+
+// gotPacket is called by the reader loop for every received packet.  It
+// keeps track of which packets were received while muted.
+func (up *rtpUpTrack) gotPacket(seqno uint16) {
+	if up.getMuted() {
+		atomic.StoreUint32(&up.atomics.mutedSeqno,
+			uint32(seqno)|(1<<16))
+		return
+	}
+	m := atomic.LoadUint32(&up.atomics.mutedSeqno)
+	if (m&(1<<16)) != 0 && seqno-uint16(m) > 0x1000 {
+		// we're well past the muted packets, forget about them
+		atomic.StoreUint32(&up.atomics.mutedSeqno, 0)
+	}
+}
+
+// mutedPacket returns true if the packet with the given seqno must not be
+// forwarded because it was received while muted.
+func (up *rtpUpTrack) mutedPacket(seqno uint16) bool {
+	if up.getMuted() {
+		return true
+	}
+	m := atomic.LoadUint32(&up.atomics.mutedSeqno)
+	if (m & (1 << 16)) == 0 {
+		return false
+	}
+	return ((uint16(m) - seqno) & 0x8000) == 0
+}
+
 func (up *rtpUpTrack) Label() string {
 	return up.label
 }
 
+// SenderReport returns the time, in jiffies, at which the last sender
+// report was received on the track, and the NTP and RTP times that it
+// carried.  The time is 0 if no sender report was received.
+func (up *rtpUpTrack) SenderReport() (uint64, uint64, uint32) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.srTime, up.srNTPTime, up.srRTPTime
+}
+
+// midLess compares two mids.  Mids are usually small integers, so we
+// compare them numerically when possible.
+func midLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// trackLess defines the order in which tracks are presented to
+// downstream clients, which is independent of the order in which they
+// arrived: by label, which is the track id announced in the sender's
+// msid, then by mid.
+func trackLess(a, b *rtpUpTrack) bool {
+	if a.label != b.label {
+		return a.label < b.label
+	}
+	return midLess(a.getMid(), b.getMid())
+}
+
+func (up *rtpUpTrack) getMid() string {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.mid
+}
+
+// setTrackMid sets the mid of a track that was learnt from the MID header
+// extension, and restores the order of the tracks.
+func (up *rtpUpConnection) setTrackMid(track *rtpUpTrack, mid string) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	track.mu.Lock()
+	track.mid = mid
+	track.mu.Unlock()
+
+	sort.SliceStable(up.tracks, func(i, j int) bool {
+		return trackLess(up.tracks[i], up.tracks[j])
+	})
+}
+
+// headerExtensionId returns the negotiated id of the header extension
+// with the given URI, or 0 if it was not negotiated.
+func headerExtensionId(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, e := range receiver.GetParameters().HeaderExtensions {
+		if e.URI == uri {
+			return uint8(e.ID)
+		}
+	}
+	return 0
+}
+
 func (up *rtpUpTrack) Kind() webrtc.RTPCodecType {
 	return up.track.Kind()
 }
 
 func (up *rtpUpTrack) Codec() webrtc.RTPCodecCapability {
-	return up.track.Codec().RTPCodecCapability
+	codec := up.track.Codec().RTPCodecCapability
+	if up.opus != nil {
+		codec.SDPFmtpLine = setFmtp(codec.SDPFmtpLine, up.opus)
+	}
+	return codec
 }
 
 func (up *rtpUpTrack) hasRtcpFb(tpe, parameter string) bool {
@@ -330,6 +1018,18 @@ func (up *rtpUpTrack) hasRtcpFb(tpe, parameter string) bool {
 	return false
 }
 
+// retransmit returns true if lost packets of the track should be
+// recovered.
+func (up *rtpUpTrack) retransmit() bool {
+	return !up.direct && !up.noRetransmission
+}
+
+// nackEnabled returns true if lost packets should be requested from the
+// sender of the track.
+func (up *rtpUpTrack) nackEnabled() bool {
+	return up.retransmit() && up.hasRtcpFb("nack", "")
+}
+
 type rtpUpConnection struct {
 	id            string
 	label         string
@@ -337,6 +1037,32 @@ type rtpUpConnection struct {
 	username      string
 	pc            *webrtc.PeerConnection
 	iceCandidates []*webrtc.ICECandidateInit
+	group         *group.Group
+	// used for sending RTCP, compound unless reduced-size was negotiated
+	rtcpOut *rtcpSizeWriter
+	// used for sending NACKs, which are not latency-sensitive
+	rtcp *rtcpBatcher
+	// called when the connection is irrecoverably broken
+	reconnect func()
+	// called when a track exceeds the group's maximum resolution
+	resolutionExceeded func(maxWidth, maxHeight int)
+	// whether stereo Opus is requested from the sender
+	stereo bool
+	// the state of extended reports, and whether they are sent; the
+	// latter is accessed atomically
+	xr        xrState
+	xrEnabled int32
+	// the number of remote candidates ignored by the candidate filter
+	droppedCandidates int
+	// used for detecting idle connections
+	keepalive keepaliveState
+	// estimates the bitrate that the sender's uplink can carry
+	uplink uplinkEstimator
+	// the ICE candidate pair in use
+	candidatePair candidatePairState
+	// cancelled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	mu      sync.Mutex
 	pushed  bool
@@ -345,7 +1071,29 @@ type rtpUpConnection struct {
 	local   []conn.Down
 }
 
+// close signals the connection's goroutines to terminate, and closes
+// the peer connection.
+func (up *rtpUpConnection) close() error {
+	up.cancel()
+	return up.pc.Close()
+}
+
+// getTracks returns the tracks of up, excluding those that the sender
+// has made inactive.
 func (up *rtpUpConnection) getTracks() []*rtpUpTrack {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	tracks := make([]*rtpUpTrack, 0, len(up.tracks))
+	for _, t := range up.tracks {
+		if !t.getInactive() {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// getAllTracks is like getTracks, but includes the inactive tracks.
+func (up *rtpUpConnection) getAllTracks() []*rtpUpTrack {
 	up.mu.Lock()
 	defer up.mu.Unlock()
 	tracks := make([]*rtpUpTrack, len(up.tracks))
@@ -363,6 +1111,18 @@ func (up *rtpUpConnection) getReplace(reset bool) string {
 	return replace
 }
 
+func (up *rtpUpConnection) setXREnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&up.xrEnabled, v)
+}
+
+func (up *rtpUpConnection) getXREnabled() bool {
+	return atomic.LoadInt32(&up.xrEnabled) != 0
+}
+
 func (up *rtpUpConnection) Id() string {
 	return up.id
 }
@@ -408,6 +1168,10 @@ func (up *rtpUpConnection) getLocal() []conn.Down {
 }
 
 func (up *rtpUpConnection) addICECandidate(candidate *webrtc.ICECandidateInit) error {
+	if dropICECandidate(up.group, candidate) {
+		up.droppedCandidates++
+		return nil
+	}
 	if up.pc.RemoteDescription() != nil {
 		return up.pc.AddICECandidate(*candidate)
 	}
@@ -427,15 +1191,25 @@ func pushConnNow(up *rtpUpConnection, g *group.Group, cs []group.Client) {
 	up.pushed = true
 	replace := up.replace
 	up.replace = ""
-	tracks := make([]conn.UpTrack, len(up.tracks))
-	for i, t := range up.tracks {
-		tracks[i] = t
+	tracks := make([]conn.UpTrack, 0, len(up.tracks))
+	for _, t := range up.tracks {
+		if !t.getInactive() {
+			tracks = append(tracks, t)
+		}
 	}
 	up.mu.Unlock()
 
 	for _, c := range cs {
 		c.PushConn(g, up.id, up, tracks, replace)
 	}
+	if g != nil {
+		g.NotifyPublisher(group.PublisherEvent{
+			Client: up.userId,
+			Id:     up.id,
+			Up:     up,
+			Tracks: tracks,
+		})
+	}
 }
 
 // pushConn schedules a call to pushConnNow
@@ -456,51 +1230,215 @@ func pushConn(up *rtpUpConnection, g *group.Group, cs []group.Client) {
 	}(g, cs)
 }
 
-func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpConnection, error) {
-	var o sdp.SessionDescription
-	err := o.Unmarshal([]byte(offer))
+// activeMids returns the set of mids of the media sections on which the
+// sender of a session description is sending media.
+func activeMids(desc string) (map[string]bool, error) {
+	var d sdp.SessionDescription
+	err := d.Unmarshal([]byte(desc))
 	if err != nil {
 		return nil, err
 	}
 
-	pc, err := c.Group().API().NewPeerConnection(*ice.ICEConfiguration())
+	mids := make(map[string]bool)
+	for _, m := range d.MediaDescriptions {
+		if m.MediaName.Port.Value == 0 {
+			continue
+		}
+		mid, ok := m.Attribute(sdp.AttrKeyMID)
+		if !ok {
+			continue
+		}
+		_, inactive := m.Attribute("inactive")
+		_, recvonly := m.Attribute("recvonly")
+		if inactive || recvonly {
+			continue
+		}
+		mids[mid] = true
+	}
+	return mids, nil
+}
+
+// updateInactiveTracks hides the tracks that the publisher has stopped
+// sending after a renegotiation, and detaches them from their local
+// tracks.  The tracks keep being read, and are shown again if they become
+// active in a later renegotiation.  It returns true if any track was
+// hidden or shown, in which case the connection needs to be pushed again
+// to the other clients.
+func (up *rtpUpConnection) updateInactiveTracks(offer string) (bool, error) {
+	mids, err := activeMids(offer)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	for _, m := range o.MediaDescriptions {
-		_, err = pc.AddTransceiverFromKind(
-			webrtc.NewRTPCodecType(m.MediaName.Media),
+	changed := false
+	for _, t := range up.getAllTracks() {
+		mid := t.getMid()
+		inactive := mid != "" && !mids[mid]
+		if inactive == t.getInactive() {
+			continue
+		}
+		changed = true
+		t.setInactive(inactive)
+		if !inactive {
+			continue
+		}
+		// don't let the last level heard occupy a slot of the
+		// audio selector
+		atomic.StoreUint32(&t.atomics.loudness, 0)
+		atomic.StoreUint64(&t.atomics.forwardUntil, 0)
+		for _, l := range t.getLocal() {
+			t.DelLocal(l)
+		}
+	}
+	return changed, nil
+}
+
+// addRecvTransceivers adds a receive-only transceiver for each audio or
+// video section of an offer.  Other sections, notably data channels, are
+// left to the negotiation, so that a client may connect without sending
+// any media.
+func addRecvTransceivers(pc *webrtc.PeerConnection, offer *sdp.SessionDescription) error {
+	for _, m := range offer.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(m.MediaName.Media)
+		if kind != webrtc.RTPCodecTypeAudio &&
+			kind != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		_, err := pc.AddTransceiverFromKind(kind,
 			webrtc.RtpTransceiverInit{
 				Direction: webrtc.RTPTransceiverDirectionRecvonly,
 			},
 		)
 		if err != nil {
-			pc.Close()
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	up := &rtpUpConnection{id: id, label: label, pc: pc}
+func newUpConn(ctx context.Context, c group.Client, id string, label string, offer string) (*rtpUpConnection, error) {
+	var o sdp.SessionDescription
+	err := o.Unmarshal([]byte(offer))
+	if err != nil {
+		return nil, err
+	}
 
-	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		up.mu.Lock()
+	err = c.Group().CheckCodecConstraints(&o)
+	if err != nil {
+		cc := c.Group().CodecConstraints()
+		if cc != nil && cc.Strict {
+			return nil, err
+		}
+		Logger.Warnf("Client %v: offer doesn't satisfy "+
+			"the codec constraints, accepting anyway", c.Id())
+	}
 
-		track := &rtpUpTrack{
-			track:      remote,
-			cache:      packetcache.New(minPacketCache(remote)),
-			rate:       estimator.New(time.Second),
-			jitter:     jitter.New(remote.Codec().ClockRate),
-			atomics:    &upTrackAtomics{},
+	conf, err := iceConfiguration(c.Group())
+	if err != nil {
+		return nil, err
+	}
+	pc, err := c.Group().API().NewPeerConnection(*conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addRecvTransceivers(pc, &o)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	rtcpOut := newRTCPSizeWriter(pc)
+	up := &rtpUpConnection{
+		id:      id,
+		label:   label,
+		pc:      pc,
+		group:   c.Group(),
+		rtcpOut: rtcpOut,
+		rtcp:    newRTCPBatcher(rtcpOut, rtcpBatchInterval),
+		stereo:  opusStereo(&o) || c.Group().OpusStereo(),
+	}
+	up.ctx, up.cancel = context.WithCancel(ctx)
+	closeOnCancel(up.ctx, pc)
+	up.candidatePair.watch(pc)
+
+	if wc, ok := c.(*webClient); ok {
+		up.reconnect = func() {
+			wc.action(connectionFailedAction{id: id})
+		}
+		up.resolutionExceeded = func(maxWidth, maxHeight int) {
+			wc.write(clientMessage{
+				Type:       "usermessage",
+				Kind:       "maxresolution",
+				Dest:       wc.id,
+				Privileged: true,
+				Value: map[string]interface{}{
+					"id":     id,
+					"width":  maxWidth,
+					"height": maxHeight,
+				},
+			})
+		}
+	}
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		var mid string
+		for _, t := range pc.GetTransceivers() {
+			if t.Receiver() == receiver {
+				mid = t.Mid()
+				break
+			}
+		}
+
+		window := rateWindow(c.Group(), remote.Kind())
+
+		up.mu.Lock()
+
+		track := &rtpUpTrack{
+			track:      remote,
+			label:      remote.ID(),
+			mid:        mid,
+			cache:      packetcache.New(minPacketCache(remote)),
+			rate:       estimator.New(window),
+			jitter:     jitter.New(remote.Codec().ClockRate),
+			clock:      jitter.NewRateDetector(remote.Codec().ClockRate),
+			atomics:    &upTrackAtomics{},
 			localCh:    make(chan localTrackAction, 2),
 			readerDone: make(chan struct{}),
+			direct: remote.Kind() == webrtc.RTPCodecTypeAudio &&
+				directAudio(c.Group()),
+			noRetransmission: noRetransmission(c.Group()),
+		}
+
+		if c.Group().Muted(c.Id(), remote.Kind()) {
+			track.setMuted(true)
+		}
+
+		track.midId = headerExtensionId(receiver, sdp.SDESMidURI)
+
+		if strings.EqualFold(remote.Codec().MimeType, "audio/opus") {
+			track.opus = opusParameters(up.stereo)
+		}
+
+		if remote.Kind() == webrtc.RTPCodecTypeAudio {
+			track.audioLevelId = audioLevelId(receiver)
+			if track.audioLevelId != 0 {
+				track.selector = addAudioSelector(c.Group(), track)
+			}
 		}
 
 		up.tracks = append(up.tracks, track)
+		sort.SliceStable(up.tracks, func(i, j int) bool {
+			return trackLess(up.tracks[i], up.tracks[j])
+		})
 
-		go readLoop(up, track)
+		spawn(func() { readLoop(up.ctx, up, track) })
 
-		go rtcpUpListener(up, track, receiver)
+		spawn(func() {
+			rtcpUpListener(
+				up.ctx, up, track, receiverReader{receiver},
+			)
+		})
 
 		up.mu.Unlock()
 
@@ -508,7 +1446,8 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 	})
 
 	pushConn(up, c.Group(), c.Group().GetClients(c))
-	go rtcpUpSender(up)
+	spawn(func() { rtcpUpSender(up.ctx, up) })
+	spawn(func() { nackSweeper(up.ctx, up) })
 
 	return up, nil
 }
@@ -516,26 +1455,53 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 var ErrUnsupportedFeedback = errors.New("unsupported feedback type")
 var ErrRateLimited = errors.New("rate limited")
 
-func (up *rtpUpConnection) sendPLI(track *rtpUpTrack) error {
+// the default minimum interval between two keyframe requests
+const keyframeRequestInterval = rtptime.JiffiesPerSec / 2
+
+// keyframeInterval returns the minimum interval, in jiffies, between two
+// keyframe requests of the given kind ("pli" or "fir").
+func (up *rtpUpConnection) keyframeInterval(kind string) uint64 {
+	if up.group != nil {
+		d := up.group.KeyframeRequestInterval(kind)
+		if d > 0 {
+			return rtptime.FromDuration(d, rtptime.JiffiesPerSec)
+		}
+	}
+	return keyframeRequestInterval
+}
+
+// keyframeRateLimited returns true if a keyframe request sent at time now
+// should be dropped because the previous one was sent less than interval
+// ago.  If it returns false, it records now as the time of the last
+// request.  If force is true, rate limiting is bypassed.
+func keyframeRateLimited(last *uint64, now uint64, interval uint64, force bool) bool {
+	l := atomic.LoadUint64(last)
+	if !force && now >= l && now-l < interval {
+		return true
+	}
+	atomic.StoreUint64(last, now)
+	return false
+}
+
+func (up *rtpUpConnection) sendPLI(track *rtpUpTrack, force bool) error {
 	if !track.hasRtcpFb("nack", "pli") {
 		return ErrUnsupportedFeedback
 	}
-	last := atomic.LoadUint64(&track.atomics.lastPLI)
 	now := rtptime.Jiffies()
-	if now >= last && now-last < rtptime.JiffiesPerSec/2 {
+	interval := up.keyframeInterval("pli")
+	if keyframeRateLimited(&track.atomics.lastPLI, now, interval, force) {
 		return ErrRateLimited
 	}
-	atomic.StoreUint64(&track.atomics.lastPLI, now)
-	return sendPLI(up.pc, track.track.SSRC())
+	return sendPLI(up.rtcpOut, track.track.SSRC())
 }
 
-func sendPLI(pc *webrtc.PeerConnection, ssrc webrtc.SSRC) error {
-	return pc.WriteRTCP([]rtcp.Packet{
+func sendPLI(w rtcpWriter, ssrc webrtc.SSRC) error {
+	return w.WriteRTCP([]rtcp.Packet{
 		&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)},
 	})
 }
 
-func (up *rtpUpConnection) sendFIR(track *rtpUpTrack, increment bool) error {
+func (up *rtpUpConnection) sendFIR(track *rtpUpTrack, increment bool, force bool) error {
 	// we need to reliably increment the seqno, even if we are going
 	// to drop the packet due to rate limiting.
 	var seqno uint8
@@ -548,17 +1514,16 @@ func (up *rtpUpConnection) sendFIR(track *rtpUpTrack, increment bool) error {
 	if !track.hasRtcpFb("ccm", "fir") {
 		return ErrUnsupportedFeedback
 	}
-	last := atomic.LoadUint64(&track.atomics.lastFIR)
 	now := rtptime.Jiffies()
-	if now >= last && now-last < rtptime.JiffiesPerSec/2 {
+	interval := up.keyframeInterval("fir")
+	if keyframeRateLimited(&track.atomics.lastFIR, now, interval, force) {
 		return ErrRateLimited
 	}
-	atomic.StoreUint64(&track.atomics.lastFIR, now)
-	return sendFIR(up.pc, track.track.SSRC(), seqno)
+	return sendFIR(up.rtcpOut, track.track.SSRC(), seqno)
 }
 
-func sendFIR(pc *webrtc.PeerConnection, ssrc webrtc.SSRC, seqno uint8) error {
-	return pc.WriteRTCP([]rtcp.Packet{
+func sendFIR(w rtcpWriter, ssrc webrtc.SSRC, seqno uint8) error {
+	return w.WriteRTCP([]rtcp.Packet{
 		&rtcp.FullIntraRequest{
 			FIR: []rtcp.FIREntry{
 				{
@@ -570,16 +1535,137 @@ func sendFIR(pc *webrtc.PeerConnection, ssrc webrtc.SSRC, seqno uint8) error {
 	})
 }
 
-func (up *rtpUpConnection) sendNACK(track *rtpUpTrack, first uint16, bitmap uint16) error {
-	if !track.hasRtcpFb("nack", "") {
+// RequestKeyframe requests a fresh keyframe on all video tracks of the
+// connection, using FIR if the track supports it and PLI otherwise.  If
+// force is true, rate limiting is bypassed; this is intended for the
+// recorder, which needs a clean cut point.  It returns true if a request
+// was actually sent for at least one track.
+func (up *rtpUpConnection) RequestKeyframe(force bool) bool {
+	sent := false
+	for _, t := range up.getTracks() {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		err := up.sendFIR(t, true, force)
+		if err == ErrUnsupportedFeedback {
+			err = up.sendPLI(t, force)
+		}
+		if err == nil {
+			sent = true
+		} else if err != ErrRateLimited &&
+			err != ErrUnsupportedFeedback {
+			ratelimitlog.Log("RequestKeyframe",
+				"conn", up.id, "error", err)
+		}
+	}
+	return sent
+}
+
+// SetMuted mutes or unmutes all tracks of the given kind, and requests a
+// keyframe when video is unmuted.
+func (up *rtpUpConnection) SetMuted(kind webrtc.RTPCodecType, muted bool) {
+	found := false
+	for _, t := range up.getAllTracks() {
+		if t.Kind() == kind {
+			t.setMuted(muted)
+			found = true
+		}
+	}
+	if found && !muted && kind == webrtc.RTPCodecTypeVideo {
+		up.RequestKeyframe(true)
+	}
+}
+
+// keyframeRequested records that a receiver has been waiting for
+// a keyframe since time now, unless an earlier request is still
+// outstanding.  It is called by the writer when a receiver cannot decode
+// the packets it is being sent; periodic requests and requests that
+// merely relay a receiver's PLI or FIR are not recorded, since the
+// sender is free to ignore them.
+func (up *rtpUpTrack) keyframeRequested(now uint64) {
+	atomic.CompareAndSwapUint64(&up.atomics.kfRequested, 0, now)
+}
+
+// gotKeyframe is called by the reader loop when a keyframe arrives.
+func (up *rtpUpTrack) gotKeyframe(now uint64) {
+	atomic.StoreUint64(&up.atomics.lastKeyframe, now)
+	atomic.StoreUint64(&up.atomics.kfRequested, 0)
+	atomic.StoreUint32(&up.atomics.kfStage, 0)
+}
+
+// The time we wait for a keyframe before escalating.
+const keyframeTimeout = 2 * rtptime.JiffiesPerSec
+
+// keyframeOverdue returns true if a keyframe requested at time
+// requested should have arrived by now.  Since the sender may be idle or
+// send at a very low frame rate, this is only the case if media kept
+// flowing for the whole timeout, as witnessed by the time at which the
+// last packet was received.
+func keyframeOverdue(now, requested, lastReceived uint64) bool {
+	if requested == 0 || now < requested ||
+		now-requested < keyframeTimeout {
+		return false
+	}
+	return lastReceived >= requested+keyframeTimeout
+}
+
+// checkKeyframes detects video tracks that keep sending media but fail to
+// produce the keyframe that a receiver is waiting for, and escalates:
+// first by sending a FIR, then by asking the client to reconnect.
+func (up *rtpUpConnection) checkKeyframes(now uint64) {
+	for _, t := range up.getTracks() {
+		if t.Kind() != webrtc.RTPCodecTypeVideo ||
+			atomic.LoadUint32(&t.atomics.kfKnown) == 0 ||
+			t.gotGoodbye() {
+			continue
+		}
+		if !keyframeOverdue(now,
+			atomic.LoadUint64(&t.atomics.kfRequested),
+			atomic.LoadUint64(&t.atomics.lastReceived)) {
+			continue
+		}
+		stage := atomic.LoadUint32(&t.atomics.kfStage)
+		switch stage {
+		case 0:
+			Logger.Infof("Track %v/%v: no keyframe, sending FIR",
+				up.id, t.getMid())
+			err := up.sendFIR(t, true, true)
+			if err == ErrUnsupportedFeedback {
+				err = up.sendPLI(t, true)
+			}
+			if err != nil {
+				Logger.Warnf("checkKeyframes: %v", err)
+			}
+		case 1:
+			Logger.Warnf("Track %v/%v: video is frozen, reconnecting",
+				up.id, t.getMid())
+			if up.reconnect != nil {
+				up.reconnect()
+			}
+		default:
+			// there's nothing more we can do, wait for the
+			// next request.
+			atomic.StoreUint64(&t.atomics.kfRequested, 0)
+			atomic.StoreUint32(&t.atomics.kfStage, 0)
+			continue
+		}
+		atomic.StoreUint32(&t.atomics.kfStage, stage+1)
+		atomic.StoreUint64(&t.atomics.kfRequested, now)
+	}
+}
+
+// sendNACK requests the packets described by entries, in a single RTCP
+// packet.
+func (up *rtpUpConnection) sendNACK(track *rtpUpTrack, entries []packetcache.BitmapEntry) error {
+	if !track.nackEnabled() {
 		return ErrUnsupportedFeedback
 	}
 
-	err := sendNACKs(up.pc, track.track.SSRC(),
-		[]rtcp.NackPair{{first, rtcp.PacketBitmap(bitmap)}},
-	)
+	nacks, seqnos := nackPairs(entries)
+	err := sendNACKs(up.rtcp, track.track.SSRC(), nacks)
 	if err == nil {
-		track.cache.Expect(1 + bits.OnesCount16(bitmap))
+		track.cache.Expect(len(seqnos))
+		track.nacks.sent(seqnos, rtptime.Jiffies())
 	}
 	return err
 }
@@ -589,8 +1675,9 @@ func (up *rtpUpConnection) sendNACKs(track *rtpUpTrack, seqnos []uint16) error {
 	if count == 0 {
 		return nil
 	}
+	all := seqnos
 
-	if !track.hasRtcpFb("nack", "") {
+	if !track.nackEnabled() {
 		return ErrUnsupportedFeedback
 	}
 
@@ -598,37 +1685,80 @@ func (up *rtpUpConnection) sendNACKs(track *rtpUpTrack, seqnos []uint16) error {
 
 	for len(seqnos) > 0 {
 		if len(nacks) >= 240 {
-			log.Printf("NACK: packet overflow")
+			ratelimitlog.Log("NACK: packet overflow", "conn", up.id)
 			break
 		}
 		var f, b uint16
 		f, b, seqnos = packetcache.ToBitmap(seqnos)
 		nacks = append(nacks, rtcp.NackPair{f, rtcp.PacketBitmap(b)})
 	}
-	err := sendNACKs(up.pc, track.track.SSRC(), nacks)
+	err := sendNACKs(up.rtcp, track.track.SSRC(), nacks)
 	if err == nil {
 		track.cache.Expect(count)
+		track.nacks.sent(all, rtptime.Jiffies())
 	}
 	return err
 }
 
-func sendNACKs(pc *webrtc.PeerConnection, ssrc webrtc.SSRC, nacks []rtcp.NackPair) error {
+func sendNACKs(w rtcpWriter, ssrc webrtc.SSRC, nacks []rtcp.NackPair) error {
 	packet := rtcp.Packet(
 		&rtcp.TransportLayerNack{
 			MediaSSRC: uint32(ssrc),
 			Nacks:     nacks,
 		},
 	)
-	return pc.WriteRTCP([]rtcp.Packet{packet})
+	return w.WriteRTCP([]rtcp.Packet{packet})
 }
 
 func gotNACK(conn *rtpDownConnection, track *rtpDownTrack, p *rtcp.TransportLayerNack) {
+	if Logger.Enabled(logger.LevelDebug) {
+		Logger.Log(logger.LevelDebug, "got NACK",
+			"conn", conn.id, "track", track.track.ID(),
+			"nacks", len(p.Nacks))
+	}
+	if track.getWaitingKeyframe() {
+		// the receiver cannot decode anything before the next
+		// keyframe, don't waste bandwidth on retransmissions.
+		return
+	}
+	if rt, ok := track.remote.(*rtpUpTrack); ok && !rt.retransmit() {
+		// a retransmission would arrive too late to be played
+		return
+	}
+	unhandled := sendRecovery(track, track.remote, track.rate, p.Nacks)
+	if len(unhandled) == 0 {
+		return
+	}
+
+	track.remote.Nack(conn.remote, unhandled)
+}
+
+// sendRecovery retransmits the packets requested by nacks that are
+// available in remote, and returns the seqnos of those that are not.  If
+// w is a down track, the seqnos in nacks are those that were sent, and
+// are mapped back through the track's translator; the seqnos returned
+// are those of remote.
+func sendRecovery(w rtpPacketWriter, remote conn.UpTrack, rate *estimator.Estimator, nacks []rtcp.NackPair) []uint16 {
 	var unhandled []uint16
 	var packet rtp.Packet
-	buf := make([]byte, packetcache.BufSize)
-	for _, nack := range p.Nacks {
+	b := packetcache.GetBuffer()
+	defer packetcache.PutBuffer(b)
+	buf := b[:]
+	down, _ := w.(*rtpDownTrack)
+	for _, nack := range nacks {
 		nack.Range(func(seqno uint16) bool {
-			l := track.remote.GetRTP(seqno, buf)
+			sent := seqno
+			var tsOffset uint32
+			if down != nil {
+				var ok bool
+				seqno, tsOffset, ok =
+					down.translator.inverse(seqno)
+				if !ok {
+					// sent from an earlier source
+					return true
+				}
+			}
+			l := remote.GetRTP(seqno, buf)
 			if l == 0 {
 				unhandled = append(unhandled, seqno)
 				return true
@@ -637,20 +1767,28 @@ func gotNACK(conn *rtpDownConnection, track *rtpDownTrack, p *rtcp.TransportLaye
 			if err != nil {
 				return true
 			}
-			err = track.track.WriteRTP(&packet)
+			if down != nil {
+				// WriteRTP would go through the translator,
+				// which belongs to the writer goroutine.
+				packet.SequenceNumber = sent
+				packet.Timestamp += tsOffset
+				packet.CSRC = withCSRC(packet.CSRC, down.csrc)
+				err = down.send(&packet)
+			} else {
+				err = w.WriteRTP(&packet)
+			}
 			if err != nil {
-				log.Printf("WriteRTP: %v", err)
+				ratelimitlog.Log("WriteRTP", "error", err)
 				return false
 			}
-			track.rate.Accumulate(uint32(l))
+			rate.Accumulate(uint32(l))
+			if down != nil {
+				down.setForwarded(rtptime.Jiffies(), true)
+			}
 			return true
 		})
 	}
-	if len(unhandled) == 0 {
-		return
-	}
-
-	track.remote.Nack(conn.remote, unhandled)
+	return unhandled
 }
 
 func (track *rtpUpTrack) Nack(conn conn.Up, nacks []uint16) error {
@@ -672,7 +1810,7 @@ outer:
 	if doit {
 		up, ok := conn.(*rtpUpConnection)
 		if !ok {
-			log.Printf("Nack: unexpected type %T", conn)
+			Logger.Errorf("Nack: unexpected type %T", conn)
 			return errors.New("unexpected connection type")
 		}
 		go nackWriter(up, track)
@@ -680,30 +1818,46 @@ outer:
 	return nil
 }
 
-func rtcpUpListener(conn *rtpUpConnection, track *rtpUpTrack, r *webrtc.RTPReceiver) {
+// rtcpUpListener reads RTCP from the sender of an up track.  It returns
+// when reading fails, which happens when the peer connection is closed;
+// the connection closes it when ctx is cancelled.
+func rtcpUpListener(ctx context.Context, conn *rtpUpConnection, track *rtpUpTrack, r io.Reader) {
+	var limiter rtcpLimiter
 	buf := make([]byte, 1500)
 
 	for {
 		firstSR := false
-		n, _, err := r.Read(buf)
+		n, err := r.Read(buf)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
-				log.Printf("Read RTCP: %v", err)
+				Logger.Warnf("Read RTCP: %v", err)
 			}
 			return
 		}
+		jiffies := rtptime.Jiffies()
+		if !limiter.allow(jiffies) {
+			ratelimitlog.Log("RTCP rate limit exceeded", "conn", conn.id)
+			continue
+		}
+
 		ps, err := rtcp.Unmarshal(buf[:n])
 		if err != nil {
-			log.Printf("Unmarshal RTCP: %v", err)
+			ratelimitlog.Log("Unmarshal RTCP",
+				"conn", conn.id, "error", err)
 			continue
 		}
-
-		jiffies := rtptime.Jiffies()
+		ps = sanitizeRTCP(ps)
 
 		for _, p := range ps {
 			local := track.getLocal()
 			switch p := p.(type) {
 			case *rtcp.SenderReport:
+				if !track.srApplies(conn, p.SSRC, jiffies) {
+					continue
+				}
 				track.mu.Lock()
 				if track.srTime == 0 {
 					firstSR = true
@@ -711,13 +1865,16 @@ func rtcpUpListener(conn *rtpUpConnection, track *rtpUpTrack, r *webrtc.RTPRecei
 				track.srTime = jiffies
 				track.srNTPTime = p.NTPTime
 				track.srRTPTime = p.RTPTime
+				track.offset.update(
+					rtptime.TimeToNTP(time.Now()), p.NTPTime,
+				)
 				track.mu.Unlock()
 				for _, l := range local {
 					l.SetTimeOffset(p.NTPTime, p.RTPTime)
 				}
 			case *rtcp.SourceDescription:
 				for _, c := range p.Chunks {
-					if c.Source != uint32(track.track.SSRC()) {
+					if c.Source != track.rtcpSSRC() {
 						continue
 					}
 					for _, i := range c.Items {
@@ -730,6 +1887,28 @@ func rtcpUpListener(conn *rtpUpConnection, track *rtpUpTrack, r *webrtc.RTPRecei
 						}
 					}
 				}
+			case *rtcp.RawPacket:
+				xr, ok := parseXR(p)
+				if ok {
+					for _, d := range xr.DLRR {
+						conn.xr.gotDLRR(d, jiffies)
+					}
+				}
+				t, ok := parseTMMBR(p)
+				if ok && t.Notification &&
+					t.SenderSSRC == track.rtcpSSRC() {
+					gotTMMBN(track, t)
+				}
+				a, ok := parseAPP(p)
+				if ok {
+					forwardAPP(conn, track, a, jiffies)
+				}
+			case *rtcp.Goodbye:
+				for _, s := range p.Sources {
+					if s == track.rtcpSSRC() {
+						gotBye(conn, track)
+					}
+				}
 			}
 		}
 
@@ -742,7 +1921,8 @@ func rtcpUpListener(conn *rtpUpConnection, track *rtpUpTrack, r *webrtc.RTPRecei
 				if ok {
 					err := sendSR(l)
 					if err != nil {
-						log.Printf("sendSR: %v", err)
+						ratelimitlog.Log("sendSR",
+							"conn", l.id, "error", err)
 					}
 				}
 			}
@@ -750,6 +1930,105 @@ func rtcpUpListener(conn *rtpUpConnection, track *rtpUpTrack, r *webrtc.RTPRecei
 	}
 }
 
+// tmmbrTarget returns the bitrate that should be requested with TMMBR
+// from the sender of a track, and false if no request is needed.  Audio
+// is limited to maxAudio, and a request is repeated until the sender
+// acknowledges it.  Video is limited to rate, like REMB, which is
+// preferred when both were negotiated.
+func tmmbrTarget(kind webrtc.RTPCodecType, fb Feedback, acked, rate, maxAudio uint64) (uint64, bool) {
+	if !fb.TMMBR {
+		return 0, false
+	}
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		target := rate
+		if maxAudio > 0 && maxAudio < target {
+			target = maxAudio
+		}
+		if target > opusMaxBitrate {
+			target = opusMaxBitrate
+		}
+		if acked > opusMaxBitrate {
+			acked = opusMaxBitrate
+		}
+		if acked == target || (acked == 0 && target == opusMaxBitrate) {
+			return 0, false
+		}
+		return target, true
+	case webrtc.RTPCodecTypeVideo:
+		if fb.REMB || rate == ^uint64(0) {
+			return 0, false
+		}
+		return rate, true
+	}
+	return 0, false
+}
+
+// upTMMBR returns a TMMBR for the tracks that need one, or nil.
+func upTMMBR(tracks []*rtpUpTrack, rate, maxAudio uint64) *tmmbr {
+	var p *tmmbr
+	for _, t := range tracks {
+		target, ok := tmmbrTarget(
+			t.track.Kind(), t.FeedbackMechanisms(),
+			atomic.LoadUint64(&t.atomics.tmmbn), rate, maxAudio,
+		)
+		if !ok {
+			continue
+		}
+		if p == nil {
+			p = &tmmbr{}
+		}
+		p.Entries = append(p.Entries, tmmbrEntry{
+			SSRC:    uint32(t.track.SSRC()),
+			Bitrate: target,
+		})
+	}
+	return p
+}
+
+// aggregateBitrate returns the highest of rates that is no larger than
+// percentile percent of rates, so that the receivers with the lowest
+// rates don't limit everyone else.  With a percentile of 100, this is
+// the minimum.  The slice is sorted in place.
+func aggregateBitrate(rates []uint64, percentile int) uint64 {
+	if len(rates) == 0 {
+		return ^uint64(0)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i] < rates[j]
+	})
+	// the number of receivers that must be accommodated, rounded up
+	n := (len(rates)*percentile + 99) / 100
+	if n < 1 {
+		n = 1
+	}
+	if n > len(rates) {
+		n = len(rates)
+	}
+	return rates[len(rates)-n]
+}
+
+// labelBitrateLimit returns the bitrate that the sender of a stream with
+// the given label and tracks may use, or 0 if there is no limit.  Only
+// video is limited by the group, so audio tracks are allowed their
+// default rate on top of the video limit.
+func labelBitrateLimit(g *group.Group, label string, tracks []*rtpUpTrack) uint64 {
+	if g == nil {
+		return 0
+	}
+	_, max := g.VideoBitrate(label)
+	if max == 0 {
+		return 0
+	}
+	limit := max
+	for _, t := range tracks {
+		if t.track.Kind() == webrtc.RTPCodecTypeAudio {
+			limit += 128 * 1024
+		}
+	}
+	return limit
+}
+
 func sendUpRTCP(conn *rtpUpConnection) error {
 	tracks := conn.getTracks()
 
@@ -802,15 +2081,35 @@ func sendUpRTCP(conn *rtpUpConnection) error {
 		},
 	}
 
-	rate := ^uint64(0)
+	if conn.getXREnabled() {
+		ntp := rtptime.TimeToNTP(time.Now())
+		xr := &extendedReport{RRTR: ntp}
+		for _, t := range tracks {
+			l, ok := t.xrLoss.report(uint32(t.track.SSRC()))
+			if ok {
+				xr.LossRLE = append(xr.LossRLE, l)
+			}
+		}
+		conn.xr.setRRTR(0, ntp, now)
+		packets = append(packets, xr)
+	}
 
-	local := conn.getLocal()
-	for _, l := range local {
-		r := l.GetMaxBitrate(now)
-		if r < rate {
-			rate = r
+	var rate uint64
+	if uplinkEstimation(conn.group) {
+		rate = conn.estimateUplink(tracks)
+	} else {
+		local := conn.getLocal()
+		rates := make([]uint64, 0, len(local))
+		for _, l := range local {
+			rates = append(rates, l.GetMaxBitrate(now))
+		}
+		percentile := 100
+		if conn.group != nil {
+			percentile = conn.group.SenderBitratePercentile()
 		}
+		rate = aggregateBitrate(rates, percentile)
 	}
+	rate = minLimit(rate, labelBitrateLimit(conn.group, conn.label, tracks))
 
 	if rate < group.MinBitrate {
 		rate = group.MinBitrate
@@ -818,7 +2117,7 @@ func sendUpRTCP(conn *rtpUpConnection) error {
 
 	var ssrcs []uint32
 	for _, t := range tracks {
-		if t.hasRtcpFb("goog-remb", "") {
+		if !t.hasRtcpFb("goog-remb", "") {
 			continue
 		}
 		ssrcs = append(ssrcs, uint32(t.track.SSRC()))
@@ -832,19 +2131,40 @@ func sendUpRTCP(conn *rtpUpConnection) error {
 			},
 		)
 	}
-	return conn.pc.WriteRTCP(packets)
+
+	var maxAudio uint64
+	if conn.group != nil {
+		maxAudio = conn.group.MaxAudioBitrate()
+	}
+	if p := upTMMBR(tracks, rate, maxAudio); p != nil {
+		packets = append(packets, p)
+	}
+	return conn.rtcpOut.WriteRTCP(packets)
 }
 
-func rtcpUpSender(conn *rtpUpConnection) {
+func rtcpUpSender(ctx context.Context, conn *rtpUpConnection) {
+	ticker := time.NewTicker(RTCPInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		err := sendUpRTCP(conn)
 		if err != nil {
 			if err == io.EOF || err == io.ErrClosedPipe {
 				return
 			}
-			log.Printf("sendUpRTCP: %v", err)
+			Logger.Warnf("sendUpRTCP: %v", err)
+		}
+		err = upKeepalive(conn, rtptime.Jiffies())
+		if err != nil {
+			ratelimitlog.Log("keepalive",
+				"conn", conn.id, "error", err)
 		}
+		conn.checkKeyframes(rtptime.Jiffies())
+		conn.requestPeriodicKeyframes(rtptime.Jiffies())
 	}
 }
 
@@ -858,30 +2178,12 @@ func sendSR(conn *rtpDownConnection) error {
 	jiffies := rtptime.TimeToJiffies(now)
 
 	for _, t := range tracks {
-		clockrate := t.track.Codec().ClockRate
-
-		var nowRTP uint32
-
-		remoteNTP, remoteRTP := t.getTimeOffset()
+		remoteNTP, _ := t.getTimeOffset()
 		if remoteNTP != 0 {
-			srTime := rtptime.NTPToTime(remoteNTP)
-			d := now.Sub(srTime)
-			if d > 0 && d < time.Hour {
-				delay := rtptime.FromDuration(
-					d, clockrate,
-				)
-				nowRTP = remoteRTP + uint32(delay)
-			}
-
-			p, b := t.rate.Totals()
+			nowRTP, _ := t.srTimestamp(now, t.clockRate())
 			packets = append(packets,
-				&rtcp.SenderReport{
-					SSRC:        uint32(t.ssrc),
-					NTPTime:     nowNTP,
-					RTPTime:     nowRTP,
-					PacketCount: p,
-					OctetCount:  b,
-				})
+				senderReport(t, nowNTP, nowRTP),
+			)
 			t.setSRTime(jiffies, nowNTP)
 		}
 
@@ -912,19 +2214,55 @@ func sendSR(conn *rtpDownConnection) error {
 		return nil
 	}
 
-	return conn.pc.WriteRTCP(packets)
+	if len(tracks) > 0 {
+		d, ok := conn.xr.dlrr(jiffies)
+		if ok {
+			packets = append(packets, &extendedReport{
+				SSRC: uint32(tracks[0].ssrc),
+				DLRR: []xrDLRR{d},
+			})
+		}
+	}
+
+	return conn.rtcpOut.WriteRTCP(packets)
+}
+
+// senderReport builds a sender report for a track.  The packet and
+// octet counts are taken modulo 2^32, as required by RFC 3550.
+func senderReport(t *rtpDownTrack, ntpTime uint64, rtpTime uint32) *rtcp.SenderReport {
+	p, b := t.rate.Totals()
+	return &rtcp.SenderReport{
+		SSRC:        uint32(t.ssrc),
+		NTPTime:     ntpTime,
+		RTPTime:     rtpTime,
+		PacketCount: p,
+		OctetCount:  b,
+	}
 }
 
-func rtcpDownSender(conn *rtpDownConnection) {
+func rtcpDownSender(ctx context.Context, conn *rtpDownConnection) {
+	ticker := time.NewTicker(RTCPInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		err := sendSR(conn)
 		if err != nil {
 			if err == io.EOF || err == io.ErrClosedPipe {
 				return
 			}
-			log.Printf("sendSR: %v", err)
+			Logger.Warnf("sendSR: %v", err)
+		}
+		err = downKeepalive(conn, rtptime.Jiffies())
+		if err != nil {
+			ratelimitlog.Log("keepalive",
+				"conn", conn.id, "error", err)
 		}
+		conn.updateQuality(rtptime.Jiffies())
+		conn.checkOneWay(rtptime.Jiffies())
 	}
 }
 
@@ -935,129 +2273,345 @@ const (
 )
 
 func (track *rtpDownTrack) updateRate(loss uint8, now uint64) {
-	rate := track.maxBitrate.Get(now)
-	if rate < minLossRate || rate > maxLossRate {
-		// no recent feedback, reset
-		rate = initLossRate
+	var rate uint64
+	if track.lossless {
+		rate = maxLossRate
+	} else {
+		r, steady, peak := track.rate.Rates(now)
+		slowStart := atomic.LoadUint32(&track.atomics.slowStart) != 0
+		rate, slowStart = slowStartRate(
+			track.maxBitrate.Get(now), track.initialRate, slowStart,
+			loss, 8*uint64(r), 8*uint64(steady), 8*uint64(peak),
+		)
+		var v uint32
+		if slowStart {
+			v = 1
+		}
+		atomic.StoreUint32(&track.atomics.slowStart, v)
+	}
+	// below the floor, rely on the sender reducing its framerate
+	// rather than its quality; the receiver's own limits still apply
+	if rate < track.minRate {
+		rate = track.minRate
+	}
+	rate = minLimit(rate, atomic.LoadUint64(&track.atomics.sdpLimit))
+	rate = minLimit(rate, track.maxRate)
+	if rate != track.maxBitrate.Get(now) {
+		// the peak must only reflect the burstiness of the path,
+		// not our own changes of rate
+		track.rate.ResetPeak()
 	}
+	// update unconditionally, to set the timestamp
+	track.maxBitrate.Set(rate, now)
+}
+
+// lossBasedRate computes a new target bitrate given the previous target,
+// the initial rate (0 for the default), the fraction lost reported by
+// the receiver, and the actual, steady-state and peak sending rates, all
+// in bits per second.  The steady-state rate excludes keyframes, which
+// would otherwise make it look like we are using the whole of our budget.
+func lossBasedRate(rate, initial uint64, loss uint8, actual, steady, peak uint64) uint64 {
+	rate, _ = resetRate(rate, initial)
+	// if the peak rate over a fraction of the interval is much larger
+	// than the average rate, then the path is bursty, and we're likely
+	// filling up buffers.
+	bursty := peak > 2*actual
+
 	if loss < 5 {
 		// if our actual rate is low, then we're not probing the
 		// bottleneck
-		r, _ := track.rate.Estimate()
-		actual := 8 * uint64(r)
-		if actual >= (rate*7)/8 {
+		if !bursty && steady >= (rate*7)/8 {
 			// loss < 0.02, multiply by 1.05
 			rate = rate * 269 / 256
 			if rate > maxLossRate {
 				rate = maxLossRate
 			}
 		}
-	} else if loss > 25 {
-		// loss > 0.1, multiply by (1 - loss/2)
+	} else if loss > 25 || (bursty && loss > 12) {
+		// loss > 0.1 (0.05 if bursty), multiply by (1 - loss/2)
 		rate = rate * (512 - uint64(loss)) / 512
 		if rate < minLossRate {
 			rate = minLossRate
 		}
 	}
+	return rate
+}
 
-	// update unconditionally, to set the timestamp
-	track.maxBitrate.Set(rate, now)
+// resetRate returns the initial rate if there has been no recent
+// feedback, in which case the previous target rate is out of range.
+func resetRate(rate, initial uint64) (uint64, bool) {
+	if rate >= minLossRate && rate <= maxLossRate {
+		return rate, false
+	}
+	if initial >= minLossRate && initial <= maxLossRate {
+		return initial, true
+	}
+	return initLossRate, true
+}
+
+// the factor by which the rate grows at every report during slow start,
+// over 256
+const slowStartGrowth = 320
+
+// slowStartRate is like lossBasedRate, but distinguishes two phases.
+// After a reset, the rate is held for one report, since it hasn't been
+// tested yet, and then grows faster than in the steady state, as long as
+// we are actually sending at the target rate.  At the first loss, it
+// falls back to the last rate that was loss-free, and the gentle AIMD
+// of lossBasedRate takes over.  It returns the new rate and whether we
+// are still in slow start.
+func slowStartRate(rate, initial uint64, slowStart bool, loss uint8, actual, steady, peak uint64) (uint64, bool) {
+	rate, reset := resetRate(rate, initial)
+	if reset {
+		if loss >= 5 {
+			return lossBasedRate(
+				rate, initial, loss, actual, steady, peak,
+			), false
+		}
+		return rate, true
+	}
+	if !slowStart {
+		return lossBasedRate(
+			rate, initial, loss, actual, steady, peak,
+		), false
+	}
+
+	if loss >= 5 {
+		// we overshot, go back to where we were before the last
+		// increase, and decrease further if the loss is heavy.
+		r := rate * 256 / slowStartGrowth
+		if r < minLossRate {
+			r = minLossRate
+		}
+		return lossBasedRate(r, initial, loss, actual, steady, peak),
+			false
+	}
+	if peak <= 2*actual && steady >= (rate*7)/8 {
+		rate = rate * slowStartGrowth / 256
+		if rate > maxLossRate {
+			rate = maxLossRate
+		}
+	}
+	return rate, true
 }
 
-func rtcpDownListener(conn *rtpDownConnection, track *rtpDownTrack, s *webrtc.RTPSender) {
-	var gotFir bool
-	lastFirSeqno := uint8(0)
+// rtcpDownListener reads RTCP from the receiver of a down track.  It
+// returns when reading fails, which happens when the peer connection is
+// closed; the connection closes it when ctx is cancelled.
+func rtcpDownListener(ctx context.Context, conn *rtpDownConnection, track *rtpDownTrack, s io.Reader) {
+	var fir firState
+	var limiter rtcpLimiter
 
 	buf := make([]byte, 1500)
 
 	for {
-		n, _, err := s.Read(buf)
+		n, err := s.Read(buf)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
-				log.Printf("Read RTCP: %v", err)
+				Logger.Warnf("Read RTCP: %v", err)
 			}
 			return
 		}
+		jiffies := rtptime.Jiffies()
+		if !limiter.allow(jiffies) {
+			ratelimitlog.Log("RTCP rate limit exceeded", "conn", conn.id)
+			continue
+		}
+
 		ps, err := rtcp.Unmarshal(buf[:n])
 		if err != nil {
-			log.Printf("Unmarshal RTCP: %v", err)
+			ratelimitlog.Log("Unmarshal RTCP",
+				"conn", conn.id, "error", err)
 			continue
 		}
-
-		jiffies := rtptime.Jiffies()
+		ps = sanitizeRTCP(ps)
 
 		for _, p := range ps {
-			switch p := p.(type) {
-			case *rtcp.PictureLossIndication:
-				remote, ok := conn.remote.(*rtpUpConnection)
-				if !ok {
-					continue
-				}
-				rt, ok := track.remote.(*rtpUpTrack)
-				if !ok {
-					continue
-				}
-				err := remote.sendPLI(rt)
-				if err != nil && err != ErrRateLimited {
-					log.Printf("sendPLI: %v", err)
-				}
-			case *rtcp.FullIntraRequest:
-				found := false
-				var seqno uint8
-				for _, entry := range p.FIR {
-					if entry.SSRC == uint32(track.ssrc) {
-						found = true
-						seqno = entry.SequenceNumber
-						break
-					}
-				}
-				if !found {
-					log.Printf("Misdirected FIR")
-					continue
-				}
+			handleDownRTCP(conn, track, &fir, p, jiffies)
+		}
+	}
+}
 
-				increment := true
-				if gotFir {
-					increment = seqno != lastFirSeqno
-				}
-				gotFir = true
-				lastFirSeqno = seqno
+// firState remembers the sequence number of the last FIR received for
+// a track, in order to detect retransmissions.
+type firState struct {
+	got   bool
+	seqno uint8
+}
 
-				remote, ok := conn.remote.(*rtpUpConnection)
-				if !ok {
-					continue
-				}
-				rt, ok := track.remote.(*rtpUpTrack)
-				if !ok {
-					continue
-				}
-				err := remote.sendFIR(rt, increment)
-				if err == ErrUnsupportedFeedback {
-					err := remote.sendPLI(rt)
-					if err != nil && err != ErrRateLimited {
-						log.Printf("sendPLI: %v", err)
-					}
-				} else if err != nil && err != ErrRateLimited {
-					log.Printf("sendFIR: %v", err)
-				}
-			case *rtcp.ReceiverEstimatedMaximumBitrate:
-				conn.maxREMBBitrate.Set(p.Bitrate, jiffies)
-			case *rtcp.ReceiverReport:
-				for _, r := range p.Reports {
-					if r.SSRC == uint32(track.ssrc) {
-						handleReport(track, r, jiffies)
-					}
-				}
-			case *rtcp.SenderReport:
-				for _, r := range p.Reports {
-					if r.SSRC == uint32(track.ssrc) {
-						handleReport(track, r, jiffies)
-					}
-				}
-			case *rtcp.TransportLayerNack:
-				gotNACK(conn, track, p)
+// handleDownRTCP handles an RTCP packet received by the listener of
+// track.  A compound packet is delivered to the listeners of all the
+// tracks that it concerns, so each listener only handles the parts that
+// are routed to its own track; parts addressed to an unknown SSRC are
+// dropped.
+func handleDownRTCP(conn *rtpDownConnection, track *rtpDownTrack, fir *firState, p rtcp.Packet, jiffies uint64) {
+	switch p := p.(type) {
+	case *rtcp.PictureLossIndication:
+		if conn.getTrackBySSRC(p.MediaSSRC) != track {
+			return
+		}
+		if track.getWaitingKeyframe() {
+			// the receiver has no decoding state, the cached
+			// keyframe is better than nothing while we wait
+			// for a fresh one.
+			track.requestReplayKeyframe()
+		}
+		remote, ok := conn.remote.(*rtpUpConnection)
+		if !ok {
+			// a synthetic sender, such as a file
+			if conn.remote != nil {
+				conn.remote.RequestKeyframe(false)
+			}
+			return
+		}
+		rt, ok := track.remote.(*rtpUpTrack)
+		if !ok {
+			return
+		}
+		err := remote.sendPLI(rt, false)
+		if err != nil && err != ErrRateLimited {
+			ratelimitlog.Log("sendPLI",
+				"conn", remote.id, "error", err)
+		}
+	case *rtcp.FullIntraRequest:
+		found := false
+		var seqno uint8
+		for _, entry := range p.FIR {
+			if conn.getTrackBySSRC(entry.SSRC) == track {
+				found = true
+				seqno = entry.SequenceNumber
+				break
 			}
 		}
+		if !found {
+			return
+		}
+		if track.getWaitingKeyframe() {
+			track.requestReplayKeyframe()
+		}
+
+		increment := true
+		if fir.got {
+			increment = seqno != fir.seqno
+		}
+		fir.got = true
+		fir.seqno = seqno
+
+		remote, ok := conn.remote.(*rtpUpConnection)
+		if !ok {
+			if conn.remote != nil {
+				conn.remote.RequestKeyframe(false)
+			}
+			return
+		}
+		rt, ok := track.remote.(*rtpUpTrack)
+		if !ok {
+			return
+		}
+		err := remote.sendFIR(rt, increment, false)
+		if err == ErrUnsupportedFeedback {
+			err := remote.sendPLI(rt, false)
+			if err != nil && err != ErrRateLimited {
+				ratelimitlog.Log("sendPLI",
+					"conn", remote.id, "error", err)
+			}
+		} else if err != nil && err != ErrRateLimited {
+			ratelimitlog.Log("sendFIR",
+				"conn", remote.id, "error", err)
+		}
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		rate, ok := rembBitrate(p.Bitrate)
+		if !ok {
+			ratelimitlog.Log("Ignoring REMB",
+				"conn", conn.id, "bitrate", p.Bitrate)
+			return
+		}
+		conn.maxREMBBitrate.Set(rate, jiffies)
+	case *rtcp.ReceiverReport:
+		for _, r := range p.Reports {
+			if conn.getTrackBySSRC(r.SSRC) == track {
+				handleReport(track, r, jiffies)
+			}
+		}
+	case *rtcp.SenderReport:
+		for _, r := range p.Reports {
+			if conn.getTrackBySSRC(r.SSRC) == track {
+				handleReport(track, r, jiffies)
+			}
+		}
+	case *rtcp.TransportLayerNack:
+		if conn.getTrackBySSRC(p.MediaSSRC) != track {
+			return
+		}
+		gotNACK(conn, track, p)
+	case *rtcp.RawPacket:
+		t, ok := parseTMMBR(p)
+		if ok && !t.Notification {
+			gotTMMBR(conn, track, t)
+			return
+		}
+		xr, ok := parseXR(p)
+		if !ok {
+			return
+		}
+		if xr.RRTR != 0 {
+			conn.xr.setRRTR(xr.SSRC, xr.RRTR, jiffies)
+		}
+		for _, l := range xr.LossRLE {
+			if conn.getTrackBySSRC(l.SSRC) == track {
+				_, _, burst := lossRLEStats(l)
+				atomic.StoreUint32(
+					&track.atomics.lossBurst, burst,
+				)
+			}
+		}
+	}
+}
+
+// gotTMMBN records the bitrate acknowledged by a sender.  We send
+// requests with a sender SSRC of 0, so that's the entry we look for; an
+// empty bounding set means that the sender is not limited.
+func gotTMMBN(track *rtpUpTrack, t *tmmbr) {
+	var bitrate uint64
+	for _, e := range t.Entries {
+		if e.SSRC == 0 {
+			bitrate = clampBitrate(e.Bitrate)
+		}
+	}
+	atomic.StoreUint64(&track.atomics.tmmbn, bitrate)
+}
+
+// gotTMMBR handles a request from a receiver, and acknowledges it.
+// Since we don't transcode, we honour the request by taking it into
+// account in the bitrate that we request from the sender.
+func gotTMMBR(conn *rtpDownConnection, track *rtpDownTrack, t *tmmbr) {
+	for _, e := range t.Entries {
+		if conn.getTrackBySSRC(e.SSRC) != track {
+			continue
+		}
+		atomic.StoreUint64(
+			&track.atomics.tmmbr, clampBitrate(e.Bitrate),
+		)
+		if conn.rtcpOut == nil {
+			continue
+		}
+		err := conn.rtcpOut.WriteRTCP([]rtcp.Packet{
+			&tmmbr{
+				Notification: true,
+				SenderSSRC:   uint32(track.ssrc),
+				Entries: []tmmbrEntry{{
+					SSRC:     t.SenderSSRC,
+					Bitrate:  e.Bitrate,
+					Overhead: e.Overhead,
+				}},
+			},
+		})
+		if err != nil {
+			ratelimitlog.Log("TMMBN", "conn", conn.id, "error", err)
+		}
 	}
 }
 
@@ -1078,14 +2632,151 @@ func handleReport(track *rtpDownTrack, report rtcp.ReceptionReport, jiffies uint
 				return
 			}
 			rtt := (jiffies - srTime) - delay
-			oldrtt := track.getRTT()
-			newrtt := rtt
-			if oldrtt > 0 {
-				newrtt = (3*oldrtt + rtt) / 4
+			track.setRTT(smoothRTT(track.getRTT(), rtt))
+		}
+	}
+}
+
+// opusParameters returns the Opus parameters that we request from
+// a sender: we want in-band FEC in order to survive packet loss, and
+// stereo if requested.  Other parameters, notably usedtx, are left as
+// negotiated by the offer.  The same parameters are announced to the
+// receivers.
+func opusParameters(stereo bool) [][2]string {
+	if stereo {
+		return [][2]string{
+			{"stereo", "1"},
+			{"useinbandfec", "1"},
+		}
+	}
+	return [][2]string{
+		{"useinbandfec", "1"},
+	}
+}
+
+// opusStereo returns true if a sender's offer announces that it is able
+// to send stereo Opus audio.
+func opusStereo(offer *sdp.SessionDescription) bool {
+	for _, m := range offer.MediaDescriptions {
+		if !strings.EqualFold(m.MediaName.Media, "audio") {
+			continue
+		}
+		for _, a := range m.Attributes {
+			if a.Key != "fmtp" {
+				continue
+			}
+			f := strings.SplitN(a.Value, " ", 2)
+			if len(f) < 2 {
+				continue
+			}
+			for _, p := range strings.Split(f[1], ";") {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				if len(kv) == 2 && kv[1] == "1" &&
+					(strings.EqualFold(kv[0], "sprop-stereo") ||
+						strings.EqualFold(kv[0], "stereo")) {
+					return true
+				}
 			}
-			track.setRTT(newrtt)
 		}
 	}
+	return false
+}
+
+// setFmtp sets the given parameters in an fmtp line, preserving the
+// order and value of any other parameters.
+func setFmtp(line string, parameters [][2]string) string {
+	var fields []string
+	if strings.TrimSpace(line) != "" {
+		fields = strings.Split(line, ";")
+	}
+outer:
+	for _, p := range parameters {
+		for i, f := range fields {
+			kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+			if strings.EqualFold(kv[0], p[0]) {
+				fields[i] = p[0] + "=" + p[1]
+				continue outer
+			}
+		}
+		fields = append(fields, p[0]+"="+p[1])
+	}
+	return strings.Join(fields, ";")
+}
+
+// fixOpusAnswer modifies the Opus parameters of an answer to a sender.
+// By default, the answer merely echoes the parameters of the offer,
+// which causes browsers to send mono audio even when they are able to
+// send stereo; stereo is requested if the argument of that name is true.
+// If maxBitrate is not 0, the sender is asked not to exceed it; unlike
+// TMMBR, this is implemented by browsers.
+func fixOpusAnswer(answer string, stereo bool, maxBitrate uint64) (string, error) {
+	parameters := opusParameters(stereo)
+	if maxBitrate > 0 {
+		if maxBitrate < 6000 {
+			maxBitrate = 6000
+		} else if maxBitrate > opusMaxBitrate {
+			maxBitrate = opusMaxBitrate
+		}
+		parameters = append(
+			parameters[:len(parameters):len(parameters)],
+			[2]string{
+				"maxaveragebitrate",
+				strconv.FormatUint(maxBitrate, 10),
+			},
+		)
+	}
+
+	var s sdp.SessionDescription
+	err := s.Unmarshal([]byte(answer))
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range s.MediaDescriptions {
+		if !strings.EqualFold(m.MediaName.Media, "audio") {
+			continue
+		}
+		pts := make(map[string]bool)
+		for _, a := range m.Attributes {
+			if a.Key != "rtpmap" {
+				continue
+			}
+			f := strings.SplitN(a.Value, " ", 2)
+			if len(f) == 2 &&
+				strings.HasPrefix(strings.ToLower(f[1]), "opus/") {
+				pts[f[0]] = false
+			}
+		}
+		for i, a := range m.Attributes {
+			if a.Key != "fmtp" {
+				continue
+			}
+			f := strings.SplitN(a.Value, " ", 2)
+			if _, ok := pts[f[0]]; !ok {
+				continue
+			}
+			var line string
+			if len(f) > 1 {
+				line = f[1]
+			}
+			m.Attributes[i].Value =
+				f[0] + " " + setFmtp(line, parameters)
+			pts[f[0]] = true
+		}
+		for pt, done := range pts {
+			if !done {
+				m.WithValueAttribute("fmtp",
+					pt+" "+setFmtp("", parameters),
+				)
+			}
+		}
+	}
+
+	b, err := s.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 func minPacketCache(track *webrtc.TrackRemote) int {
@@ -1098,7 +2789,7 @@ func minPacketCache(track *webrtc.TrackRemote) int {
 func updateUpTrack(track *rtpUpTrack) {
 	now := rtptime.Jiffies()
 
-	clockrate := track.track.Codec().ClockRate
+	clockrate := track.clockRate()
 	local := track.getLocal()
 	var maxrto uint64
 	for _, l := range local {
@@ -1116,12 +2807,18 @@ func updateUpTrack(track *rtpUpTrack) {
 	}
 	_, r := track.rate.Estimate()
 	packets := int((uint64(r) * maxrto * 4) / rtptime.JiffiesPerSec)
+	if !track.retransmit() {
+		// the cache doesn't serve retransmissions
+		packets = 0
+	}
 	min := minPacketCache(track.track)
 	if packets < min {
 		packets = min
 	}
-	if packets > 1024 {
-		packets = 1024
+	// under memory pressure, the ceiling may be below the minimum
+	ceiling := currentCacheCeiling()
+	if packets > ceiling {
+		packets = ceiling
 	}
 	track.cache.ResizeCond(packets)
 }
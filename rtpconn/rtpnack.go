@@ -0,0 +1,207 @@
+package rtpconn
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/ratelimitlog"
+	"github.com/jech/galene/rtptime"
+)
+
+// readLoop sends NACKs based on the loss bitmap of the packet cache,
+// which only remembers a few dozen packets, and forgets a packet once it
+// has been NACKed.  Packets lost in a long burst, or whose retransmission
+// was lost too, are therefore never recovered.  In order to avoid that,
+// each up track keeps a list of missing packets, which is periodically
+// swept by nackSweeper.
+
+const (
+	// the interval at which the missing packets are examined
+	nackSweepInterval = 20 * time.Millisecond
+	// how long we wait for a reordered packet before the first NACK
+	nackReorderDelay = rtptime.JiffiesPerSec / 50
+	// how long we wait for a retransmission before NACKing again
+	nackRetryDelay = rtptime.JiffiesPerSec / 10
+	// after this time, a missing packet is not worth recovering
+	nackMaxAge = rtptime.JiffiesPerSec / 2
+	// the maximum number of NACKs sent for a single packet
+	nackMaxAttempts = 3
+	// the maximum number of missing packets that are tracked
+	nackMaxPending = 256
+)
+
+type nackEntry struct {
+	seqno uint16
+	// the time at which the loss was detected
+	lost uint64
+	// the time at which the last NACK was sent
+	sent     uint64
+	attempts int
+}
+
+// nackState tracks the missing packets of an up track.
+type nackState struct {
+	mu      sync.Mutex
+	valid   bool
+	highest uint16
+	// ordered by seqno modulo 2^16
+	pending []nackEntry
+}
+
+// received records the arrival of a packet.  If the packet is more recent
+// than any packet seen so far, the packets in between are recorded as
+// missing.
+func (s *nackState) received(seqno uint16, now uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.valid {
+		s.valid = true
+		s.highest = seqno
+		return
+	}
+
+	delta := seqno - s.highest
+	if delta == 0 || (delta&0x8000) != 0 {
+		// a late packet, most probably a retransmission
+		for i := range s.pending {
+			if s.pending[i].seqno == seqno {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	if delta > nackMaxPending {
+		// the sender skipped a bunch of seqnos, resynchronise
+		s.pending = s.pending[:0]
+		s.highest = seqno
+		return
+	}
+
+	for i := uint16(1); i < delta; i++ {
+		s.pending = append(s.pending, nackEntry{
+			seqno: s.highest + i,
+			lost:  now,
+		})
+	}
+	s.highest = seqno
+
+	if len(s.pending) > nackMaxPending {
+		n := len(s.pending) - nackMaxPending
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+	}
+}
+
+// sent records that a NACK was sent for the given seqnos.
+func (s *nackState) sent(seqnos []uint16, now uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seqno := range seqnos {
+		for i := range s.pending {
+			if s.pending[i].seqno == seqno {
+				s.pending[i].sent = now
+				s.pending[i].attempts++
+				break
+			}
+		}
+	}
+}
+
+// due returns the seqnos that should be NACKed at time now, in order.
+// The function has indicates whether a packet has arrived in the
+// meantime.  Packets that have arrived, are too old, or have been NACKed
+// too many times are forgotten.
+func (s *nackState) due(now uint64, has func(uint16) bool) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var seqnos []uint16
+	pending := s.pending[:0]
+	for _, e := range s.pending {
+		if now-e.lost > nackMaxAge || e.attempts >= nackMaxAttempts {
+			continue
+		}
+		if has(e.seqno) {
+			continue
+		}
+		pending = append(pending, e)
+		if e.attempts == 0 {
+			if now-e.lost >= nackReorderDelay {
+				seqnos = append(seqnos, e.seqno)
+			}
+		} else if now-e.sent >= nackRetryDelay {
+			seqnos = append(seqnos, e.seqno)
+		}
+	}
+	s.pending = pending
+	return seqnos
+}
+
+// nackSeqnos returns the seqnos described by a NACK pair.
+func nackSeqnos(first uint16, bitmap uint16) []uint16 {
+	seqnos := []uint16{first}
+	for i := uint16(0); i < 16; i++ {
+		if (bitmap & (1 << i)) != 0 {
+			seqnos = append(seqnos, first+i+1)
+		}
+	}
+	return seqnos
+}
+
+// nackPairs converts the entries returned by the cache into NACK pairs,
+// and returns the seqnos that they describe.
+func nackPairs(entries []packetcache.BitmapEntry) ([]rtcp.NackPair, []uint16) {
+	nacks := make([]rtcp.NackPair, 0, len(entries))
+	var seqnos []uint16
+	for _, e := range entries {
+		nacks = append(nacks,
+			rtcp.NackPair{
+				PacketID:    e.First,
+				LostPackets: rtcp.PacketBitmap(e.Bitmap),
+			},
+		)
+		seqnos = append(seqnos, nackSeqnos(e.First, e.Bitmap)...)
+	}
+	return nacks, seqnos
+}
+
+func (up *rtpUpConnection) sweepNACKs(now uint64) {
+	for _, t := range up.getTracks() {
+		if !t.nackEnabled() || t.allWaitingKeyframe() ||
+			t.gotGoodbye() {
+			continue
+		}
+		seqnos := t.nacks.due(now, func(seqno uint16) bool {
+			return t.cache.Get(seqno, nil) > 0
+		})
+		if len(seqnos) == 0 {
+			continue
+		}
+		err := up.sendNACKs(t, seqnos)
+		if err != nil {
+			ratelimitlog.Log("sendNACKs", "conn", up.id, "error", err)
+		}
+	}
+}
+
+// nackSweeper periodically NACKs the packets that are still missing on
+// the tracks of conn.  It returns when ctx is cancelled.
+func nackSweeper(ctx context.Context, conn *rtpUpConnection) {
+	ticker := time.NewTicker(nackSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		conn.sweepNACKs(rtptime.Jiffies())
+	}
+}
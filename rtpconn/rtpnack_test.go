@@ -0,0 +1,168 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/packetcache"
+)
+
+func TestNackSeqnos(t *testing.T) {
+	seqnos := nackSeqnos(65534, 0x8003)
+	expected := []uint16{65534, 65535, 0, 14}
+	if len(seqnos) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, seqnos)
+	}
+	for i := range seqnos {
+		if seqnos[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, seqnos)
+		}
+	}
+}
+
+func TestNackBurst(t *testing.T) {
+	var s nackState
+	arrived := make(map[uint16]bool)
+	has := func(seqno uint16) bool {
+		return arrived[seqno]
+	}
+	receive := func(seqno uint16, now uint64) {
+		arrived[seqno] = true
+		s.received(seqno, now)
+	}
+
+	now := uint64(1000000)
+	for i := uint16(0); i < 10; i++ {
+		receive(i, now)
+	}
+	// a burst of 40 packets is lost
+	receive(50, now)
+
+	// nothing is requested before the reordering delay
+	if d := s.due(now, has); len(d) != 0 {
+		t.Errorf("Expected nothing, got %v", d)
+	}
+
+	// readLoop only requests the first 17 packets
+	s.sent(nackSeqnos(10, 0xFFFF), now)
+
+	now += nackReorderDelay
+	d := s.due(now, has)
+	if len(d) != 23 || d[0] != 27 || d[22] != 49 {
+		t.Fatalf("Expected 27..49, got %v", d)
+	}
+	s.sent(d, now)
+
+	// some retransmissions arrive
+	for i := uint16(10); i < 40; i++ {
+		receive(i, now)
+	}
+
+	now += nackRetryDelay
+	d = s.due(now, has)
+	if len(d) != 10 || d[0] != 40 || d[9] != 49 {
+		t.Fatalf("Expected 40..49, got %v", d)
+	}
+
+	for i := 1; i < nackMaxAttempts; i++ {
+		s.sent(d, now)
+		now += nackRetryDelay
+		d = s.due(now, has)
+	}
+	if len(d) != 0 {
+		t.Errorf("Expected nothing after %v attempts, got %v",
+			nackMaxAttempts, d)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("Expected no pending packets, got %v", len(s.pending))
+	}
+}
+
+func TestNackMaxAge(t *testing.T) {
+	var s nackState
+	has := func(seqno uint16) bool { return false }
+
+	now := uint64(1000000)
+	s.received(65534, now)
+	s.received(2, now)
+
+	d := s.due(now+nackReorderDelay, has)
+	if len(d) != 3 || d[0] != 65535 || d[2] != 1 {
+		t.Errorf("Expected 65535..1, got %v", d)
+	}
+
+	d = s.due(now+nackMaxAge+1, has)
+	if len(d) != 0 || len(s.pending) != 0 {
+		t.Errorf("Expected nothing, got %v %v", d, len(s.pending))
+	}
+}
+
+func TestNackLate(t *testing.T) {
+	var s nackState
+	now := uint64(1000000)
+	s.received(10, now)
+	s.received(13, now)
+	s.received(11, now)
+	if len(s.pending) != 1 || s.pending[0].seqno != 12 {
+		t.Errorf("Expected 12, got %v", s.pending)
+	}
+
+	// a large jump resynchronises
+	s.received(10000, now)
+	if len(s.pending) != 0 {
+		t.Errorf("Expected nothing, got %v", s.pending)
+	}
+}
+
+func TestNackRestart(t *testing.T) {
+	var s nackState
+	now := uint64(1000000)
+	s.received(40000, now)
+	s.received(40002, now)
+
+	// after a restart, the new seqnos are not late packets
+	s.reset()
+	s.received(5, now)
+	s.received(7, now)
+	if len(s.pending) != 1 || s.pending[0].seqno != 6 {
+		t.Errorf("Expected 6, got %v", s.pending)
+	}
+}
+
+func TestNACKBurst(t *testing.T) {
+	// a burst of 50 losses across a wraparound
+	base := uint16(65530)
+	cache := packetcache.New(16)
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		cache.Store(base+uint16(i), 0, false, false, buf)
+	}
+	for i := 60; i < 70; i++ {
+		cache.Store(base+uint16(i), 0, false, false, buf)
+	}
+
+	nacks, seqnos := nackPairs(cache.BitmapGetAll(base + 66))
+	var w rtcpRecorder
+	err := sendNACKs(&w, 42, nacks)
+	if err != nil {
+		t.Fatalf("sendNACKs: %v", err)
+	}
+	if len(w.packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %v", len(w.packets))
+	}
+	var requested []uint16
+	for _, p := range w.packets[0].(*rtcp.TransportLayerNack).Nacks {
+		requested = append(requested, p.PacketList()...)
+	}
+	if len(requested) != 50 || len(seqnos) != 50 {
+		t.Fatalf("Expected 50 packets, got %v %v",
+			len(requested), len(seqnos))
+	}
+	for i := range requested {
+		if requested[i] != base+10+uint16(i) || seqnos[i] != requested[i] {
+			t.Errorf("Expected %v, got %v %v",
+				base+10+uint16(i), requested[i], seqnos[i])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package rtpconn
+
+import (
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// networkQuality is a coarse indication of the quality of the network
+// path to a receiver.  Larger values are worse.
+type networkQuality int
+
+const (
+	qualityUnknown networkQuality = iota
+	qualityGood
+	qualityMedium
+	qualityPoor
+)
+
+func (q networkQuality) String() string {
+	switch q {
+	case qualityGood:
+		return "good"
+	case qualityMedium:
+		return "medium"
+	case qualityPoor:
+		return "poor"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// the number of consecutive samples required before the quality
+	// is allowed to degrade or improve.  Improving is slower, so that
+	// the indicator doesn't flicker when conditions are borderline.
+	qualityDegradeSamples = 2
+	qualityImproveSamples = 5
+)
+
+// qualitySample computes the instantaneous quality from the loss rate
+// (as a fraction of 256), the round-trip time, the bitrate being sent and
+// the bitrate allowed by congestion control.  The result is the worst of
+// the qualities indicated by each metric.
+func qualitySample(th group.NetworkQuality, loss uint8, rtt time.Duration, rate, maxRate uint64) networkQuality {
+	q := qualityGood
+	worse := func(r networkQuality) {
+		if r > q {
+			q = r
+		}
+	}
+
+	l := int(loss) * 100 / 256
+	if l >= th.PoorLoss {
+		worse(qualityPoor)
+	} else if l >= th.MediumLoss {
+		worse(qualityMedium)
+	}
+
+	ms := int(rtt / time.Millisecond)
+	if ms >= th.PoorRTT {
+		worse(qualityPoor)
+	} else if ms >= th.MediumRTT {
+		worse(qualityMedium)
+	}
+
+	if rate > 0 {
+		r := maxRate * 100 / rate
+		if r < uint64(th.PoorRate) {
+			worse(qualityPoor)
+		} else if r < uint64(th.MediumRate) {
+			worse(qualityMedium)
+		}
+	}
+	return q
+}
+
+// A qualityTracker applies hysteresis to a sequence of quality samples.
+// It is only accessed by rtcpDownSender, and therefore not protected.
+type qualityTracker struct {
+	current   networkQuality
+	candidate networkQuality
+	count     int
+}
+
+// update feeds a new sample to the tracker.  It returns the current
+// quality, and true if it just changed.
+func (t *qualityTracker) update(q networkQuality) (networkQuality, bool) {
+	if t.current == qualityUnknown {
+		t.current = q
+		return q, q != qualityUnknown
+	}
+
+	if q == t.current {
+		t.candidate = qualityUnknown
+		t.count = 0
+		return t.current, false
+	}
+
+	if q == t.candidate {
+		t.count++
+	} else {
+		t.candidate = q
+		t.count = 1
+	}
+
+	needed := qualityImproveSamples
+	if q > t.current {
+		needed = qualityDegradeSamples
+	}
+	if t.count < needed {
+		return t.current, false
+	}
+
+	t.current = q
+	t.candidate = qualityUnknown
+	t.count = 0
+	return q, true
+}
+
+// updateQuality recomputes the quality of a down connection, and
+// notifies the receiver if it changed.
+func (down *rtpDownConnection) updateQuality(now uint64) {
+	if down.group == nil {
+		return
+	}
+
+	tracks := down.getTracks()
+	if len(tracks) == 0 {
+		return
+	}
+
+	var loss uint8
+	var rtt, rate uint64
+	for _, t := range tracks {
+		l, _ := t.stats.Get(now)
+		if l > loss {
+			loss = l
+		}
+		if r := t.getRTT(); r > rtt {
+			rtt = r
+		}
+		r, _ := t.rate.Estimate()
+		rate += 8 * uint64(r)
+	}
+
+	q := qualitySample(
+		down.group.NetworkQuality(), loss,
+		rtptime.ToDuration(rtt, rtptime.JiffiesPerSec),
+		rate, down.GetMaxBitrate(now),
+	)
+	q, changed := down.quality.update(q)
+	if changed && down.onQuality != nil {
+		down.onQuality(q)
+	}
+}
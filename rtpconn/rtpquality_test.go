@@ -0,0 +1,132 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+func TestQualitySample(t *testing.T) {
+	th := group.DefaultNetworkQuality
+	a := []struct {
+		loss          uint8
+		rtt           time.Duration
+		rate, maxRate uint64
+		q             networkQuality
+	}{
+		{0, 50 * time.Millisecond, 0, 0, qualityGood},
+		{0, 50 * time.Millisecond, 1000000, 1000000, qualityGood},
+		{16, 50 * time.Millisecond, 1000000, 1000000, qualityMedium},
+		{64, 50 * time.Millisecond, 1000000, 1000000, qualityPoor},
+		{0, 400 * time.Millisecond, 1000000, 1000000, qualityMedium},
+		{0, time.Second, 1000000, 1000000, qualityPoor},
+		{0, 50 * time.Millisecond, 1000000, 700000, qualityMedium},
+		{0, 50 * time.Millisecond, 1000000, 300000, qualityPoor},
+		{16, time.Second, 1000000, 1000000, qualityPoor},
+	}
+
+	for _, s := range a {
+		q := qualitySample(th, s.loss, s.rtt, s.rate, s.maxRate)
+		if q != s.q {
+			t.Errorf("%v %v %v %v: expected %v, got %v",
+				s.loss, s.rtt, s.rate, s.maxRate, s.q, q)
+		}
+	}
+
+	th.PoorRTT = 200
+	q := qualitySample(th, 0, 250*time.Millisecond, 0, 0)
+	if q != qualityPoor {
+		t.Errorf("Expected %v, got %v", qualityPoor, q)
+	}
+}
+
+func TestQualityTracker(t *testing.T) {
+	var tr qualityTracker
+
+	q, changed := tr.update(qualityGood)
+	if q != qualityGood || !changed {
+		t.Errorf("Expected good, changed, got %v %v", q, changed)
+	}
+
+	// a single bad sample is ignored
+	tr.update(qualityPoor)
+	q, changed = tr.update(qualityGood)
+	if q != qualityGood || changed {
+		t.Errorf("Expected good, got %v %v", q, changed)
+	}
+
+	for i := 0; i < qualityDegradeSamples; i++ {
+		q, changed = tr.update(qualityPoor)
+	}
+	if q != qualityPoor || !changed {
+		t.Errorf("Expected poor, changed, got %v %v", q, changed)
+	}
+
+	// alternating samples don't cause flicker
+	for i := 0; i < 20; i++ {
+		s := qualityGood
+		if i%2 == 0 {
+			s = qualityMedium
+		}
+		q, changed = tr.update(s)
+		if changed {
+			t.Errorf("Unexpected change to %v", q)
+		}
+	}
+
+	tr.update(qualityPoor)
+	for i := 0; i < qualityImproveSamples; i++ {
+		q, changed = tr.update(qualityGood)
+		if i < qualityImproveSamples-1 && changed {
+			t.Errorf("Improved too early")
+		}
+	}
+	if q != qualityGood || !changed {
+		t.Errorf("Expected good, changed, got %v %v", q, changed)
+	}
+}
+
+func TestReceiverLossHistory(t *testing.T) {
+	var s receiverStats
+	if h := s.History(); len(h) != 0 {
+		t.Errorf("Expected empty history, got %v", h)
+	}
+	for i := 0; i < 10; i++ {
+		s.Set(uint8(i), 0, uint64(i))
+	}
+	h := s.History()
+	if len(h) != 10 || h[0] != 0 || h[9] != 9 {
+		t.Errorf("Unexpected history %v", h)
+	}
+	for i := 10; i < 100; i++ {
+		s.Set(uint8(i), 0, uint64(i))
+	}
+	h = s.History()
+	if len(h) != lossHistorySize || h[0] != 100-lossHistorySize ||
+		h[lossHistorySize-1] != 99 {
+		t.Errorf("Unexpected history %v", h)
+	}
+	if l, _ := s.Get(99); l != 99 {
+		t.Errorf("Expected 99, got %v", l)
+	}
+}
+
+func TestSteadyLoss(t *testing.T) {
+	a := []struct {
+		history []uint8
+		steady  bool
+	}{
+		{nil, false},
+		{[]uint8{0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{[]uint8{0, 0, 0, 0, 0, 0, 0, 100}, false},
+		{[]uint8{0, 20, 0, 20, 0, 20, 0, 20}, true},
+		{[]uint8{20, 20, 20, 20, 20, 0, 0, 0, 0, 0, 0, 0}, false},
+		{[]uint8{30}, true},
+	}
+	for _, s := range a {
+		if steadyLoss(s.history) != s.steady {
+			t.Errorf("%v: expected %v", s.history, s.steady)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package rtpconn
 
 import (
+	"context"
 	"io"
-	"log"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/ratelimitlog"
 	"github.com/jech/galene/rtptime"
 )
 
@@ -117,44 +119,165 @@ func isKeyframe(codec string, packet *rtp.Packet) (bool, bool) {
 	}
 }
 
-func readLoop(conn *rtpUpConnection, track *rtpUpTrack) {
-	writers := rtpWriterPool{conn: conn, track: track}
+// packetMid returns the value of the MID header extension of a packet,
+// or the empty string if it is absent.
+func packetMid(packet *rtp.Packet, id uint8) string {
+	if id == 0 {
+		return ""
+	}
+	return string(packet.GetExtension(id))
+}
+
+// readLoop reads RTP from an up track and forwards it to the down
+// tracks.  It returns when reading fails, which happens when the peer
+// connection is closed; the connection closes it when ctx is cancelled.
+func readLoop(ctx context.Context, conn *rtpUpConnection, track *rtpUpTrack) {
+	writers := rtpWriterPool{
+		conn:     conn,
+		track:    track,
+		lossless: lossless(conn.group),
+	}
+	pacing := writerPacingName(conn.group)
+	pacer := newWriterPacer(pacing)
 	defer func() {
 		writers.close()
+		if track.selector != nil {
+			track.selector.del(track)
+		}
+		// we are the only writer to the cache
+		track.cache.Close()
 		close(track.readerDone)
 	}()
 
 	isvideo := track.track.Kind() == webrtc.RTPCodecTypeVideo
 	codec := track.track.Codec()
-	sendNACK := track.hasRtcpFb("nack", "")
-	buf := make([]byte, packetcache.BufSize)
+	sendNACK := track.nackEnabled()
+	midKnown := track.getMid() != ""
+	// true if the last known resolution exceeds the group's limit
+	oversize := false
+	pt := payloadTypeCheck{expected: uint8(track.track.PayloadType())}
+	b := packetcache.GetBuffer()
+	defer packetcache.PutBuffer(b)
+	buf := b[:]
 	var packet rtp.Packet
 	for {
 		bytes, _, err := track.track.Read(buf)
+		if ctx.Err() != nil {
+			break
+		}
+		if err == io.ErrShortBuffer {
+			// the packet is larger than we can cache, and has
+			// been truncated.  Drop it rather than forwarding
+			// garbage.
+			ratelimitlog.Log("Read RTP: packet too large",
+				"conn", conn.id)
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("%v", err)
+				Logger.Warnf("%v", err)
 			}
 			break
 		}
+		arrival := rtptime.Jiffies()
 		track.rate.Accumulate(uint32(bytes))
 
 		err = packet.Unmarshal(buf[:bytes])
 		if err != nil {
-			log.Printf("%v", err)
+			ratelimitlog.Log("Unmarshal RTP",
+				"conn", conn.id, "error", err)
 			continue
 		}
 
+		if !track.checkPayloadType(conn, &pt,
+			packet.PayloadType, arrival) {
+			continue
+		}
+
+		if track.cache.Seen(packet.SequenceNumber) {
+			// both the original and a retransmission arrived,
+			// we have already forwarded this packet.
+			continue
+		}
+
+		if track.cache.Stray(packet.SequenceNumber) {
+			// either garbage or the first packet after a
+			// restart, which will be confirmed by the next one
+			continue
+		}
+
+		if track.cache.Discontinuous(packet.SequenceNumber) {
+			track.restartSequence(packet.SequenceNumber)
+		}
+
+		if !midKnown && track.midId != 0 {
+			// the transceiver didn't tell us the mid, use the
+			// header extension.
+			mid := packetMid(&packet, track.midId)
+			if mid != "" {
+				conn.setTrackMid(track, mid)
+				midKnown = true
+			}
+		}
+
+		if track.gotGoodbye() {
+			// the sender has resumed sending
+			atomic.StoreUint32(&track.atomics.bye, 0)
+		}
+
 		track.jitter.Accumulate(packet.Timestamp)
+		track.checkClockRate(packet.Timestamp, arrival)
+		track.synthesizeSR(packet.Timestamp, arrival)
+		atomic.StoreUint64(&track.atomics.queueDelay,
+			track.uplink.accumulate(
+				packet.Timestamp, arrival, track.clockRate(),
+			),
+		)
+		track.gotPacket(packet.SequenceNumber)
+		track.nacks.received(packet.SequenceNumber, arrival)
+		track.xrLoss.received(packet.SequenceNumber)
 
-		kf, _ := isKeyframe(codec.MimeType, &packet)
+		kf, kfKnown := isKeyframe(codec.MimeType, &packet)
+		if kfKnown && isvideo {
+			atomic.StoreUint32(&track.atomics.kfKnown, 1)
+		}
+		if kf {
+			track.gotKeyframe(arrival)
+		}
 
-		first, index := track.cache.Store(
+		if isvideo {
+			w, h, ok := videoDimensions(codec.MimeType, &packet)
+			if ok {
+				track.setResolution(w, h)
+				maxw, maxh := conn.maxResolution()
+				over := exceedsResolution(w, h, maxw, maxh)
+				if over && !oversize {
+					conn.limitResolution(w, h, maxw, maxh)
+				}
+				if over != oversize {
+					var v uint32
+					if over {
+						v = 1
+					}
+					atomic.StoreUint32(
+						&track.atomics.oversize, v,
+					)
+				}
+				oversize = over
+			}
+		}
+
+		// Oversize packets are cached, since the cache is what
+		// detects losses on the sender's side, but they are never
+		// served: they are not recorded as keyframes, so they are
+		// never replayed, and they are skipped, so no receiver
+		// requests them.
+		first, index := track.cache.StoreAt(
 			packet.SequenceNumber, packet.Timestamp,
-			kf, packet.Marker, buf[:bytes],
+			kf && !oversize, packet.Marker, arrival, buf[:bytes],
 		)
 
-		_, rate := track.rate.Estimate()
+		byteRate, rate := track.rate.Estimate()
 
 		delta := packet.SequenceNumber - first
 		if (delta & 0x8000) != 0 {
@@ -177,30 +300,51 @@ func readLoop(conn *rtpUpConnection, track *rtpUpTrack) {
 			unnacked = uint16(packets)
 		}
 		if uint32(delta) > packets {
-			found, first, bitmap := track.cache.BitmapGet(
+			entries := track.cache.BitmapGetAll(
 				packet.SequenceNumber - unnacked,
 			)
-			if found && sendNACK {
-				err := conn.sendNACK(track, first, bitmap)
+			if len(entries) > 0 && sendNACK &&
+				!track.allWaitingKeyframe() {
+				err := conn.sendNACK(track, entries)
 				if err != nil {
-					log.Printf("%v", err)
+					ratelimitlog.Log("NACK",
+						"conn", conn.id, "error", err)
 				}
 			}
 		}
 
-		delay := uint32(rtptime.JiffiesPerSec / 1024)
-		if rate > 512 {
-			delay = rtptime.JiffiesPerSec / rate / 2
+		var delay uint32
+		if !writers.lossless && !track.direct {
+			// in direct mode, a congested writer drops audio
+			// rather than delaying it
+			delay = pacer.Delay(arrival, bytes, byteRate, rate)
 		}
 
-		writers.write(packet.SequenceNumber, index, delay,
-			isvideo, packet.Marker)
+		forward := true
+		if track.selector != nil {
+			track.gotAudioLevel(&packet)
+			forward = track.selector.forward(
+				track, rtptime.Jiffies(),
+			)
+		}
+
+		if forward && !oversize {
+			writers.write(packet.SequenceNumber, index, delay,
+				isvideo, packet.Marker, kf)
+		} else {
+			writers.skip()
+		}
 
 		select {
 		case action := <-track.localCh:
+			writers.lossless = lossless(conn.group)
+			if p := writerPacingName(conn.group); p != pacing {
+				pacing = p
+				pacer = newWriterPacer(pacing)
+			}
 			err := writers.add(action.track, action.add)
 			if err != nil {
-				log.Printf("add/remove track: %v", err)
+				Logger.Warnf("add/remove track: %v", err)
 			}
 		default:
 		}
@@ -0,0 +1,399 @@
+package rtpconn
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+
+	"github.com/jech/galene/ratelimitlog"
+)
+
+// videoDimensions returns the resolution carried by a packet, if any.
+// For VP8, the resolution is found in the header of keyframes; for H.264,
+// it is found in the sequence parameter set, which may be sent on its own
+// or aggregated with other NALUs.
+func videoDimensions(codec string, packet *rtp.Packet) (int, int, bool) {
+	switch strings.ToLower(codec) {
+	case "video/vp8":
+		var vp8 codecs.VP8Packet
+		_, err := vp8.Unmarshal(packet.Payload)
+		if err != nil || vp8.S == 0 || vp8.PID != 0 {
+			return 0, 0, false
+		}
+		return vp8Dimensions(vp8.Payload)
+	case "video/h264":
+		return h264Dimensions(packet.Payload)
+	default:
+		return 0, 0, false
+	}
+}
+
+// vp8Dimensions parses the beginning of a VP8 frame.  See RFC 6386
+// Section 9.1.
+func vp8Dimensions(data []byte) (int, int, bool) {
+	if len(data) < 10 || (data[0]&0x1) != 0 {
+		// too short, or not a keyframe
+		return 0, 0, false
+	}
+	if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+		return 0, 0, false
+	}
+	width := (int(data[6]) | int(data[7])<<8) & 0x3FFF
+	height := (int(data[8]) | int(data[9])<<8) & 0x3FFF
+	if width == 0 || height == 0 {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// h264Dimensions looks for a sequence parameter set in a single NALU or
+// in a STAP-A packet.  See RFC 6184 Section 5.7.1.
+func h264Dimensions(payload []byte) (int, int, bool) {
+	if len(payload) < 1 {
+		return 0, 0, false
+	}
+	nalu := payload[0] & 0x1F
+	switch {
+	case nalu == 7:
+		return h264SPSDimensions(payload)
+	case nalu == 24:
+		i := 1
+		for i+2 <= len(payload) {
+			length := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if length == 0 || i+length > len(payload) {
+				return 0, 0, false
+			}
+			if payload[i]&0x1F == 7 {
+				return h264SPSDimensions(payload[i : i+length])
+			}
+			i += length
+		}
+	}
+	return 0, 0, false
+}
+
+var errShortSPS = errors.New("SPS too short")
+
+// bitReader reads an H.264 RBSP, from which emulation prevention bytes
+// have been removed.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errShortSPS
+	}
+	b := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() (uint32, error) {
+	zeroes := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0 {
+			break
+		}
+		zeroes++
+		if zeroes > 31 {
+			return 0, errors.New("bad Exp-Golomb code")
+		}
+	}
+	v, err := r.bits(zeroes)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << uint(zeroes)) - 1 + v, nil
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32(v/2 + 1), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// unescapeRBSP removes emulation prevention bytes.
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeroes := 0
+	for _, b := range data {
+		if zeroes >= 2 && b == 3 {
+			zeroes = 0
+			continue
+		}
+		if b == 0 {
+			zeroes++
+		} else {
+			zeroes = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// skipScalingList skips a scaling list in a SPS.
+func skipScalingList(r *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// h264SPSDimensions parses a sequence parameter set NALU, including its
+// header, and returns the cropped frame size.  See ITU-T H.264 Section
+// 7.3.2.1.1.
+func h264SPSDimensions(nalu []byte) (int, int, bool) {
+	w, h, err := parseSPS(nalu)
+	if err != nil || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+func parseSPS(nalu []byte) (int, int, error) {
+	if len(nalu) < 4 {
+		return 0, 0, errShortSPS
+	}
+	profile := nalu[1]
+	r := &bitReader{data: unescapeRBSP(nalu[4:])}
+
+	// seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint32(1)
+	separateColourPlanes := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		chromaFormat, err = r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			separateColourPlanes, err = r.bit()
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for i := 0; i < 2; i++ {
+			if _, err := r.ue(); err != nil {
+				return 0, 0, err
+			}
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err := r.bit(); err != nil {
+			return 0, 0, err
+		}
+		scaling, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scaling != 0 {
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				err = skipScalingList(r, size)
+				if err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err := r.ue(); err != nil {
+			return 0, 0, err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err := r.bit(); err != nil {
+			return 0, 0, err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		for i := 0; i < 2; i++ {
+			if _, err := r.se(); err != nil {
+				return 0, 0, err
+			}
+		}
+		n, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		if n > 255 {
+			return 0, 0, errors.New("bad SPS")
+		}
+		for i := uint32(0); i < n; i++ {
+			if _, err := r.se(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err := r.bit(); err != nil {
+		return 0, 0, err
+	}
+	widthMbs, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	if widthMbs > 4096 || heightMapUnits > 4096 {
+		return 0, 0, errors.New("bad SPS")
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		if _, err := r.bit(); err != nil {
+			return 0, 0, err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err := r.bit(); err != nil {
+		return 0, 0, err
+	}
+
+	width := int(widthMbs+1) * 16
+	height := int(heightMapUnits+1) * 16 * int(2-frameMbsOnly)
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping != 0 {
+		var crop [4]uint32
+		for i := range crop {
+			crop[i], err = r.ue()
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		cropX, cropY := 1, 2-int(frameMbsOnly)
+		if separateColourPlanes == 0 && chromaFormat != 0 {
+			if chromaFormat == 1 || chromaFormat == 2 {
+				cropX = 2
+			}
+			if chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		width -= cropX * int(crop[0]+crop[1])
+		height -= cropY * int(crop[2]+crop[3])
+	}
+	return width, height, nil
+}
+
+func (up *rtpUpTrack) setResolution(width, height int) {
+	atomic.StoreUint32(&up.atomics.resolution,
+		uint32(width&0xFFFF)<<16|uint32(height&0xFFFF))
+}
+
+// getResolution returns the last known resolution of a video track, or
+// zeroes if it is not known.
+func (up *rtpUpTrack) getResolution() (int, int) {
+	r := atomic.LoadUint32(&up.atomics.resolution)
+	return int(r >> 16), int(r & 0xFFFF)
+}
+
+// exceedsResolution returns true if a frame of the given size is larger
+// than allowed in either dimension.  A maximum of 0 means no limit.
+func exceedsResolution(width, height, maxWidth, maxHeight int) bool {
+	return (maxWidth > 0 && width > maxWidth) ||
+		(maxHeight > 0 && height > maxHeight)
+}
+
+// maxResolution returns the largest video resolution accepted on conn.
+func (up *rtpUpConnection) maxResolution() (int, int) {
+	if up.group == nil {
+		return 0, 0
+	}
+	return up.group.MaxVideoResolution()
+}
+
+// limitResolution is called when a track starts exceeding the maximum
+// resolution, and asks the sender to reduce its resolution.
+func (up *rtpUpConnection) limitResolution(width, height, maxWidth, maxHeight int) {
+	ratelimitlog.Log("Video resolution exceeds the limit",
+		"conn", up.id, "width", width, "height", height,
+		"max-width", maxWidth, "max-height", maxHeight)
+	if up.resolutionExceeded != nil {
+		spawn(func() {
+			up.resolutionExceeded(maxWidth, maxHeight)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestVP8Dimensions(t *testing.T) {
+	// VP8 payload descriptor with S set, followed by a keyframe header
+	// for 640x360 with a horizontal scale in the top bits of the width
+	payload := []byte{
+		0x10,
+		0x50, 0x2f, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x42, 0x68, 0x01,
+	}
+	packet := &rtp.Packet{Payload: payload}
+	w, h, ok := videoDimensions("video/VP8", packet)
+	if !ok || w != 640 || h != 360 {
+		t.Errorf("Expected 640x360, got %vx%v %v", w, h, ok)
+	}
+
+	// interframe
+	payload[1] |= 1
+	_, _, ok = videoDimensions("video/VP8", packet)
+	if ok {
+		t.Errorf("Got dimensions for interframe")
+	}
+	payload[1] &^= 1
+
+	// not the start of a partition
+	payload[0] = 0
+	_, _, ok = videoDimensions("video/VP8", packet)
+	if ok {
+		t.Errorf("Got dimensions for continuation packet")
+	}
+}
+
+func TestH264Dimensions(t *testing.T) {
+	sps720 := []byte{
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb,
+		0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03,
+		0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+	}
+	sps1080 := []byte{
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27,
+		0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00,
+		0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+
+	w, h, ok := videoDimensions("video/H264", &rtp.Packet{Payload: sps720})
+	if !ok || w != 1280 || h != 720 {
+		t.Errorf("Expected 1280x720, got %vx%v %v", w, h, ok)
+	}
+
+	stap := []byte{24}
+	for _, nalu := range [][]byte{sps1080, pps} {
+		stap = append(stap, byte(len(nalu)>>8), byte(len(nalu)))
+		stap = append(stap, nalu...)
+	}
+	w, h, ok = videoDimensions("video/H264", &rtp.Packet{Payload: stap})
+	if !ok || w != 1920 || h != 1080 {
+		t.Errorf("Expected 1920x1080, got %vx%v %v", w, h, ok)
+	}
+
+	_, _, ok = videoDimensions("video/H264", &rtp.Packet{Payload: pps})
+	if ok {
+		t.Errorf("Got dimensions for PPS")
+	}
+
+	for i := 1; i < len(sps720); i++ {
+		_, _, ok = videoDimensions("video/H264",
+			&rtp.Packet{Payload: sps720[:i]})
+		if ok && i < 8 {
+			t.Errorf("Got dimensions for truncated SPS %v", i)
+		}
+	}
+}
+
+func TestExceedsResolution(t *testing.T) {
+	a := []struct {
+		w, h, maxw, maxh int
+		expected         bool
+	}{
+		{1280, 720, 0, 0, false},
+		{1280, 720, 1280, 720, false},
+		{1280, 720, 640, 0, true},
+		{1280, 720, 0, 480, true},
+		{640, 480, 1280, 360, true},
+		{640, 360, 1280, 720, false},
+	}
+	for _, s := range a {
+		e := exceedsResolution(s.w, s.h, s.maxw, s.maxh)
+		if e != s.expected {
+			t.Errorf("%vx%v %vx%v: expected %v, got %v",
+				s.w, s.h, s.maxw, s.maxh, s.expected, e)
+		}
+	}
+}
+
+func TestTrackResolution(t *testing.T) {
+	up := &rtpUpTrack{atomics: &upTrackAtomics{}}
+	w, h := up.getResolution()
+	if w != 0 || h != 0 {
+		t.Errorf("Expected unknown resolution, got %vx%v", w, h)
+	}
+	up.setResolution(1920, 1080)
+	w, h = up.getResolution()
+	if w != 1920 || h != 1080 {
+		t.Errorf("Expected 1920x1080, got %vx%v", w, h)
+	}
+}
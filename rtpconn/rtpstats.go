@@ -2,25 +2,51 @@ package rtpconn
 
 import (
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/jech/galene/rtptime"
 	"github.com/jech/galene/stats"
 )
 
+// jiffiesToTime converts the time tm, in jiffies, to wall-clock time,
+// given that the current time is now.  It returns nil if tm is 0.
+func jiffiesToTime(tm uint64, now uint64, wall time.Time) *time.Time {
+	if tm == 0 {
+		return nil
+	}
+	if tm >= now {
+		return &wall
+	}
+	t := wall.Add(-rtptime.ToDuration(now-tm, rtptime.JiffiesPerSec))
+	return &t
+}
+
 func (c *webClient) GetStats() *stats.Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	wall := time.Now()
+	jiffies := rtptime.TimeToJiffies(wall)
+
 	cs := stats.Client{
 		Id: c.id,
 	}
 
 	for _, up := range c.up {
+		tracks := up.getTracks()
+		if len(tracks) == 0 {
+			// a connection without media is not a publisher
+			continue
+		}
 		conns := stats.Conn{
-			Id: up.id,
+			Id:            up.id,
+			MaxBitrate:    up.uplink.get(),
+			CandidatePair: up.CandidatePair(),
 		}
-		tracks := up.getTracks()
+		// only known if extended reports are in use
+		rtt := rtptime.ToDuration(up.xr.getRTT(),
+			rtptime.JiffiesPerSec)
 		for _, t := range tracks {
 			expected, lost, _, _ := t.cache.GetStats(false)
 			if expected == 0 {
@@ -30,10 +56,22 @@ func (c *webClient) GetStats() *stats.Client {
 			jitter := time.Duration(t.jitter.Jitter()) *
 				(time.Second / time.Duration(t.jitter.HZ()))
 			rate, _ := t.rate.Estimate()
+			var level *int
+			if l, ok := t.getMeter(jiffies); ok {
+				level = &l
+			}
+			received, last := t.getReceived()
 			conns.Tracks = append(conns.Tracks, stats.Track{
-				Bitrate: uint64(rate) * 8,
-				Loss:    loss,
-				Jitter:  jitter,
+				Bitrate:         uint64(rate) * 8,
+				Loss:            loss,
+				Rtt:             rtt,
+				Jitter:          jitter,
+				Feedback:        t.FeedbackMechanisms().Names(),
+				AudioLevel:      level,
+				Packets:         received,
+				LastPacket:      jiffiesToTime(last, jiffies, wall),
+				ClockRate:       t.clock.Observed(),
+				EstimatedTiming: t.hasSyntheticSR(),
 			})
 		}
 		cs.Up = append(cs.Up, conns)
@@ -42,11 +80,11 @@ func (c *webClient) GetStats() *stats.Client {
 		return cs.Up[i].Id < cs.Up[j].Id
 	})
 
-	jiffies := rtptime.Jiffies()
 	for _, down := range c.down {
 		conns := stats.Conn{
-			Id:         down.id,
-			MaxBitrate: down.GetMaxBitrate(jiffies),
+			Id:            down.id,
+			MaxBitrate:    down.GetMaxBitrate(jiffies),
+			CandidatePair: down.CandidatePair(),
 		}
 		for _, t := range down.tracks {
 			rate, _ := t.rate.Estimate()
@@ -54,13 +92,28 @@ func (c *webClient) GetStats() *stats.Client {
 				rtptime.JiffiesPerSec)
 			loss, jitter := t.stats.Get(jiffies)
 			j := time.Duration(jitter) * time.Second /
-				time.Duration(t.track.Codec().ClockRate)
+				time.Duration(t.clockRate())
+			forwarded, recovered, last := t.getForwarded()
+			h := t.stats.History()
+			history := make([]int, len(h))
+			for i := range h {
+				history[i] = int(h[i]) * 100 / 256
+			}
 			conns.Tracks = append(conns.Tracks, stats.Track{
 				Bitrate:    uint64(rate) * 8,
 				MaxBitrate: t.maxBitrate.Get(jiffies),
 				Loss:       uint8(uint32(loss) * 100 / 256),
 				Rtt:        rtt,
 				Jitter:     j,
+				LossBurst: atomic.LoadUint32(
+					&t.atomics.lossBurst,
+				),
+				LossHistory: history,
+				OneWay:      t.getOneWay(),
+				Feedback:    t.FeedbackMechanisms().Names(),
+				Packets:     forwarded,
+				Recovered:   recovered,
+				LastPacket:  jiffiesToTime(last, jiffies, wall),
 			})
 		}
 		cs.Down = append(cs.Down, conns)
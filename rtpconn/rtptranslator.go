@@ -0,0 +1,183 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// An rtpTranslator rewrites the sequence numbers and timestamps of the
+// packets sent on a down track, so that they remain continuous when the
+// track switches between sources, or when packets are deliberately not
+// forwarded.  Until the first change, it is the identity.
+//
+// The translate and resync methods are only called by the goroutine that
+// writes to the track, which owns the unexported state; the other
+// methods may be called concurrently, and don't take any locks.
+type rtpTranslator struct {
+	// incremented by switchSource, accessed atomically
+	switches uint32
+	// the offsets in use, a *translation, nil until the first change
+	current atomic.Value
+
+	// the value of switches last seen by translate
+	seenSwitches uint32
+	// true if at least one packet has been sent
+	started bool
+	// true if the source changed since the last packet was sent
+	switching bool
+	// true if packets were dropped since the last packet was sent
+	resyncing bool
+	// after a switch, true if the next packet starts a frame
+	frameStart bool
+
+	seqnoOffset uint16
+	tsOffset    uint32
+
+	// the last seqno and timestamp sent, and the time at which the
+	// latter was sent
+	lastSeqno uint16
+	lastTs    uint32
+	lastTime  uint64
+}
+
+// A translation is the set of offsets applied to the packets sent
+// starting with seqno first.  It is immutable.
+type translation struct {
+	seqnoOffset uint16
+	tsOffset    uint32
+	first       uint16
+	// true if the packets sent before first came from a different
+	// source
+	switched bool
+	// the offsets applied to the packets sent before first
+	previous *translation
+}
+
+// seqnoBefore returns true if seqno a comes before seqno b.
+func seqnoBefore(a, b uint16) bool {
+	return ((a - b) & 0x8000) != 0
+}
+
+// switchSource indicates that the following packets come from
+// a different source, with unrelated seqnos and timestamps.
+func (t *rtpTranslator) switchSource() {
+	atomic.AddUint32(&t.switches, 1)
+}
+
+// resync indicates that the packets preceding the next one were
+// deliberately not forwarded, and that the seqnos should remain
+// continuous, so that the receiver doesn't see any loss.  The next packet
+// must start a frame.
+func (t *rtpTranslator) resync() {
+	t.resyncing = true
+}
+
+// setOffsets changes the offsets applied to the packets sent from the
+// next one on.
+func (t *rtpTranslator) setOffsets(seqnoOffset uint16, tsOffset uint32, switched bool) {
+	previous := &translation{}
+	if c, ok := t.current.Load().(*translation); ok {
+		previous = &translation{
+			seqnoOffset: c.seqnoOffset,
+			tsOffset:    c.tsOffset,
+			first:       c.first,
+			switched:    c.switched,
+		}
+	}
+	t.seqnoOffset = seqnoOffset
+	t.tsOffset = tsOffset
+	t.current.Store(&translation{
+		seqnoOffset: seqnoOffset,
+		tsOffset:    tsOffset,
+		first:       t.lastSeqno + 1,
+		switched:    switched,
+		previous:    previous,
+	})
+}
+
+// translate maps the seqno and timestamp of a packet received from the
+// current source to the values that should be sent.  After a switch, the
+// first packet sent is given the seqno following the last one sent, and
+// a timestamp that reflects the elapsed time.  For video, packets are
+// dropped until the beginning of a frame, which is detected by the marker
+// bit of the previous packet; the last parameter is false in that case.
+func (t *rtpTranslator) translate(seqno uint16, ts uint32, marker bool, isvideo bool, clockrate uint32, now uint64) (uint16, uint32, bool) {
+	if n := atomic.LoadUint32(&t.switches); n != t.seenSwitches {
+		t.seenSwitches = n
+		t.switching = true
+		t.frameStart = false
+	}
+
+	if t.switching && t.started {
+		if isvideo && !t.frameStart {
+			if marker {
+				t.frameStart = true
+			}
+			return 0, 0, false
+		}
+		var delta uint32
+		if now > t.lastTime {
+			delta = uint32(
+				(now - t.lastTime) * uint64(clockrate) /
+					rtptime.JiffiesPerSec,
+			)
+		}
+		if delta == 0 {
+			delta = 1
+		}
+		t.setOffsets(t.lastSeqno+1-seqno, t.lastTs+delta-ts, true)
+	} else if t.resyncing && t.started {
+		if o := t.lastSeqno + 1 - seqno; o != t.seqnoOffset {
+			t.setOffsets(o, t.tsOffset, false)
+		}
+	}
+	t.switching = false
+	t.resyncing = false
+
+	s := seqno + t.seqnoOffset
+	tt := ts + t.tsOffset
+
+	if !t.started || !seqnoBefore(s, t.lastSeqno) {
+		t.lastSeqno = s
+	}
+	if !t.started || ((tt-t.lastTs)&0x80000000) == 0 {
+		t.lastTs = tt
+		t.lastTime = now
+	}
+	t.started = true
+	return s, tt, true
+}
+
+// inverse maps a seqno that was sent to the seqno received from the
+// current source, and returns the offset that was applied to the
+// packet's timestamp.  This is used for mapping NACKs.  The offsets in
+// use before the last change are remembered, older ones are not.  The
+// last value is false if the packet was sent from an earlier source, in
+// which case it cannot be retransmitted.
+func (t *rtpTranslator) inverse(seqno uint16) (uint16, uint32, bool) {
+	c, ok := t.current.Load().(*translation)
+	if !ok {
+		return seqno, 0, true
+	}
+	for c.previous != nil && seqnoBefore(seqno, c.first) {
+		if c.switched {
+			return 0, 0, false
+		}
+		c = c.previous
+	}
+	if c.switched && seqnoBefore(seqno, c.first) {
+		return 0, 0, false
+	}
+	return seqno - c.seqnoOffset, c.tsOffset, true
+}
+
+// timestamp maps a timestamp of the current source to the value that
+// should be sent, for use in sender reports.
+func (t *rtpTranslator) timestamp(ts uint32) uint32 {
+	c, ok := t.current.Load().(*translation)
+	if !ok {
+		return ts
+	}
+	return ts + c.tsOffset
+}
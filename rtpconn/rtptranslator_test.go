@@ -0,0 +1,103 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestTranslatorIdentity(t *testing.T) {
+	var tr rtpTranslator
+	now := rtptime.Jiffies()
+	for i := uint16(0); i < 4; i++ {
+		s, ts, ok := tr.translate(
+			65534+i, 42+960*uint32(i), false, false, 48000, now,
+		)
+		if !ok || s != 65534+i || ts != 42+960*uint32(i) {
+			t.Errorf("Expected %v %v, got %v %v %v",
+				65534+i, 42+960*uint32(i), s, ts, ok)
+		}
+	}
+}
+
+func TestTranslatorAudioSwitch(t *testing.T) {
+	var tr rtpTranslator
+	now := rtptime.Jiffies()
+	tr.translate(100, 1000, false, false, 48000, now)
+	tr.translate(101, 1960, false, false, 48000, now)
+
+	tr.switchSource()
+	now += rtptime.JiffiesPerSec / 50
+	s, ts, ok := tr.translate(5000, 123456, false, false, 48000, now)
+	if !ok || s != 102 || ts != 1960+960 {
+		t.Errorf("Expected 102 %v, got %v %v %v", 1960+960, s, ts, ok)
+	}
+	s, ts, ok = tr.translate(5001, 123456+960, false, false, 48000, now)
+	if !ok || s != 103 || ts != 1960+2*960 {
+		t.Errorf("Expected 103 %v, got %v %v %v",
+			1960+2*960, s, ts, ok)
+	}
+	if seqno, _, ok := tr.inverse(103); !ok || seqno != 5001 {
+		t.Errorf("Expected 5001, got %v %v", seqno, ok)
+	}
+	// packets sent from the previous source cannot be mapped
+	if seqno, _, ok := tr.inverse(101); ok {
+		t.Errorf("Expected failure, got %v", seqno)
+	}
+	if ts := tr.timestamp(123456); ts != 1960+960 {
+		t.Errorf("Expected %v, got %v", 1960+960, ts)
+	}
+}
+
+func TestTranslatorVideoSwitch(t *testing.T) {
+	var tr rtpTranslator
+	now := rtptime.Jiffies()
+	tr.translate(100, 1000, true, true, 90000, now)
+
+	tr.switchSource()
+	// the tail of a frame is dropped, including the marker packet
+	_, _, ok := tr.translate(7, 5000, false, true, 90000, now)
+	if ok {
+		t.Errorf("Expected drop")
+	}
+	_, _, ok = tr.translate(8, 5000, true, true, 90000, now)
+	if ok {
+		t.Errorf("Expected drop")
+	}
+	s, ts, ok := tr.translate(9, 8000, false, true, 90000, now)
+	if !ok || s != 101 || ts != 1001 {
+		t.Errorf("Expected 101 1001, got %v %v %v", s, ts, ok)
+	}
+}
+
+func TestTranslatorResync(t *testing.T) {
+	var tr rtpTranslator
+	now := rtptime.Jiffies()
+	tr.translate(100, 1000, false, false, 48000, now)
+	tr.translate(101, 1960, false, false, 48000, now)
+
+	// 102 to 109 are not forwarded
+	tr.resync()
+	s, ts, ok := tr.translate(110, 9640, false, false, 48000, now)
+	if !ok || s != 102 || ts != 9640 {
+		t.Errorf("Expected 102 9640, got %v %v %v", s, ts, ok)
+	}
+	s, _, _ = tr.translate(111, 10600, false, false, 48000, now)
+	if s != 103 {
+		t.Errorf("Expected 103, got %v", s)
+	}
+
+	// a lost packet still leaves a gap
+	s, _, _ = tr.translate(113, 12520, false, false, 48000, now)
+	if s != 105 {
+		t.Errorf("Expected 105, got %v", s)
+	}
+
+	if seqno, _, ok := tr.inverse(103); !ok || seqno != 111 {
+		t.Errorf("Expected 111, got %v %v", seqno, ok)
+	}
+	// the source didn't change, earlier packets are still mapped
+	if seqno, _, ok := tr.inverse(101); !ok || seqno != 101 {
+		t.Errorf("Expected 101, got %v %v", seqno, ok)
+	}
+}
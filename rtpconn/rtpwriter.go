@@ -2,12 +2,14 @@ package rtpconn
 
 import (
 	"errors"
-	"log"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/conn"
 	"github.com/jech/galene/packetcache"
@@ -20,6 +22,11 @@ type packetIndex struct {
 	seqno uint16
 	// the index in the cache
 	index uint16
+	// true if this is the first packet of a keyframe
+	keyframe bool
+	// true if packets were deliberately not forwarded just before
+	// this one, the down tracks should keep their seqnos continuous
+	resync bool
 }
 
 // An rtpWriterPool is a set of rtpWriters
@@ -28,6 +35,10 @@ type rtpWriterPool struct {
 	track   *rtpUpTrack
 	writers []*rtpWriter
 	count   int
+	// if true, block on congested writers instead of dropping
+	lossless bool
+	// set by skip, cleared by write
+	resync bool
 }
 
 // sqrt computes the integer square root
@@ -63,7 +74,7 @@ func (wp *rtpWriterPool) add(track conn.DownTrack, add bool) error {
 				if wp.count > 0 {
 					wp.count--
 				} else {
-					log.Printf("Negative writer count!")
+					Logger.Errorf("Negative writer count!")
 				}
 			}
 			return nil
@@ -92,6 +103,7 @@ func (wp *rtpWriterPool) del(w *rtpWriter) bool {
 	for i, ww := range wp.writers {
 		if ww == w {
 			close(w.ch)
+			w.schedule()
 			wp.writers = append(wp.writers[:i], wp.writers[i+1:]...)
 			return true
 		}
@@ -103,17 +115,39 @@ func (wp *rtpWriterPool) del(w *rtpWriter) bool {
 func (wp *rtpWriterPool) close() {
 	for _, w := range wp.writers {
 		close(w.ch)
+		w.schedule()
 	}
 	wp.writers = nil
 	wp.count = 0
 }
 
+// skip indicates that a packet was deliberately not forwarded.  The down
+// tracks rewrite the seqnos of the following packets, so that receivers
+// don't mistake the skipped packets for losses.  The next packet written
+// must start a frame.
+func (wp *rtpWriterPool) skip() {
+	wp.resync = true
+}
+
 // write writes a packet stored in the packet cache to all local tracks
-func (wp *rtpWriterPool) write(seqno uint16, index uint16, delay uint32, isvideo bool, marker bool) {
-	pi := packetIndex{seqno, index}
+func (wp *rtpWriterPool) write(seqno uint16, index uint16, delay uint32, isvideo bool, marker bool, keyframe bool) {
+	wp.track.setReceived(rtptime.Jiffies())
+	if wp.track.getMuted() {
+		wp.skip()
+		return
+	}
+
+	resync := wp.resync
+	wp.resync = false
 
 	var dead []*rtpWriter
 	for _, w := range wp.writers {
+		pi := packetIndex{seqno, index, keyframe, resync || w.resync}
+		if pi.resync {
+			// if the packet doesn't make it to the writer, the
+			// resync is carried over to the next one
+			w.resync = true
+		}
 		if w.drop > 0 {
 			// currently dropping
 			if marker {
@@ -127,11 +161,23 @@ func (wp *rtpWriterPool) write(seqno uint16, index uint16, delay uint32, isvideo
 		select {
 		case w.ch <- pi:
 			// all is well
+			w.resync = false
+			w.schedule()
 		case <-w.done:
 			// the writer is dead.
 			dead = append(dead, w)
 		default:
 			// the writer is congested
+			if wp.lossless {
+				select {
+				case w.ch <- pi:
+					w.resync = false
+					w.schedule()
+				case <-w.done:
+					dead = append(dead, w)
+				}
+				continue
+			}
 			if isvideo {
 				// drop until the end of the frame
 				if !marker {
@@ -148,6 +194,8 @@ func (wp *rtpWriterPool) write(seqno uint16, index uint16, delay uint32, isvideo
 			select {
 			case w.ch <- pi:
 				timer.Stop()
+				w.resync = false
+				w.schedule()
 			case <-w.done:
 				dead = append(dead, w)
 			case <-timer.C:
@@ -174,14 +222,26 @@ type writerAction struct {
 	ch        chan error
 }
 
-// an rtpWriter is a thread writing to a set of tracks.
+// an rtpWriter is a thread writing to a set of tracks.  It either runs
+// in its own goroutine, or is run by the shared writer workers.
 type rtpWriter struct {
 	ch     chan packetIndex
 	done   chan struct{}
 	action chan writerAction
 
+	// the writer's state if it is run by the shared workers, nil if it
+	// runs in its own goroutine
+	state *writerState
+	// the queue served by the shared workers
+	queue chan *rtpWriter
+	// 1 if the writer is queued or being run by a worker, accessed
+	// atomically
+	scheduled int32
+
 	// this is not touched by the writer loop, used by the caller
 	drop int
+	// a resync is pending, used by the caller
+	resync bool
 }
 
 func newRtpWriter(conn *rtpUpConnection, track *rtpUpTrack) *rtpWriter {
@@ -190,15 +250,140 @@ func newRtpWriter(conn *rtpUpConnection, track *rtpUpTrack) *rtpWriter {
 		done:   make(chan struct{}),
 		action: make(chan writerAction, 1),
 	}
-	go rtpWriterLoop(writer, conn, track)
+	if WriterWorkers > 0 {
+		writer.queue = addPooledWriter()
+		writer.state = newWriterState(conn, track)
+		// the writer counts as a goroutine for Shutdown
+		goroutineAdd()
+		return writer
+	}
+	spawn(func() { rtpWriterLoop(writer, conn, track) })
 	return writer
 }
 
+// WriterWorkers is the number of goroutines shared by all writers.  If it
+// is 0, every writer runs in its own goroutine.
+var WriterWorkers int
+
+// writerBatch is the number of events that a worker handles before
+// moving on to the next writer.
+const writerBatch = 16
+
+// writerQueue holds the writers that have pending events.  The workers
+// only run while there are pooled writers, so that Shutdown can wait for
+// them.
+var writerQueue struct {
+	mu      sync.Mutex
+	ch      chan *rtpWriter
+	writers int
+}
+
+// addPooledWriter registers a pooled writer, starting the workers if
+// necessary, and returns the queue that the writer must use.
+func addPooledWriter() chan *rtpWriter {
+	writerQueue.mu.Lock()
+	defer writerQueue.mu.Unlock()
+	if writerQueue.writers == 0 {
+		ch := make(chan *rtpWriter, 1024)
+		for i := 0; i < WriterWorkers; i++ {
+			spawn(func() {
+				for w := range ch {
+					w.run()
+				}
+			})
+		}
+		writerQueue.ch = ch
+	}
+	writerQueue.writers++
+	return writerQueue.ch
+}
+
+// delPooledWriter unregisters a pooled writer.  When the last one is
+// gone, the workers terminate.
+func delPooledWriter() {
+	writerQueue.mu.Lock()
+	defer writerQueue.mu.Unlock()
+	writerQueue.writers--
+	if writerQueue.writers == 0 {
+		close(writerQueue.ch)
+		writerQueue.ch = nil
+	}
+}
+
+// schedule arranges for a pooled writer to be run after an event has been
+// sent to it.  It is a no-op for writers that run in their own goroutine.
+// If the queue is full, the writer is run by the caller, so that the
+// reader never blocks on the workers.
+func (writer *rtpWriter) schedule() {
+	if writer.state == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&writer.scheduled, 0, 1) {
+		select {
+		case writer.queue <- writer:
+		default:
+			writer.run()
+		}
+	}
+}
+
+// run handles the pending events of a pooled writer.  After writerBatch
+// events, the writer is requeued, so that a busy writer doesn't starve
+// the others.
+func (writer *rtpWriter) run() {
+	for {
+		for i := 0; i < writerBatch; i++ {
+			select {
+			case action := <-writer.action:
+				if writer.state.handleAction(action) {
+					writer.finish()
+					return
+				}
+			case pi, ok := <-writer.ch:
+				if !ok {
+					writer.finish()
+					return
+				}
+				writer.state.handlePacket(pi)
+			default:
+				atomic.StoreInt32(&writer.scheduled, 0)
+				// an event might have arrived before we
+				// cleared the flag
+				if len(writer.ch) == 0 && len(writer.action) == 0 {
+					return
+				}
+				if !atomic.CompareAndSwapInt32(
+					&writer.scheduled, 0, 1,
+				) {
+					// somebody else requeued the writer
+					return
+				}
+			}
+		}
+		select {
+		case writer.queue <- writer:
+			return
+		default:
+			// the queue is full, keep going
+		}
+	}
+}
+
+// finish terminates a pooled writer.  The scheduled flag is left set, so
+// that the writer is never queued again.
+func (writer *rtpWriter) finish() {
+	close(writer.done)
+	writer.state.release()
+	delPooledWriter()
+	goroutineDone()
+}
+
 // add adds or removes a track from a writer.
 func (writer *rtpWriter) add(track conn.DownTrack, add bool, max int) error {
 	ch := make(chan error, 1)
 	select {
 	case writer.action <- writerAction{add, track, max, ch}:
+		writer.schedule()
 		select {
 		case err := <-ch:
 			return err
@@ -210,24 +395,61 @@ func (writer *rtpWriter) add(track conn.DownTrack, add bool, max int) error {
 	}
 }
 
-func sendKeyframe(kf []uint16, track conn.DownTrack, cache *packetcache.Cache) {
-	buf := make([]byte, packetcache.BufSize)
-	var packet rtp.Packet
-	for _, seqno := range kf {
-		bytes := cache.Get(seqno, buf)
-		if bytes == 0 {
-			return
-		}
-		err := packet.Unmarshal(buf[:bytes])
+// replayKeyframe sends the last keyframe stored in the cache of up to
+// track, if it is recent enough.  It is only called by the writer loop,
+// so that the keyframe is not interleaved with other packets.  It returns
+// true if the keyframe was sent; if it wasn't, the second value indicates
+// that a keyframe was available, but too old.  Only VP8 keyframes are
+// replayed, and nothing is replayed from a muted track.
+func replayKeyframe(track conn.DownTrack, up *rtpUpTrack, codec webrtc.RTPCodecCapability) (bool, bool) {
+	if strings.ToLower(codec.MimeType) != "video/vp8" || up.getMuted() {
+		return false, false
+	}
+	found, _, lts := up.cache.Last()
+	kts, packets := up.cache.GetKeyframe()
+	if !found || packets == nil {
+		return false, false
+	}
+	if ((lts-kts)&0x80000000) == 0 && lts-kts >= 2*codec.ClockRate {
+		return false, true
+	}
+
+	ps := make([]rtp.Packet, len(packets))
+	for i, buf := range packets {
+		err := ps[i].Unmarshal(buf)
 		if err != nil {
-			return
+			return false, false
+		}
+		if up.mutedPacket(ps[i].SequenceNumber) {
+			// the keyframe was received while muted
+			return false, false
 		}
-		err = track.WriteRTP(&packet)
+	}
+	for i := range ps {
+		err := track.WriteRTP(&ps[i])
 		if err != nil && err != conn.ErrKeyframeNeeded {
-			return
+			return false, false
 		}
-		track.Accumulate(uint32(bytes))
+		accumulate(track, uint32(len(packets[i])), true)
+	}
+	return true, false
+}
+
+// accumulate records a packet sent on a down track.  Keyframe packets
+// are accounted separately, so that they don't inflate the steady-state
+// rate used by congestion control.
+func accumulate(track conn.DownTrack, bytes uint32, keyframe bool) {
+	d, ok := track.(*rtpDownTrack)
+	if !ok {
+		track.Accumulate(bytes)
+		return
+	}
+	d.setForwarded(rtptime.Jiffies(), false)
+	if keyframe {
+		d.rate.AccumulateKeyframe(bytes)
+		return
 	}
+	d.Accumulate(bytes)
 }
 
 const (
@@ -237,140 +459,234 @@ const (
 	kfNeededNewFIR
 )
 
-// rtpWriterLoop is the main loop of an rtpWriter.
-func rtpWriterLoop(writer *rtpWriter, up *rtpUpConnection, track *rtpUpTrack) {
-	defer close(writer.done)
+// writerState is the state of an rtpWriter.  It is only touched by the
+// goroutine that runs the writer.
+type writerState struct {
+	up      *rtpUpConnection
+	track   *rtpUpTrack
+	codec   webrtc.RTPCodecParameters
+	isvideo bool
+
+	b      *[packetcache.BufSize]byte
+	packet rtp.Packet
+	local  []conn.DownTrack
+
+	kfNeeded int
+	// true if some local tracks are waiting for a keyframe
+	kfWaiting bool
+	// the timestamp of the last keyframe, all the packets of a frame
+	// share the same timestamp
+	kfTimestamp      uint32
+	kfTimestampValid bool
+}
+
+func newWriterState(up *rtpUpConnection, track *rtpUpTrack) *writerState {
+	return &writerState{
+		up:       up,
+		track:    track,
+		codec:    track.track.Codec(),
+		isvideo:  track.track.Kind() == webrtc.RTPCodecTypeVideo,
+		b:        packetcache.GetBuffer(),
+		local:    make([]conn.DownTrack, 0),
+		kfNeeded: kfUnneeded,
+	}
+}
+
+// release returns the resources held by s.
+func (s *writerState) release() {
+	packetcache.PutBuffer(s.b)
+	s.b = nil
+}
 
-	codec := track.track.Codec()
+// handleAction adds or removes a local track.  It returns true if the
+// writer has no tracks left and should terminate.
+func (s *writerState) handleAction(action writerAction) bool {
+	track := s.track
+	if action.add {
+		if len(s.local) >= action.maxTracks {
+			action.ch <- ErrWriterBusy
+			close(action.ch)
+			return false
+		}
+		s.local = append(s.local, action.track)
+		action.ch <- nil
+		close(action.ch)
+
+		track.mu.Lock()
+		ntp := track.srNTPTime
+		rtp := track.srRTPTime
+		if ntp == 0 {
+			ntp = track.syntheticNTPTime
+			rtp = track.syntheticRTPTime
+		}
+		track.mu.Unlock()
+		if ntp != 0 {
+			action.track.SetTimeOffset(ntp, rtp)
+		}
+		cname, ok := track.cname.Load().(string)
+		if ok && cname != "" {
+			action.track.SetCname(cname)
+		}
 
-	buf := make([]byte, packetcache.BufSize)
-	var packet rtp.Packet
+		waiting := s.isvideo
+		if s.isvideo {
+			sent, stale := replayKeyframe(
+				action.track, track, s.codec.RTPCodecCapability,
+			)
+			if sent {
+				waiting = false
+			} else if stale {
+				// Request a new keyframe
+				s.kfNeeded = kfNeededNewFIR
+			}
+			// otherwise, there is no complete keyframe yet,
+			// one should arrive soon.  Do nothing.
+		}
+		if waiting {
+			if d, ok := action.track.(*rtpDownTrack); ok {
+				d.setWaitingKeyframe(true)
+				s.kfWaiting = true
+			}
+		}
+		return false
+	}
 
-	local := make([]conn.DownTrack, 0)
+	found := false
+	for i, t := range s.local {
+		if t == action.track {
+			s.local = append(s.local[:i], s.local[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		action.ch <- ErrUnknownTrack
+	} else {
+		action.ch <- nil
+	}
+	close(action.ch)
+	return len(s.local) == 0
+}
 
-	kfNeeded := kfUnneeded
+// handlePacket writes a packet from the cache to all local tracks.
+func (s *writerState) handlePacket(pi packetIndex) {
+	track := s.track
+	codec := s.codec
+	buf := s.b[:]
+	packet := &s.packet
 
-	for {
-		select {
-		case action := <-writer.action:
-			if action.add {
-				if len(local) >= action.maxTracks {
-					action.ch <- ErrWriterBusy
-					close(action.ch)
-					continue
-				}
-				local = append(local, action.track)
-				action.ch <- nil
-				close(action.ch)
-
-				track.mu.Lock()
-				ntp := track.srNTPTime
-				rtp := track.srRTPTime
-				track.mu.Unlock()
-				if ntp != 0 {
-					action.track.SetTimeOffset(ntp, rtp)
-				}
-				cname, ok := track.cname.Load().(string)
-				if ok && cname != "" {
-					action.track.SetCname(cname)
-				}
+	bytes := track.cache.GetAt(pi.seqno, pi.index, buf)
+	if bytes == 0 {
+		return
+	}
 
-				found, _, lts := track.cache.Last()
-				kts, _, kf := track.cache.Keyframe()
-				if strings.ToLower(codec.MimeType) == "video/vp8" &&
-					found && len(kf) > 0 {
-					if ((lts-kts)&0x80000000) != 0 ||
-						lts-kts < 2*90000 {
-						// we got a recent keyframe
-						go sendKeyframe(
-							kf,
-							action.track,
-							track.cache,
-						)
-					} else {
-						// Request a new keyframe
-						kfNeeded = kfNeededNewFIR
-					}
-				} else {
-					// no keyframe yet, one should
-					// arrive soon.  Do nothing.
-				}
-			} else {
-				found := false
-				for i, t := range local {
-					if t == action.track {
-						local = append(local[:i],
-							local[i+1:]...)
-						found = true
-						break
-					}
-				}
-				if !found {
-					action.ch <- ErrUnknownTrack
-				} else {
-					action.ch <- nil
-				}
-				close(action.ch)
-				if len(local) == 0 {
-					return
+	err := packet.Unmarshal(buf[:bytes])
+	if err != nil {
+		return
+	}
+
+	if pi.keyframe {
+		s.kfTimestamp = packet.Timestamp
+		s.kfTimestampValid = true
+	}
+	inKeyframe := s.kfTimestampValid && packet.Timestamp == s.kfTimestamp
+
+	if s.kfWaiting {
+		kf, kfKnown := isKeyframe(codec.MimeType, packet)
+		if kf || !kfKnown {
+			for _, l := range s.local {
+				d, ok := l.(*rtpDownTrack)
+				if ok {
+					d.setWaitingKeyframe(false)
 				}
 			}
-		case pi, ok := <-writer.ch:
-			if !ok {
-				return
-			}
+			s.kfWaiting = false
+		}
+	}
 
-			bytes := track.cache.GetAt(pi.seqno, pi.index, buf)
-			if bytes == 0 {
-				continue
+	for _, l := range s.local {
+		d, ok := l.(*rtpDownTrack)
+		if ok && d.getPaused() {
+			// watch for the keyframe that will follow the resume,
+			// and keep the seqnos continuous across the pause so
+			// that the receiver doesn't see a burst of losses
+			s.kfWaiting = true
+			d.translator.resync()
+			continue
+		}
+		if ok && d.takeReplayKeyframe() {
+			sent, _ := replayKeyframe(
+				d, track, codec.RTPCodecCapability,
+			)
+			if sent {
+				d.setWaitingKeyframe(false)
 			}
-
-			err := packet.Unmarshal(buf[:bytes])
-			if err != nil {
+		}
+		if ok && pi.resync {
+			d.translator.resync()
+		}
+		err := l.WriteRTP(packet)
+		if err != nil {
+			if err == conn.ErrKeyframeNeeded {
+				s.kfNeeded = kfNeededPLI
+				track.keyframeRequested(rtptime.Jiffies())
+			} else {
 				continue
 			}
+		}
+		accumulate(l, uint32(bytes), inKeyframe)
+	}
 
-			for _, l := range local {
-				err := l.WriteRTP(&packet)
-				if err != nil {
-					if err == conn.ErrKeyframeNeeded {
-						kfNeeded = kfNeededPLI
-					} else {
-						continue
-					}
-				}
-				l.Accumulate(uint32(bytes))
+	if s.kfNeeded > kfUnneeded {
+		kf, kfKnown := isKeyframe(codec.MimeType, packet)
+		if kf {
+			s.kfNeeded = kfUnneeded
+		}
+
+		if s.kfNeeded >= kfNeededFIR {
+			err := s.up.sendFIR(
+				track,
+				s.kfNeeded >= kfNeededNewFIR,
+				false,
+			)
+			if err == ErrUnsupportedFeedback {
+				s.kfNeeded = kfNeededPLI
+			} else {
+				s.kfNeeded = kfNeededFIR
 			}
+		}
 
-			if kfNeeded > kfUnneeded {
-				kf, kfKnown :=
-					isKeyframe(codec.MimeType, &packet)
-				if kf {
-					kfNeeded = kfUnneeded
-				}
+		if s.kfNeeded == kfNeededPLI {
+			s.up.sendPLI(track, false)
+		}
 
-				if kfNeeded >= kfNeededFIR {
-					err := up.sendFIR(
-						track,
-						kfNeeded >= kfNeededNewFIR,
-					)
-					if err == ErrUnsupportedFeedback {
-						kfNeeded = kfNeededPLI
-					} else {
-						kfNeeded = kfNeededFIR
-					}
-				}
+		if !kfKnown {
+			// we cannot detect keyframes for this codec, reset
+			// our state
+			s.kfNeeded = kfUnneeded
+		}
+	}
+}
 
-				if kfNeeded == kfNeededPLI {
-					up.sendPLI(track)
-				}
+// rtpWriterLoop is the main loop of an rtpWriter that runs in its own
+// goroutine.
+func rtpWriterLoop(writer *rtpWriter, up *rtpUpConnection, track *rtpUpTrack) {
+	defer close(writer.done)
 
-				if !kfKnown {
-					// we cannot detect keyframes for
-					// this codec, reset our state
-					kfNeeded = kfUnneeded
-				}
+	s := newWriterState(up, track)
+	defer s.release()
+
+	for {
+		select {
+		case action := <-writer.action:
+			if s.handleAction(action) {
+				return
+			}
+		case pi, ok := <-writer.ch:
+			if !ok {
+				return
 			}
+			s.handlePacket(pi)
 		}
 	}
 }
@@ -387,7 +703,7 @@ func nackWriter(conn *rtpUpConnection, track *rtpUpTrack) {
 	track.bufferedNACKs = nil
 	track.mu.Unlock()
 
-	if len(nacks) == 0 || !track.hasRtcpFb("nack", "") {
+	if len(nacks) == 0 || !track.nackEnabled() {
 		return
 	}
 
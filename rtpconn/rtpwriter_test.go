@@ -0,0 +1,210 @@
+package rtpconn
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/packetcache"
+)
+
+// countingTrack is a down track that records the seqnos of the packets
+// written to it.
+type countingTrack struct {
+	mu     sync.Mutex
+	seqnos []uint16
+	wg     *sync.WaitGroup
+}
+
+func (t *countingTrack) WriteRTP(p *rtp.Packet) error {
+	if t.wg != nil {
+		t.wg.Done()
+		return nil
+	}
+	t.mu.Lock()
+	t.seqnos = append(t.seqnos, p.SequenceNumber)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *countingTrack) Accumulate(bytes uint32) {}
+
+func (t *countingTrack) SetTimeOffset(ntp uint64, rtp uint32) {}
+
+func (t *countingTrack) SetCname(string) {}
+
+// newWriterTestTrack returns an up track with 64 packets in its cache,
+// and the indices at which they are stored.
+func newWriterTestTrack(t testing.TB) (*rtpUpTrack, []uint16) {
+	up := &rtpUpTrack{
+		track:   &webrtc.TrackRemote{},
+		cache:   packetcache.New(64),
+		atomics: &upTrackAtomics{},
+	}
+	indices := make([]uint16, 64)
+	for i := 0; i < 64; i++ {
+		p := rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i)},
+			Payload: make([]byte, 1200),
+		}
+		buf, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		_, indices[i] = up.cache.Store(uint16(i), 0, false, false, buf)
+	}
+	return up, indices
+}
+
+// withWriterWorkers runs f with the given number of writer workers.
+func withWriterWorkers(n int, f func()) {
+	old := WriterWorkers
+	WriterWorkers = n
+	defer func() { WriterWorkers = old }()
+	f()
+}
+
+func TestPooledWriter(t *testing.T) {
+	withWriterWorkers(4, func() {
+		up, indices := newWriterTestTrack(t)
+		wp := rtpWriterPool{
+			conn:     &rtpUpConnection{},
+			track:    up,
+			lossless: true,
+		}
+		var tracks []*countingTrack
+		for i := 0; i < 10; i++ {
+			track := &countingTrack{}
+			tracks = append(tracks, track)
+			err := wp.add(track, true)
+			if err != nil {
+				t.Fatalf("add: %v", err)
+			}
+		}
+		if len(wp.writers) != 3 {
+			t.Errorf("Expected 3 writers, got %v", len(wp.writers))
+		}
+		for _, w := range wp.writers {
+			if w.state == nil {
+				t.Errorf("Writer is not pooled")
+			}
+		}
+
+		for i := 0; i < 64; i++ {
+			wp.write(uint16(i), indices[i], 0, false, true, false)
+		}
+
+		// closing the writers drains their queues
+		writers := wp.writers
+		wp.close()
+		for _, w := range writers {
+			<-w.done
+		}
+
+		for _, track := range tracks {
+			if len(track.seqnos) != 64 {
+				t.Errorf("Expected 64 packets, got %v",
+					len(track.seqnos))
+				continue
+			}
+			for i, seqno := range track.seqnos {
+				if seqno != uint16(i) {
+					t.Errorf("Expected %v, got %v", i, seqno)
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestPooledWriterFullQueue(t *testing.T) {
+	withWriterWorkers(1, func() {
+		up, indices := newWriterTestTrack(t)
+		wp := rtpWriterPool{
+			conn:     &rtpUpConnection{},
+			track:    up,
+			lossless: true,
+		}
+		track := &countingTrack{}
+		err := wp.add(track, true)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+
+		// a queue that nobody reads, the writer must be run inline
+		w := wp.writers[0]
+		w.queue = make(chan *rtpWriter)
+		for i := 0; i < 64; i++ {
+			wp.write(uint16(i), indices[i], 0, false, true, false)
+		}
+		wp.close()
+		<-w.done
+
+		if len(track.seqnos) != 64 {
+			t.Errorf("Expected 64 packets, got %v", len(track.seqnos))
+		}
+
+		writerQueue.mu.Lock()
+		n, ch := writerQueue.writers, writerQueue.ch
+		writerQueue.mu.Unlock()
+		if n != 0 || ch != nil {
+			t.Errorf("Expected workers to stop, got %v %v", n, ch)
+		}
+	})
+}
+
+func benchmarkWriters(b *testing.B, workers int, ntracks int) {
+	withWriterWorkers(workers, func() {
+		var wg sync.WaitGroup
+		pools := make([]*rtpWriterPool, ntracks)
+		var indices []uint16
+		for i := range pools {
+			var up *rtpUpTrack
+			up, indices = newWriterTestTrack(b)
+			pools[i] = &rtpWriterPool{
+				conn:     &rtpUpConnection{},
+				track:    up,
+				lossless: true,
+			}
+			err := pools[i].add(&countingTrack{wg: &wg}, true)
+			if err != nil {
+				b.Fatalf("add: %v", err)
+			}
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			seqno := uint16(i % 64)
+			wg.Add(ntracks)
+			for _, wp := range pools {
+				wp.write(seqno, indices[seqno],
+					0, false, true, false)
+			}
+			wg.Wait()
+		}
+		b.StopTimer()
+
+		for _, wp := range pools {
+			writers := wp.writers
+			wp.close()
+			for _, w := range writers {
+				<-w.done
+			}
+		}
+	})
+}
+
+func BenchmarkWriters(b *testing.B) {
+	for _, ntracks := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("goroutines-%v", ntracks), func(b *testing.B) {
+			benchmarkWriters(b, 0, ntracks)
+		})
+		b.Run(fmt.Sprintf("pool-%v", ntracks), func(b *testing.B) {
+			benchmarkWriters(b, 4, ntracks)
+		})
+	}
+}
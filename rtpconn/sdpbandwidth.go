@@ -0,0 +1,131 @@
+package rtpconn
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Bandwidth lines in a session description (RFC 4566 Section 5.8 and RFC
+// 3890).  AS is expressed in kilobits per second, TIAS in bits per
+// second.  They indicate the bandwidth that the sender of the description
+// is willing to receive.  A line in a media section applies to that media
+// alone, while a session-level line applies to the session as a whole.
+
+// bandwidthLimit returns the limit in bits per second expressed by the
+// AS and TIAS values of a section, 0 meaning that the line is absent.
+// TIAS excludes the transport overhead, and is therefore preferred over AS
+// when both are present.
+func bandwidthLimit(as, tias uint64) uint64 {
+	if tias > 0 {
+		return tias
+	}
+	return as * 1000
+}
+
+// sdpBandwidth returns the session-level bandwidth limit of the session
+// description s, and the limits of its media sections indexed by mid.
+// We parse the bandwidth lines ourselves, since the SDP library doesn't
+// know about TIAS.
+func sdpBandwidth(s string) (uint64, map[string]uint64) {
+	var session uint64
+	limits := make(map[string]uint64)
+
+	media := false
+	var mid string
+	var as, tias uint64
+	flush := func() {
+		limit := bandwidthLimit(as, tias)
+		if !media {
+			session = limit
+		} else if mid != "" && limit > 0 {
+			limits[mid] = limit
+		}
+		mid = ""
+		as, tias = 0, 0
+	}
+
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			flush()
+			media = true
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "b="):
+			kv := strings.SplitN(line[2:], ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "AS":
+				as = v
+			case "TIAS":
+				tias = v
+			}
+		}
+	}
+	flush()
+	return session, limits
+}
+
+// stripTIAS removes the TIAS bandwidth lines from a session description,
+// which would otherwise cause the SDP library to reject it.
+func stripTIAS(s string) string {
+	if !strings.Contains(s, "b=TIAS:") {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "b=TIAS:") {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// minLimit returns the smaller of rate and limit, where a limit of 0
+// means no limit.
+func minLimit(rate, limit uint64) uint64 {
+	if limit > 0 && limit < rate {
+		return limit
+	}
+	return rate
+}
+
+// setBandwidthLimits applies the bandwidth lines of the remote description
+// s, which describe what the client is willing to receive, to the
+// connection and its tracks.  It must be called after the description has
+// been applied, so that the tracks' mids are known.
+func (down *rtpDownConnection) setBandwidthLimits(s string) {
+	session, media := sdpBandwidth(s)
+	down.mu.Lock()
+	down.sdpLimit = session
+	down.mu.Unlock()
+
+	transceivers := down.pc.GetTransceivers()
+	for _, t := range down.getTracks() {
+		var mid string
+		for _, tr := range transceivers {
+			if tr.Sender() == t.sender {
+				mid = tr.Mid()
+				break
+			}
+		}
+		atomic.StoreUint64(&t.atomics.sdpLimit, media[mid])
+	}
+}
+
+// getBandwidthLimit returns the session-level bandwidth limit, or 0 if
+// there is none.
+func (down *rtpDownConnection) getBandwidthLimit() uint64 {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	return down.sdpLimit
+}
@@ -0,0 +1,99 @@
+package rtpconn
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/sdp/v3"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/rtptime"
+)
+
+const bandwidthSDP = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"b=AS:2000\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:500\r\n" +
+	"b=TIAS:400000\r\n" +
+	"a=mid:1\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:300\r\n" +
+	"a=mid:2\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n"
+
+func TestSDPBandwidth(t *testing.T) {
+	session, media := sdpBandwidth(bandwidthSDP)
+	if session != 2000000 {
+		t.Errorf("Expected 2000000, got %v", session)
+	}
+	if len(media) != 2 || media["1"] != 400000 || media["2"] != 300000 {
+		t.Errorf("Unexpected media limits %v", media)
+	}
+
+	session, media = sdpBandwidth("garbage")
+	if session != 0 || len(media) != 0 {
+		t.Errorf("Expected no limits, got %v %v", session, media)
+	}
+}
+
+func TestStripTIAS(t *testing.T) {
+	s := stripTIAS(bandwidthSDP)
+	if strings.Contains(s, "TIAS") || !strings.Contains(s, "b=AS:500\r\n") {
+		t.Errorf("Unexpected SDP %q", s)
+	}
+	var d sdp.SessionDescription
+	err := d.Unmarshal([]byte(s))
+	if err != nil {
+		t.Errorf("Unmarshal: %v", err)
+	}
+	session, media := sdpBandwidth(s)
+	if session != 2000000 || media["1"] != 500000 {
+		t.Errorf("Unexpected limits %v %v", session, media)
+	}
+}
+
+func TestBandwidthLimitedRate(t *testing.T) {
+	newTrack := func(limit uint64) *rtpDownTrack {
+		track := &rtpDownTrack{
+			maxBitrate: new(bitrate),
+			rate:       estimator.New(time.Second),
+			stats:      new(receiverStats),
+			atomics:    &downTrackAtomics{sdpLimit: limit},
+		}
+		return track
+	}
+	t1 := newTrack(300000)
+	t2 := newTrack(0)
+	conn := &rtpDownConnection{
+		maxREMBBitrate: new(bitrate),
+		tracks:         []*rtpDownTrack{t1, t2},
+	}
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+
+	t1.maxBitrate.Set(1000000, now)
+	t2.maxBitrate.Set(1000000, now)
+	if r := conn.GetMaxBitrate(now); r != 1300000 {
+		t.Errorf("Expected 1300000, got %v", r)
+	}
+
+	conn.sdpLimit = 800000
+	if r := conn.GetMaxBitrate(now); r != 800000 {
+		t.Errorf("Expected 800000, got %v", r)
+	}
+
+	t1.updateRate(0, now)
+	if r := t1.maxBitrate.Get(now); r > 300000 {
+		t.Errorf("Expected at most 300000, got %v", r)
+	}
+}
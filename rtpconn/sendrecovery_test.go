@@ -0,0 +1,126 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestSendRecoveryTranslated(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000},
+		"track", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	// the pacer allows observing the packets that are sent
+	p := newPacer()
+	down := &rtpDownTrack{
+		track:   local,
+		rate:    estimator.New(time.Second),
+		atomics: &downTrackAtomics{},
+		pacer:   p,
+	}
+	pop := func() []*rtp.Packet {
+		var packets []*rtp.Packet
+		for {
+			_, packet, _ := p.pop(rtptime.Jiffies(), 100000000)
+			if packet == nil {
+				return packets
+			}
+			packets = append(packets, packet)
+		}
+	}
+
+	// the remote track is the new source, its packet 101 is sent as
+	// seqno 12
+	remote := &rtpUpTrack{
+		cache:   packetcache.New(16),
+		atomics: &upTrackAtomics{},
+	}
+	for _, seqno := range []uint16{100, 101, 102} {
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seqno,
+				Timestamp:      3000,
+				Marker:         true,
+			},
+			Payload: []byte{2},
+		}
+		buf, err := packet.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		remote.cache.Store(seqno, 3000, false, true, buf)
+	}
+
+	for i := uint16(0); i < 2; i++ {
+		err := down.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: 10 + i,
+				Timestamp:      1000,
+				Marker:         true,
+			},
+			Payload: []byte{1},
+		})
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	// after a switch, video is dropped until the start of a frame
+	down.translator.switchSource()
+	for _, seqno := range []uint16{100, 101} {
+		down.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seqno,
+				Timestamp:      3000,
+				Marker:         true,
+			},
+			Payload: []byte{2},
+		})
+	}
+	sent := pop()
+	if len(sent) != 3 || sent[2].SequenceNumber != 12 {
+		t.Fatalf("Expected 3 packets, got %v", sent)
+	}
+	sent12 := sent[2]
+
+	// packet 11 was sent from the old source, and cannot be
+	// retransmitted; 12 and 13 are 101 and 102, which are resent with
+	// the seqnos and timestamps that the receiver expects
+	unhandled := sendRecovery(down, remote, down.rate,
+		[]rtcp.NackPair{{PacketID: 11, LostPackets: 0x7}},
+	)
+	resent := pop()
+	if len(resent) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", resent)
+	}
+	if resent[0].SequenceNumber != 12 || resent[0].Payload[0] != 2 ||
+		resent[0].Timestamp != sent12.Timestamp {
+		t.Errorf("Expected packet 101 as 12, got %v", resent[0])
+	}
+	if resent[1].SequenceNumber != 13 || resent[1].Payload[0] != 2 {
+		t.Errorf("Expected packet 102 as 13, got %v", resent[1])
+	}
+
+	// packets that are not in the remote track are reported with the
+	// remote's seqnos
+	if len(unhandled) != 1 || unhandled[0] != 103 {
+		t.Errorf("Expected [103], got %v", unhandled)
+	}
+	_, recovered, _ := down.getForwarded()
+	if recovered != 2 {
+		t.Errorf("Expected 2, got %v", recovered)
+	}
+}
@@ -0,0 +1,34 @@
+package rtpconn
+
+// restartSequence is called by the reader of a track when the sender has
+// restarted its sequence numbers, typically because its encoder was
+// restarted.  The packet cache flushes itself, but the loss trackers
+// would otherwise take the jump for a burst of losses, or consider every
+// subsequent packet as late, so they start over at seqno.  The down
+// tracks switch source, so that the receivers see no discontinuity.
+func (up *rtpUpTrack) restartSequence(seqno uint16) {
+	up.nacks.reset()
+	up.xrLoss.reset()
+	for _, l := range up.getLocal() {
+		if down, ok := l.(*rtpDownTrack); ok {
+			down.translator.switchSource()
+		}
+	}
+	Logger.Infof("Track %v: sequence restarted at %v",
+		up.track.ID(), seqno)
+}
+
+// reset forgets about the packets that were missing.
+func (s *nackState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.valid = false
+	s.pending = s.pending[:0]
+}
+
+// reset starts a new interval at the next packet received.
+func (h *lossHistory) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.valid = false
+}
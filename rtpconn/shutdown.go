@@ -0,0 +1,126 @@
+package rtpconn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jech/galene/group"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// connectionContext is the parent of the contexts of all connections.
+// It is cancelled if Shutdown times out, which closes the connections'
+// peer connections and forces their goroutines to terminate.
+var connectionContext, cancelConnections = context.WithCancel(
+	context.Background(),
+)
+
+// set to 1 when the server is draining, accessed atomically
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// goroutines counts the goroutines associated with clients and
+// connections, so that Shutdown can wait for them to terminate.
+var goroutines struct {
+	mu    sync.Mutex
+	count int
+	// closed when count drops to zero, created on demand
+	idle chan struct{}
+}
+
+func goroutineAdd() {
+	goroutines.mu.Lock()
+	goroutines.count++
+	goroutines.mu.Unlock()
+}
+
+func goroutineDone() {
+	goroutines.mu.Lock()
+	goroutines.count--
+	if goroutines.count == 0 && goroutines.idle != nil {
+		close(goroutines.idle)
+		goroutines.idle = nil
+	}
+	goroutines.mu.Unlock()
+}
+
+// closeOnCancel closes c when ctx is cancelled.  Checking ctx is not
+// enough to stop a goroutine blocked in Read, closing the underlying
+// object is what causes Read to return.
+func closeOnCancel(ctx context.Context, c io.Closer) {
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+}
+
+// spawn runs f in a new goroutine that is waited for by Shutdown.
+func spawn(f func()) {
+	goroutineAdd()
+	go func() {
+		defer goroutineDone()
+		f()
+	}()
+}
+
+// waitGoroutines waits until all goroutines started by spawn have
+// terminated, or ctx is done.
+func waitGoroutines(ctx context.Context) error {
+	goroutines.mu.Lock()
+	if goroutines.count == 0 {
+		goroutines.mu.Unlock()
+		return nil
+	}
+	if goroutines.idle == nil {
+		goroutines.idle = make(chan struct{})
+	}
+	idle := goroutines.idle
+	goroutines.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const shutdownMessage = "the server is restarting, please reconnect"
+
+// Shutdown drains the server: new clients and connections are refused,
+// clients are told to reconnect, and all connections are closed.  It
+// waits until the goroutines associated with clients and connections
+// have terminated.  If ctx is done before that, the connections'
+// goroutines are cancelled, and an error is returned.
+func Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&draining, 1)
+
+	group.Range(func(g *group.Group) bool {
+		for _, c := range g.GetClients(nil) {
+			if wc, ok := c.(*webClient); ok {
+				wc.write(clientMessage{
+					Type:       "usermessage",
+					Kind:       "reconnect",
+					Dest:       wc.id,
+					Privileged: true,
+					Value:      shutdownMessage,
+				})
+			}
+		}
+		go g.Shutdown(shutdownMessage)
+		return true
+	})
+
+	err := waitGoroutines(ctx)
+	if err != nil {
+		cancelConnections()
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package rtpconn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+func TestWaitGoroutines(t *testing.T) {
+	release := make(chan struct{})
+	spawn(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	err := waitGoroutines(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	close(release)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel2()
+	err = waitGoroutines(ctx2)
+	if err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	group.Directory = dir
+	err = ioutil.WriteFile(filepath.Join(dir, "shutdown-test.json"),
+		[]byte(`{"presenter": [{"username": "obs"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	g, err := group.Add("shutdown-test", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	c := NewWhipClient(g, "publisher", "obs", "")
+	_, err = group.AddClient(g.Name(), c)
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+
+	defer atomic.StoreInt32(&draining, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	for i := 0; i < 100 && len(g.GetClients(nil)) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(g.GetClients(nil)); n != 0 {
+		t.Errorf("Expected no clients, got %v", n)
+	}
+
+	pc, offer := whipOffer(t)
+	defer pc.Close()
+	c2 := NewWhipClient(g, "late", "obs", "")
+	_, err = c2.NewConnection(ctx, offer)
+	if err != ErrShuttingDown {
+		t.Errorf("Expected ErrShuttingDown, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// the interval over which the reference packet is chosen, after
+	// the first one, which is shorter so that receivers can
+	// synchronise early
+	syntheticSRInterval      = 5 * rtptime.JiffiesPerSec
+	syntheticSRFirstInterval = rtptime.JiffiesPerSec
+)
+
+// syntheticSR estimates the correspondence between RTP and wall-clock
+// time for a track whose sender doesn't send sender reports, from the
+// arrival times of its packets.  In each interval, the packet with the
+// shortest transit time is taken as the reference, which filters out
+// jitter and follows the drift of the sender's clock.  Only accessed by
+// the reader loop.
+type syntheticSR struct {
+	// the start of the current interval, 0 if none
+	start uint64
+	// the arrival time, timestamp and transit time of the best packet
+	// of the current interval; the transit time is measured from the
+	// start of the interval, in units of the clock rate
+	time      uint64
+	timestamp uint32
+	transit   uint32
+	emitted   bool
+}
+
+// accumulate records the arrival of a packet at time now, in jiffies.
+// At the end of each interval, it returns the arrival time and
+// timestamp of the reference packet.
+func (s *syntheticSR) accumulate(timestamp uint32, now uint64, clockrate uint32) (uint64, uint32, bool) {
+	if clockrate == 0 {
+		return 0, 0, false
+	}
+	if s.start == 0 || now < s.start {
+		s.reset(timestamp, now)
+		return 0, 0, false
+	}
+
+	elapsed := now - s.start
+	transit := uint32(elapsed*uint64(clockrate)/rtptime.JiffiesPerSec) -
+		timestamp
+	if int32(transit-s.transit) < 0 {
+		s.time = now
+		s.timestamp = timestamp
+		s.transit = transit
+	}
+
+	interval := uint64(syntheticSRInterval)
+	if !s.emitted {
+		interval = syntheticSRFirstInterval
+	}
+	if elapsed < interval {
+		return 0, 0, false
+	}
+	tm, ts := s.time, s.timestamp
+	s.emitted = true
+	s.reset(timestamp, now)
+	return tm, ts, true
+}
+
+func (s *syntheticSR) reset(timestamp uint32, now uint64) {
+	s.start = now
+	s.time = now
+	s.timestamp = timestamp
+	s.transit = -timestamp
+}
+
+// synthesizeSR is called by the reader loop for every packet.  If the
+// sender has never sent a sender report, it estimates the timing of the
+// track from the arrival times of packets, and passes it to the down
+// tracks, so that receivers are still able to synchronise audio and
+// video.
+func (up *rtpUpTrack) synthesizeSR(timestamp uint32, now uint64) {
+	tm, ts, ok := up.synthetic.accumulate(timestamp, now, up.clockRate())
+	if !ok {
+		return
+	}
+
+	wall := time.Now()
+	ntp := rtptime.TimeToNTP(
+		*jiffiesToTime(tm, rtptime.TimeToJiffies(wall), wall),
+	)
+
+	up.mu.Lock()
+	if up.srTime != 0 {
+		// the sender has started sending sender reports
+		up.mu.Unlock()
+		atomic.StoreUint32(&up.atomics.syntheticSR, 0)
+		return
+	}
+	up.syntheticNTPTime = ntp
+	up.syntheticRTPTime = ts
+	up.mu.Unlock()
+
+	if atomic.SwapUint32(&up.atomics.syntheticSR, 1) == 0 {
+		Logger.Infof("Track %v: no sender reports, estimating timing",
+			up.track.ID())
+	}
+	for _, l := range up.getLocal() {
+		l.SetTimeOffset(ntp, ts)
+	}
+}
+
+// hasSyntheticSR returns true if the timing of the track is estimated
+// from the arrival times of packets rather than taken from sender
+// reports.
+func (up *rtpUpTrack) hasSyntheticSR() bool {
+	return atomic.LoadUint32(&up.atomics.syntheticSR) != 0
+}
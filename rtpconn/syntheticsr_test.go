@@ -0,0 +1,59 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestSyntheticSR(t *testing.T) {
+	const clockrate = 48000
+	wall := time.Now()
+	start := rtptime.TimeToJiffies(wall)
+	toTime := func(tm uint64) time.Time {
+		return wall.Add(
+			rtptime.ToDuration(tm-start, rtptime.JiffiesPerSec),
+		)
+	}
+	base := uint32(0xFFFF0000)
+	// the timestamp at the sender at time tm
+	timestamp := func(tm uint64) uint32 {
+		return base + uint32((tm-start)*clockrate/rtptime.JiffiesPerSec)
+	}
+
+	// a source that never sends sender reports, sending a packet every
+	// 20ms, whose packets take between 10ms and 50ms to arrive
+	down := &rtpDownTrack{atomics: &downTrackAtomics{}}
+	var s syntheticSR
+	emitted := 0
+	for i := 0; i < 1000; i++ {
+		sent := start + uint64(i)*rtptime.JiffiesPerSec/50
+		delay := uint64(10+(i*7919)%41) * rtptime.JiffiesPerSec / 1000
+		arrival := sent + delay
+		tm, ts, ok := s.accumulate(timestamp(sent), arrival, clockrate)
+		if ok {
+			emitted++
+			down.SetTimeOffset(rtptime.TimeToNTP(toTime(tm)), ts)
+		}
+		if emitted == 0 {
+			continue
+		}
+
+		// the reference is the least delayed packet, so the
+		// estimated timestamps lag by the minimum delay, plus a
+		// little jitter
+		ts, ok = down.srTimestamp(toTime(arrival), clockrate)
+		if !ok {
+			t.Fatalf("No timestamp")
+		}
+		d := int32(timestamp(arrival) - ts)
+		if d < 10*clockrate/1000 || d > 15*clockrate/1000 {
+			t.Errorf("Expected %v, got %v", timestamp(arrival), ts)
+		}
+	}
+	// one after 1s, then one every 5s
+	if emitted != 4 {
+		t.Errorf("Expected 4, got %v", emitted)
+	}
+}
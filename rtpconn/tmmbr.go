@@ -0,0 +1,145 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtcp"
+)
+
+// Temporary Maximum Media Stream Bit Rate Request and Notification
+// (RFC 5104 Section 4.2).  As with extended reports, the version of
+// pion/rtcp that we use doesn't know about them, so they are returned
+// as raw packets.
+
+const (
+	rtcpFormatTMMBR = 3
+	rtcpFormatTMMBN = 4
+)
+
+// the highest bitrate that makes sense for Opus
+const opusMaxBitrate = 510000
+
+var errTMMBRMalformed = errors.New("malformed TMMBR")
+
+// tmmbrEntry is a single FCI entry of a TMMBR or TMMBN packet.
+type tmmbrEntry struct {
+	SSRC uint32
+	// the maximum bitrate, in bits per second
+	Bitrate uint64
+	// the per-packet overhead, in bytes
+	Overhead uint16
+}
+
+// tmmbr is a TMMBR packet, or a TMMBN packet if Notification is set.
+// In a request, the entries carry the SSRCs of the media senders; in
+// a notification, they carry the SSRCs of the requesters.
+type tmmbr struct {
+	Notification bool
+	SenderSSRC   uint32
+	Entries      []tmmbrEntry
+}
+
+func (t *tmmbr) DestinationSSRC() []uint32 {
+	if t.Notification {
+		return []uint32{t.SenderSSRC}
+	}
+	ssrcs := make([]uint32, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		ssrcs = append(ssrcs, e.SSRC)
+	}
+	return ssrcs
+}
+
+// encodeTMMBRBitrate encodes a bitrate as a 6-bit exponent and a 17-bit
+// mantissa, rounding down.
+func encodeTMMBRBitrate(bitrate uint64) (uint8, uint32) {
+	exp := uint8(0)
+	for bitrate > 0x1FFFF {
+		bitrate >>= 1
+		exp++
+	}
+	return exp, uint32(bitrate)
+}
+
+func (t *tmmbr) Marshal() ([]byte, error) {
+	b := make([]byte, 12, 12+8*len(t.Entries))
+	binary.BigEndian.PutUint32(b[4:], t.SenderSSRC)
+	// the media source SSRC is unused and must be 0
+	for _, e := range t.Entries {
+		exp, mantissa := encodeTMMBRBitrate(e.Bitrate)
+		var d [8]byte
+		binary.BigEndian.PutUint32(d[0:], e.SSRC)
+		binary.BigEndian.PutUint32(d[4:],
+			uint32(exp)<<26|mantissa<<9|uint32(e.Overhead&0x1FF))
+		b = append(b, d[:]...)
+	}
+
+	format := uint8(rtcpFormatTMMBR)
+	if t.Notification {
+		format = rtcpFormatTMMBN
+	}
+	h := rtcp.Header{
+		Count:  format,
+		Type:   rtcp.TypeTransportSpecificFeedback,
+		Length: uint16(len(b)/4 - 1),
+	}
+	hb, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, hb)
+	return b, nil
+}
+
+func (t *tmmbr) Unmarshal(b []byte) error {
+	var h rtcp.Header
+	err := h.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	if h.Type != rtcp.TypeTransportSpecificFeedback ||
+		(h.Count != rtcpFormatTMMBR && h.Count != rtcpFormatTMMBN) {
+		return errTMMBRMalformed
+	}
+	length := 4 * (int(h.Length) + 1)
+	if len(b) < length || length < 12 {
+		return errTMMBRMalformed
+	}
+	b = b[:length]
+
+	*t = tmmbr{
+		Notification: h.Count == rtcpFormatTMMBN,
+		SenderSSRC:   binary.BigEndian.Uint32(b[4:]),
+	}
+	for i := 12; i+8 <= len(b); i += 8 {
+		v := binary.BigEndian.Uint32(b[i+4:])
+		exp := v >> 26
+		mantissa := uint64((v >> 9) & 0x1FFFF)
+		bitrate := mantissa << exp
+		if bitrate>>exp != mantissa {
+			// overflow, this is effectively unlimited
+			bitrate = ^uint64(0)
+		}
+		t.Entries = append(t.Entries, tmmbrEntry{
+			SSRC:     binary.BigEndian.Uint32(b[i:]),
+			Bitrate:  bitrate,
+			Overhead: uint16(v & 0x1FF),
+		})
+	}
+	return nil
+}
+
+// parseTMMBR returns the TMMBR or TMMBN contained in p, if any.
+func parseTMMBR(p *rtcp.RawPacket) (*tmmbr, bool) {
+	h := p.Header()
+	if h.Type != rtcp.TypeTransportSpecificFeedback {
+		return nil, false
+	}
+	var t tmmbr
+	err := t.Unmarshal(*p)
+	if err != nil {
+		return nil, false
+	}
+	return &t, true
+}
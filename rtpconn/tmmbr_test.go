@@ -0,0 +1,163 @@
+package rtpconn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/rtptime"
+)
+
+func TestTMMBRMarshal(t *testing.T) {
+	p := &tmmbr{
+		SenderSSRC: 42,
+		Entries: []tmmbrEntry{
+			{SSRC: 1, Bitrate: 32000, Overhead: 40},
+			{SSRC: 2, Bitrate: 100000},
+		},
+	}
+	buf, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: 42}, p,
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	ps, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(ps))
+	}
+	raw, ok := ps[1].(*rtcp.RawPacket)
+	if !ok {
+		t.Fatalf("Expected raw packet, got %T", ps[1])
+	}
+	p2, ok := parseTMMBR(raw)
+	if !ok {
+		t.Fatalf("Couldn't parse TMMBR")
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Errorf("Expected %v, got %v", p, p2)
+	}
+
+	p.Notification = true
+	buf, err = p.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var p3 tmmbr
+	err = p3.Unmarshal(buf)
+	if err != nil || !p3.Notification {
+		t.Errorf("Expected notification, got %v %v", p3, err)
+	}
+
+	// a NACK is not a TMMBR
+	nack := rtcp.RawPacket(buf)
+	nack[0] = (nack[0] &^ 0x1F) | 1
+	if _, ok := parseTMMBR(&nack); ok {
+		t.Errorf("NACK parsed as TMMBR")
+	}
+}
+
+func TestTMMBRBitrate(t *testing.T) {
+	for _, b := range []uint64{0, 1, 0x1FFFF, 0x20000, 510000, 1 << 40} {
+		exp, mantissa := encodeTMMBRBitrate(b)
+		d := uint64(mantissa) << exp
+		if d > b || d < b-b/0x10000 {
+			t.Errorf("%v: got %v", b, d)
+		}
+	}
+
+	// a value that doesn't fit in 64 bits
+	buf, _ := (&tmmbr{Entries: []tmmbrEntry{{Bitrate: 1}}}).Marshal()
+	buf[16] = 0xFF
+	var p tmmbr
+	err := p.Unmarshal(buf)
+	if err != nil || p.Entries[0].Bitrate != ^uint64(0) {
+		t.Errorf("Expected unlimited, got %v %v", p.Entries, err)
+	}
+}
+
+func TestGotTMMBR(t *testing.T) {
+	track := &rtpDownTrack{
+		ssrc:       1,
+		maxBitrate: new(bitrate),
+		rate:       estimator.New(time.Second),
+		stats:      new(receiverStats),
+		atomics:    &downTrackAtomics{},
+	}
+	recorder := &rtcpRecorder{}
+	conn := &rtpDownConnection{
+		maxREMBBitrate: new(bitrate),
+		tracks:         []*rtpDownTrack{track},
+		ssrcs:          map[webrtc.SSRC]*rtpDownTrack{1: track},
+		rtcpOut:        newRTCPSizeWriter(recorder),
+	}
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+	var fir firState
+
+	buf, err := (&tmmbr{
+		SenderSSRC: 7,
+		Entries: []tmmbrEntry{
+			{SSRC: 1, Bitrate: 24000},
+			{SSRC: 2, Bitrate: 1000},
+		},
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	raw := rtcp.RawPacket(buf)
+	handleDownRTCP(conn, track, &fir, &raw, now)
+
+	track.maxBitrate.Set(64000, now)
+	if r := conn.GetMaxBitrate(now); r != 24000 {
+		t.Errorf("Expected 24000, got %v", r)
+	}
+
+	if len(recorder.packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(recorder.packets))
+	}
+	n, ok := recorder.packets[1].(*tmmbr)
+	if !ok || !n.Notification || n.SenderSSRC != 1 ||
+		len(n.Entries) != 1 || n.Entries[0].SSRC != 7 ||
+		n.Entries[0].Bitrate != 24000 {
+		t.Errorf("Unexpected TMMBN %v", recorder.packets[1])
+	}
+}
+
+func TestTMMBRTarget(t *testing.T) {
+	audio := webrtc.RTPCodecTypeAudio
+	video := webrtc.RTPCodecTypeVideo
+	unlimited := ^uint64(0)
+	tests := []struct {
+		kind                  webrtc.RTPCodecType
+		fb                    Feedback
+		acked, rate, maxAudio uint64
+		target                uint64
+		ok                    bool
+	}{
+		{audio, Feedback{}, 0, 20000, 0, 0, false},
+		{audio, Feedback{TMMBR: true}, 0, unlimited, 0, 0, false},
+		{audio, Feedback{TMMBR: true}, 0, unlimited, 32000, 32000, true},
+		{audio, Feedback{TMMBR: true}, 32000, unlimited, 32000, 0, false},
+		{audio, Feedback{TMMBR: true}, 32000, 24000, 32000, 24000, true},
+		{audio, Feedback{TMMBR: true}, 32000, unlimited, 0,
+			opusMaxBitrate, true},
+		{video, Feedback{TMMBR: true}, 0, 300000, 32000, 300000, true},
+		{video, Feedback{TMMBR: true}, 0, unlimited, 0, 0, false},
+		{video, Feedback{TMMBR: true, REMB: true}, 0, 300000, 0, 0, false},
+	}
+	for i, test := range tests {
+		target, ok := tmmbrTarget(test.kind, test.fb,
+			test.acked, test.rate, test.maxAudio)
+		if target != test.target || ok != test.ok {
+			t.Errorf("%v: expected %v %v, got %v %v",
+				i, test.target, test.ok, target, ok)
+		}
+	}
+}
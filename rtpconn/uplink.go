@@ -0,0 +1,166 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// the period over which the smallest one-way delay is remembered,
+	// which is taken as the delay of an empty queue
+	uplinkBaseWindow = 10 * rtptime.JiffiesPerSec
+	// a gap in arrivals after which delay measurements start afresh
+	uplinkGap = 2 * rtptime.JiffiesPerSec
+	// queuing delays above which the uplink is considered to be
+	// overused, and below which it is considered to be underused
+	uplinkOveruse  = 50 * rtptime.JiffiesPerSec / 1000
+	uplinkUnderuse = 20 * rtptime.JiffiesPerSec / 1000
+	// the initial estimate, in bits per second
+	uplinkInitialRate = 512 * 1000
+)
+
+// uplinkDelay measures the queuing delay on the path from a sender by
+// comparing the arrival times of frames with their timestamps.  Only the
+// first packet of each frame is considered, since the others are delayed
+// by pacing at the sender.  Only accessed by the reader loop; the result
+// is stored in the track's atomics.
+type uplinkDelay struct {
+	// the reference packet, against which relative delays are
+	// computed, 0 if none
+	time      uint64
+	timestamp uint32
+	last      uint64
+	lastTS    uint32
+	// the smallest relative delay in the current and the previous
+	// windows, and the start of the current window
+	min, prevMin int64
+	minStart     uint64
+	// the smoothed relative delay
+	delay int64
+}
+
+// accumulate records the arrival of a packet at time now, and returns the
+// current queuing delay, in jiffies.
+func (u *uplinkDelay) accumulate(timestamp uint32, now uint64, clockrate uint32) uint64 {
+	if clockrate == 0 {
+		return 0
+	}
+	if u.time == 0 || now < u.last || now-u.last > uplinkGap {
+		u.time = now
+		u.timestamp = timestamp
+		u.last = now
+		u.lastTS = timestamp
+		u.min = 0
+		u.prevMin = 0
+		u.minStart = now
+		u.delay = 0
+		return 0
+	}
+	if timestamp == u.lastTS || int32(timestamp-u.lastTS) < 0 {
+		// not the first packet of a frame, or reordered
+		u.last = now
+		return u.queue()
+	}
+	u.last = now
+	u.lastTS = timestamp
+
+	elapsed := int64(now - u.time)
+	media := int64(int32(timestamp-u.timestamp)) *
+		rtptime.JiffiesPerSec / int64(clockrate)
+	d := elapsed - media
+	if d < -int64(rtptime.JiffiesPerSec) || d > 10*int64(rtptime.JiffiesPerSec) {
+		// timestamp jump, start afresh
+		u.time = 0
+		return 0
+	}
+
+	if now-u.minStart > uplinkBaseWindow {
+		u.prevMin = u.min
+		u.min = d
+		u.minStart = now
+	} else if d < u.min {
+		u.min = d
+	}
+	u.delay += (d - u.delay) / 8
+	return u.queue()
+}
+
+func (u *uplinkDelay) queue() uint64 {
+	base := u.min
+	if u.prevMin < base {
+		base = u.prevMin
+	}
+	if u.delay <= base {
+		return 0
+	}
+	return uint64(u.delay - base)
+}
+
+// uplinkEstimator estimates the bitrate that the uplink of a sender can
+// carry, from the queuing delay measured on its tracks and the rate at
+// which data is received.  The estimate increases multiplicatively while
+// the queues are empty, and falls below the received rate when they
+// grow.  Only accessed by rtcpUpSender, except for the estimate, which
+// is accessed atomically.
+type uplinkEstimator struct {
+	rate uint64
+}
+
+// update returns a new estimate given the largest queuing delay, in
+// jiffies, and the received rate, in bits per second.
+func (e *uplinkEstimator) update(queue uint64, received uint64) uint64 {
+	rate := atomic.LoadUint64(&e.rate)
+	if rate == 0 {
+		rate = uplinkInitialRate
+	}
+	if queue > uplinkOveruse {
+		r := received * 85 / 100
+		if r < rate {
+			rate = r
+		}
+	} else if queue < uplinkUnderuse {
+		rate = rate * 108 / 100
+		// don't grow far beyond what is actually sent
+		max := received * 3 / 2
+		if max < uplinkInitialRate {
+			max = uplinkInitialRate
+		}
+		if rate > max {
+			rate = max
+		}
+	}
+	if rate < group.MinBitrate {
+		rate = group.MinBitrate
+	}
+	atomic.StoreUint64(&e.rate, rate)
+	return rate
+}
+
+// get returns the current estimate, or 0 if none.
+func (e *uplinkEstimator) get() uint64 {
+	return atomic.LoadUint64(&e.rate)
+}
+
+// estimateUplink updates the uplink estimate of a connection from the
+// state of its tracks.
+func (up *rtpUpConnection) estimateUplink(tracks []*rtpUpTrack) uint64 {
+	var queue, received uint64
+	for _, t := range tracks {
+		q := atomic.LoadUint64(&t.atomics.queueDelay)
+		if q > queue {
+			queue = q
+		}
+		r, _ := t.rate.Estimate()
+		received += 8 * uint64(r)
+	}
+	return up.uplink.update(queue, received)
+}
+
+// uplinkEstimation returns true if the bitrate requested from senders in
+// group g should be estimated from their uplinks rather than derived from
+// the receivers.
+func uplinkEstimation(g *group.Group) bool {
+	return g != nil && g.UplinkEstimation()
+}
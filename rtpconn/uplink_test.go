@@ -0,0 +1,63 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestUplinkDelay(t *testing.T) {
+	const clockrate = 90000
+	var u uplinkDelay
+	now := rtptime.Jiffies() + rtptime.JiffiesPerSec
+	ts := uint32(0xFFFFF000)
+	frame := uint64(rtptime.JiffiesPerSec / 30)
+
+	// an uncongested path, with a little jitter
+	var queue uint64
+	for i := 0; i < 300; i++ {
+		jitter := uint64(i%3) * rtptime.JiffiesPerSec / 1000
+		queue = u.accumulate(ts, now+jitter, clockrate)
+		// a second packet of the same frame, delayed by pacing
+		u.accumulate(ts, now+jitter+frame/2, clockrate)
+		now += frame
+		ts += clockrate / 30
+	}
+	if queue >= uplinkUnderuse {
+		t.Errorf("Expected no queue, got %v", queue)
+	}
+
+	// a queue builds up by 1ms per frame
+	for i := 0; i < 150; i++ {
+		queue = u.accumulate(ts,
+			now+uint64(i)*rtptime.JiffiesPerSec/1000, clockrate)
+		now += frame
+		ts += clockrate / 30
+	}
+	if queue <= uplinkOveruse {
+		t.Errorf("Expected a queue, got %v", queue)
+	}
+}
+
+func TestUplinkEstimator(t *testing.T) {
+	var e uplinkEstimator
+	rate := e.update(0, 1000000)
+	if rate != uplinkInitialRate*108/100 {
+		t.Errorf("Expected %v, got %v", uplinkInitialRate*108/100, rate)
+	}
+	for i := 0; i < 100; i++ {
+		rate = e.update(0, 1000000)
+	}
+	if rate != 1500000 {
+		t.Errorf("Expected %v, got %v", 1500000, rate)
+	}
+	rate = e.update(uplinkOveruse+1, 1000000)
+	if rate != 850000 {
+		t.Errorf("Expected %v, got %v", 850000, rate)
+	}
+	// between the thresholds, the estimate is held
+	rate = e.update((uplinkOveruse+uplinkUnderuse)/2, 1000000)
+	if rate != 850000 || e.get() != 850000 {
+		t.Errorf("Expected %v, got %v", 850000, rate)
+	}
+}
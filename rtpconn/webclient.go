@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 	"time"
@@ -16,7 +15,6 @@ import (
 	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/estimator"
 	"github.com/jech/galene/group"
-	"github.com/jech/galene/ice"
 )
 
 func errorToWSCloseMessage(id string, err error) (*clientMessage, []byte) {
@@ -65,10 +63,16 @@ type webClient struct {
 	writerDone  chan struct{}
 	actionCh    chan struct{}
 
+	// per-source requests, overriding requested
+	sourceRequested map[string]map[string][]string
+
 	mu      sync.Mutex
 	down    map[string]*rtpDownConnection
 	up      map[string]*rtpUpConnection
 	actions []interface{}
+	// the start of the last bandwidth test, and whether it is running
+	bandwidthTest        time.Time
+	bandwidthTestRunning bool
 }
 
 func (c *webClient) Group() *group.Group {
@@ -89,7 +93,7 @@ func (c *webClient) Challenge(group string, creds group.ClientCredentials) bool
 	}
 	m, err := creds.Password.Match(c.password)
 	if err != nil {
-		log.Printf("Password match: %v", err)
+		Logger.Warnf("Password match: %v", err)
 		return false
 	}
 	return m
@@ -185,7 +189,7 @@ func addUpConn(c *webClient, id, label string, offer string) (*rtpUpConnection,
 		return old, false, nil
 	}
 
-	conn, err := newUpConn(c, id, label, offer)
+	conn, err := newUpConn(connectionContext, c, id, label, offer)
 	if err != nil {
 		return nil, false, err
 	}
@@ -231,16 +235,19 @@ func delUpConn(c *webClient, id string, userId string, push bool) error {
 	g := c.group
 	c.mu.Unlock()
 
-	conn.pc.Close()
+	conn.close()
 
 	if push && g != nil {
 		for _, c := range g.GetClients(c) {
 			err := c.PushConn(g, id, nil, nil, replace)
 			if err != nil {
-				log.Printf("PushConn: %v", err)
+				Logger.Warnf("PushConn: %v", err)
 			}
 		}
 	}
+	if g != nil {
+		g.NotifyPublisher(group.PublisherEvent{Client: c.id, Id: id})
+	}
 
 	return nil
 }
@@ -289,7 +296,7 @@ func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error)
 		return down, false, nil
 	}
 
-	down, err := newDownConn(c, id, remote)
+	down, err := newDownConn(connectionContext, c, id, remote)
 	if err != nil {
 		return nil, false, err
 	}
@@ -304,15 +311,23 @@ func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error)
 		}
 	})
 
+	down.onQuality = func(q networkQuality) {
+		c.write(clientMessage{
+			Type:  "quality",
+			Id:    down.id,
+			Value: q.String(),
+		})
+	}
+
 	err = remote.AddLocal(down)
 	if err != nil {
-		down.pc.Close()
+		down.close()
 		return nil, false, err
 	}
 
 	c.down[down.id] = down
 
-	go rtcpDownSender(down)
+	spawn(func() { rtcpDownSender(down.ctx, down) })
 
 	return down, true, nil
 }
@@ -320,7 +335,11 @@ func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error)
 func delDownConn(c *webClient, id string) error {
 	conn := delDownConnHelper(c, id)
 	if conn != nil {
-		conn.pc.Close()
+		err := sendBye(conn, conn.getTracks())
+		if err != nil {
+			Logger.Warnf("sendBye: %v", err)
+		}
+		conn.close()
 		return nil
 	}
 	return os.ErrNotExist
@@ -361,40 +380,104 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack, remo
 		}
 	}
 
-	local, err := webrtc.NewTrackLocalStaticRTP(
-		remoteTrack.Codec(),
+	var policy string
+	if conn.group != nil {
+		policy = conn.group.ForwardedCNAME()
+	}
+	_, err := addDownTrackHelper(
+		conn, remoteTrack,
 		remoteTrack.track.ID(), remoteTrack.track.StreamID(),
+		forwardedCname(policy, remoteTrack, remoteConn),
+	)
+	return err
+}
+
+// forwardedCname returns the CNAME of a down track forwarding
+// remoteTrack, or the empty string if the sender's CNAME should be used.
+func forwardedCname(policy string, remoteTrack *rtpUpTrack, remoteConn conn.Up) string {
+	switch policy {
+	case "stream":
+		return remoteTrack.track.StreamID()
+	case "user":
+		id, _ := remoteConn.User()
+		return id
+	default:
+		return ""
+	}
+}
+
+// addDownTrackHelper adds a track to conn that forwards remoteTrack.  If
+// cname is not empty, it is announced instead of the sender's CNAME.
+// Called locked.
+func addDownTrackHelper(conn *rtpDownConnection, remoteTrack conn.UpTrack, id, streamID, cname string) (*rtpDownTrack, error) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		remoteTrack.Codec(), id, streamID,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sender, err := conn.pc.AddTrack(local)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	parms := sender.GetParameters()
 	if len(parms.Encodings) != 1 {
-		return errors.New("got multiple encodings")
+		return nil, errors.New("got multiple encodings")
 	}
 
+	var initialRate, maxRate, minRate uint64
+	if conn.group != nil {
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo &&
+			conn.remote != nil {
+			initialRate, maxRate =
+				conn.group.VideoBitrate(conn.remote.Label())
+			minRate =
+				conn.group.VideoMinBitrate(conn.remote.Label())
+		} else {
+			initialRate =
+				conn.group.InitialBitrate(remoteTrack.Kind())
+		}
+	}
+	window := rateWindow(conn.group, remoteTrack.Kind())
+
 	track := &rtpDownTrack{
-		track:      local,
-		sender:     sender,
-		ssrc:       parms.Encodings[0].SSRC,
-		remote:     remoteTrack,
-		maxBitrate: new(bitrate),
-		stats:      new(receiverStats),
-		rate:       estimator.New(time.Second),
-		atomics:    &downTrackAtomics{},
+		track:       local,
+		sender:      sender,
+		ssrc:        parms.Encodings[0].SSRC,
+		remote:      remoteTrack,
+		initialRate: initialRate,
+		maxRate:     maxRate,
+		minRate:     minRate,
+		maxBitrate:  new(bitrate),
+		stats:       new(receiverStats),
+		rate:        estimator.New(window),
+		atomics:     &downTrackAtomics{},
+		fixedCname:  cname != "",
+		lossless:    lossless(conn.group),
+		pacer:       conn.pacer,
+	}
+	if cname != "" {
+		track.cname.Store(cname)
+	}
+	if addCSRC(conn.group) {
+		track.csrc = contributingSource(remoteTrack)
 	}
 
 	conn.tracks = append(conn.tracks, track)
+	if conn.ssrcs == nil {
+		conn.ssrcs = make(map[webrtc.SSRC]*rtpDownTrack)
+	}
+	conn.ssrcs[track.ssrc] = track
 
-	go rtcpDownListener(conn, track, sender)
+	spawn(func() {
+		rtcpDownListener(
+			conn.ctx, conn, track, senderReader{sender},
+		)
+	})
 
-	return nil
+	return track, nil
 }
 
 func delDownTrackUnlocked(conn *rtpDownConnection, track *rtpDownTrack) error {
@@ -403,13 +486,21 @@ func delDownTrackUnlocked(conn *rtpDownConnection, track *rtpDownTrack) error {
 			track.remote.DelLocal(track)
 			conn.tracks =
 				append(conn.tracks[:i], conn.tracks[i+1:]...)
+			delete(conn.ssrcs, track.ssrc)
+			err := sendBye(conn, []*rtpDownTrack{track})
+			if err != nil {
+				Logger.Warnf("sendBye: %v", err)
+			}
 			return conn.pc.RemoveTrack(track.sender)
 		}
 	}
 	return os.ErrNotExist
 }
 
-func replaceTracks(conn *rtpDownConnection, remote []conn.UpTrack, remoteConn conn.Up) error {
+// replaceTracks sets the tracks of a down connection to the local tracks
+// of remote.  It returns true if any tracks were added or removed, in
+// which case the connection needs to be renegotiated.
+func replaceTracks(conn *rtpDownConnection, remote []conn.UpTrack, remoteConn conn.Up) (bool, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
@@ -420,12 +511,12 @@ outer:
 	for _, rtrack := range remote {
 		rt, ok := rtrack.(*rtpUpTrack)
 		if !ok {
-			return errUnexpectedTrackType
+			return false, errUnexpectedTrackType
 		}
 		for _, track := range conn.tracks {
 			rt2, ok := track.remote.(*rtpUpTrack)
 			if !ok {
-				return errUnexpectedTrackType
+				return false, errUnexpectedTrackType
 			}
 			if rt == rt2 {
 				continue outer
@@ -438,12 +529,12 @@ outer2:
 	for _, track := range conn.tracks {
 		rt, ok := track.remote.(*rtpUpTrack)
 		if !ok {
-			return errUnexpectedTrackType
+			return false, errUnexpectedTrackType
 		}
 		for _, rtrack := range remote {
 			rt2, ok := rtrack.(*rtpUpTrack)
 			if !ok {
-				return errUnexpectedTrackType
+				return false, errUnexpectedTrackType
 			}
 			if rt == rt2 {
 				continue outer2
@@ -455,18 +546,18 @@ outer2:
 	for _, t := range del {
 		err := delDownTrackUnlocked(conn, t)
 		if err != nil {
-			return err
+			return true, err
 		}
 	}
 
 	for _, rt := range add {
 		err := addDownTrackUnlocked(conn, rt, remoteConn)
 		if err != nil {
-			return err
+			return true, err
 		}
 	}
 
-	return nil
+	return len(del) > 0 || len(add) > 0, nil
 }
 
 func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace string) error {
@@ -488,6 +579,11 @@ func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace s
 		return err
 	}
 
+	err = mungeSDP(down.group, &offer)
+	if err != nil {
+		return err
+	}
+
 	err = down.pc.SetLocalDescription(offer)
 	if err != nil {
 		return err
@@ -519,7 +615,7 @@ func sendICE(c *webClient, id string, candidate *webrtc.ICECandidate) error {
 }
 
 func gotOffer(c *webClient, id, label string, sdp string, replace string) error {
-	up, _, err := addUpConn(c, id, label, sdp)
+	up, isnew, err := addUpConn(c, id, label, sdp)
 	if err != nil {
 		return err
 	}
@@ -538,12 +634,39 @@ func gotOffer(c *webClient, id, label string, sdp string, replace string) error
 	if err != nil {
 		return err
 	}
+	up.rtcpOut.setReducedSize(reducedSizeRTCP(sdp))
+	up.setXREnabled(
+		(up.group != nil && up.group.RTCPXR()) || rtcpXR(sdp),
+	)
+
+	if !isnew {
+		changed, err := up.updateInactiveTracks(sdp)
+		if err != nil {
+			Logger.Warnf("updateInactiveTracks: %v", err)
+		} else if changed {
+			pushConn(up, c.group, c.group.GetClients(c))
+		}
+	}
 
 	answer, err := up.pc.CreateAnswer(nil)
 	if err != nil {
 		return err
 	}
 
+	var maxAudio uint64
+	if up.group != nil {
+		maxAudio = up.group.MaxAudioBitrate()
+	}
+	answer.SDP, err = fixOpusAnswer(answer.SDP, up.stereo, maxAudio)
+	if err != nil {
+		return err
+	}
+
+	err = mungeSDP(up.group, &answer)
+	if err != nil {
+		return err
+	}
+
 	err = up.pc.SetLocalDescription(answer)
 	if err != nil {
 		return err
@@ -551,7 +674,7 @@ func gotOffer(c *webClient, id, label string, sdp string, replace string) error
 
 	err = up.flushICECandidates()
 	if err != nil {
-		log.Printf("ICE: %v", err)
+		Logger.Warnf("ICE: %v", err)
 	}
 
 	return c.write(clientMessage{
@@ -569,6 +692,8 @@ func gotAnswer(c *webClient, id string, sdp string) error {
 		return ErrUnknownId
 	}
 
+	limits := sdp
+	sdp = stripTIAS(sdp)
 	err := down.pc.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
 		SDP:  sdp,
@@ -576,6 +701,8 @@ func gotAnswer(c *webClient, id string, sdp string) error {
 	if err != nil {
 		return err
 	}
+	down.rtcpOut.setReducedSize(reducedSizeRTCP(sdp))
+	down.setBandwidthLimits(limits)
 
 	for _, t := range down.tracks {
 		local := t.track.Codec()
@@ -588,7 +715,7 @@ func gotAnswer(c *webClient, id string, sdp string) error {
 
 	err = down.flushICECandidates()
 	if err != nil {
-		log.Printf("ICE: %v", err)
+		Logger.Warnf("ICE: %v", err)
 	}
 
 	add := func() {
@@ -617,30 +744,78 @@ func gotICE(c *webClient, candidate *webrtc.ICECandidateInit, id string) error {
 	return conn.addICECandidate(candidate)
 }
 
-func (c *webClient) setRequested(requested map[string][]string) error {
+// setRequested sets the streams requested by the client.  If source is
+// not empty, the request only applies to the streams of the given client,
+// which must be in the group, and a nil request reverts to the client's
+// global request.
+func (c *webClient) setRequested(source string, requested map[string][]string) error {
 	if c.group == nil {
 		return errors.New("attempted to request with no group joined")
 	}
-	c.requested = requested
 
-	pushConns(c, c.group)
+	if source == "" {
+		c.requested = requested
+		pushConns(c, c.group)
+		return nil
+	}
+
+	cc := c.group.GetClient(source)
+	if requested == nil {
+		delete(c.sourceRequested, source)
+	} else {
+		if cc == nil {
+			return c.error(group.UserError("user unknown"))
+		}
+		// forget about clients that have left, so that the map
+		// doesn't grow without bound
+		for id := range c.sourceRequested {
+			if id != source && c.group.GetClient(id) == nil {
+				delete(c.sourceRequested, id)
+			}
+		}
+		if c.sourceRequested == nil {
+			c.sourceRequested =
+				make(map[string]map[string][]string)
+		}
+		c.sourceRequested[source] = requested
+	}
+
+	if cc != nil {
+		requestConns(cc, c, c.group)
+	}
 	return nil
 }
 
+// pushConns causes all clients to push their connections to c.
 func pushConns(c group.Client, g *group.Group) {
 	clients := g.GetClients(c)
 	for _, cc := range clients {
-		ccc, ok := cc.(*webClient)
-		if ok {
-			ccc.action(pushConnsAction{g, c})
-		}
+		requestConns(cc, c, g)
+	}
+}
+
+// requestConns causes source to push its connections to c.
+func requestConns(source group.Client, c group.Client, g *group.Group) {
+	switch s := source.(type) {
+	case *webClient:
+		s.action(pushConnsAction{g, c})
+	case *WhipClient:
+		s.pushConns(g, c)
+	case *fileClient:
+		s.pushConns(g, c)
 	}
 }
 
 func requestedTracks(c *webClient, up conn.Up, tracks []conn.UpTrack) []conn.UpTrack {
-	r, ok := c.requested[up.Label()]
+	requested := c.requested
+	id, _ := up.User()
+	if sr, ok := c.sourceRequested[id]; ok {
+		requested = sr
+	}
+
+	r, ok := requested[up.Label()]
 	if !ok {
-		r, ok = c.requested[""]
+		r, ok = requested[""]
 	}
 	if !ok || len(r) == 0 {
 		return nil
@@ -654,14 +829,15 @@ func requestedTracks(c *webClient, up conn.Up, tracks []conn.UpTrack) []conn.UpT
 		case "video":
 			video = true
 		default:
-			log.Printf("client requested unknown value %v", s)
+			Logger.Warnf("client requested unknown value %v", s)
 		}
 	}
 
 	var ts []conn.UpTrack
 	if audio {
 		for _, t := range tracks {
-			if t.Kind() == webrtc.RTPCodecTypeAudio {
+			if t.Kind() == webrtc.RTPCodecTypeAudio &&
+				maySubscribe(c, up, t) {
 				ts = append(ts, t)
 				break
 			}
@@ -669,7 +845,8 @@ func requestedTracks(c *webClient, up conn.Up, tracks []conn.UpTrack) []conn.UpT
 	}
 	if video {
 		for _, t := range tracks {
-			if t.Kind() == webrtc.RTPCodecTypeVideo {
+			if t.Kind() == webrtc.RTPCodecTypeVideo &&
+				maySubscribe(c, up, t) {
 				ts = append(ts, t)
 				break
 			}
@@ -679,6 +856,25 @@ func requestedTracks(c *webClient, up conn.Up, tracks []conn.UpTrack) []conn.UpT
 	return ts
 }
 
+// maySubscribe returns true if the server's policy allows c to receive
+// track t of up.
+func maySubscribe(c group.Client, up conn.Up, t conn.UpTrack) bool {
+	source, username := up.User()
+	var label string
+	if l, ok := t.(interface{ Label() string }); ok {
+		label = l.Label()
+	}
+	return group.MaySubscribe(group.SubscribeRequest{
+		Group:      c.Group(),
+		Client:     c,
+		Source:     source,
+		Username:   username,
+		Label:      up.Label(),
+		TrackLabel: label,
+		Kind:       t.Kind(),
+	})
+}
+
 func (c *webClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
 	err := c.action(pushConnAction{g, id, up, tracks, replace})
 	if err != nil {
@@ -698,6 +894,20 @@ func readMessage(conn *websocket.Conn, m *clientMessage) error {
 }
 
 func StartClient(conn *websocket.Conn) (err error) {
+	goroutineAdd()
+	defer goroutineDone()
+
+	if isDraining() {
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(
+				websocket.CloseTryAgainLater,
+				shutdownMessage,
+			),
+		)
+		conn.Close()
+		return ErrShuttingDown
+	}
+
 	var m clientMessage
 
 	err = readMessage(conn, &m)
@@ -764,6 +974,11 @@ type connectionFailedAction struct {
 
 type permissionsChangedAction struct{}
 
+type bandwidthTestAction struct {
+	up   *bandwidthTestUp
+	done bool
+}
+
 type kickAction struct {
 	id       string
 	username string
@@ -783,6 +998,9 @@ func clientLoop(c *webClient, ws *websocket.Conn) error {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
+	meterTicker := time.NewTicker(audioMeterInterval)
+	defer meterTicker.Stop()
+
 	err := c.write(clientMessage{
 		Type: "handshake",
 	})
@@ -817,6 +1035,11 @@ func clientLoop(c *webClient, ws *websocket.Conn) error {
 					return err
 				}
 			}
+		case <-meterTicker.C:
+			err := sendAudioLevels(c)
+			if err != nil {
+				return err
+			}
 		case <-ticker.C:
 			if time.Since(readTime) > 75*time.Second {
 				return errors.New("client is dead")
@@ -858,25 +1081,29 @@ func handleAction(c *webClient, a interface{}) error {
 			return nil
 		}
 
-		down, _, err := addDownConn(c, a.conn)
+		down, isnew, err := addDownConn(c, a.conn)
 		if err != nil {
 			return err
 		}
-		err = replaceTracks(down, tracks, a.conn)
+		changed, err := replaceTracks(down, tracks, a.conn)
 		if err != nil {
 			return err
 		}
 		if a.replace != "" {
 			err := delDownConn(c, a.replace)
 			if err != nil {
-				log.Printf("Replace: %v", err)
+				Logger.Warnf("Replace: %v", err)
 			}
 		}
+		if !isnew && !changed && a.replace == "" {
+			// the client already has the right tracks
+			return nil
+		}
 		err = negotiate(
 			c, down, false, a.replace,
 		)
 		if err != nil {
-			log.Printf(
+			Logger.Warnf(
 				"Negotiation failed: %v",
 				err)
 			closeDownConn(c, down.id,
@@ -890,6 +1117,10 @@ func handleAction(c *webClient, a interface{}) error {
 		for _, u := range c.up {
 			tracks := u.getTracks()
 			replace := u.getReplace(false)
+			if len(tracks) == 0 && replace == "" {
+				// no media, nothing to subscribe to
+				continue
+			}
 
 			ts := make([]conn.UpTrack, len(tracks))
 			for i, t := range tracks {
@@ -897,15 +1128,19 @@ func handleAction(c *webClient, a interface{}) error {
 			}
 			err := a.client.PushConn(g, u.id, u, ts, replace)
 			if err != nil {
-				log.Printf("PushConn: %v", err)
+				Logger.Warnf("PushConn: %v", err)
 			}
 		}
 	case connectionFailedAction:
 		if down := getDownConn(c, a.id); down != nil {
+			logDroppedCandidates(a.id, down.droppedCandidates)
 			err := negotiate(c, down, true, "")
 			if err != nil {
 				return err
 			}
+			if _, ok := down.remote.(*bandwidthTestUp); ok {
+				return nil
+			}
 			tracks := make(
 				[]conn.UpTrack, len(down.tracks),
 			)
@@ -918,12 +1153,13 @@ func handleAction(c *webClient, a interface{}) error {
 				tracks, "",
 			)
 		} else if up := getUpConn(c, a.id); up != nil {
+			logDroppedCandidates(a.id, up.droppedCandidates)
 			c.write(clientMessage{
 				Type: "renegotiate",
 				Id:   a.id,
 			})
 		} else {
-			log.Printf("Attempting to renegotiate " +
+			Logger.Infof("Attempting to renegotiate " +
 				"unknown connection")
 		}
 
@@ -932,6 +1168,10 @@ func handleAction(c *webClient, a interface{}) error {
 		if g == nil {
 			return errors.New("Permissions changed in no group")
 		}
+		conf, err := iceConfiguration(g)
+		if err != nil {
+			return err
+		}
 		perms := c.permissions
 		c.write(clientMessage{
 			Type:             "joined",
@@ -939,7 +1179,7 @@ func handleAction(c *webClient, a interface{}) error {
 			Group:            g.Name(),
 			Username:         c.username,
 			Permissions:      &perms,
-			RTCConfiguration: ice.ICEConfiguration(),
+			RTCConfiguration: conf,
 		})
 		if !c.permissions.Present {
 			up := getUpConns(c)
@@ -964,17 +1204,52 @@ func handleAction(c *webClient, a interface{}) error {
 				cc.PushClient(id, user, perms, s, "change")
 			}
 		}(clients)
+	case bandwidthTestAction:
+		if a.done {
+			if getDownConn(c, a.up.id) != nil {
+				closeDownConn(c, a.up.id, "")
+			}
+			return nil
+		}
+		down, _, err := addDownConn(c, a.up)
+		if err != nil {
+			a.up.done(err)
+			return nil
+		}
+		down.mu.Lock()
+		_, err = addDownTrackHelper(
+			down, &bandwidthTestTrack{a.up},
+			bandwidthTestLabel, a.up.id, "",
+		)
+		down.mu.Unlock()
+		if err == nil {
+			err = negotiate(c, down, false, "")
+		}
+		if err != nil {
+			a.up.done(err)
+			closeDownConn(c, down.id, "")
+		}
 	case kickAction:
 		return group.KickError{
 			a.id, a.username, a.message,
 		}
 	default:
-		log.Printf("unexpected action %T", a)
+		Logger.Errorf("unexpected action %T", a)
 		return errors.New("unexpected action")
 	}
 	return nil
 }
 
+// logDroppedCandidates is called when ICE fails, since the failure may
+// be caused by the candidate filter.
+func logDroppedCandidates(id string, dropped int) {
+	if dropped > 0 {
+		Logger.Warnf("ICE failed on connection %v after ignoring "+
+			"%v remote candidates, check the -ice-filter option",
+			id, dropped)
+	}
+}
+
 func failUpConnection(c *webClient, id string, message string) error {
 	if id != "" {
 		err := c.write(clientMessage{
@@ -1014,13 +1289,14 @@ func leaveGroup(c *webClient) {
 	c.permissions = group.ClientPermissions{}
 	c.status = nil
 	c.requested = make(map[string][]string)
+	c.sourceRequested = nil
 	c.group = nil
 }
 
 func closeDownConn(c *webClient, id string, message string) error {
 	err := delDownConn(c, id)
 	if err != nil && !os.IsNotExist(err) {
-		log.Printf("Close down connection: %v", err)
+		Logger.Warnf("Close down connection: %v", err)
 	}
 	err = c.write(clientMessage{
 		Type: "close",
@@ -1068,6 +1344,150 @@ func setPermissions(g *group.Group, id string, perm string) error {
 	return c.action(permissionsChangedAction{})
 }
 
+// A publisher is a client that sends media to the server.
+type publisher interface {
+	group.Client
+	upConns() []conn.Up
+}
+
+func (c *webClient) upConns() []conn.Up {
+	var up []conn.Up
+	for _, u := range getUpConns(c) {
+		up = append(up, u)
+	}
+	return up
+}
+
+// setTrackMuted mutes or unmutes all tracks of a given kind sent by c to
+// group g, including any tracks that c might send in the future, even
+// after leaving and joining the group again with the same id.
+func setTrackMuted(g *group.Group, c publisher, kind webrtc.RTPCodecType, muted bool) {
+	g.SetMuted(c.Id(), kind, muted)
+	for _, up := range c.upConns() {
+		up.SetMuted(kind, muted)
+	}
+}
+
+func muteTrack(g *group.Group, m clientMessage) error {
+	client := g.GetClient(m.Dest)
+	if client == nil {
+		return group.UserError("no such user")
+	}
+
+	c, ok := client.(publisher)
+	if !ok {
+		return group.UserError("this client doesn't publish")
+	}
+
+	var kind webrtc.RTPCodecType
+	switch m.Value {
+	case "audio", nil:
+		kind = webrtc.RTPCodecTypeAudio
+	case "video":
+		kind = webrtc.RTPCodecTypeVideo
+	default:
+		return group.UserError("unknown track kind")
+	}
+
+	setTrackMuted(g, c, kind, m.Kind == "mutetrack")
+
+	wc, ok := c.(*webClient)
+	if !ok {
+		return nil
+	}
+	return wc.write(clientMessage{
+		Type:       "usermessage",
+		Kind:       m.Kind,
+		Source:     m.Source,
+		Username:   m.Username,
+		Dest:       wc.id,
+		Privileged: true,
+		Value:      kind.String(),
+	})
+}
+
+// MuteClient mutes or unmutes the tracks of the given kind sent by client
+// id, and informs the client.  It is used by the administrative interface.
+func MuteClient(g *group.Group, id string, kind string, muted bool) error {
+	m := clientMessage{
+		Kind:  "unmutetrack",
+		Dest:  id,
+		Value: kind,
+	}
+	if muted {
+		m.Kind = "mutetrack"
+	}
+	return muteTrack(g, m)
+}
+
+// StartRecording starts recording a group to disk.
+func StartRecording(g *group.Group) error {
+	for _, cc := range g.GetClients(nil) {
+		_, ok := cc.(*diskwriter.Client)
+		if ok {
+			return group.UserError("already recording")
+		}
+	}
+	disk := diskwriter.New(g)
+	_, err := group.AddClient(g.Name(), disk)
+	if err != nil {
+		disk.Close()
+		return err
+	}
+	pushConns(disk, g)
+	return nil
+}
+
+// StopRecording stops all recordings of a group.  It returns false if
+// the group was not being recorded.
+func StopRecording(g *group.Group) bool {
+	found := false
+	for _, cc := range g.GetClients(nil) {
+		disk, ok := cc.(*diskwriter.Client)
+		if ok {
+			disk.Close()
+			group.DelClient(disk)
+			found = true
+		}
+	}
+	return found
+}
+
+// PauseRecording pauses all recordings of a group.  If split is true,
+// the recorded files are closed, and resuming creates new ones.  It
+// returns false if the group was not being recorded.
+func PauseRecording(g *group.Group, split bool) (bool, error) {
+	found := false
+	for _, cc := range g.GetClients(nil) {
+		disk, ok := cc.(*diskwriter.Client)
+		if ok {
+			err := disk.Pause(split)
+			if err != nil {
+				return true, err
+			}
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// ResumeRecording resumes all paused recordings of a group.  It returns
+// false if the group was not being recorded.
+func ResumeRecording(g *group.Group) (bool, error) {
+	found := false
+	for _, cc := range g.GetClients(nil) {
+		disk, ok := cc.(*diskwriter.Client)
+		if ok {
+			err := disk.Resume()
+			if err != nil {
+				return true, err
+			}
+			found = true
+		}
+	}
+	return found, nil
+}
+
 func (c *webClient) Kick(id, user, message string) error {
 	return c.action(kickAction{id, user, message})
 }
@@ -1134,7 +1554,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				s = string(e)
 			} else {
 				s = "internal server error"
-				log.Printf("Join group: %v", err)
+				Logger.Warnf("Join group: %v", err)
 			}
 			return c.write(clientMessage{
 				Type:        "joined",
@@ -1158,6 +1578,19 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			})
 		}
 		c.group = g
+		conf, err := iceConfiguration(g)
+		if err != nil {
+			Logger.Warnf("Join group %v: %v", g.Name(), err)
+			leaveGroup(c)
+			return c.write(clientMessage{
+				Type:        "joined",
+				Kind:        "fail",
+				Group:       m.Group,
+				Username:    c.username,
+				Permissions: &group.ClientPermissions{},
+				Value:       "this group requires a TURN server",
+			})
+		}
 		perms := c.permissions
 		err = c.write(clientMessage{
 			Type:             "joined",
@@ -1165,7 +1598,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			Group:            m.Group,
 			Username:         c.username,
 			Permissions:      &perms,
-			RTCConfiguration: ice.ICEConfiguration(),
+			RTCConfiguration: conf,
 		})
 		if err != nil {
 			return err
@@ -1185,7 +1618,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			}
 		}
 	case "request":
-		return c.setRequested(m.Request)
+		return c.setRequested(m.Source, m.Request)
 	case "offer":
 		if m.Id == "" {
 			return errEmptyId
@@ -1202,7 +1635,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotOffer(c, m.Id, m.Label, m.SDP, m.Replace)
 		if err != nil {
-			log.Printf("gotOffer: %v", err)
+			Logger.Warnf("gotOffer: %v", err)
 			return failUpConnection(c, m.Id, "negotiation failed")
 		}
 	case "answer":
@@ -1211,7 +1644,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotAnswer(c, m.Id, m.SDP)
 		if err != nil {
-			log.Printf("gotAnswer: %v", err)
+			Logger.Warnf("gotAnswer: %v", err)
 			message := ""
 			if err != ErrUnknownId {
 				message = "negotiation failed"
@@ -1244,15 +1677,38 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				)
 			}
 		} else {
-			log.Printf("Trying to renegotiate unknown connection")
+			Logger.Warnf("Trying to renegotiate unknown connection")
+		}
+	case "pause", "resume":
+		if m.Id == "" {
+			return errEmptyId
+		}
+		down := getDownConn(c, m.Id)
+		if down == nil {
+			Logger.Warnf("Trying to pause unknown connection")
+			return nil
+		}
+		err := down.pauseTracks(m.Kind, m.Type == "pause")
+		if err != nil {
+			return err
+		}
+	case "keyframe":
+		if m.Id == "" {
+			return errEmptyId
 		}
+		down := getDownConn(c, m.Id)
+		if down == nil {
+			Logger.Warnf("Requesting keyframe on unknown connection")
+			return nil
+		}
+		down.requestKeyframes()
 	case "close":
 		if m.Id == "" {
 			return errEmptyId
 		}
 		err := delUpConn(c, m.Id, c.id, true)
 		if err != nil {
-			log.Printf("Deleting up connection %v: %v",
+			Logger.Warnf("Deleting up connection %v: %v",
 				m.Id, err)
 			return nil
 		}
@@ -1270,7 +1726,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotICE(c, m.Candidate, m.Id)
 		if err != nil {
-			log.Printf("ICE: %v", err)
+			Logger.Warnf("ICE: %v", err)
 		}
 	case "chat", "usermessage":
 		g := c.group
@@ -1305,7 +1761,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			}
 			err := broadcast(g.GetClients(except), mm)
 			if err != nil {
-				log.Printf("broadcast(chat): %v", err)
+				Logger.Warnf("broadcast(chat): %v", err)
 			}
 		} else {
 			cc := g.GetClient(m.Dest)
@@ -1335,7 +1791,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			}
 			err := broadcast(g.GetClients(nil), m)
 			if err != nil {
-				log.Printf("broadcast(clearchat): %v", err)
+				Logger.Warnf("broadcast(clearchat): %v", err)
 			}
 		case "lock", "unlock":
 			if !c.permissions.Op {
@@ -1351,29 +1807,31 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			if !c.permissions.Record {
 				return c.error(group.UserError("not authorised"))
 			}
-			for _, cc := range g.GetClients(c) {
-				_, ok := cc.(*diskwriter.Client)
-				if ok {
-					return c.error(group.UserError("already recording"))
-				}
-			}
-			disk := diskwriter.New(g)
-			_, err := group.AddClient(g.Name(), disk)
+			err := StartRecording(g)
 			if err != nil {
-				disk.Close()
 				return c.error(err)
 			}
-			pushConns(disk, c.group)
 		case "unrecord":
 			if !c.permissions.Record {
 				return c.error(group.UserError("not authorised"))
 			}
-			for _, cc := range g.GetClients(c) {
-				disk, ok := cc.(*diskwriter.Client)
-				if ok {
-					disk.Close()
-					group.DelClient(disk)
-				}
+			StopRecording(g)
+		case "play", "loop":
+			if !c.permissions.Op {
+				return c.error(group.UserError("not authorised"))
+			}
+			name, _ := m.Value.(string)
+			err := StartPlayback(g, name, m.Kind == "loop")
+			if err != nil {
+				return c.error(err)
+			}
+		case "unplay":
+			if !c.permissions.Op {
+				return c.error(group.UserError("not authorised"))
+			}
+			err := StopPlayback(g)
+			if err != nil {
+				return c.error(err)
 			}
 		case "subgroups":
 			if !c.permissions.Op {
@@ -1412,6 +1870,14 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			if err != nil {
 				return c.error(err)
 			}
+		case "mutetrack", "unmutetrack":
+			if !c.permissions.Op {
+				return c.error(group.UserError("not authorised"))
+			}
+			err := muteTrack(g, m)
+			if err != nil {
+				return c.error(err)
+			}
 		case "kick":
 			if !c.permissions.Op {
 				return c.error(group.UserError("not authorised"))
@@ -1458,6 +1924,28 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		default:
 			return group.ProtocolError("unknown user action")
 		}
+	case "bandwidth-test":
+		if c.group == nil {
+			return c.error(group.UserError("join a group first"))
+		}
+		spawn(func() {
+			rate, err := StartBandwidthTest(c)
+			if err != nil {
+				Logger.Warnf("Bandwidth test: %v", err)
+				if _, ok := err.(group.UserError); !ok {
+					err = group.UserError("bandwidth test failed")
+				}
+				c.error(err)
+				c.write(clientMessage{
+					Type: "bandwidth-test",
+				})
+				return
+			}
+			c.write(clientMessage{
+				Type:  "bandwidth-test",
+				Value: rate,
+			})
+		})
 	case "pong":
 		// nothing
 	case "ping":
@@ -1465,7 +1953,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			Type: "pong",
 		})
 	default:
-		log.Printf("unexpected message: %v", m.Type)
+		Logger.Warnf("unexpected message: %v", m.Type)
 		return group.ProtocolError("unexpected message")
 	}
 	return nil
@@ -1529,7 +2017,7 @@ func clientWriter(conn *websocket.Conn, ch <-chan interface{}, done chan<- struc
 			}
 			return
 		default:
-			log.Printf("clientWiter: unexpected message %T", m)
+			Logger.Errorf("clientWiter: unexpected message %T", m)
 			return
 		}
 	}
@@ -1633,6 +2121,27 @@ func errorMessage(id string, err error) *clientMessage {
 	}
 }
 
+// startBandwidthTest returns false if the client already has a bandwidth
+// test running, or if the last one was started too recently.
+func (c *webClient) startBandwidthTest(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bandwidthTestRunning ||
+		(!c.bandwidthTest.IsZero() &&
+			now.Sub(c.bandwidthTest) < BandwidthTestInterval) {
+		return false
+	}
+	c.bandwidthTest = now
+	c.bandwidthTestRunning = true
+	return true
+}
+
+func (c *webClient) endBandwidthTest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bandwidthTestRunning = false
+}
+
 func (c *webClient) error(err error) error {
 	m := errorMessage(c.id, err)
 	if m == nil {
@@ -0,0 +1,194 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+)
+
+type fakeUpTrack struct {
+	kind webrtc.RTPCodecType
+}
+
+func (t *fakeUpTrack) AddLocal(conn.DownTrack) error {
+	return nil
+}
+
+func (t *fakeUpTrack) DelLocal(conn.DownTrack) bool {
+	return false
+}
+
+func (t *fakeUpTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *fakeUpTrack) Codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{}
+}
+
+func (t *fakeUpTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	return 0
+}
+
+func (t *fakeUpTrack) Nack(conn conn.Up, seqnos []uint16) error {
+	return nil
+}
+
+func TestRequestedTracks(t *testing.T) {
+	audio := &fakeUpTrack{kind: webrtc.RTPCodecTypeAudio}
+	video := &fakeUpTrack{kind: webrtc.RTPCodecTypeVideo}
+	tracks := []conn.UpTrack{audio, video}
+
+	camera := &rtpUpConnection{label: "camera", userId: "alice"}
+	screen := &rtpUpConnection{label: "screenshare", userId: "alice"}
+	other := &rtpUpConnection{label: "camera", userId: "bob"}
+
+	c := &webClient{
+		requested: map[string][]string{
+			"":            {"audio", "video"},
+			"screenshare": {"video"},
+		},
+		sourceRequested: map[string]map[string][]string{
+			"bob": {"": {"audio"}},
+		},
+	}
+
+	a := []struct {
+		up       *rtpUpConnection
+		expected []conn.UpTrack
+	}{
+		{camera, []conn.UpTrack{audio, video}},
+		{screen, []conn.UpTrack{video}},
+		{other, []conn.UpTrack{audio}},
+	}
+	for _, s := range a {
+		ts := requestedTracks(c, s.up, tracks)
+		if len(ts) != len(s.expected) {
+			t.Errorf("%v/%v: expected %v, got %v",
+				s.up.userId, s.up.label, s.expected, ts)
+			continue
+		}
+		for i := range ts {
+			if ts[i] != s.expected[i] {
+				t.Errorf("%v/%v: expected %v, got %v",
+					s.up.userId, s.up.label,
+					s.expected, ts)
+			}
+		}
+	}
+
+	// an empty per-source request suppresses all tracks
+	c.sourceRequested["bob"] = map[string][]string{}
+	if ts := requestedTracks(c, other, tracks); len(ts) != 0 {
+		t.Errorf("Expected no tracks, got %v", ts)
+	}
+}
+
+func TestRequestUnknownSource(t *testing.T) {
+	g, err := group.Add("request-source-test", &group.Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	defer group.Delete(g.Name())
+
+	c := &webClient{
+		id:      "carol",
+		group:   g,
+		writeCh: make(chan interface{}, 1),
+		sourceRequested: map[string]map[string][]string{
+			"alice": {"": {"audio"}},
+		},
+	}
+	err = c.setRequested("bob", map[string][]string{"": {"audio"}})
+	if err != nil {
+		t.Errorf("setRequested: %v", err)
+	}
+	if _, ok := c.sourceRequested["bob"]; ok {
+		t.Errorf("Request for unknown source was recorded")
+	}
+	select {
+	case m := <-c.writeCh:
+		if mm, ok := m.(clientMessage); !ok || mm.Kind != "error" {
+			t.Errorf("Expected error, got %v", m)
+		}
+	default:
+		t.Errorf("Expected error message")
+	}
+
+	// reverting a request doesn't require the source to be present
+	err = c.setRequested("alice", nil)
+	if err != nil || len(c.sourceRequested) != 0 {
+		t.Errorf("Expected empty map, got %v %v", c.sourceRequested, err)
+	}
+}
+
+func TestSubscribeHook(t *testing.T) {
+	audio := &fakeUpTrack{kind: webrtc.RTPCodecTypeAudio}
+	video := &fakeUpTrack{kind: webrtc.RTPCodecTypeVideo}
+	tracks := []conn.UpTrack{audio, video}
+
+	alice := &rtpUpConnection{label: "camera", userId: "alice"}
+	bob := &rtpUpConnection{label: "camera", userId: "bob"}
+
+	c := &webClient{
+		id:        "carol",
+		requested: map[string][]string{"": {"audio", "video"}},
+	}
+
+	var requests []group.SubscribeRequest
+	group.SubscribeHook = func(r group.SubscribeRequest) bool {
+		requests = append(requests, r)
+		return r.Source != "bob" || r.Kind == webrtc.RTPCodecTypeAudio
+	}
+	defer func() {
+		group.SubscribeHook = nil
+	}()
+
+	if ts := requestedTracks(c, alice, tracks); len(ts) != 2 {
+		t.Errorf("Expected 2 tracks, got %v", ts)
+	}
+	ts := requestedTracks(c, bob, tracks)
+	if len(ts) != 1 || ts[0] != audio {
+		t.Errorf("Expected %v, got %v", []conn.UpTrack{audio}, ts)
+	}
+
+	if len(requests) != 4 {
+		t.Fatalf("Expected 4 requests, got %v", len(requests))
+	}
+	r := requests[3]
+	if r.Client.Id() != "carol" || r.Source != "bob" ||
+		r.Label != "camera" || r.Kind != webrtc.RTPCodecTypeVideo {
+		t.Errorf("Unexpected request %v", r)
+	}
+}
+
+func TestForwardedCname(t *testing.T) {
+	remote := &rtpUpTrack{track: &webrtc.TrackRemote{}}
+	up := &rtpUpConnection{userId: "alice"}
+
+	if c := forwardedCname("", remote, up); c != "" {
+		t.Errorf("Expected empty CNAME, got %v", c)
+	}
+	if c := forwardedCname("sender", remote, up); c != "" {
+		t.Errorf("Expected empty CNAME, got %v", c)
+	}
+	if c := forwardedCname("user", remote, up); c != "alice" {
+		t.Errorf("Expected alice, got %v", c)
+	}
+
+	down := &rtpDownTrack{fixedCname: true}
+	down.cname.Store("alice")
+	down.SetCname("sender-cname")
+	if c, _ := down.cname.Load().(string); c != "alice" {
+		t.Errorf("Expected alice, got %v", c)
+	}
+
+	down = &rtpDownTrack{}
+	down.SetCname("sender-cname")
+	if c, _ := down.cname.Load().(string); c != "sender-cname" {
+		t.Errorf("Expected sender-cname, got %v", c)
+	}
+}
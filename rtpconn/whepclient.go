@@ -0,0 +1,315 @@
+package rtpconn
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+)
+
+// A WhepClient is a client that receives a single publisher's stream over
+// a down connection that was negotiated over WHEP, the WebRTC-HTTP Egress
+// Protocol.  Unlike with the websocket protocol, the offer is generated
+// by the receiver, and there is no renegotiation: if the publisher goes
+// away or changes its tracks, the connection is closed.
+type WhepClient struct {
+	group    *group.Group
+	id       string
+	username string
+	token    string
+
+	mu          sync.Mutex
+	permissions group.ClientPermissions
+	connection  *rtpDownConnection
+	closed      bool
+}
+
+func NewWhepClient(g *group.Group, id string, username string, token string) *WhepClient {
+	return &WhepClient{
+		group:    g,
+		id:       id,
+		username: username,
+		token:    token,
+	}
+}
+
+func (c *WhepClient) Group() *group.Group {
+	return c.group
+}
+
+func (c *WhepClient) Id() string {
+	return c.id
+}
+
+func (c *WhepClient) Username() string {
+	return c.username
+}
+
+func (c *WhepClient) Token() string {
+	return c.token
+}
+
+func (c *WhepClient) Challenge(group string, creds group.ClientCredentials) bool {
+	if creds.Password == nil {
+		return true
+	}
+	m, err := creds.Password.Match(c.token)
+	if err != nil {
+		Logger.Warnf("Password match: %v", err)
+		return false
+	}
+	return m
+}
+
+func (c *WhepClient) OverridePermissions(g *group.Group) bool {
+	return false
+}
+
+func (c *WhepClient) SetPermissions(perms group.ClientPermissions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.permissions = perms
+}
+
+func (c *WhepClient) Permissions() group.ClientPermissions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.permissions
+}
+
+func (c *WhepClient) Status() map[string]interface{} {
+	return nil
+}
+
+func (c *WhepClient) PushClient(id, username string, permissions group.ClientPermissions, status map[string]interface{}, kind string) error {
+	return nil
+}
+
+// PushConn closes the down connection if its source goes away, is
+// replaced or loses a track, since WHEP provides no way to renegotiate.
+func (c *WhepClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if g != c.group {
+		return nil
+	}
+
+	c.mu.Lock()
+	down := c.connection
+	c.mu.Unlock()
+	if down == nil {
+		return nil
+	}
+
+	if (up == nil && id == down.id) || replace == down.id {
+		go c.Kick("", "", "")
+		return nil
+	}
+
+	if id == down.id {
+	outer:
+		for _, t := range down.getTracks() {
+			for _, tt := range tracks {
+				if t.remote == tt {
+					continue outer
+				}
+			}
+			go c.Kick("", "", "")
+			break
+		}
+	}
+	return nil
+}
+
+// findUpConn returns an up connection of group g that matches publisher,
+// which is either a connection id, a client id or a username.  If
+// publisher is empty, any up connection is returned.
+func findUpConn(g *group.Group, publisher string) *rtpUpConnection {
+	clients := g.GetClients(nil)
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id() < clients[j].Id()
+	})
+
+	for _, c := range clients {
+		var ups []*rtpUpConnection
+		switch c := c.(type) {
+		case *webClient:
+			ups = getUpConns(c)
+			sort.Slice(ups, func(i, j int) bool {
+				return ups[i].id < ups[j].id
+			})
+		case *WhipClient:
+			c.mu.Lock()
+			if c.connection != nil {
+				ups = append(ups, c.connection)
+			}
+			c.mu.Unlock()
+		}
+		for _, up := range ups {
+			if len(up.getTracks()) == 0 {
+				continue
+			}
+			if publisher == "" || publisher == up.id ||
+				publisher == c.Id() || publisher == c.Username() {
+				return up
+			}
+		}
+	}
+	return nil
+}
+
+var ErrNoPublisher = errors.New("no such publisher")
+
+// NewConnection creates the down connection of a WHEP client from an SDP
+// offer, and returns the answer.  As with WHIP, the answer is only
+// returned once ICE gathering completes.
+func (c *WhepClient) NewConnection(ctx context.Context, publisher string, offer string) (string, error) {
+	if isDraining() {
+		return "", ErrShuttingDown
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return "", errors.New("WHEP client is closed")
+	}
+	if c.connection != nil {
+		c.mu.Unlock()
+		return "", errors.New("WHEP client already has a connection")
+	}
+
+	up := findUpConn(c.group, publisher)
+	if up == nil {
+		c.mu.Unlock()
+		return "", ErrNoPublisher
+	}
+
+	down, err := newDownConn(connectionContext, c, up.id, up)
+	if err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	down.mu.Lock()
+	for _, t := range up.getTracks() {
+		if !maySubscribe(c, up, t) {
+			continue
+		}
+		err = addDownTrackUnlocked(down, t, up)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && len(down.tracks) == 0 {
+		err = group.ErrNotAuthorised
+	}
+	down.mu.Unlock()
+	if err != nil {
+		down.close()
+		c.mu.Unlock()
+		return "", err
+	}
+
+	err = up.AddLocal(down)
+	if err != nil {
+		down.close()
+		c.mu.Unlock()
+		return "", err
+	}
+	c.connection = down
+	c.mu.Unlock()
+
+	spawn(func() { rtcpDownSender(down.ctx, down) })
+
+	down.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed {
+			go c.Kick("", "", "ICE failed")
+		}
+	})
+
+	limits := offer
+	offer = stripTIAS(offer)
+	err = down.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+	down.rtcpOut.setReducedSize(reducedSizeRTCP(offer))
+	down.setBandwidthLimits(limits)
+
+	answer, err := down.pc.CreateAnswer(nil)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	err = mungeSDP(down.group, &answer)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(down.pc)
+
+	err = down.pc.SetLocalDescription(answer)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		c.Close()
+		return "", ctx.Err()
+	}
+
+	add := func() {
+		down.pc.OnConnectionStateChange(nil)
+		for _, t := range down.getTracks() {
+			t.remote.AddLocal(t)
+		}
+	}
+	down.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			add()
+		}
+	})
+	if down.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		add()
+	}
+
+	return down.pc.LocalDescription().SDP, nil
+}
+
+// Close tears down the connection of a WHEP client.  It does not remove
+// the client from its group.
+func (c *WhepClient) Close() error {
+	c.mu.Lock()
+	down := c.connection
+	c.connection = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	if down == nil {
+		return nil
+	}
+
+	down.remote.DelLocal(down)
+	for _, t := range down.getTracks() {
+		t.remote.DelLocal(t)
+	}
+	return down.close()
+}
+
+func (c *WhepClient) Kick(id, user, message string) error {
+	err := c.Close()
+	group.DelClient(c)
+	return err
+}
@@ -0,0 +1,251 @@
+package rtpconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+)
+
+// A WhipClient is a client that publishes a single up connection that
+// was negotiated over WHIP, the WebRTC-HTTP Ingestion Protocol.  It does
+// not receive any media.
+type WhipClient struct {
+	group    *group.Group
+	id       string
+	username string
+	token    string
+
+	mu          sync.Mutex
+	permissions group.ClientPermissions
+	connection  *rtpUpConnection
+	closed      bool
+}
+
+// NewWhipClient creates a WHIP client.  The token is the bearer token
+// that was provided by the publisher; it is checked against the group's
+// passwords, and must be presented again in order to delete the resource.
+func NewWhipClient(g *group.Group, id string, username string, token string) *WhipClient {
+	return &WhipClient{
+		group:    g,
+		id:       id,
+		username: username,
+		token:    token,
+	}
+}
+
+func (c *WhipClient) Group() *group.Group {
+	return c.group
+}
+
+func (c *WhipClient) Id() string {
+	return c.id
+}
+
+func (c *WhipClient) Username() string {
+	return c.username
+}
+
+func (c *WhipClient) Token() string {
+	return c.token
+}
+
+func (c *WhipClient) Challenge(group string, creds group.ClientCredentials) bool {
+	if creds.Password == nil {
+		return true
+	}
+	m, err := creds.Password.Match(c.token)
+	if err != nil {
+		Logger.Warnf("Password match: %v", err)
+		return false
+	}
+	return m
+}
+
+func (c *WhipClient) OverridePermissions(g *group.Group) bool {
+	return false
+}
+
+func (c *WhipClient) SetPermissions(perms group.ClientPermissions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.permissions = perms
+}
+
+func (c *WhipClient) Permissions() group.ClientPermissions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.permissions
+}
+
+func (c *WhipClient) Status() map[string]interface{} {
+	return nil
+}
+
+func (c *WhipClient) PushClient(id, username string, permissions group.ClientPermissions, status map[string]interface{}, kind string) error {
+	return nil
+}
+
+func (c *WhipClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	return nil
+}
+
+func (c *WhipClient) upConns() []conn.Up {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connection == nil {
+		return nil
+	}
+	return []conn.Up{c.connection}
+}
+
+// pushConns pushes the up connection of c, if any, to client cc.
+func (c *WhipClient) pushConns(g *group.Group, cc group.Client) {
+	if g != c.group {
+		return
+	}
+	c.mu.Lock()
+	up := c.connection
+	c.mu.Unlock()
+	if up == nil {
+		return
+	}
+
+	tracks := up.getTracks()
+	ts := make([]conn.UpTrack, len(tracks))
+	for i, t := range tracks {
+		ts[i] = t
+	}
+	err := cc.PushConn(g, up.id, up, ts, "")
+	if err != nil {
+		Logger.Warnf("PushConn: %v", err)
+	}
+}
+
+var ErrWhipDuplicate = errors.New("WHIP client already has a connection")
+
+// NewConnection creates the up connection of a WHIP client from an SDP
+// offer, and returns the answer.  Since WHIP publishers don't necessarily
+// support trickle ICE, it waits until ICE gathering completes, so that
+// the answer includes all of our candidates.
+func (c *WhipClient) NewConnection(ctx context.Context, offer string) (string, error) {
+	if isDraining() {
+		return "", ErrShuttingDown
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return "", errors.New("WHIP client is closed")
+	}
+	if c.connection != nil {
+		c.mu.Unlock()
+		return "", ErrWhipDuplicate
+	}
+	if !c.permissions.Present {
+		c.mu.Unlock()
+		return "", group.UserError("not authorised")
+	}
+
+	up, err := newUpConn(connectionContext, c, c.id, "camera", offer)
+	if err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+	up.userId = c.id
+	up.username = c.username
+	c.connection = up
+	c.mu.Unlock()
+
+	up.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed {
+			go c.Kick("", "", "ICE failed")
+		}
+	})
+
+	err = up.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+	up.rtcpOut.setReducedSize(reducedSizeRTCP(offer))
+	up.setXREnabled(
+		(up.group != nil && up.group.RTCPXR()) || rtcpXR(offer),
+	)
+
+	answer, err := up.pc.CreateAnswer(nil)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	var maxAudio uint64
+	if up.group != nil {
+		maxAudio = up.group.MaxAudioBitrate()
+	}
+	answer.SDP, err = fixOpusAnswer(answer.SDP, up.stereo, maxAudio)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	err = mungeSDP(up.group, &answer)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(up.pc)
+
+	err = up.pc.SetLocalDescription(answer)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		c.Close()
+		return "", ctx.Err()
+	}
+
+	return up.pc.LocalDescription().SDP, nil
+}
+
+// Close tears down the connection of a WHIP client, and tells the other
+// clients that it is gone.  It does not remove the client from its group.
+func (c *WhipClient) Close() error {
+	c.mu.Lock()
+	up := c.connection
+	c.connection = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	if up == nil {
+		return nil
+	}
+
+	g := c.group
+	for _, cc := range g.GetClients(c) {
+		err := cc.PushConn(g, up.id, nil, nil, "")
+		if err != nil {
+			Logger.Warnf("PushConn: %v", err)
+		}
+	}
+	g.NotifyPublisher(group.PublisherEvent{Client: c.id, Id: up.id})
+	return up.close()
+}
+
+func (c *WhipClient) Kick(id, user, message string) error {
+	err := c.Close()
+	group.DelClient(c)
+	return err
+}
@@ -0,0 +1,173 @@
+package rtpconn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+func whipOffer(t *testing.T) (*webrtc.PeerConnection, string) {
+	pc, err := group.APIFromNames([]string{"opus", "vp8"}).
+		NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	for _, kind := range []webrtc.RTPCodecType{
+		webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo,
+	} {
+		_, err = pc.AddTransceiverFromKind(kind,
+			webrtc.RtpTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionSendonly,
+			},
+		)
+		if err != nil {
+			t.Fatalf("AddTransceiver: %v", err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+	return pc, offer.SDP
+}
+
+func TestWhipClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	group.Directory = dir
+	err = ioutil.WriteFile(filepath.Join(dir, "whip-test.json"),
+		[]byte(`{"presenter": [{"username": "obs", "password": "secret"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	g, err := group.Add("whip-test", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	bad := NewWhipClient(g, "bad", "obs", "wrong")
+	_, err = group.AddClient(g.Name(), bad)
+	if err != group.ErrNotAuthorised {
+		t.Errorf("Expected ErrNotAuthorised, got %v", err)
+	}
+
+	c := NewWhipClient(g, "good", "obs", "secret")
+	_, err = group.AddClient(g.Name(), c)
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	defer c.Kick("", "", "")
+	if !c.Permissions().Present {
+		t.Errorf("Expected present permission")
+	}
+
+	pc, offer := whipOffer(t)
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	answer, err := c.NewConnection(ctx, offer)
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+	if !strings.Contains(answer, "a=candidate:") {
+		t.Errorf("Answer has no candidates")
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		t.Errorf("SetRemoteDescription: %v", err)
+	}
+
+	_, err = c.NewConnection(ctx, offer)
+	if err != ErrWhipDuplicate {
+		t.Errorf("Expected ErrWhipDuplicate, got %v", err)
+	}
+
+	c.Close()
+	_, err = c.NewConnection(ctx, offer)
+	if err == nil {
+		t.Errorf("Expected error after close")
+	}
+}
+
+func TestFindUpConn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	group.Directory = dir
+	err = ioutil.WriteFile(filepath.Join(dir, "whep-test.json"),
+		[]byte(`{"presenter": [{"username": "obs", "password": "secret"}], "other": [{"username": "viewer"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	g, err := group.Add("whep-test", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	c := NewWhipClient(g, "publisher", "obs", "secret")
+	_, err = group.AddClient(g.Name(), c)
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	defer group.DelClient(c)
+
+	if up := findUpConn(g, ""); up != nil {
+		t.Errorf("Expected nil, got %v", up.id)
+	}
+
+	up := &rtpUpConnection{
+		id:     "up",
+		tracks: []*rtpUpTrack{{}},
+	}
+	c.mu.Lock()
+	c.connection = up
+	c.mu.Unlock()
+
+	for _, p := range []string{"", "up", "publisher", "obs"} {
+		if found := findUpConn(g, p); found != up {
+			t.Errorf("Publisher %v: expected %v, got %v",
+				p, up, found)
+		}
+	}
+	if found := findUpConn(g, "unknown"); found != nil {
+		t.Errorf("Expected nil, got %v", found)
+	}
+
+	v := NewWhepClient(g, "viewer", "viewer", "")
+	_, err = group.AddClient(g.Name(), v)
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	defer group.DelClient(v)
+	_, err = v.NewConnection(context.Background(), "unknown", "")
+	if err != ErrNoPublisher {
+		t.Errorf("Expected ErrNoPublisher, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package rtpconn
+
+import (
+	"sync"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+// A WriterPacer decides how long the reader of an up track may wait for
+// a congested writer before giving up on an audio packet.  Waiting
+// longer avoids losses on short bursts, at the cost of delaying all the
+// receivers of the track; video is never delayed, but dropped until the
+// end of the frame.  Every track has its own WriterPacer, which is only
+// called by the track's reader.  This is distinct from the pacer of down
+// connections, which smooths what is sent to each receiver.
+type WriterPacer interface {
+	// Delay is called for every packet forwarded.  Now is the arrival
+	// time of the packet in jiffies, bytes its size, and rate and
+	// packetRate the rates of the track in bytes and packets per
+	// second, or 0 if unknown.  It returns the delay in jiffies.
+	Delay(now uint64, bytes int, rate, packetRate uint32) uint32
+}
+
+// rateWriterPacer is the default strategy: it waits for half the interval
+// between packets, which keeps the reader from falling behind the
+// sender.
+type rateWriterPacer struct{}
+
+func (p rateWriterPacer) Delay(now uint64, bytes int, rate, packetRate uint32) uint32 {
+	if packetRate > 512 {
+		return rtptime.JiffiesPerSec / packetRate / 2
+	}
+	return rtptime.JiffiesPerSec / 1024
+}
+
+// immediateWriterPacer never waits, which gives the lowest latency, but
+// drops packets whenever a writer is congested, however briefly.  This
+// is meant for local networks, where congestion is rare.
+type immediateWriterPacer struct{}
+
+func (p immediateWriterPacer) Delay(now uint64, bytes int, rate, packetRate uint32) uint32 {
+	return 0
+}
+
+const (
+	// the longest wait allowed by the leaky bucket
+	leakyBucketMaxWait = 20 * rtptime.JiffiesPerSec / 1000
+)
+
+// leakyBucketWriterPacer waits for as long as it takes to send the data
+// received recently at the rate of the track.  It tolerates larger
+// bursts than rateWriterPacer, such as the ones caused by jitter on
+// the sender's uplink, at the cost of more latency during the bursts.
+type leakyBucketWriterPacer struct {
+	// the amount of data in the bucket, in bytes, and the time at
+	// which it was last updated
+	level uint64
+	time  uint64
+}
+
+func (p *leakyBucketWriterPacer) Delay(now uint64, bytes int, rate, packetRate uint32) uint32 {
+	if rate == 0 {
+		p.level = 0
+		p.time = now
+		return rtptime.JiffiesPerSec / 1024
+	}
+	if now > p.time {
+		drained := (now - p.time) * uint64(rate) / rtptime.JiffiesPerSec
+		if drained >= p.level {
+			p.level = 0
+		} else {
+			p.level -= drained
+		}
+	}
+	p.time = now
+	p.level += uint64(bytes)
+
+	delay := p.level * rtptime.JiffiesPerSec / uint64(rate)
+	if delay > leakyBucketMaxWait {
+		// the bucket is full, don't let it grow any further
+		p.level = leakyBucketMaxWait * uint64(rate) /
+			rtptime.JiffiesPerSec
+		delay = leakyBucketMaxWait
+	}
+	return uint32(delay)
+}
+
+var writerPacers struct {
+	mu      sync.Mutex
+	pacers  map[string]func() WriterPacer
+	unknown map[string]bool
+}
+
+func init() {
+	RegisterWriterPacer("rate", func() WriterPacer {
+		return rateWriterPacer{}
+	})
+	RegisterWriterPacer("immediate", func() WriterPacer {
+		return immediateWriterPacer{}
+	})
+	RegisterWriterPacer("leaky-bucket", func() WriterPacer {
+		return &leakyBucketWriterPacer{}
+	})
+}
+
+// RegisterWriterPacer makes a pacing strategy available to the groups
+// whose writer-pacing field is name.  F is called once for every track.
+// It replaces any strategy previously registered under the same name.
+func RegisterWriterPacer(name string, f func() WriterPacer) {
+	writerPacers.mu.Lock()
+	defer writerPacers.mu.Unlock()
+	if writerPacers.pacers == nil {
+		writerPacers.pacers = make(map[string]func() WriterPacer)
+	}
+	writerPacers.pacers[name] = f
+}
+
+// writerPacingName returns the name of the pacing strategy used in group g.
+func writerPacingName(g *group.Group) string {
+	if g == nil {
+		return ""
+	}
+	return g.WriterPacing()
+}
+
+// newWriterPacer returns a new pacer for the strategy called name.  If no
+// strategy is registered under this name, it logs a warning, once, and
+// falls back to the default.
+func newWriterPacer(name string) WriterPacer {
+	if name == "" {
+		return rateWriterPacer{}
+	}
+	writerPacers.mu.Lock()
+	f, ok := writerPacers.pacers[name]
+	if !ok {
+		warn := !writerPacers.unknown[name]
+		if writerPacers.unknown == nil {
+			writerPacers.unknown = make(map[string]bool)
+		}
+		writerPacers.unknown[name] = true
+		writerPacers.mu.Unlock()
+		if warn {
+			Logger.Warnf("Unknown pacing strategy %v, "+
+				"using the default", name)
+		}
+		return rateWriterPacer{}
+	}
+	writerPacers.mu.Unlock()
+	return f()
+}
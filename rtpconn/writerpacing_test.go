@@ -0,0 +1,73 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestRateWriterPacer(t *testing.T) {
+	p := newWriterPacer("")
+	d := p.Delay(0, 1000, 100000, 100)
+	if d != rtptime.JiffiesPerSec/1024 {
+		t.Errorf("Expected %v, got %v", rtptime.JiffiesPerSec/1024, d)
+	}
+	d = p.Delay(0, 1000, 1000000, 1000)
+	if d != rtptime.JiffiesPerSec/2000 {
+		t.Errorf("Expected %v, got %v", rtptime.JiffiesPerSec/2000, d)
+	}
+}
+
+func TestImmediateWriterPacer(t *testing.T) {
+	p := newWriterPacer("immediate")
+	d := p.Delay(0, 1000, 100000, 100)
+	if d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+}
+
+func TestLeakyBucketWriterPacer(t *testing.T) {
+	p := newWriterPacer("leaky-bucket")
+	now := rtptime.Jiffies()
+	// 1000 bytes at 100kB/s take 10ms to drain
+	d := p.Delay(now, 1000, 100000, 100)
+	if d != 10*rtptime.JiffiesPerSec/1000 {
+		t.Errorf("Expected %v, got %v",
+			10*rtptime.JiffiesPerSec/1000, d)
+	}
+
+	// a burst is capped
+	for i := 0; i < 10; i++ {
+		d = p.Delay(now, 1000, 100000, 100)
+	}
+	if d != leakyBucketMaxWait {
+		t.Errorf("Expected %v, got %v", leakyBucketMaxWait, d)
+	}
+
+	// and drains over time
+	d = p.Delay(now+rtptime.JiffiesPerSec, 1000, 100000, 100)
+	if d != 10*rtptime.JiffiesPerSec/1000 {
+		t.Errorf("Expected %v, got %v",
+			10*rtptime.JiffiesPerSec/1000, d)
+	}
+}
+
+func TestRegisterWriterPacer(t *testing.T) {
+	RegisterWriterPacer("test", func() WriterPacer {
+		return immediateWriterPacer{}
+	})
+	defer func() {
+		writerPacers.mu.Lock()
+		delete(writerPacers.pacers, "test")
+		writerPacers.mu.Unlock()
+	}()
+
+	_, ok := newWriterPacer("test").(immediateWriterPacer)
+	if !ok {
+		t.Errorf("Registered pacer not used")
+	}
+	_, ok = newWriterPacer("no-such-pacer").(rateWriterPacer)
+	if !ok {
+		t.Errorf("Unknown pacer didn't fall back to the default")
+	}
+}
@@ -26,6 +26,14 @@ let group;
 /** @type {ServerConnection} */
 let serverConnection;
 
+/**
+ * The number of times we still try to connect after the server asked us
+ * to reconnect.
+ *
+ * @type {number}
+ */
+let reconnectAttempts = 0;
+
 /**
  * @typedef {Object} userpass
  * @property {string} username
@@ -308,6 +316,7 @@ function setConnected(connected) {
 
 /** @this {ServerConnection} */
 function gotConnected() {
+    reconnectAttempts = 0;
     setConnected(true);
     let up = getUserPass();
     this.join(group, up.username, up.password);
@@ -323,6 +332,11 @@ function gotClose(code, reason) {
     if(code != 1000) {
         console.warn('Socket close', code, reason);
     }
+    if(reconnectAttempts > 0) {
+        // the server is restarting, give it some time
+        reconnectAttempts--;
+        setTimeout(serverConnect, 2000);
+    }
 }
 
 /**
@@ -835,6 +849,41 @@ async function setMaxVideoThroughput(c, bps) {
     }
 }
 
+/**
+ * limitVideoResolution scales down the video sent on c so that it fits
+ * within the given dimensions.  A dimension of 0 means no limit.
+ *
+ * @param {Stream} c
+ * @param {number} width
+ * @param {number} height
+ */
+async function limitVideoResolution(c, width, height) {
+    let senders = c.pc.getSenders();
+    for(let i = 0; i < senders.length; i++) {
+        let s = senders[i];
+        if(!s.track || s.track.kind !== 'video')
+            continue;
+        let settings = s.track.getSettings();
+        let scale = 1;
+        if(width > 0 && settings.width > width)
+            scale = Math.max(scale, settings.width / width);
+        if(height > 0 && settings.height > height)
+            scale = Math.max(scale, settings.height / height);
+        let p = s.getParameters();
+        if(!p.encodings)
+            p.encodings = [{}];
+        p.encodings.forEach(e => {
+            e.scaleResolutionDownBy =
+                Math.max(e.scaleResolutionDownBy || 1, scale);
+        });
+        try {
+            await s.setParameters(p);
+        } catch(e) {
+            console.error(e);
+        }
+    }
+}
+
 /**
  * @typedef {Object} filterDefinition
  * @property {string} [description]
@@ -1775,6 +1824,30 @@ function delUser(id) {
     div.removeChild(user);
 }
 
+/**
+ * The level in dBov above which a user is marked as audible.
+ */
+const audibleLevel = -50;
+
+/**
+ * gotAudioLevels marks the users who are currently making noise.
+ *
+ * @param {Array<{id: string, source: string, level: number}>} levels
+ */
+function gotAudioLevels(levels) {
+    let audible = {};
+    for(let i = 0; i < levels.length; i++) {
+        let l = levels[i];
+        if(l.level !== null && l.level > audibleLevel)
+            audible[l.source] = true;
+    }
+    let us = document.getElementById('users').children;
+    for(let i = 0; i < us.length; i++) {
+        let id = us[i].id.slice('user-'.length);
+        us[i].classList.toggle('user-audible', !!audible[id]);
+    }
+}
+
 /**
  * @param {string} id
  * @param {string} kind
@@ -1910,6 +1983,40 @@ function gotUserMessage(id, dest, username, time, privileged, kind, message) {
             console.error(`Got unprivileged message of kind ${kind}`);
         }
         break;
+    case 'mutetrack':
+    case 'unmutetrack':
+        if(privileged) {
+            let by = username ? ' by ' + username : '';
+            let what = kind === 'mutetrack' ? 'muted' : 'unmuted';
+            displayWarning(`Your ${message} has been ${what}${by}`);
+        } else {
+            console.error(`Got unprivileged message of kind ${kind}`);
+        }
+        break;
+    case 'reconnect':
+        if(privileged) {
+            displayWarning(message);
+            reconnectAttempts = 10;
+        } else
+            console.error(`Got unprivileged message of kind ${kind}`);
+        break;
+    case 'maxresolution':
+        if(privileged) {
+            let c = serverConnection.up[message.id];
+            if(c)
+                limitVideoResolution(c, message.width, message.height);
+            displayWarning('Your video resolution is too high ' +
+                           'for this group, reducing it');
+        } else {
+            console.error(`Got unprivileged message of kind ${kind}`);
+        }
+        break;
+    case 'audiolevels':
+        if(privileged)
+            gotAudioLevels(message);
+        else
+            console.error(`Got unprivileged message of kind ${kind}`);
+        break;
     case 'clearchat':
         if(privileged) {
             clearChat();
@@ -2240,6 +2347,36 @@ commands.unrecord = {
     }
 };
 
+commands.play = {
+    predicate: operatorPredicate,
+    description: 'play a file from the recordings directory',
+    parameters: 'file',
+    f: (c, r) => {
+        if(!r)
+            throw new Error('no file given');
+        serverConnection.groupAction('play', r.trim());
+    }
+};
+
+commands.loop = {
+    predicate: operatorPredicate,
+    description: 'play a file from the recordings directory in a loop',
+    parameters: 'file',
+    f: (c, r) => {
+        if(!r)
+            throw new Error('no file given');
+        serverConnection.groupAction('loop', r.trim());
+    }
+};
+
+commands.unplay = {
+    predicate: operatorPredicate,
+    description: 'stop playing a file, revert the effect of /play or /loop',
+    f: (c, r) => {
+        serverConnection.groupAction('unplay');
+    }
+};
+
 commands.subgroups = {
     predicate: operatorPredicate,
     description: 'list subgroups',
@@ -2258,6 +2395,14 @@ commands.renegotiate = {
     }
 };
 
+commands.keyframe = {
+    description: 'request fresh video from all senders',
+    f: (c, r) => {
+        for(let id in serverConnection.down)
+            serverConnection.down[id].requestKeyframe();
+    }
+};
+
 /**
  * parseCommand splits a string into two space-separated parts.  The first
  * part may be quoted and may include backslash escapes.
@@ -2389,6 +2534,20 @@ commands.mute = {
     f: userMessage,
 };
 
+commands.mutetrack = {
+    parameters: 'user [audio|video]',
+    description: 'stop forwarding a user\'s audio or video',
+    predicate: operatorPredicate,
+    f: userCommand,
+};
+
+commands.unmutetrack = {
+    parameters: 'user [audio|video]',
+    description: 'resume forwarding a user\'s audio or video',
+    predicate: operatorPredicate,
+    f: userCommand,
+};
+
 commands.muteall = {
     description: 'mute all remote users',
     predicate: operatorPredicate,
@@ -193,6 +193,14 @@ function ServerConnection() {
      * @type {(this: ServerConnection, id: string, dest: string, username: string, time: number, privileged: boolean, kind: string, message: unknown) => void}
      */
     this.onusermessage = null;
+    /**
+     * onbandwidthtest is called when a bandwidth test completes.  Rate
+     * is the measured capacity in bits per second, or null if the test
+     * failed.
+     *
+     * @type {(this: ServerConnection, rate: number) => void}
+     */
+    this.onbandwidthtest = null;
 }
 
 /**
@@ -315,6 +323,9 @@ ServerConnection.prototype.connect = async function(url) {
             case 'ice':
                 sc.gotRemoteIce(m.id, m.candidate);
                 break;
+            case 'quality':
+                sc.gotQuality(m.id, m.value);
+                break;
             case 'joined':
                 if(sc.group) {
                     if(m.group !== sc.group) {
@@ -396,6 +407,12 @@ ServerConnection.prototype.connect = async function(url) {
                     type: 'pong',
                 });
                 break;
+            case 'bandwidth-test':
+                if(sc.onbandwidthtest)
+                    sc.onbandwidthtest.call(
+                        sc, typeof m.value === 'number' ? m.value : null,
+                    );
+                break;
             case 'pong':
                 /* nothing */
                 break;
@@ -445,12 +462,18 @@ ServerConnection.prototype.leave = function(group) {
  * @param {Object<string,Array<string>>} what
  *     - A dictionary that maps labels to a sequence of 'audio' and 'video'.
  *       An entry with an empty label '' provides the default.
+ *       If source is set, null reverts to the global request.
+ * @param {string} [source]
+ *     - If set, the request only applies to the streams of this peer.
  */
-ServerConnection.prototype.request = function(what) {
-    this.send({
+ServerConnection.prototype.request = function(what, source) {
+    let m = {
         type: 'request',
         request: what,
-    });
+    };
+    if(source)
+        m.source = source;
+    this.send(m);
 };
 
 /**
@@ -550,7 +573,8 @@ ServerConnection.prototype.chat = function(kind, dest, value) {
 /**
  * userAction sends a request to act on a user.
  *
- * @param {string} kind - One of "op", "unop", "kick", "present", "unpresent".
+ * @param {string} kind - One of "op", "unop", "kick", "present", "unpresent",
+ *                        "mutetrack", "unmutetrack".
  * @param {string} dest - The id of the user to act upon.
  * @param {any} [value] - An action-dependent parameter.
  */
@@ -590,8 +614,10 @@ ServerConnection.prototype.userMessage = function(kind, dest, value, noecho) {
  * groupAction sends a request to act on the current group.
  *
  * @param {string} kind
- *     - One of 'clearchat', 'lock', 'unlock', 'record' or 'unrecord'.
- * @param {string} [message] - An optional user-readable message.
+ *     - One of 'clearchat', 'lock', 'unlock', 'record', 'unrecord',
+ *       'play', 'loop' or 'unplay'.
+ * @param {string} [message]
+ *     - An optional user-readable message, or the name of the file to play.
  */
 ServerConnection.prototype.groupAction = function(kind, message) {
     this.send({
@@ -603,6 +629,16 @@ ServerConnection.prototype.groupAction = function(kind, message) {
     });
 };
 
+/**
+ * bandwidthTest asks the server to measure the capacity of the path
+ * towards us.  The result is passed to onbandwidthtest.
+ */
+ServerConnection.prototype.bandwidthTest = function() {
+    this.send({
+        type: 'bandwidth-test',
+    });
+};
+
 /**
  * Called when we receive an offer from the server.  Don't call this.
  *
@@ -688,7 +724,8 @@ ServerConnection.prototype.gotOffer = async function(id, label, source, username
     c.source = source;
     c.username = username;
 
-    if(sc.ondownstream)
+    // the bandwidth test stream carries no media
+    if(sc.ondownstream && label !== 'bandwidth-test')
         sc.ondownstream.call(sc, c);
 
     try {
@@ -792,6 +829,25 @@ ServerConnection.prototype.gotAbort = function(id) {
     c.close();
 };
 
+/**
+ * Called when we receive a network quality indication from the server.
+ * Don't call this.
+ *
+ * @param {string} id
+ * @param {string} quality
+ */
+ServerConnection.prototype.gotQuality = function(id, quality) {
+    let c = this.down[id];
+    if(!c) {
+        // the stream may have been closed while the message was in flight
+        console.warn('Quality of unknown stream');
+        return;
+    }
+    c.quality = quality;
+    if(c.onquality)
+        c.onquality.call(c, quality);
+};
+
 /**
  * Called when we receive an ICE candidate from the server.  Don't call this.
  *
@@ -926,6 +982,14 @@ function Stream(sc, id, localId, pc, up) {
      * @type {number}
      */
     this.statsHandler = null;
+    /**
+     * The network quality last indicated by the server, one of 'good',
+     * 'medium' or 'poor', or null if unknown.  Only meaningful for
+     * down streams.
+     *
+     * @type {string}
+     */
+    this.quality = null;
     /**
      * userdata is a convenient place to attach data to a Stream.
      * It is not used by the library.
@@ -977,6 +1041,13 @@ function Stream(sc, id, localId, pc, up) {
      * @type{(this: Stream, stats: Object<unknown,unknown>) => void}
      */
     this.onstats = null;
+    /**
+     * onquality is called when the server indicates that the quality of
+     * the network changed.
+     *
+     * @type{(this: Stream, quality: string) => void}
+     */
+    this.onquality = null;
 }
 
 /**
@@ -1081,6 +1152,54 @@ Stream.prototype.abort = function() {
     });
 };
 
+/**
+ * pause requests that the server temporarily stop sending media on
+ * a down stream, without renegotiating.
+ *
+ * @param {string} [kind] - 'audio' or 'video', or all tracks if omitted.
+ */
+Stream.prototype.pause = function(kind) {
+    let c = this;
+    if(c.up)
+        throw new Error("Pause called on an up stream");
+    c.sc.send({
+        type: 'pause',
+        id: c.id,
+        kind: kind || '',
+    });
+};
+
+/**
+ * resume undoes the effect of pause.
+ *
+ * @param {string} [kind] - 'audio' or 'video', or all tracks if omitted.
+ */
+Stream.prototype.resume = function(kind) {
+    let c = this;
+    if(c.up)
+        throw new Error("Resume called on an up stream");
+    c.sc.send({
+        type: 'resume',
+        id: c.id,
+        kind: kind || '',
+    });
+};
+
+/**
+ * requestKeyframe asks the server for a fresh keyframe on the video
+ * tracks of a down stream, for example when the decoder has got into
+ * a bad state.  The request is subject to rate limiting.
+ */
+Stream.prototype.requestKeyframe = function() {
+    let c = this;
+    if(c.up)
+        throw new Error("requestKeyframe called on an up stream");
+    c.sc.send({
+        type: 'keyframe',
+        id: c.id,
+    });
+};
+
 /**
  * Called when we get a local ICE candidate.  Don't call this.
  *
@@ -8,8 +8,9 @@ import (
 )
 
 type GroupStats struct {
-	Name    string
-	Clients []*Client
+	Name          string
+	RejectedJoins uint64
+	Clients       []*Client
 }
 
 type Client struct {
@@ -25,6 +26,20 @@ type Conn struct {
 	Id         string
 	MaxBitrate uint64
 	Tracks     []Track
+	// the ICE candidate pair in use, nil if not known yet
+	CandidatePair *CandidatePair `json:",omitempty"`
+}
+
+// CandidatePair describes the pair of ICE candidates selected for a
+// connection.  A type of "relay" on either side means that media goes
+// through a TURN server.  The addresses are omitted if the server is
+// configured not to reveal them.
+type CandidatePair struct {
+	Protocol      string
+	LocalType     string
+	LocalAddress  string `json:",omitempty"`
+	RemoteType    string
+	RemoteAddress string `json:",omitempty"`
 }
 
 type Track struct {
@@ -33,6 +48,32 @@ type Track struct {
 	Loss       uint8
 	Rtt        time.Duration
 	Jitter     time.Duration
+	// the longest burst of consecutive losses reported in an RTCP
+	// extended report, 0 if unknown
+	LossBurst uint32 `json:",omitempty"`
+	// the last loss rates reported by the receiver, in percent,
+	// oldest first
+	LossHistory []int `json:",omitempty"`
+	// true if media sent on this track doesn't reach the receiver
+	OneWay bool `json:",omitempty"`
+	// the level of an audio track in dBov, nil if unknown
+	AudioLevel *int `json:",omitempty"`
+	// the RTCP feedback mechanisms negotiated for this track
+	Feedback []string `json:",omitempty"`
+	// the number of packets received on an up track or forwarded on
+	// a down track
+	Packets uint64 `json:",omitempty"`
+	// the number of packets resent in reply to a NACK
+	Recovered uint64 `json:",omitempty"`
+	// the time at which the last packet was received or forwarded,
+	// nil if none
+	LastPacket *time.Time `json:",omitempty"`
+	// the rate at which the timestamps of an up track advance, if it
+	// differs from the declared clock rate
+	ClockRate uint32 `json:",omitempty"`
+	// true if the sender of an up track doesn't send sender reports,
+	// and the timing of the track is estimated from arrival times
+	EstimatedTiming bool `json:",omitempty"`
 }
 
 func GetGroups() []GroupStats {
@@ -44,26 +85,7 @@ func GetGroups() []GroupStats {
 		if g == nil {
 			continue
 		}
-		clients := g.GetClients(nil)
-		stats := GroupStats{
-			Name:    name,
-			Clients: make([]*Client, 0, len(clients)),
-		}
-		for _, c := range clients {
-			s, ok := c.(Statable)
-			if ok {
-				cs := s.GetStats()
-				stats.Clients = append(stats.Clients, cs)
-			} else {
-				stats.Clients = append(stats.Clients,
-					&Client{Id: c.Id()},
-				)
-			}
-		}
-		sort.Slice(stats.Clients, func(i, j int) bool {
-			return stats.Clients[i].Id < stats.Clients[j].Id
-		})
-		gs = append(gs, stats)
+		gs = append(gs, getGroupStats(g))
 	}
 	sort.Slice(gs, func(i, j int) bool {
 		return gs[i].Name < gs[j].Name
@@ -71,3 +93,38 @@ func GetGroups() []GroupStats {
 
 	return gs
 }
+
+// GetGroup returns the statistics of a single group, or nil if the group
+// does not exist.
+func GetGroup(name string) *GroupStats {
+	g := group.Get(name)
+	if g == nil {
+		return nil
+	}
+	stats := getGroupStats(g)
+	return &stats
+}
+
+func getGroupStats(g *group.Group) GroupStats {
+	clients := g.GetClients(nil)
+	stats := GroupStats{
+		Name:          g.Name(),
+		RejectedJoins: g.RejectedJoins(),
+		Clients:       make([]*Client, 0, len(clients)),
+	}
+	for _, c := range clients {
+		s, ok := c.(Statable)
+		if ok {
+			cs := s.GetStats()
+			stats.Clients = append(stats.Clients, cs)
+		} else {
+			stats.Clients = append(stats.Clients,
+				&Client{Id: c.Id()},
+			)
+		}
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		return stats.Clients[i].Id < stats.Clients[j].Id
+	})
+	return stats
+}
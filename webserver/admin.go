@@ -0,0 +1,351 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/stats"
+)
+
+// The administrative API is a JSON interface under /galene-api/, which
+// is only available to the server administrator.
+//
+//	GET    /galene-api/groups                       list of groups
+//	GET    /galene-api/groups/name                  statistics of a group
+//	DELETE /galene-api/groups/name/clients/id       kick a client
+//	POST   /galene-api/groups/name/clients/id/mute  mute a client's tracks
+//	GET    /galene-api/groups/name/clients/id/debug internal state of a client
+//	POST   /galene-api/groups/name/recording        start recording
+//	DELETE /galene-api/groups/name/recording        stop recording
+//	POST   /galene-api/groups/name/recording/pause  pause recording
+//	POST   /galene-api/groups/name/recording/resume resume recording
+
+const (
+	// the sustained rate of requests allowed per client address
+	adminRate = 5
+	// the number of requests that may be made in a burst
+	adminBurst = 20
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A rateLimiter limits the rate of requests from each address using
+// a token bucket.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) allow(addr string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[addr]
+	if b == nil {
+		if len(l.buckets) > 10000 {
+			l.expire(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[addr] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// expire forgets about the buckets that are full.  Called locked.
+func (l *rateLimiter) expire(now time.Time) {
+	for addr, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, addr)
+		}
+	}
+}
+
+var adminLimiter = newRateLimiter(adminRate, adminBurst)
+
+// checkAdmin returns true if the request carries the credentials of the
+// server administrator.
+func checkAdmin(r *http.Request, dataDir string) bool {
+	u, p, err := getPassword(dataDir)
+	if err != nil {
+		log.Printf("Passwd: %v", err)
+		return false
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(username), []byte(u)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(p)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+	e := json.NewEncoder(w)
+	err := e.Encode(v)
+	if err != nil {
+		log.Printf("Encode: %v", err)
+	}
+}
+
+type adminGroup struct {
+	Name    string `json:"name"`
+	Clients int    `json:"clients"`
+	Locked  bool   `json:"locked,omitempty"`
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !adminLimiter.allow(host, time.Now()) {
+		w.Header().Set("retry-after", "1")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if !checkAdmin(r, dataDir) {
+		failAuthentication(w, "galene-api")
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/galene-api/")
+	if p == r.URL.Path {
+		notFound(w)
+		return
+	}
+	elts := strings.Split(strings.TrimSuffix(p, "/"), "/")
+
+	if elts[0] != "groups" {
+		notFound(w)
+		return
+	}
+
+	if len(elts) == 1 {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		names := group.GetNames()
+		groups := make([]adminGroup, 0, len(names))
+		for _, name := range names {
+			g := group.Get(name)
+			if g == nil {
+				continue
+			}
+			locked, _ := g.Locked()
+			groups = append(groups, adminGroup{
+				Name:    name,
+				Clients: len(g.GetClients(nil)),
+				Locked:  locked,
+			})
+		}
+		writeJSON(w, r, groups)
+		return
+	}
+
+	// group names may contain slashes, and even components that look
+	// like actions: use the longest prefix that names a group.
+	var name string
+	var g *group.Group
+	i := len(elts)
+	for ; i > 1; i-- {
+		name = strings.Join(elts[1:i], "/")
+		g = group.Get(name)
+		if g != nil {
+			break
+		}
+	}
+	if g == nil {
+		notFound(w)
+		return
+	}
+	rest := elts[i:]
+
+	switch {
+	case len(rest) == 0:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		s := stats.GetGroup(name)
+		if s == nil {
+			notFound(w)
+			return
+		}
+		writeJSON(w, r, s)
+	case len(rest) == 1 && rest[0] == "recording":
+		adminRecording(w, r, g)
+	case len(rest) == 2 && rest[0] == "recording":
+		adminPauseRecording(w, r, g, rest[1])
+	case len(rest) == 2 && rest[0] == "clients":
+		adminClient(w, r, g, rest[1], "")
+	case len(rest) == 3 && rest[0] == "clients":
+		adminClient(w, r, g, rest[1], rest[2])
+	default:
+		notFound(w)
+	}
+}
+
+func adminRecording(w http.ResponseWriter, r *http.Request, g *group.Group) {
+	switch r.Method {
+	case "POST":
+		err := rtpconn.StartRecording(g)
+		if err != nil {
+			if _, ok := err.(group.UserError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if !rtpconn.StopRecording(g) {
+			notFound(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminPauseRecording(w http.ResponseWriter, r *http.Request, g *group.Group, action string) {
+	if action != "pause" && action != "resume" {
+		notFound(w)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var found bool
+	var err error
+	if action == "pause" {
+		split := r.URL.Query().Get("split") == "true"
+		found, err = rtpconn.PauseRecording(g, split)
+	} else {
+		found, err = rtpconn.ResumeRecording(g)
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if !found {
+		notFound(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminMute struct {
+	Kind  string `json:"kind"`
+	Muted *bool  `json:"muted"`
+}
+
+func adminClient(w http.ResponseWriter, r *http.Request, g *group.Group, id string, action string) {
+	c := g.GetClient(id)
+	if c == nil {
+		notFound(w)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		err := c.Kick("", "", r.URL.Query().Get("message"))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "mute":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		var m adminMute
+		d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		err := d.Decode(&m)
+		if err != nil {
+			http.Error(w, "couldn't parse request",
+				http.StatusBadRequest)
+			return
+		}
+		muted := true
+		if m.Muted != nil {
+			muted = *m.Muted
+		}
+		err = rtpconn.MuteClient(g, id, m.Kind, muted)
+		if err != nil {
+			if _, ok := err.(group.UserError); ok {
+				http.Error(w, err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "debug":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		d, ok := rtpconn.DebugSnapshot(c)
+		if !ok {
+			notFound(w)
+			return
+		}
+		writeJSON(w, r, d)
+	default:
+		notFound(w)
+	}
+}
@@ -0,0 +1,167 @@
+package webserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/stats"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now) {
+			t.Errorf("Request %v was limited", i)
+		}
+	}
+	if l.allow("a", now) {
+		t.Errorf("Burst was not limited")
+	}
+	if !l.allow("b", now) {
+		t.Errorf("Other address was limited")
+	}
+	if !l.allow("a", now.Add(time.Second/2)) {
+		t.Errorf("Request was limited after refill")
+	}
+	if l.allow("a", now.Add(time.Second/2)) {
+		t.Errorf("Request was not limited")
+	}
+
+	l.expire(now.Add(time.Hour))
+	if len(l.buckets) != 0 {
+		t.Errorf("Expected no buckets, got %v", len(l.buckets))
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "passwd"),
+		[]byte("admin:secret\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err = group.Add("admin-test", &group.Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	adminLimiter = newRateLimiter(1000, 1000)
+
+	request := func(method, path, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if password != "" {
+			r.SetBasicAuth("admin", password)
+		}
+		w := httptest.NewRecorder()
+		adminHandler(w, r, dir)
+		return w
+	}
+
+	if w := request("GET", "/galene-api/groups", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %v", w.Code)
+	}
+	if w := request("GET", "/galene-api/groups", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %v", w.Code)
+	}
+
+	w := request("GET", "/galene-api/groups", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v", w.Code)
+	}
+	var groups []adminGroup
+	err = json.Unmarshal(w.Body.Bytes(), &groups)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	found := false
+	for _, g := range groups {
+		if g.Name == "admin-test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Group not found in %v", groups)
+	}
+
+	w = request("GET", "/galene-api/groups/admin-test", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v", w.Code)
+	}
+	var gs stats.GroupStats
+	err = json.Unmarshal(w.Body.Bytes(), &gs)
+	if err != nil || gs.Name != "admin-test" {
+		t.Errorf("Expected admin-test, got %v %v", gs.Name, err)
+	}
+
+	// a nested group whose name looks like an action
+	_, err = group.Add("x/recording", &group.Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	w = request("GET", "/galene-api/groups/x/recording", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v", w.Code)
+	}
+	gs = stats.GroupStats{}
+	err = json.Unmarshal(w.Body.Bytes(), &gs)
+	if err != nil || gs.Name != "x/recording" {
+		t.Errorf("Expected x/recording, got %v %v", gs.Name, err)
+	}
+
+	a := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/galene-api/groups/nonexistent", http.StatusNotFound},
+		{"GET", "/galene-api/other", http.StatusNotFound},
+		{"POST", "/galene-api/groups", http.StatusMethodNotAllowed},
+		{"DELETE", "/galene-api/groups/admin-test/clients/foo",
+			http.StatusNotFound},
+		{"DELETE", "/galene-api/groups/admin-test/recording",
+			http.StatusNotFound},
+		{"PUT", "/galene-api/groups/admin-test/recording",
+			http.StatusMethodNotAllowed},
+		{"POST", "/galene-api/groups/admin-test/recording/pause",
+			http.StatusNotFound},
+		{"GET", "/galene-api/groups/admin-test/recording/resume",
+			http.StatusMethodNotAllowed},
+		{"POST", "/galene-api/groups/admin-test/recording/foo",
+			http.StatusNotFound},
+		{"DELETE", "/galene-api/groups/x/recording/recording",
+			http.StatusNotFound},
+		{"PUT", "/galene-api/groups/x/recording/recording",
+			http.StatusMethodNotAllowed},
+		{"DELETE", "/galene-api/groups/x/recording/clients/foo",
+			http.StatusNotFound},
+		{"GET", "/galene-api/groups/x", http.StatusNotFound},
+	}
+	for _, s := range a {
+		w := request(s.method, s.path, "secret")
+		if w.Code != s.code {
+			t.Errorf("%v %v: expected %v, got %v",
+				s.method, s.path, s.code, w.Code)
+		}
+	}
+
+	adminLimiter = newRateLimiter(0, 1)
+	request("GET", "/galene-api/groups", "secret")
+	w = request("GET", "/galene-api/groups", "secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %v", w.Code)
+	}
+	adminLimiter = newRateLimiter(adminRate, adminBurst)
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
 	"github.com/jech/galene/rtpconn"
 	"github.com/jech/galene/stats"
 )
@@ -50,6 +51,10 @@ func Serve(address string, dataDir string) error {
 	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		statsHandler(w, r, dataDir)
 	})
+	http.HandleFunc("/galene-api/",
+		func(w http.ResponseWriter, r *http.Request) {
+			adminHandler(w, r, dataDir)
+		})
 
 	s := &http.Server{
 		Addr:              address,
@@ -63,13 +68,6 @@ func Serve(address string, dataDir string) error {
 			},
 		}
 	}
-	s.RegisterOnShutdown(func() {
-		group.Range(func(g *group.Group) bool {
-			go g.Shutdown("server is shutting down")
-			return true
-		})
-	})
-
 	server.Store(s)
 
 	var err error
@@ -267,6 +265,11 @@ func parseGroupName(prefix string, p string) string {
 }
 
 func groupHandler(w http.ResponseWriter, r *http.Request) {
+	if _, name, _ := parseWhip(r.URL.Path); name != "" {
+		whipHandler(w, r)
+		return
+	}
+
 	if redirect(w, r) {
 		return
 	}
@@ -348,15 +351,7 @@ func failAuthentication(w http.ResponseWriter, realm string) {
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
-	u, p, err := getPassword(dataDir)
-	if err != nil {
-		log.Printf("Passwd: %v", err)
-		failAuthentication(w, "stats")
-		return
-	}
-
-	username, password, ok := r.BasicAuth()
-	if !ok || username != u || password != p {
+	if !checkAdmin(r, dataDir) {
 		failAuthentication(w, "stats")
 		return
 	}
@@ -374,6 +369,12 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 	fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/common.css\"/>")
 	fmt.Fprintf(w, "<head><body>\n")
 
+	fmt.Fprintf(w, "<p>Packet caches: %vkB", packetcache.Memory()/1024)
+	if rtpconn.CacheMemory > 0 {
+		fmt.Fprintf(w, " of %vMB", rtpconn.CacheMemory)
+	}
+	fmt.Fprintf(w, "</p>\n")
+
 	printBitrate := func(w io.Writer, rate, maxRate uint64) error {
 		var err error
 		if maxRate != 0 && maxRate != ^uint64(0) {
@@ -400,11 +401,33 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 			fmt.Fprintf(w, "&#177;%v", t.Jitter)
 		}
 		fmt.Fprintf(w, "</td>")
+		fmt.Fprintf(w, "<td>")
+		if t.Packets > 0 {
+			fmt.Fprintf(w, "%v", t.Packets)
+			if t.Recovered > 0 {
+				fmt.Fprintf(w, " (%v resent)", t.Recovered)
+			}
+		}
+		if t.LastPacket != nil {
+			fmt.Fprintf(w, ", last %v ago",
+				time.Since(*t.LastPacket).Round(time.Millisecond))
+		}
+		fmt.Fprintf(w, "</td>")
+		if t.ClockRate > 0 {
+			fmt.Fprintf(w, "<td>clock rate %v</td>", t.ClockRate)
+		}
+		if t.OneWay {
+			fmt.Fprintf(w, "<td>not received</td>")
+		}
 		fmt.Fprintf(w, "</tr>")
 	}
 
 	for _, gs := range ss {
-		fmt.Fprintf(w, "<p>%v</p>\n", html.EscapeString(gs.Name))
+		fmt.Fprintf(w, "<p>%v", html.EscapeString(gs.Name))
+		if gs.RejectedJoins > 0 {
+			fmt.Fprintf(w, " (%v joins rejected)", gs.RejectedJoins)
+		}
+		fmt.Fprintf(w, "</p>\n")
 		fmt.Fprintf(w, "<table>")
 		for _, cs := range gs.Clients {
 			fmt.Fprintf(w, "<tr><td>%v</td></tr>\n", cs.Id)
@@ -660,13 +683,45 @@ func serveGroupRecordings(w http.ResponseWriter, r *http.Request, f *os.File, gr
 	fmt.Fprintf(w, "</body></html>\n")
 }
 
-func Shutdown() {
-	v := server.Load()
-	if v == nil {
+// the time given to in-flight HTTP requests on shutdown
+const httpShutdownTimeout = 2 * time.Second
+
+// Shutdown stops accepting connections, then drains all client
+// connections, giving up after timeout, then waits for the web server to
+// finish.  The web server has its own timeout, counted from the end of
+// the drain, so that a slow drain doesn't cut in-flight requests short.
+func Shutdown(timeout time.Duration) {
+	// stop accepting connections first, so that the clients that we
+	// ask to reconnect don't come straight back.  Websockets are
+	// hijacked, and are not waited for by the HTTP server.
+	var s *http.Server
+	var done chan error
+	httpCtx, httpCancel := context.WithCancel(context.Background())
+	defer httpCancel()
+	if v := server.Load(); v != nil {
+		s = v.(*http.Server)
+		s.SetKeepAlivesEnabled(false)
+		done = make(chan error, 1)
+		go func() {
+			done <- s.Shutdown(httpCtx)
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := rtpconn.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+
+	if s == nil {
 		return
 	}
-	s := v.(*http.Server)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	s.Shutdown(ctx)
+	timer := time.AfterFunc(httpShutdownTimeout, httpCancel)
+	defer timer.Stop()
+	err = <-done
+	if err != nil {
+		log.Printf("Shutdown: %v", err)
+		s.Close()
+	}
 }
@@ -29,3 +29,29 @@ func TestParseGroupName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseWhip(t *testing.T) {
+	a := []struct{ p, e, g, id string }{
+		{"", "", "", ""},
+		{"/group/foo", "", "", ""},
+		{"/group/.whip", ".whip", "", ""},
+		{"/group/foo/.whip", ".whip", "foo", ""},
+		{"/group/foo/.whip/", ".whip", "foo", ""},
+		{"/group/foo/bar/.whip", ".whip", "foo/bar", ""},
+		{"/group/foo/.whip/1234", ".whip", "foo", "1234"},
+		{"/group/foo/bar/.whip/1234", ".whip", "foo/bar", "1234"},
+		{"/group/foo/.whip/1234/", "", "", ""},
+		{"/group/foo/.whep", ".whep", "foo", ""},
+		{"/group/foo/bar/.whep/1234", ".whep", "foo/bar", "1234"},
+	}
+
+	for _, pg := range a {
+		t.Run(pg.p, func(t *testing.T) {
+			e, g, id := parseWhip(pg.p)
+			if g != pg.g || id != pg.id || (g != "" && e != pg.e) {
+				t.Errorf("Path %v, got %v %v %v, expected %v %v %v",
+					pg.p, e, g, id, pg.e, pg.g, pg.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package webserver
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+)
+
+const (
+	// the maximum size of a WHIP or WHEP offer
+	whipMaxOffer = 1024 * 1024
+	// how long we wait for ICE gathering to complete
+	whipGatherTimeout = 10 * time.Second
+)
+
+// parseWhip parses the path of a WHIP or WHEP request.  The endpoints are
+// at /group/name/.whip and /group/name/.whep, and the resource created by
+// a POST to an endpoint is at /group/name/.whip/id or /group/name/.whep/id.
+// It returns the endpoint, the group name and the resource id, which is
+// empty for the endpoint itself; the group name is empty if the path is
+// not a WHIP or WHEP path.
+func parseWhip(p string) (string, string, string) {
+	dir, id := path.Split(p)
+	if id == ".whip" || id == ".whep" {
+		return id, parseGroupName("/group/", dir), ""
+	}
+	for _, endpoint := range []string{".whip", ".whep"} {
+		if strings.HasSuffix(dir, "/"+endpoint+"/") {
+			name := parseGroupName("/group/",
+				dir[:len(dir)-len(endpoint)-1])
+			return endpoint, name, id
+		}
+	}
+	return "", "", ""
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// getBearerToken returns the bearer token of a request, or the empty
+// string if there is none.
+func getBearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// A whipClient is either a WHIP or a WHEP client.
+type whipClient interface {
+	group.Client
+	Token() string
+}
+
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	endpoint, name, id := parseWhip(r.URL.Path)
+	if name == "" {
+		notFound(w)
+		return
+	}
+
+	if id == "" {
+		whipEndpointHandler(w, r, endpoint, name)
+	} else {
+		whipResourceHandler(w, r, endpoint, name, id)
+	}
+}
+
+func whipEndpointHandler(w http.ResponseWriter, r *http.Request, endpoint, name string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctype := r.Header.Get("Content-Type")
+	if !strings.EqualFold(strings.TrimSpace(ctype), "application/sdp") {
+		http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, whipMaxOffer))
+	if err != nil {
+		http.Error(w, "couldn't read offer", http.StatusBadRequest)
+		return
+	}
+
+	g, err := group.Add(name, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			notFound(w)
+		} else {
+			log.Printf("addGroup: %v", err)
+			http.Error(w, "Internal server error",
+				http.StatusInternalServerError)
+		}
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	var c whipClient
+	if endpoint == ".whip" {
+		c = rtpconn.NewWhipClient(
+			g, newId(), username, getBearerToken(r),
+		)
+	} else {
+		c = rtpconn.NewWhepClient(
+			g, newId(), username, getBearerToken(r),
+		)
+	}
+
+	_, err = group.AddClient(g.Name(), c)
+	if err == group.ErrNotAuthorised {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "not authorised", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("%v: %v", endpoint, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if endpoint == ".whip" && !c.Permissions().Present {
+		group.DelClient(c)
+		http.Error(w, "not authorised to publish",
+			http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), whipGatherTimeout)
+	defer cancel()
+	var answer string
+	switch c := c.(type) {
+	case *rtpconn.WhipClient:
+		answer, err = c.NewConnection(ctx, string(body))
+	case *rtpconn.WhepClient:
+		answer, err = c.NewConnection(
+			ctx, r.URL.Query().Get("publisher"), string(body),
+		)
+	}
+	if err == rtpconn.ErrNoPublisher {
+		c.Kick("", "", "")
+		notFound(w)
+		return
+	} else if err == group.ErrNotAuthorised {
+		c.Kick("", "", "")
+		http.Error(w, "not authorised", http.StatusForbidden)
+		return
+	} else if err == rtpconn.ErrShuttingDown {
+		c.Kick("", "", "")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		c.Kick("", "", "")
+		log.Printf("%v offer: %v", endpoint, err)
+		http.Error(w, "couldn't negotiate connection",
+			http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(r.URL.Path, c.Id()))
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+func whipResourceHandler(w http.ResponseWriter, r *http.Request, endpoint, name, id string) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	g := group.Get(name)
+	if g == nil {
+		notFound(w)
+		return
+	}
+
+	var c whipClient
+	switch cc := g.GetClient(id).(type) {
+	case *rtpconn.WhipClient:
+		if endpoint == ".whip" {
+			c = cc
+		}
+	case *rtpconn.WhepClient:
+		if endpoint == ".whep" {
+			c = cc
+		}
+	}
+	if c == nil {
+		notFound(w)
+		return
+	}
+
+	token := getBearerToken(r)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token())) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "not authorised", http.StatusUnauthorized)
+		return
+	}
+
+	c.Kick("", "", "")
+	w.WriteHeader(http.StatusOK)
+}